@@ -0,0 +1,151 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	accessLogFormatJSON    = "json"
+	accessLogFormatConsole = "console"
+)
+
+// createAccessLogger creates the logger of the requests, writing to its own file or stream rather than
+// along with the service logs
+func createAccessLogger(config *Config) (*zap.Logger, error) {
+	var output zapcore.WriteSyncer
+	switch config.AccessLogFile {
+	case "stdout":
+		output = zapcore.Lock(os.Stdout)
+	case "stderr":
+		output = zapcore.Lock(os.Stderr)
+	default:
+		file, err := newRotatingFile(config.AccessLogFile, int64(config.AccessLogMaxSize), config.AccessLogMaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open the access log file: %w", err)
+		}
+		output = file
+	}
+
+	format := config.AccessLogFormat
+	if format == "" {
+		format = accessLogFormatConsole
+		if config.EnableJSONLogging {
+			format = accessLogFormatJSON
+		}
+	}
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	var encoder zapcore.Encoder
+	switch format {
+	case accessLogFormatJSON:
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	default:
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	}
+
+	return zap.New(zapcore.NewCore(encoder, output, zap.InfoLevel)), nil
+}
+
+// rotatingFile is a log file which is rotated once it exceeds its maximum size, keeping a number of backups
+// suffixed with their generation, i.e. access.log.1 is the most recent one
+type rotatingFile struct {
+	sync.Mutex
+	// path is the location of the current file
+	path string
+	// maxSize is the size in bytes beyond which the file is rotated, zero to never rotate
+	maxSize int64
+	// backups is the number of rotated files kept
+	backups int
+	// file is the current file
+	file *os.File
+	// size is the number of bytes in the current file
+	size int64
+}
+
+// newRotatingFile opens the log file, appending to any existing content
+func newRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+
+	return nil
+}
+
+// Write appends to the file, rotating it beforehand when the entry would exceed the maximum size
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// rotate shifts the backups by one generation, dropping the oldest one, then starts a new file
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.backups > 0 {
+		for i := f.backups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+// Sync flushes the file to the disk
+func (f *rotatingFile) Sync() error {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.file.Sync()
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "access.log")
+
+	f, err := newRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	for _, entry := range []string{"0123456789", "abc", "defghijklm", "nopqrstuvw"} {
+		_, err := f.Write([]byte(entry))
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.Sync())
+
+	read := func(name string) string {
+		content, err := ioutil.ReadFile(name)
+		require.NoError(t, err)
+		return string(content)
+	}
+	assert.Equal(t, "nopqrstuvw", read(path))
+	assert.Equal(t, "defghijklm", read(path+".1"))
+	assert.Equal(t, "abc", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "only two backups should be kept")
+}
+
+func TestCreateAccessLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.AccessLogFile = filepath.Join(dir, "access.log")
+	cfg.AccessLogFormat = accessLogFormatJSON
+	log, err := createAccessLogger(cfg)
+	require.NoError(t, err)
+	log.Info("client request", zap.String("path", "/admin"))
+	require.NoError(t, log.Sync())
+
+	content, err := ioutil.ReadFile(cfg.AccessLogFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `"msg":"client request"`)
+	assert.Contains(t, string(content), `"path":"/admin"`)
+
+	cfg.AccessLogFile = filepath.Join(dir, "missing", "access.log")
+	_, err = createAccessLogger(cfg)
+	assert.Error(t, err)
+}
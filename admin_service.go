@@ -40,6 +40,7 @@ func (r *oauthProxy) createAdminRoutes() chi.Router {
 	// step: health
 	r.log.Info("enabling health service", zap.String("path", path.Clean(r.config.WithOAuthURI(healthURL))))
 	admin.Get(healthURL, r.healthHandler)
+	admin.Get(readyURL, r.readyHandler)
 
 	// step: metrics
 	if r.config.EnableMetrics {
@@ -0,0 +1,99 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	auditDecisionPermit = "permit"
+	auditDecisionDeny   = "deny"
+
+	auditReasonAuthorized        = "authorized"
+	auditReasonNotYetValid       = "token-not-yet-valid"
+	auditReasonInvalidToken      = "invalid-token"
+	auditReasonAuthenticationAge = "authentication-age"
+)
+
+// createAuditLogger creates the logger of the access decisions, one json line per decision, apart from
+// the service logs so they can be shipped on their own
+func createAuditLogger(config *Config) (*zap.Logger, error) {
+	var output zapcore.WriteSyncer
+	switch config.AuditLogPath {
+	case "stdout":
+		output = zapcore.Lock(os.Stdout)
+	case "stderr":
+		output = zapcore.Lock(os.Stderr)
+	default:
+		file, err := newRotatingFile(config.AuditLogPath, 0, 0)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open the audit log file: %w", err)
+		}
+		output = file
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	return zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), output, zap.InfoLevel)), nil
+}
+
+// audit records an access decision on the request to the audit log and the audit webhook, when enabled
+func (r *oauthProxy) audit(req *http.Request, decision, reason string) {
+	if r.auditLog == nil && r.auditWebhook == nil {
+		return
+	}
+
+	resource, username, subject := req.URL.Path, "", ""
+	if scope, ok := req.Context().Value(contextScopeName).(*RequestScope); ok {
+		if scope.MatchedResource != nil {
+			resource = scope.MatchedResource.URL
+		}
+		if scope.Identity != nil {
+			username, subject = scope.Identity.name, scope.Identity.id
+		}
+	}
+	requestID := req.Header.Get(r.config.RequestIDHeader)
+	if r.auditLog != nil {
+		r.auditLog.Info("access decision",
+			zap.String("decision", decision),
+			zap.String("reason", reason),
+			zap.String("username", username),
+			zap.String("subject", subject),
+			zap.String("resource", resource),
+			zap.String("method", req.Method),
+			zap.String("request_id", requestID))
+	}
+	if r.auditWebhook != nil {
+		r.auditWebhook.send(auditEvent{
+			Time:      time.Now().UTC(),
+			Decision:  decision,
+			Reason:    reason,
+			Username:  username,
+			Subject:   subject,
+			Resource:  resource,
+			Method:    req.Method,
+			RequestID: requestID,
+		})
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditAccessDecisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditlog")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.AuditLogPath = filepath.Join(dir, "audit.log")
+	cfg.RequestIDHeader = "X-Request-ID"
+	cfg.Resources = []*Resource{
+		{
+			URL:     fakeAdminRoleURL,
+			Methods: allHTTPMethods,
+			Roles:   []string{fakeAdminRole},
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:          "/admin/users",
+			HasToken:     true,
+			Headers:      map[string]string{"X-Request-ID": "denied-request"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/admin/users",
+			Method:        http.MethodPost,
+			HasToken:      true,
+			Roles:         []string{fakeAdminRole},
+			Headers:       map[string]string{"X-Request-ID": "permitted-request"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+
+	content, err := ioutil.ReadFile(cfg.AuditLogPath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 2)
+
+	var events []map[string]interface{}
+	for _, line := range lines {
+		event := make(map[string]interface{})
+		require.NoError(t, json.Unmarshal([]byte(line), &event), "each decision is a json line")
+		events = append(events, event)
+	}
+	expected := []map[string]string{
+		{
+			"decision":   auditDecisionDeny,
+			"reason":     denyReasonRoles,
+			"method":     http.MethodGet,
+			"request_id": "denied-request",
+		},
+		{
+			"decision":   auditDecisionPermit,
+			"reason":     auditReasonAuthorized,
+			"method":     http.MethodPost,
+			"request_id": "permitted-request",
+		},
+	}
+	for i, fields := range expected {
+		for k, v := range fields {
+			assert.Equal(t, v, events[i][k], "case %d, field %s", i, k)
+		}
+		assert.Equal(t, "rjayawardene", events[i]["username"], "case %d", i)
+		assert.Equal(t, defaultTestTokenClaims["sub"], events[i]["subject"], "case %d", i)
+		assert.Equal(t, fakeAdminRoleURL, events[i]["resource"], "case %d", i)
+	}
+}
+
+func TestCreateAuditLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditlog")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.AuditLogPath = filepath.Join(dir, "missing", "audit.log")
+	_, err = createAuditLogger(cfg)
+	assert.Error(t, err)
+}
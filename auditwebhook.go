@@ -0,0 +1,178 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// auditEvent is an access decision posted to the audit webhook
+type auditEvent struct {
+	Time      time.Time `json:"time"`
+	Decision  string    `json:"decision"`
+	Reason    string    `json:"reason"`
+	Username  string    `json:"username"`
+	Subject   string    `json:"subject"`
+	Resource  string    `json:"resource"`
+	Method    string    `json:"method"`
+	RequestID string    `json:"request_id"`
+}
+
+// auditWebhook posts the access decisions to a webhook in batches. The decisions are queued without
+// ever blocking the requests: those beyond the capacity of the queue are dropped and counted.
+type auditWebhook struct {
+	url    string
+	client *http.Client
+	log    *zap.Logger
+	// batchSize is the maximum number of decisions posted at once
+	batchSize int
+	// interval is the pause before posting an incomplete batch
+	interval time.Duration
+	// retries is the number of times a batch is posted again after a failure
+	retries int
+	// retryDelay is the pause before the first retry, doubled on each attempt
+	retryDelay time.Duration
+	queue      chan auditEvent
+	stop       chan struct{}
+	stopped    sync.Once
+	wg         sync.WaitGroup
+}
+
+func newAuditWebhook(config *Config, log *zap.Logger) *auditWebhook {
+	return &auditWebhook{
+		url:        config.AuditWebhookURL,
+		client:     &http.Client{Timeout: auditWebhookTimeout},
+		log:        log,
+		batchSize:  config.AuditWebhookBatchSize,
+		interval:   config.AuditWebhookFlushInterval,
+		retries:    config.AuditWebhookRetries,
+		retryDelay: auditWebhookRetryDelay,
+		queue:      make(chan auditEvent, config.AuditWebhookQueueSize),
+		stop:       make(chan struct{}),
+	}
+}
+
+// send queues a decision, or drops it when the queue is full
+func (w *auditWebhook) send(event auditEvent) {
+	select {
+	case w.queue <- event:
+	default:
+		auditEventsDroppedMetric.Inc()
+	}
+}
+
+// start posts the queued decisions until closed
+func (w *auditWebhook) start() {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		batch := make([]auditEvent, 0, w.batchSize)
+		flush := func() {
+			if len(batch) > 0 {
+				w.post(batch)
+				batch = make([]auditEvent, 0, w.batchSize)
+			}
+		}
+		for {
+			select {
+			case event := <-w.queue:
+				if batch = append(batch, event); len(batch) >= w.batchSize {
+					flush()
+				}
+			case <-ticker.C:
+				flush()
+			case <-w.stop:
+				// the decisions queued so far are posted before leaving
+				for {
+					select {
+					case event := <-w.queue:
+						if batch = append(batch, event); len(batch) >= w.batchSize {
+							flush()
+						}
+					default:
+						flush()
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// post sends a batch to the webhook, retrying with a backoff; the batch is dropped when all the attempts fail
+func (w *auditWebhook) post(batch []auditEvent) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		w.log.Error("unable to encode the access decisions for the audit webhook", zap.Error(err))
+		auditEventsDroppedMetric.Add(float64(len(batch)))
+		return
+	}
+
+	delay := w.retryDelay
+	for attempt := 0; ; attempt++ {
+		if err = w.postOnce(body); err == nil {
+			return
+		}
+		if attempt >= w.retries {
+			break
+		}
+		// the retries are no longer delayed once closing, not to hold up the shutdown
+		select {
+		case <-time.After(delay):
+		case <-w.stop:
+		}
+		delay *= 2
+	}
+
+	w.log.Warn("unable to post the access decisions to the audit webhook, dropping them",
+		zap.Int("decisions", len(batch)),
+		zap.Error(err))
+	auditEventsDroppedMetric.Add(float64(len(batch)))
+}
+
+// postOnce sends the encoded decisions to the webhook, expecting a successful status
+func (w *auditWebhook) postOnce(body []byte) error {
+	resp, err := w.client.Post(w.url, jsonMime, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("the audit webhook responded %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// close posts the queued decisions and stops
+func (w *auditWebhook) close() {
+	w.stopped.Do(func() { close(w.stop) })
+	w.wg.Wait()
+}
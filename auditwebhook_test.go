@@ -0,0 +1,193 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeAuditSink collects the batches posted to the audit webhook
+type fakeAuditSink struct {
+	sync.Mutex
+	*httptest.Server
+	batches [][]auditEvent
+	// failures is the number of posts answered with an error before succeeding
+	failures int32
+}
+
+func newFakeAuditSink(t *testing.T) *fakeAuditSink {
+	sink := &fakeAuditSink{}
+	sink.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&sink.failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []auditEvent
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&batch))
+		sink.Lock()
+		defer sink.Unlock()
+		sink.batches = append(sink.batches, batch)
+	}))
+
+	return sink
+}
+
+func (f *fakeAuditSink) events() []auditEvent {
+	f.Lock()
+	defer f.Unlock()
+	var events []auditEvent
+	for _, batch := range f.batches {
+		events = append(events, batch...)
+	}
+
+	return events
+}
+
+func newTestAuditWebhook(url string) *auditWebhook {
+	cfg := newFakeKeycloakConfig()
+	cfg.AuditWebhookURL = url
+	cfg.AuditWebhookBatchSize = 2
+	cfg.AuditWebhookFlushInterval = 50 * time.Millisecond
+	cfg.AuditWebhookQueueSize = 10
+	w := newAuditWebhook(cfg, zap.NewNop())
+	w.retryDelay = 10 * time.Millisecond
+
+	return w
+}
+
+func TestAuditWebhookAccessDecisions(t *testing.T) {
+	sink := newFakeAuditSink(t)
+	defer sink.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.AuditWebhookURL = sink.URL
+	cfg.AuditWebhookBatchSize = 10
+	cfg.AuditWebhookFlushInterval = 50 * time.Millisecond
+	cfg.AuditWebhookQueueSize = 10
+	cfg.RequestIDHeader = "X-Request-ID"
+	cfg.Resources = []*Resource{
+		{
+			URL:     fakeAdminRoleURL,
+			Methods: allHTTPMethods,
+			Roles:   []string{fakeAdminRole},
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:          "/admin/users",
+			HasToken:     true,
+			Headers:      map[string]string{"X-Request-ID": "denied-request"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/admin/users",
+			HasToken:      true,
+			Roles:         []string{fakeAdminRole},
+			Headers:       map[string]string{"X-Request-ID": "permitted-request"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+	p := newFakeProxy(cfg)
+	p.RunTests(t, requests)
+
+	require.Eventually(t, func() bool { return len(sink.events()) == 2 }, time.Second, 10*time.Millisecond)
+	events := sink.events()
+	assert.Equal(t, auditDecisionDeny, events[0].Decision)
+	assert.Equal(t, denyReasonRoles, events[0].Reason)
+	assert.Equal(t, "denied-request", events[0].RequestID)
+	assert.Equal(t, auditDecisionPermit, events[1].Decision)
+	assert.Equal(t, auditReasonAuthorized, events[1].Reason)
+	assert.Equal(t, "permitted-request", events[1].RequestID)
+	for i, event := range events {
+		assert.Equal(t, "rjayawardene", event.Username, "case %d", i)
+		assert.Equal(t, defaultTestTokenClaims["sub"], event.Subject, "case %d", i)
+		assert.Equal(t, fakeAdminRoleURL, event.Resource, "case %d", i)
+		assert.Equal(t, http.MethodGet, event.Method, "case %d", i)
+	}
+	p.proxy.auditWebhook.close()
+}
+
+func TestAuditWebhookBatches(t *testing.T) {
+	sink := newFakeAuditSink(t)
+	defer sink.Close()
+	w := newTestAuditWebhook(sink.URL)
+	w.start()
+
+	for _, id := range []string{"1", "2", "3"} {
+		w.send(auditEvent{Decision: auditDecisionPermit, RequestID: id})
+	}
+	// the full batch is posted at once, the remainder after the flush interval
+	require.Eventually(t, func() bool { return len(sink.events()) == 3 }, time.Second, 10*time.Millisecond)
+	w.close()
+
+	sink.Lock()
+	defer sink.Unlock()
+	require.Len(t, sink.batches, 2)
+	assert.Len(t, sink.batches[0], 2)
+	assert.Len(t, sink.batches[1], 1)
+}
+
+func TestAuditWebhookRetries(t *testing.T) {
+	sink := newFakeAuditSink(t)
+	defer sink.Close()
+	atomic.StoreInt32(&sink.failures, 2)
+
+	w := newTestAuditWebhook(sink.URL)
+	w.retries = 2
+	w.start()
+	w.send(auditEvent{Decision: auditDecisionDeny, RequestID: "retried"})
+	require.Eventually(t, func() bool { return len(sink.events()) == 1 }, time.Second, 10*time.Millisecond)
+	w.close()
+	assert.Equal(t, "retried", sink.events()[0].RequestID)
+
+	// a batch failing all its attempts is dropped
+	atomic.StoreInt32(&sink.failures, 1)
+	w = newTestAuditWebhook(sink.URL)
+	w.retries = 0
+	w.send(auditEvent{Decision: auditDecisionDeny, RequestID: "dropped"})
+	w.start()
+	w.close()
+	assert.Len(t, sink.events(), 1)
+}
+
+func TestAuditWebhookQueueFull(t *testing.T) {
+	sink := newFakeAuditSink(t)
+	defer sink.Close()
+
+	w := newTestAuditWebhook(sink.URL)
+	w.queue = make(chan auditEvent, 1)
+	// the decisions beyond the capacity of the queue are dropped, without blocking
+	for _, id := range []string{"queued", "dropped", "dropped"} {
+		w.send(auditEvent{Decision: auditDecisionPermit, RequestID: id})
+	}
+	w.start()
+	w.close()
+
+	events := sink.events()
+	require.Len(t, events, 1)
+	assert.Equal(t, "queued", events[0].RequestID)
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+// bindsSessions indicates the browser sessions are bound to some attributes of the client at login
+func (r *oauthProxy) bindsSessions() bool {
+	return r.config.SessionIPBinding != "" || r.config.EnableSessionUserAgentBinding
+}
+
+// boundAddress returns the address of the client a session is bound to, i.e. the network of the client when only
+// binding to its subnet
+func (r *oauthProxy) boundAddress(req *http.Request) string {
+	addr := realIP(req, r.trustedProxies)
+	ip := net.ParseIP(addr)
+	if ip == nil || r.config.SessionIPBinding != sessionIPBindingSubnet {
+		return addr
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// sessionBindings computes the MACs of the client attributes bound to the session. The attributes themselves are
+// not disclosed in the cookie, and the MACs cannot be replayed for another user. They only cover the session itself
+// when the tokens carry a session id (sid): otherwise the binding of a session holds for the other sessions of the
+// user opened from the same client.
+func (r *oauthProxy) sessionBindings(req *http.Request, token jose.JWT, subject string) url.Values {
+	session := getSessionID(token) + "|" + subject
+	bindings := url.Values{}
+	if r.config.SessionIPBinding != "" {
+		bindings.Set("ip", cookieMAC(sessionBindingCookie, session+"|"+r.boundAddress(req), r.config.EncryptionKey))
+	}
+	if r.config.EnableSessionUserAgentBinding {
+		bindings.Set("ua", cookieMAC(sessionBindingCookie, session+"|"+req.UserAgent(), r.config.EncryptionKey))
+	}
+
+	return bindings
+}
+
+// dropSessionBindingCookie binds the session of the browser to the current client
+func (r *oauthProxy) dropSessionBindingCookie(req *http.Request, w http.ResponseWriter, token jose.JWT, subject string) {
+	if !r.bindsSessions() {
+		return
+	}
+	r.dropCookie(w, req, sessionBindingCookie, r.sessionBindings(req, token, subject).Encode(), 0)
+}
+
+// clearSessionBindingCookie clears the binding of the session
+func (r *oauthProxy) clearSessionBindingCookie(req *http.Request, w http.ResponseWriter) {
+	r.dropCookie(w, req, sessionBindingCookie, "", -10*time.Hour)
+}
+
+// checkSessionBinding verifies the session of the user is presented by the client it was bound to. A session without
+// any binding, e.g. opened before the binding was enabled, is rejected as well.
+func (r *oauthProxy) checkSessionBinding(req *http.Request, user *userContext) error {
+	cookie, err := req.Cookie(sessionBindingCookie)
+	if err != nil {
+		return fmt.Errorf("%w: the session is not bound", ErrSessionBinding)
+	}
+	bound, err := url.ParseQuery(cookie.Value)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSessionBinding, err)
+	}
+	for name, expected := range r.sessionBindings(req, user.token, user.id) {
+		if !hmac.Equal([]byte(bound.Get(name)), []byte(expected[0])) {
+			return fmt.Errorf("%w: the %s differs", ErrSessionBinding, name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionIPBinding(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.SessionIPBinding = sessionIPBindingExact
+	cfg.TrustedProxies = []string{"127.0.0.1/32"}
+	cfg.EncryptionKey = testKey
+	p := newFakeProxy(cfg)
+
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasLogin:      true,
+			Redirects:     true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// the cookies were stolen and replayed from another address
+			URI:          fakeAuthAllURL,
+			HasLogin:     true,
+			Redirects:    true,
+			Headers:      map[string]string{"X-Forwarded-For": "10.0.0.1"},
+			ExpectedCode: http.StatusTemporaryRedirect,
+			ExpectedCookiesValidator: map[string]func(string) bool{
+				cfg.CookieAccessName: func(v string) bool { return v == "" },
+			},
+		},
+	})
+}
+
+func TestSessionIPBindingForgedAddress(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.SessionIPBinding = sessionIPBindingExact
+	cfg.EncryptionKey = testKey
+	p := newFakeProxy(cfg)
+
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasLogin:      true,
+			Redirects:     true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// no proxy is trusted, the session stays bound to the peer whatever the forwarded address
+			URI:           fakeAuthAllURL,
+			HasLogin:      true,
+			Redirects:     true,
+			Headers:       map[string]string{"X-Forwarded-For": "10.0.0.1", "X-Real-IP": "10.0.0.1"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	})
+}
+
+func TestSessionIPBindingUnbound(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.SessionIPBinding = sessionIPBindingExact
+	cfg.EncryptionKey = testKey
+	p := newFakeProxy(cfg)
+
+	p.RunTests(t, []fakeRequest{
+		{
+			// a session opened without the binding
+			URI:            fakeAuthAllURL,
+			HasCookieToken: true,
+			HasToken:       true,
+			ExpectedCode:   http.StatusUnauthorized,
+		},
+		{
+			// the bearer tokens are not bound
+			URI:           fakeAuthAllURL,
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	})
+}
+
+func TestSessionIPBindingSubnet(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.SessionIPBinding = sessionIPBindingSubnet
+	cfg.TrustedProxies = []string{"127.0.0.1/32"}
+	cfg.EncryptionKey = testKey
+	p := newFakeProxy(cfg)
+
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasLogin:      true,
+			Redirects:     true,
+			Headers:       map[string]string{"X-Forwarded-For": "127.0.0.42"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          fakeAuthAllURL,
+			HasLogin:     true,
+			Redirects:    true,
+			Headers:      map[string]string{"X-Forwarded-For": "127.0.1.1"},
+			ExpectedCode: http.StatusTemporaryRedirect,
+		},
+	})
+}
+
+func TestSessionUserAgentBinding(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableSessionUserAgentBinding = true
+	cfg.EncryptionKey = testKey
+	p := newFakeProxy(cfg)
+
+	// the login is performed with the default user agent of the http client
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasLogin:      true,
+			Redirects:     true,
+			Headers:       map[string]string{"User-Agent": "Go-http-client/1.1"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          fakeAuthAllURL,
+			HasLogin:     true,
+			Redirects:    true,
+			Headers:      map[string]string{"User-Agent": "Mozilla/5.0 (X11; Linux x86_64; rv:91.0) Firefox/91.0"},
+			ExpectedCode: http.StatusTemporaryRedirect,
+		},
+	})
+}
+
+func TestBoundAddress(t *testing.T) {
+	cases := []struct {
+		Binding  string
+		Address  string
+		Expected string
+	}{
+		{Binding: sessionIPBindingExact, Address: "192.168.1.10", Expected: "192.168.1.10"},
+		{Binding: sessionIPBindingSubnet, Address: "192.168.1.10", Expected: "192.168.1.0"},
+		{Binding: sessionIPBindingSubnet, Address: "2001:db8::1:2:3:4", Expected: "2001:db8::"},
+		{Binding: sessionIPBindingSubnet, Address: "not_an_ip", Expected: "not_an_ip"},
+	}
+	for _, c := range cases {
+		p := &oauthProxy{config: &Config{SessionIPBinding: c.Binding}}
+		req := &http.Request{RemoteAddr: net.JoinHostPort(c.Address, "1234"), Header: http.Header{}}
+		assert.Equal(t, c.Expected, p.boundAddress(req), "binding %s of %s", c.Binding, c.Address)
+	}
+}
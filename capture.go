@@ -0,0 +1,150 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const redacted = "[redacted]"
+
+// bodyCapture keeps the head of a request body as the upstream transport reads it
+type bodyCapture struct {
+	io.ReadCloser
+	sync.Mutex
+	limit int
+	head  bytes.Buffer
+}
+
+func (c *bodyCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.Lock()
+	if room := c.limit - c.head.Len(); room > 0 && n > 0 {
+		if n < room {
+			room = n
+		}
+		_, _ = c.head.Write(p[:room])
+	}
+	c.Unlock()
+
+	return n, err
+}
+
+// bytes returns the part of the body captured so far
+func (c *bodyCapture) bytes() []byte {
+	c.Lock()
+	defer c.Unlock()
+
+	return append([]byte(nil), c.head.Bytes()...)
+}
+
+// compileRedactions compiles the patterns of the content to redact from the captured bodies
+func compileRedactions(patterns []string) ([]*regexp.Regexp, error) {
+	redactions := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		redactions = append(redactions, re)
+	}
+
+	return redactions, nil
+}
+
+// captureBodies prepares the request so its body may be logged along with the response of the upstream.
+// Upgraded connections are never captured.
+func (r *oauthProxy) captureBodies(req *http.Request) *http.Request {
+	if !r.config.DebugCaptureBodies || req.Header.Get("Upgrade") != "" {
+		return req
+	}
+	capture := &bodyCapture{ReadCloser: http.NoBody, limit: r.config.DebugCaptureBodiesSize}
+	if req.Body != nil && req.Body != http.NoBody {
+		capture.ReadCloser = req.Body
+		req.Body = capture
+	}
+
+	return req.WithContext(context.WithValue(req.Context(), contextBodyCapture, capture))
+}
+
+// logCapturedBodies logs the head of the request and response bodies of an upstream server error. Streamed
+// responses are left alone.
+func (r *oauthProxy) logCapturedBodies(res *http.Response) {
+	if res.StatusCode < http.StatusInternalServerError || res.Request == nil {
+		return
+	}
+	capture, ok := res.Request.Context().Value(contextBodyCapture).(*bodyCapture)
+	if !ok || strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		return
+	}
+
+	head, err := ioutil.ReadAll(io.LimitReader(res.Body, int64(r.config.DebugCaptureBodiesSize)))
+	// step: hand the whole body over to the client regardless
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), res.Body), res.Body}
+	if err != nil {
+		r.log.Warn("unable to capture the upstream response body", zap.Error(err))
+	}
+
+	r.log.Warn("upstream server error",
+		zap.Int("status", res.StatusCode),
+		zap.String("method", res.Request.Method),
+		zap.String("path", res.Request.URL.Path),
+		zap.Any("request_headers", redactHeaders(res.Request.Header)),
+		zap.String("request_body", r.redactBody(capture.bytes())),
+		zap.Any("response_headers", redactHeaders(res.Header)),
+		zap.String("response_body", r.redactBody(head)))
+}
+
+// redactBody hides the content of the body matching the redaction patterns
+func (r *oauthProxy) redactBody(body []byte) string {
+	for _, re := range r.captureRedactions {
+		body = re.ReplaceAll(body, []byte(redacted))
+	}
+
+	return string(body)
+}
+
+// redactHeaders returns a copy of the headers, without the credentials
+func redactHeaders(headers http.Header) http.Header {
+	copied := make(http.Header, len(headers))
+	for k, v := range headers {
+		switch {
+		case strings.EqualFold(k, authorizationHeader),
+			strings.EqualFold(k, "Proxy-Authorization"),
+			strings.EqualFold(k, "Cookie"),
+			strings.EqualFold(k, "Set-Cookie"),
+			strings.EqualFold(k, "X-Auth-Token"),
+			strings.HasPrefix(http.CanonicalHeaderKey(k), headerAuthTokenPart):
+			copied[k] = []string{redacted}
+		default:
+			copied[k] = v
+		}
+	}
+
+	return copied
+}
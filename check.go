@@ -0,0 +1,152 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// selfCheck is the result of one of the checks run by the check mode
+type selfCheck struct {
+	name   string
+	detail string
+	err    error
+	// skipped indicates the check does not apply to the configuration
+	skipped bool
+}
+
+// runSelfChecks checks the connectivity with the provider and the store, and loads the certificates, without
+// starting the service. The checks go through the paths used on startup.
+func runSelfChecks(config *Config) []selfCheck {
+	svc := &oauthProxy{config: config, log: zap.NewNop()}
+	var checks []selfCheck
+
+	// step: the provider discovery, then the keys the tokens are verified with
+	if config.SkipTokenVerification {
+		checks = append(checks,
+			selfCheck{name: "discovery", skipped: true},
+			selfCheck{name: "jwks", skipped: true},
+			selfCheck{name: "oauth client", skipped: true})
+	} else {
+		_, idp, hc, err := svc.newOpenIDClient()
+		checks = append(checks, selfCheck{name: "discovery", detail: config.DiscoveryURL, err: err})
+		if err != nil {
+			checks = append(checks,
+				selfCheck{name: "jwks", err: errors.New("no provider configuration")},
+				selfCheck{name: "oauth client", err: errors.New("no provider configuration")})
+		} else {
+			svc.idp, svc.idpClient = idp, hc
+			check := selfCheck{name: "jwks", err: errors.New("the provider advertises no keys endpoint")}
+			if idp.KeysEndpoint != nil {
+				var keys int
+				keys, check.err = fetchKeySet(hc, idp.KeysEndpoint.String())
+				check.detail = fmt.Sprintf("%s, %d keys", idp.KeysEndpoint, keys)
+			}
+			checks = append(checks, check)
+			_, err = svc.getOAuthClient(config.RedirectionURL + config.WithOAuthURI("callback"))
+			checks = append(checks, selfCheck{name: "oauth client", detail: config.ClientID, err: err})
+		}
+	}
+
+	// step: the store must take a probe key
+	if config.StoreURL == "" {
+		checks = append(checks, selfCheck{name: "store", skipped: true})
+	} else {
+		check := selfCheck{name: "store"}
+		if svc.store, check.err = createStorage(config.StoreURL); check.err == nil {
+			check.err = svc.probeStore(config.StoreKeyPrefix + storeProbeKeyPrefix + uuid.NewString())
+			_ = svc.CloseStore()
+		}
+		checks = append(checks, check)
+	}
+
+	// step: the certificates and keys must load
+	certificate := selfCheck{name: "tls certificate", skipped: config.TLSCertificate == "" || config.TLSPrivateKey == ""}
+	if !certificate.skipped {
+		certificate.detail = config.TLSCertificate
+		_, certificate.err = newCertificateRotator(config.TLSCertificate, config.TLSPrivateKey, svc.log)
+	}
+	checks = append(checks, certificate)
+	for _, ca := range []struct {
+		name string
+		who  string
+		path string
+	}{
+		{name: "tls ca certificate", who: "CA", path: config.TLSCaCertificate},
+		{name: "tls client certificate", who: "client", path: config.TLSClientCertificate},
+		{name: "upstream ca", who: "upstream CA", path: config.UpstreamCA},
+		{name: "openid provider ca", who: "OpenID provider", path: config.OpenIDProviderCA},
+	} {
+		check := selfCheck{name: ca.name, detail: ca.path, skipped: ca.path == ""}
+		if !check.skipped {
+			_, check.err = makeCertPool(ca.who, ca.path)
+		}
+		checks = append(checks, check)
+	}
+
+	return checks
+}
+
+// fetchKeySet retrieves the keys published by the provider, returning how many there are
+func fetchKeySet(hc *http.Client, endpoint string) (int, error) {
+	resp, err := hc.Get(endpoint)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %d from the keys endpoint", resp.StatusCode)
+	}
+	var keySet struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&keySet); err != nil {
+		return 0, err
+	}
+	if len(keySet.Keys) == 0 {
+		return 0, errors.New("the provider publishes no keys")
+	}
+
+	return len(keySet.Keys), nil
+}
+
+// printSelfChecks writes the report of the checks, returning the number of failed checks
+func printSelfChecks(w io.Writer, checks []selfCheck) int {
+	var failed int
+	for _, check := range checks {
+		switch {
+		case check.skipped:
+			fmt.Fprintf(w, "[skip] %s\n", check.name)
+		case check.err != nil:
+			failed++
+			fmt.Fprintf(w, "[fail] %s: %v\n", check.name, check.err)
+		case check.detail != "":
+			fmt.Fprintf(w, "[ok]   %s: %s\n", check.name, check.detail)
+		default:
+			fmt.Fprintf(w, "[ok]   %s\n", check.name)
+		}
+	}
+
+	return failed
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunSelfChecks(t *testing.T) {
+	auth := newFakeAuthServer()
+	defer auth.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.DiscoveryURL = auth.getLocation()
+	cfg.UpstreamCA = "/no/such/ca.pem"
+	checks := runSelfChecks(cfg)
+
+	results := make(map[string]selfCheck, len(checks))
+	for _, check := range checks {
+		results[check.name] = check
+	}
+	require.Contains(t, results, "discovery")
+	assert.NoError(t, results["discovery"].err)
+	assert.NoError(t, results["jwks"].err)
+	assert.NoError(t, results["oauth client"].err)
+	assert.True(t, results["store"].skipped)
+	assert.True(t, results["tls certificate"].skipped)
+	assert.Error(t, results["upstream ca"].err)
+
+	report := &bytes.Buffer{}
+	assert.Equal(t, 1, printSelfChecks(report, checks))
+	assert.Contains(t, report.String(), "[ok]   discovery: "+cfg.DiscoveryURL)
+	assert.Contains(t, report.String(), "[fail] upstream ca: ")
+	assert.Contains(t, report.String(), "[skip] store")
+}
@@ -20,11 +20,13 @@ import (
 	"os"
 	"os/signal"
 	"reflect"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/oneconcern/keycloak-gatekeeper/version"
 	"github.com/urfave/cli"
+	"go.uber.org/zap"
 )
 
 const durationType = "time.Duration"
@@ -66,6 +68,15 @@ func newOauthProxyApp() *cli.App {
 		if err := config.isValid(); err != nil {
 			return printError(err.Error())
 		}
+		config.warnDeprecations(os.Stderr)
+
+		// step: only check the connectivity and certificates, e.g. to gate a deployment
+		if config.CheckOnly {
+			if failed := printSelfChecks(os.Stdout, runSelfChecks(config)); failed > 0 {
+				return printError("%d of the checks failed", failed)
+			}
+			return nil
+		}
 
 		// step: create the proxy
 		proxy, err := newProxy(config)
@@ -78,10 +89,24 @@ func newOauthProxyApp() *cli.App {
 			return printError(err.Error())
 		}
 
-		// step: setup the termination signals
+		// step: setup the termination signals, a hangup reloads the lockdown settings and a quit exits
+		// without draining the requests in flight
 		signalChannel := make(chan os.Signal, 1)
 		signal.Notify(signalChannel, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-		<-signalChannel
+		for sig := range signalChannel {
+			switch sig {
+			case syscall.SIGQUIT:
+				return nil
+			case syscall.SIGINT, syscall.SIGTERM:
+				if err := proxy.Shutdown(); err != nil {
+					return printError(err.Error())
+				}
+				return nil
+			}
+			if err := proxy.reloadLockdown(configFile); err != nil {
+				proxy.log.Error("unable to reload the lockdown settings", zap.Error(err))
+			}
+		}
 
 		return nil
 	}
@@ -178,7 +203,19 @@ func parseCLIOptions(cx *cli.Context, config *Config) (err error) {
 			case reflect.String:
 				reflect.ValueOf(config).Elem().FieldByName(field.Name).SetString(cx.String(name))
 			case reflect.Slice:
-				reflect.ValueOf(config).Elem().FieldByName(field.Name).Set(reflect.ValueOf(cx.StringSlice(name)))
+				if field.Type.Elem().Kind() != reflect.Int {
+					reflect.ValueOf(config).Elem().FieldByName(field.Name).Set(reflect.ValueOf(cx.StringSlice(name)))
+					continue
+				}
+				values := make([]int, 0, len(cx.StringSlice(name)))
+				for _, x := range cx.StringSlice(name) {
+					v, err := strconv.Atoi(x)
+					if err != nil {
+						return fmt.Errorf("the values of %s must be integers", name)
+					}
+					values = append(values, v)
+				}
+				reflect.ValueOf(config).Elem().FieldByName(field.Name).Set(reflect.ValueOf(values))
 			case reflect.Int:
 				reflect.ValueOf(config).Elem().FieldByName(field.Name).Set(reflect.ValueOf(cx.Int(name)))
 			case reflect.Int64:
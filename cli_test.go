@@ -44,3 +44,18 @@ func TestReadOptions(t *testing.T) {
 	err := c.Run([]string{""})
 	assert.NoError(t, err)
 }
+
+func TestReadIntSliceOptions(t *testing.T) {
+	config := &Config{}
+	c := cli.NewApp()
+	c.Flags = getCommandLineOptions()
+	c.Action = func(cx *cli.Context) error {
+		return parseCLIOptions(cx, config)
+	}
+	err := c.Run([]string{"", "--upstream-retry-on-status=502", "--upstream-retry-on-status=503"})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{502, 503}, config.RetryOnStatus)
+
+	err = c.Run([]string{"", "--upstream-retry-on-status=unavailable"})
+	assert.Error(t, err)
+}
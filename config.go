@@ -16,9 +16,13 @@ limitations under the License.
 package main
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"regexp"
@@ -29,6 +33,9 @@ import (
 const (
 	jaegerExporter  = "jaeger"
 	datadogExporter = "datadog"
+
+	traceContextPropagation = "tracecontext"
+	b3Propagation           = "b3"
 )
 
 // newDefaultConfig returns a initialized config
@@ -49,10 +56,16 @@ func newDefaultConfig() *Config {
 		EnableAuthorizationHeader:     true,
 		EnableCSRF:                    false,
 		EnableDefaultDeny:             true,
+		EnableIDTokenNonce:            true,
+		PKCEChallengeMethod:           pkceMethodS256,
+		SessionIDFormat:               sessionIDFormatUUID,
+		RefreshGracePeriod:            time.Minute,
+		BackgroundRefreshWorkers:      4,
 		EnableSessionCookies:          true,
 		EnableTokenHeader:             true,
 		EnableClaimsHeaders:           true,
 		EnableMetrics:                 true,
+		MetricsClaimMaxValues:         100,
 		TracingExporter:               "jaeger",
 		HTTPOnlyCookie:                true,
 		Headers:                       make(map[string]string),
@@ -62,6 +75,21 @@ func newDefaultConfig() *Config {
 		MaxIdleConnsPerHost:           50,
 		OAuthURI:                      "/oauth",
 		OpenIDProviderTimeout:         30 * time.Second,
+		UserinfoTimeout:               10 * time.Second,
+		UserinfoRetries:               1,
+		OpaqueTokenTTL:                30 * time.Second,
+		RefreshCooldown:               10 * time.Second,
+		RedirectLoopWindow:            30 * time.Second,
+		UnavailableRetryAfter:         30 * time.Second,
+		RefreshTokenSource:            refreshTokenSourceStore,
+		RefreshRateWindow:             time.Hour,
+		AccessLogMaxBackups:           5,
+		AuditWebhookBatchSize:         100,
+		AuditWebhookFlushInterval:     5 * time.Second,
+		AuditWebhookQueueSize:         10000,
+		AuditWebhookRetries:           3,
+		AcceptedTokenTypes:            []string{"Bearer", "JWT", "at+jwt"},
+		DebugCaptureBodiesSize:        4096,
 		PreserveHost:                  false,
 		SelfSignedTLSExpiration:       3 * time.Hour,
 		SelfSignedTLSHostnames:        hostnames,
@@ -70,6 +98,7 @@ func newDefaultConfig() *Config {
 		SameSiteCookie:                SameSiteLax,
 		SecureCookie:                  true,
 		ServerIdleTimeout:             120 * time.Second,
+		ShutdownGracePeriod:           20 * time.Second,
 		ServerReadTimeout:             10 * time.Second,
 		ServerWriteTimeout:            11 * time.Second, // make it upstream timeout + 1s to avoid closing the connection before headers are sent
 		SkipOpenIDProviderTLSVerify:   false,
@@ -79,6 +108,9 @@ func newDefaultConfig() *Config {
 		UpstreamKeepaliveTimeout:      10 * time.Second,
 		UpstreamKeepalives:            true,
 		UpstreamResponseHeaderTimeout: 10 * time.Second,
+		MaxResponseHeaderBytes:        256 << 10,
+		UpstreamResponseHeaderPolicy:  upstreamHeaderPolicyError,
+		UpstreamRetryBackoff:          100 * time.Millisecond,
 		UpstreamTLSHandshakeTimeout:   10 * time.Second,
 		UpstreamTimeout:               10 * time.Second,
 		UseLetsEncrypt:                false,
@@ -94,6 +126,66 @@ func (r *Config) WithOAuthURI(uri string) string {
 	return fmt.Sprintf("%s/%s", r.OAuthURI, uri)
 }
 
+// redacted returns a copy of the configuration without the secrets, e.g. to be logged
+func (r *Config) redacted() *Config {
+	c := *r
+	for _, secret := range []*string{&c.ClientSecret, &c.EncryptionKey, &c.ForwardingPassword, &c.TestModeSecret, &c.UpstreamSigningKey} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	if u, err := url.Parse(c.StoreURL); err == nil && u.User != nil {
+		if _, found := u.User.Password(); found {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			c.StoreURL = u.String()
+		}
+	}
+
+	return &c
+}
+
+// deprecatedField is a setting superseded by another one, or no longer needed. It is still accepted, but a warning
+// is printed once the configuration is validated, until the setting is removed.
+type deprecatedField struct {
+	// name is the name of the setting, as in the configuration file
+	name string
+	// replacement is the setting to use instead, if any
+	replacement string
+	// isSet checks whether the configuration uses the setting
+	isSet func(*Config) bool
+}
+
+// deprecatedFields is the registry of the deprecated settings
+var deprecatedFields = []deprecatedField{
+	{
+		name:  "cors-disable-upstream",
+		isSet: func(c *Config) bool { return c.CorsDisableUpstream },
+	},
+}
+
+// deprecations returns the deprecated settings used by the configuration
+func (r *Config) deprecations() []deprecatedField {
+	var found []deprecatedField
+	for _, field := range deprecatedFields {
+		if field.isSet(r) {
+			found = append(found, field)
+		}
+	}
+
+	return found
+}
+
+// warnDeprecations prints a warning for each of the deprecated settings used by the configuration
+func (r *Config) warnDeprecations(w io.Writer) {
+	for _, field := range r.deprecations() {
+		if field.replacement != "" {
+			fmt.Fprintf(w, "[warn] the setting %s is deprecated and will be removed, please use %s instead\n", field.name, field.replacement)
+			continue
+		}
+		fmt.Fprintf(w, "[warn] the setting %s is deprecated and will be removed, please update the configuration\n", field.name)
+	}
+}
+
 // isValid validates if the config is valid
 func (r *Config) isValid() error {
 	if err := r.isListenValid(); err != nil {
@@ -107,6 +199,34 @@ func (r *Config) isValid() error {
 		return fmt.Errorf("the letsencrypt cache dir has not been set")
 	}
 
+	if r.AccessLogFile != "" && !r.EnableLogging {
+		return errors.New("an access-log-file requires enable-logging")
+	}
+	if r.AccessLogFormat != "" && r.AccessLogFormat != accessLogFormatJSON && r.AccessLogFormat != accessLogFormatConsole {
+		return fmt.Errorf("access-log-format must be one of %s|%s", accessLogFormatJSON, accessLogFormatConsole)
+	}
+	if r.AccessLogMaxSize < 0 || r.AccessLogMaxBackups < 0 {
+		return errors.New("the access log rotation settings cannot be negative")
+	}
+	if r.ShutdownGracePeriod < 0 {
+		return errors.New("shutdown-grace-period cannot be negative")
+	}
+	if r.AuditWebhookURL != "" {
+		if u, err := url.Parse(r.AuditWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("the audit-webhook-url must be an absolute http(s) url")
+		}
+		if r.AuditWebhookBatchSize <= 0 || r.AuditWebhookQueueSize <= 0 || r.AuditWebhookFlushInterval <= 0 {
+			return errors.New("the audit webhook batch size, queue size and flush interval must be positive")
+		}
+		if r.AuditWebhookRetries < 0 {
+			return errors.New("audit-webhook-retries cannot be negative")
+		}
+	}
+
+	if r.DisableDefaultScopes && !containedIn("openid", r.Scopes, false) {
+		return errors.New("the scopes must include openid when the default scopes are disabled")
+	}
+
 	if r.EnableForwarding {
 		return r.isForwardingValid()
 	}
@@ -117,10 +237,38 @@ func (r *Config) isValid() error {
 	if r.EnableTracing && r.TracingExporter != jaegerExporter && r.TracingExporter != datadogExporter {
 		return fmt.Errorf("unsupported trace exporter. Current supported values are %q|%q", jaegerExporter, datadogExporter)
 	}
+	for _, format := range r.TracingPropagation {
+		if format != traceContextPropagation && format != b3Propagation {
+			return fmt.Errorf("unsupported trace propagation %q. Current supported values are %q|%q", format, traceContextPropagation, b3Propagation)
+		}
+	}
 
 	if r.SameSiteCookie != "" && r.SameSiteCookie != SameSiteStrict && r.SameSiteCookie != SameSiteLax && r.SameSiteCookie != SameSiteNone {
 		return errors.New("same-site-cookie must be one of Strict|Lax|None")
 	}
+	if r.EnablePartitionedCookies && (!r.SecureCookie || r.SameSiteCookie != SameSiteNone) {
+		return errors.New("partitioned cookies require secure-cookie and same-site-cookie None")
+	}
+	if r.SameSiteRedirectCookie != "" && r.SameSiteRedirectCookie != SameSiteLax && r.SameSiteRedirectCookie != SameSiteNone {
+		return errors.New("same-site-redirect-cookie must be one of Lax|None")
+	}
+	if r.SameSiteRedirectCookie == SameSiteNone && !r.SecureCookie {
+		return errors.New("same-site-redirect-cookie None requires secure-cookie")
+	}
+	for name, policy := range map[string]string{
+		"same-site-access-cookie":  r.SameSiteAccessCookie,
+		"same-site-refresh-cookie": r.SameSiteRefreshCookie,
+	} {
+		switch policy {
+		case "", SameSiteStrict, SameSiteLax:
+		case SameSiteNone:
+			if !r.SecureCookie {
+				return fmt.Errorf("%s None requires secure-cookie", name)
+			}
+		default:
+			return fmt.Errorf("%s must be one of Strict|Lax|None", name)
+		}
+	}
 
 	return r.isReverseProxyValid()
 }
@@ -130,6 +278,16 @@ func (r *Config) hasCustomSignInPage() bool {
 	return r.SignInPage != ""
 }
 
+// hasCustomRedirectLoopPage checks if there is a custom page for the redirect loops
+func (r *Config) hasCustomRedirectLoopPage() bool {
+	return r.RedirectLoopPage != ""
+}
+
+// hasCustomLogoutPage checks if there is a custom page confirming the logout
+func (r *Config) hasCustomLogoutPage() bool {
+	return r.LogoutPage != ""
+}
+
 // hasForbiddenPage checks if there is a custom forbidden page
 func (r *Config) hasCustomForbiddenPage() bool {
 	return r.ForbiddenPage != ""
@@ -365,6 +523,12 @@ func (r *Config) isListenValid() error {
 	if r.MaxIdleConnsPerHost < 0 || r.MaxIdleConnsPerHost > r.MaxIdleConns {
 		return errors.New("maxi-idle-connections-per-host must be a number > 0 and <= max-idle-connections")
 	}
+	if r.UpstreamMaxConnsPerPool < 0 {
+		return errors.New("upstream-max-connections-per-pool must be a number >= 0")
+	}
+	if r.UpstreamMaxConnsPerPool > 0 && !r.EnableUpstreamPoolIsolation {
+		return errors.New("upstream-max-connections-per-pool requires enable-upstream-pool-isolation")
+	}
 	return nil
 }
 
@@ -392,6 +556,42 @@ func (r *Config) isTLSValid() error {
 	return nil
 }
 
+// isMiddlewareOrderValid checks each middleware is listed once, after the middleware it depends on
+func (r *Config) isMiddlewareOrderValid() error {
+	if len(r.MiddlewareOrder) == 0 {
+		return nil
+	}
+	position := make(map[string]int, len(r.MiddlewareOrder))
+	for i, name := range r.MiddlewareOrder {
+		if !containsString(name, defaultMiddlewareOrder) {
+			return fmt.Errorf("unknown middleware %q in middleware-order, expected one of %s", name, strings.Join(defaultMiddlewareOrder, ", "))
+		}
+		if _, found := position[name]; found {
+			return fmt.Errorf("the middleware %q is listed more than once in middleware-order", name)
+		}
+		position[name] = i
+	}
+	for _, name := range defaultMiddlewareOrder {
+		if _, found := position[name]; !found {
+			return fmt.Errorf("the middleware %q is missing from middleware-order", name)
+		}
+	}
+	for name, dependencies := range middlewareDependencies {
+		for _, dependency := range dependencies {
+			if position[name] < position[dependency] {
+				return fmt.Errorf("the middleware %q must come after %q in middleware-order", name, dependency)
+			}
+		}
+	}
+	// step: the csrf state scoped to a claim is keyed by the identity of the user
+	if r.CSRFScopeClaim != "" && position[middlewareCSRF] < position[middlewareAuthentication] {
+		return fmt.Errorf("the middleware %q must come after %q in middleware-order when csrf-scope-claim is set",
+			middlewareCSRF, middlewareAuthentication)
+	}
+
+	return nil
+}
+
 func (r *Config) isTLSClientCertValid() error {
 	if r.TLSClientCertificate != "" && len(r.TLSClientCertificates) > 0 {
 		return fmt.Errorf("specify only one of single TLSAdminClientCertificate or array TLSAdminClientCertificates")
@@ -404,6 +604,18 @@ func (r *Config) isTLSClientCertValid() error {
 			return fmt.Errorf("the tls client certificate %s does not exist", clientCertFile)
 		}
 	}
+	if r.TLSClientCAFile != "" && !fileExists(r.TLSClientCAFile) {
+		return fmt.Errorf("the tls client ca file %s does not exist", r.TLSClientCAFile)
+	}
+	switch r.TLSClientAuth {
+	case "", tlsClientAuthRequest, tlsClientAuthRequire:
+	case tlsClientAuthVerify:
+		if r.TLSClientCAFile == "" && r.TLSClientCertificate == "" && len(r.TLSClientCertificates) == 0 {
+			return errors.New("verifying the client certificates requires a tls-client-ca-file")
+		}
+	default:
+		return fmt.Errorf("tls-client-auth must be one of %s|%s|%s", tlsClientAuthRequest, tlsClientAuthRequire, tlsClientAuthVerify)
+	}
 
 	if r.TLSAdminClientCertificate != "" && len(r.TLSAdminClientCertificates) > 0 {
 		return fmt.Errorf("specify only one of single TLSAdminClientCertificate or array TLSAdminClientCertificates")
@@ -486,6 +698,47 @@ func (r *Config) isReverseProxyValid() error {
 		return fmt.Errorf("you cannot require to check upstream tls and omit to specify the root ca to verify it: %s", r.UpstreamCA)
 	}
 
+	if r.MaxResponseHeaderBytes < 0 {
+		return errors.New("max-response-header-bytes cannot be negative")
+	}
+	switch r.DuplicateHeaderPolicy {
+	case "", duplicateHeaderPolicyFirst, duplicateHeaderPolicyLast, duplicateHeaderPolicyReject:
+	default:
+		return fmt.Errorf("duplicate-header-policy must be one of %s|%s|%s",
+			duplicateHeaderPolicyFirst, duplicateHeaderPolicyLast, duplicateHeaderPolicyReject)
+	}
+	switch r.UpstreamResponseHeaderPolicy {
+	case "", upstreamHeaderPolicyError, upstreamHeaderPolicyTruncate:
+	default:
+		return fmt.Errorf("upstream-response-header-policy must be either %s or %s", upstreamHeaderPolicyError, upstreamHeaderPolicyTruncate)
+	}
+	if r.UpstreamSigningKey != "" && len(r.UpstreamSigningKey) < 16 {
+		return fmt.Errorf("the upstream signing key (%d) must be at least 16 characters", len(r.UpstreamSigningKey))
+	}
+	if r.UpstreamRetries < 0 || r.UpstreamRetryBackoff < 0 {
+		return errors.New("the upstream retry settings cannot be negative")
+	}
+	for _, status := range r.RetryOnStatus {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("the upstream retry status %d is not a valid http status", status)
+		}
+	}
+	if len(r.RetryOnStatus) > 0 && r.UpstreamRetries == 0 {
+		return errors.New("upstream-retry-on-status requires upstream-retries")
+	}
+	if r.MetricsClaim != "" && r.MetricsClaimMaxValues <= 0 {
+		return errors.New("metrics-claim-max-values must be positive when counting the requests by claim")
+	}
+	if err := r.isMiddlewareOrderValid(); err != nil {
+		return err
+	}
+	if r.EnableIntrospection && r.ClientSecret == "" {
+		return errors.New("the token introspection requires a client-secret to authenticate the callers")
+	}
+	if r.EnableIntrospection && r.SkipTokenVerification {
+		return errors.New("the token introspection cannot be enabled while skipping the token verification")
+	}
+
 	// step: if token verification is enabled (skip is off), we need the below checks
 	if !r.SkipTokenVerification {
 		if err := r.isTokenConfigValid(); err != nil {
@@ -498,21 +751,38 @@ func (r *Config) isReverseProxyValid() error {
 		if err := resource.valid(); err != nil {
 			return err
 		}
+		if resource.CertAuth && r.TLSClientCAFile == "" && r.TLSClientCertificate == "" && len(r.TLSClientCertificates) == 0 {
+			return fmt.Errorf("the resource %s authenticates the clients by certificate, which requires a tls-client-ca-file", resource.getName())
+		}
 		// expand resources with multiple urls
 		if len(resource.URLs) > 0 {
 			for _, u := range resource.URLs {
 				res := &Resource{
-					URL:            u,
-					URLs:           nil,
-					Methods:        append([]string{}, resource.Methods...),
-					WhiteListed:    resource.WhiteListed,
-					BlackListed:    resource.BlackListed,
-					RequireAnyRole: resource.RequireAnyRole,
-					Roles:          append([]string{}, resource.Roles...),
-					Groups:         append([]string{}, resource.Groups...),
-					EnableCSRF:     resource.EnableCSRF,
-					StripBasePath:  resource.StripBasePath,
-					Upstream:       resource.Upstream,
+					Name:                resource.Name,
+					URL:                 u,
+					URLs:                nil,
+					Methods:             append([]string{}, resource.Methods...),
+					WhiteListed:         resource.WhiteListed,
+					BlackListed:         resource.BlackListed,
+					RequireAnyRole:      resource.RequireAnyRole,
+					Roles:               append([]string{}, resource.Roles...),
+					Groups:              append([]string{}, resource.Groups...),
+					EnableCSRF:          resource.EnableCSRF,
+					AllowAnonymous:      resource.AllowAnonymous,
+					CertAuth:            resource.CertAuth,
+					EnableTrailers:      resource.EnableTrailers,
+					StripBasePath:       resource.StripBasePath,
+					StepUpMaxAge:        resource.StepUpMaxAge,
+					StepUpMethods:       append([]string{}, resource.StepUpMethods...),
+					RateLimits:          resource.RateLimits,
+					MatchClaims:         resource.MatchClaims,
+					SkipSecurityHeaders: resource.SkipSecurityHeaders,
+					SecurityHeaders:     resource.SecurityHeaders,
+					Upstream:            resource.Upstream,
+					Upstreams:           append([]string{}, resource.Upstreams...),
+					UpstreamBasicAuth:   resource.UpstreamBasicAuth,
+					UpstreamCRL:         resource.UpstreamCRL,
+					EnableUpstreamOCSP:  resource.EnableUpstreamOCSP,
 				}
 				newResources = append(newResources, res)
 			}
@@ -535,6 +805,12 @@ func (r *Config) isReverseProxyValid() error {
 		}
 	}
 
+	for _, claim := range r.RequiredClaims {
+		if strings.TrimSpace(claim) == "" {
+			return errors.New("the required claims cannot contain an empty claim name")
+		}
+	}
+
 	// step: validate the claims are validate regex's
 	for k, claim := range r.MatchClaims {
 		if _, err := regexp.Compile(claim); err != nil {
@@ -542,6 +818,17 @@ func (r *Config) isReverseProxyValid() error {
 		}
 	}
 
+	// step: an identity asserted by a proxy may only be accepted from explicitly trusted peers
+	if _, err := parseTrustedProxies(r.TrustedProxies); err != nil {
+		return err
+	}
+	if _, err := parseNetworks("lockdown allowlist", r.LockdownAllowlist); err != nil {
+		return err
+	}
+	if r.TrustedIdentityHeader != "" && len(r.TrustedProxies) == 0 {
+		return errors.New("a trusted identity header requires the trusted proxies to be specified")
+	}
+
 	// step: validity checks for CSRF options
 	if r.EnableCSRF {
 		if r.EncryptionKey == "" {
@@ -558,6 +845,46 @@ func (r *Config) isReverseProxyValid() error {
 			return fmt.Errorf("flag EnableCSRF is set but no protected resource sets EnableCSRF")
 		}
 	}
+	if r.CSRFTokenCookie != "" && !r.EnableCSRF {
+		return fmt.Errorf("a CSRF token cookie requires EnableCSRF to be set")
+	}
+	if r.CSRFScopeClaim != "" && !r.EnableCSRF {
+		return fmt.Errorf("a CSRF scope claim requires EnableCSRF to be set")
+	}
+	for header, exact := range r.IdentityHeadersCase {
+		if !strings.EqualFold(header, exact) {
+			return fmt.Errorf("the casing %q does not spell the identity header %q", exact, header)
+		}
+	}
+	switch r.AddClaimsArrayFormat {
+	case "", claimArrayFormatJoin, claimArrayFormatRepeat:
+	default:
+		return fmt.Errorf("add-claims-array-format must be either %s or %s", claimArrayFormatJoin, claimArrayFormatRepeat)
+	}
+	switch r.IdentityHeadersEncoding {
+	case "", identityHeadersEncodingRFC8187, identityHeadersEncodingPercent, identityHeadersEncodingBase64:
+	default:
+		return fmt.Errorf("identity-headers-encoding must be one of %s|%s|%s",
+			identityHeadersEncodingRFC8187, identityHeadersEncodingPercent, identityHeadersEncodingBase64)
+	}
+	for claim, field := range r.ClientCertClaims {
+		if !containsString(field, clientCertFields) {
+			return fmt.Errorf("the claim %q cannot be taken from the unknown client certificate field %q", claim, field)
+		}
+	}
+	for claim, header := range r.ClaimHeaderMap {
+		if header == "" || strings.ContainsAny(header, " \t\r\n:") {
+			return fmt.Errorf("the claim %q cannot be passed in the header %q", claim, header)
+		}
+	}
+	for claim, header := range r.ClientResponseClaimHeaders {
+		if containsString(claim, sensitiveClaims) {
+			return fmt.Errorf("the claim %q cannot be returned to the client", claim)
+		}
+		if header == "" || containsString(http.CanonicalHeaderKey(header), protectedResponseHeaders) {
+			return fmt.Errorf("the claim %q cannot be returned in the response header %q", claim, header)
+		}
+	}
 	return nil
 }
 
@@ -568,6 +895,11 @@ func (r *Config) isDiscoveryValid() error {
 	if u, err := url.Parse(r.DiscoveryURL); err != nil || u.Scheme == "" || u.Host == "" {
 		return fmt.Errorf("discovery url is not a valid URL: %s", r.DiscoveryURL)
 	}
+	for _, pin := range r.OpenIDProviderPinnedSPKI {
+		if hash, err := base64.StdEncoding.DecodeString(pin); err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("the pinned public key %q is not a base64 sha256 hash", pin)
+		}
+	}
 	return nil
 }
 
@@ -586,6 +918,12 @@ func (r *Config) isTokenConfigValid() error {
 			return fmt.Errorf("redirection url is not a valid URL: %s", r.RedirectionURL)
 		}
 	}
+	if r.WWWAuthenticate != "" && !r.EnableLoginChallenge {
+		return errors.New("the www-authenticate header is only sent with the login challenges, enable-login-challenge must be set")
+	}
+	if r.EnableRedirectionURLCheck && (r.RedirectionURL == "" || r.NoRedirects) {
+		return errors.New("checking the redirection url requires a redirection-url, with the redirects to the provider enabled")
+	}
 	if !r.EnableSecurityFilter {
 		if r.EnableHTTPSRedirect {
 			return errors.New("the security filter must be switched on for this feature: http-redirect")
@@ -604,18 +942,189 @@ func (r *Config) isTokenConfigValid() error {
 		}
 	}
 
+	for _, v := range r.SuspiciousPathsAllowlist {
+		if !containsString(strings.ToLower(v), suspiciousPathEncodings) {
+			return fmt.Errorf("suspicious-paths-allowlist entry %q is not one of %s", v, strings.Join(suspiciousPathEncodings, ", "))
+		}
+		if v == "%00" {
+			return errors.New("null bytes cannot be allowed in the paths")
+		}
+	}
+	if r.EnableCSPNonce && !strings.Contains(r.ContentSecurityPolicy, cspNoncePlaceholder) {
+		return fmt.Errorf("the content-security-policy must contain a %s placeholder when enable-csp-nonce is set", cspNoncePlaceholder)
+	}
+
 	if (r.EnableEncryptedToken || r.ForceEncryptedCookie) && r.EncryptionKey == "" {
 		return errors.New("you have not specified an encryption key for encoding the access token")
 	}
+	if r.EnableCookieMAC && r.EncryptionKey == "" {
+		return errors.New("signing the cookies requires an encryption key")
+	}
 	if r.EnableRefreshTokens && r.EncryptionKey == "" {
 		return errors.New("you have not specified an encryption key for encoding the session state")
 	}
 	if r.EnableRefreshTokens && (len(r.EncryptionKey) != 16 && len(r.EncryptionKey) != 32) {
 		return fmt.Errorf("the encryption key (%d) must be either 16 or 32 characters for AES-128/AES-256 selection", len(r.EncryptionKey))
 	}
-	if !r.NoRedirects && r.SecureCookie && r.RedirectionURL != "" && !strings.HasPrefix(r.RedirectionURL, "https") {
+	if !r.NoRedirects && r.SecureCookie && !r.EnableAdaptiveSecureCookie && !r.EnableForwardedSecureCookie && r.RedirectionURL != "" && !strings.HasPrefix(r.RedirectionURL, "https") {
 		return errors.New("the cookie is set to secure but your redirection url is non-tls")
 	}
+	if r.EnableAdaptiveSecureCookie && !r.SecureCookie {
+		return errors.New("adapting the secure attribute of the cookies requires secure-cookie")
+	}
+	if r.EnableForwardedSecureCookie && r.EnableAdaptiveSecureCookie {
+		return errors.New("the secure attribute of the cookies cannot be both adaptive and forwarded")
+	}
+	if r.EnableForwardedSecureCookie && len(r.TrustedProxies) == 0 {
+		return errors.New("deriving the secure attribute of the cookies from X-Forwarded-Proto requires the trusted proxies to be specified")
+	}
+	if r.EnableStoredAccessToken && (r.StoreURL == "" || !r.EnableRefreshTokens) {
+		return errors.New("keeping the access token in the store requires a store-url and refresh tokens to be enabled")
+	}
+	if r.EnableOpaqueSessionCookie && r.StoreURL == "" {
+		return errors.New("opaque session cookies require a store-url to hold the sessions")
+	}
+	if r.EnableBackgroundRefresh && (!r.EnableOpaqueSessionCookie || !r.EnableRefreshTokens || r.EnableStoredAccessToken) {
+		return errors.New("refreshing the sessions in the background requires opaque session cookies and refresh tokens to be enabled, without keeping the access token in the store")
+	}
+	if r.EnableBackgroundRefresh && r.RefreshGracePeriod <= 0 {
+		return errors.New("refresh-grace-period must be positive when refreshing the sessions in the background")
+	}
+	if r.EnableBackgroundRefresh && r.BackgroundRefreshWorkers <= 0 {
+		return errors.New("background-refresh-workers must be positive when refreshing the sessions in the background")
+	}
+	switch r.SessionIDFormat {
+	case "", sessionIDFormatUUID, sessionIDFormatBase64:
+	default:
+		return fmt.Errorf("session-id-format must be either %s or %s", sessionIDFormatUUID, sessionIDFormatBase64)
+	}
+	if r.RefreshTokenSource != "" && r.RefreshTokenSource != refreshTokenSourceStore && r.RefreshTokenSource != refreshTokenSourceCookie {
+		return fmt.Errorf("refresh-token-source must be either %s or %s", refreshTokenSourceStore, refreshTokenSourceCookie)
+	}
+	if r.EnableRefreshTokenMigration && (r.StoreURL == "" || !r.EnableRefreshTokens || r.EnableStoredAccessToken) {
+		return errors.New("migrating the refresh tokens requires a store-url and refresh tokens to be enabled, without keeping the access token in the store")
+	}
+	if r.EnableRefreshTokenMigration && r.RefreshTokenSource == refreshTokenSourceCookie {
+		return errors.New("migrating the refresh tokens to the store cannot be combined with looking them up in cookies first")
+	}
+	if r.EnableSessionRotation && !r.EnableRefreshTokens {
+		return errors.New("rotating the sessions on a privilege change requires refresh tokens to be enabled")
+	}
+	if r.EnableTestMode && r.TestModeSecret == "" {
+		return errors.New("the test mode requires a test-mode-secret to be shared with the tests")
+	}
+	if r.AccessCookieDuration < 0 || r.RefreshCookieDuration < 0 {
+		return errors.New("the access and refresh cookie durations cannot be negative")
+	}
+	if r.EnableSessionAccessCookie && r.AccessCookieDuration > 0 {
+		return errors.New("a session access cookie cannot be given an access-cookie-duration")
+	}
+	if r.EnableSessionCookies && (r.AccessCookieDuration > 0 || r.RefreshCookieDuration > 0) {
+		return errors.New("the cookie durations cannot be combined with enable-session-cookies")
+	}
+	if r.MaxAuthorizationHeaderSize < 0 {
+		return errors.New("max-authorization-header-size cannot be negative")
+	}
+	if r.RefreshCooldown < 0 {
+		return errors.New("refresh-cooldown cannot be negative")
+	}
+	if r.FailedAuthDelay < 0 {
+		return errors.New("failed-auth-delay cannot be negative")
+	}
+	if r.UnavailableRetryAfter < 0 {
+		return errors.New("unavailable-retry-after cannot be negative")
+	}
+	if r.RedirectLoopLimit < 0 {
+		return errors.New("redirect-loop-limit cannot be negative")
+	}
+	if r.RedirectLoopLimit > 0 && r.RedirectLoopWindow <= 0 {
+		return errors.New("redirect-loop-window must be positive when detecting redirect loops")
+	}
+	if r.RedirectLoopLimit > 0 && r.NoRedirects {
+		return errors.New("detecting redirect loops cannot be combined with no-redirects")
+	}
+	if r.LogoutPage != "" && r.EnableLogoutRedirect {
+		return errors.New("a logout-page cannot be combined with enable-logout-redirect, which signs out on the provider")
+	}
+	if r.RedirectLoopPage != "" && r.RedirectLoopLimit == 0 {
+		return errors.New("a redirect-loop-page requires the redirect-loop-limit to be set")
+	}
+	if r.UserinfoTimeout < 0 {
+		return errors.New("userinfo-timeout cannot be negative")
+	}
+	if r.UserinfoRetries < 0 {
+		return errors.New("userinfo-retries cannot be negative")
+	}
+	if r.EnableUserinfoMerge && len(r.UserinfoClaims) == 0 {
+		return errors.New("merging the userinfo requires the userinfo-claims to merge")
+	}
+	if r.EnableOpaqueTokens && r.OpaqueTokenTTL <= 0 {
+		return errors.New("opaque-token-ttl must be positive when accepting opaque tokens")
+	}
+	if r.DebugCaptureBodies && r.DebugCaptureBodiesSize <= 0 {
+		return errors.New("debug-capture-bodies-size must be positive")
+	}
+	if _, err := compileRedactions(r.DebugCaptureRedact); err != nil {
+		return fmt.Errorf("invalid debug-capture-redact pattern: %v", err)
+	}
+	if r.WarmupTimeout < 0 {
+		return errors.New("warmup-timeout cannot be negative")
+	}
+	if r.StoreHealthInterval < 0 {
+		return errors.New("store-health-interval cannot be negative")
+	}
+	if r.MaxSessionsPerUser < 0 {
+		return errors.New("max-sessions-per-user cannot be negative")
+	}
+	if r.EnableSessionIDIndex && (r.StoreURL == "" || !r.EnableRefreshTokens) {
+		return errors.New("indexing the sessions by session id requires a store-url and refresh tokens to be enabled")
+	}
+	if r.MaxSessionsPerUser > 0 && (r.StoreURL == "" || !r.EnableRefreshTokens) {
+		return errors.New("limiting the sessions per user requires a store-url and refresh tokens to be enabled")
+	}
+	switch r.SessionIPBinding {
+	case "", sessionIPBindingExact, sessionIPBindingSubnet:
+	default:
+		return fmt.Errorf("session-ip-binding must be either %s or %s", sessionIPBindingExact, sessionIPBindingSubnet)
+	}
+	if r.SessionIPBinding != "" && r.EncryptionKey == "" {
+		return errors.New("binding the sessions to the client address requires the encryption-key")
+	}
+	if r.EnableSessionUserAgentBinding && r.EncryptionKey == "" {
+		return errors.New("binding the sessions to the user agent requires the encryption-key")
+	}
+	switch r.PKCEChallengeMethod {
+	case "", pkceMethodS256, pkceMethodPlain:
+	default:
+		return fmt.Errorf("pkce-challenge-method must be either %s or %s", pkceMethodS256, pkceMethodPlain)
+	}
+	if r.EnablePKCE && r.EncryptionKey == "" {
+		return errors.New("enabling pkce requires the encryption-key to protect the code verifier cookie")
+	}
+	for _, alg := range r.AllowedSigningAlgorithms {
+		if !containedIn(alg, asymmetricSigningAlgorithms, false) {
+			return fmt.Errorf("the signing algorithm %q is not allowed, only asymmetric algorithms are: %s",
+				alg, strings.Join(asymmetricSigningAlgorithms, ","))
+		}
+	}
+	if r.EnableTokenTypeCheck && len(r.AcceptedTokenTypes) == 0 {
+		return errors.New("checking the type of the tokens requires the accepted-token-types")
+	}
+	if r.RefreshRateLimit < 0 {
+		return errors.New("refresh-rate-limit cannot be negative")
+	}
+	if r.RefreshRateLimit > 0 && (r.StoreURL == "" || !r.EnableRefreshTokens) {
+		return errors.New("limiting the refresh rate of the sessions requires a store-url and refresh tokens to be enabled")
+	}
+	if r.RefreshRateLimit > 0 && r.RefreshRateWindow <= 0 {
+		return errors.New("refresh-rate-window must be positive when limiting the refresh rate")
+	}
+	if r.EncryptStoreTokens && r.StoreURL == "" {
+		return errors.New("encrypting the store tokens requires a store-url")
+	}
+	if r.EncryptStoreTokens && len(r.EncryptionKey) != 16 && len(r.EncryptionKey) != 32 {
+		return fmt.Errorf("encrypting the store tokens requires an encryption key (%d) of either 16 or 32 characters for AES-128/AES-256 selection", len(r.EncryptionKey))
+	}
 
 	return r.isStoreValid()
 }
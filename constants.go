@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 type contextKey int8
 
 const (
@@ -10,6 +12,7 @@ const (
 	callbackURL      = "/callback"
 	expiredURL       = "/expired"
 	healthURL        = "/health"
+	readyURL         = "/ready"
 	loginURL         = "/login"
 	logoutURL        = "/logout"
 	metricsURL       = "/metrics"
@@ -17,38 +20,209 @@ const (
 	debugURL         = "/debug/pprof"
 	refreshURL       = "/refresh"
 	traceURL         = "/trace"
+	introspectURL    = "/introspect"
+	testTokenURL     = "/test-token"
 
 	// default claims used to analyze access token
-	claimAudience       = "aud"
-	claimPreferredName  = "preferred_username"
-	claimRealmAccess    = "realm_access"
-	claimResourceAccess = "resource_access"
-	claimResourceRoles  = "roles"
-	claimGroups         = "groups"
+	claimAudience        = "aud"
+	claimPreferredName   = "preferred_username"
+	claimRealmAccess     = "realm_access"
+	claimResourceAccess  = "resource_access"
+	claimResourceRoles   = "roles"
+	claimGroups          = "groups"
+	claimEmail           = "email"
+	claimAuthTime        = "auth_time"
+	claimIssuedAt        = "iat"
+	claimExpiration      = "exp"
+	claimNotBefore       = "nbf"
+	claimAuthMethods     = "amr"
+	claimNonce           = "nonce"
+	claimAuthorizedParty = "azp"
+	claimSessionID       = "sid"
+	claimTokenType       = "typ"
+
+	// authMethodRolePrefix prefixes the authentication methods of the user when used as roles
+	authMethodRolePrefix = "amr:"
 
 	// default cookies names
 	accessCookie       = "kc-access"
 	refreshCookie      = "kc-state"
 	requestURICookie   = "request_uri"
 	requestStateCookie = "OAuth_Token_Request_State"
+	requestNonceCookie = "OAuth_Token_Request_Nonce"
+	// requestCodeVerifierCookie holds the encrypted pkce code verifier of the authorization request
+	requestCodeVerifierCookie = "OAuth_Token_Request_Verifier"
+	// refreshCooldownCookie holds the end of the cooldown following a rejected refresh token
+	refreshCooldownCookie = "kc-refresh-cooldown"
+	// redirectLoopCookie counts the redirections of a browser to the authorization since the start of the window
+	redirectLoopCookie = "kc-redirect-loop"
+	// sessionBindingCookie holds the MAC of the client attributes a session is bound to
+	sessionBindingCookie = "kc-session-binding"
+
+	// accessTokenKeyPrefix namespaces the access tokens kept in the store
+	accessTokenKeyPrefix = "access:"
+	// sessionsKeyPrefix namespaces the index of the sessions of the users in the store
+	sessionsKeyPrefix = "sessions:"
+	// sessionIDKeyPrefix namespaces the index of the sessions by session id (sid claim) in the store
+	sessionIDKeyPrefix = "sid:"
+	// storeProbeKeyPrefix namespaces the keys written when probing the store
+	storeProbeKeyPrefix = "probe:"
+	// refreshCountKeyPrefix namespaces the counts of the refreshes of the sessions in the store
+	refreshCountKeyPrefix = "refreshes:"
+	// opaqueSessionKeyPrefix namespaces the sessions held by the opaque session cookies in the store
+	opaqueSessionKeyPrefix = "opaque:"
 
 	unsecureScheme = "http"
 	secureScheme   = "https"
 	anyMethod      = "ANY"
 	allRoutes      = "/*"
+	regexURLPrefix = "^"
+	promptLogin    = "login"
+
+	// policies applied to the upstream responses with oversized headers
+	upstreamHeaderPolicyError    = "error"
+	upstreamHeaderPolicyTruncate = "truncate"
+
+	// policies applied to the requests with duplicate Authorization or Cookie headers
+	duplicateHeaderPolicyFirst  = "first"
+	duplicateHeaderPolicyLast   = "last"
+	duplicateHeaderPolicyReject = "reject"
+
+	// encodings of the identity headers holding characters which cannot be sent as is
+	identityHeadersEncodingRFC8187 = "rfc8187"
+	identityHeadersEncodingPercent = "percent"
+	identityHeadersEncodingBase64  = "base64"
+
+	// serializations of the custom claims holding arrays
+	claimArrayFormatJoin   = "join"
+	claimArrayFormatRepeat = "repeat"
+
+	// policies of the listener for the client certificates
+	tlsClientAuthRequest = "request"
+	tlsClientAuthRequire = "require"
+	tlsClientAuthVerify  = "verify"
+
+	// fields of the client certificates the identities of the cert-auth resources are taken from
+	certFieldCommonName         = "cn"
+	certFieldOrganization       = "o"
+	certFieldOrganizationalUnit = "ou"
+	certFieldDNS                = "dns"
+	certFieldURI                = "uri"
+	certFieldEmail              = "email"
+	certFieldSerial             = "serial"
+
+	// the middleware protecting the resources which may be reordered
+	middlewareAuthentication  = "authentication"
+	middlewareAdmission       = "admission"
+	middlewareRateLimit       = "rate-limit"
+	middlewareIdentityHeaders = "identity-headers"
+	middlewareCSRF            = "csrf"
+
+	// reasons of the denials told to the trusted clients
+	denyReasonClaimTypes = "claim-types"
+	denyReasonRoles      = "roles"
+	denyReasonGroups     = "groups"
+	denyReasonClaim      = "claim"
+	// denyReasonRequiredClaim tells a required claim is absent or empty
+	denyReasonRequiredClaim = "required-claim"
+	// denyReasonInvalidToken tells the token failed its verification, e.g. its signature, audience or issuer
+	denyReasonInvalidToken = "invalid-token"
+
+	// bindings of the sessions to the address of the client
+	sessionIPBindingExact  = "exact"
+	sessionIPBindingSubnet = "subnet"
+
+	// formats of the opaque session ids
+	sessionIDFormatUUID   = "uuid"
+	sessionIDFormatBase64 = "base64"
+
+	// methods deriving the pkce code challenge from the verifier
+	pkceMethodS256  = "S256"
+	pkceMethodPlain = "plain"
+
+	// redirectionCheckState is the state of the authorization request checking the redirection url on startup
+	redirectionCheckState = "redirection-url-check"
+
+	// placeholders substituted in the WWW-Authenticate header of the login challenges
+	loginURLPlaceholder     = "{login_url}"
+	authEndpointPlaceholder = "{authorization_endpoint}"
+
+	// cookieMACSeparator separates the value of a cookie from its MAC
+	cookieMACSeparator = "."
+
+	// cspNoncePlaceholder is substituted with the nonce of the request in the content security policy
+	cspNoncePlaceholder = "{nonce}"
+
+	// sources of the refresh token, when both a store and cookies may hold it
+	refreshTokenSourceStore  = "store"
+	refreshTokenSourceCookie = "cookie"
 
 	_ contextKey = iota
 	contextScopeName
+	contextBodyCapture
+
+	jsonMime                   = "application/json; charset=utf-8"
+	headerXForwardedFor        = "X-Forwarded-For"
+	headerXRealIP              = "X-Real-IP"
+	headerXForwardedClientCert = "X-Forwarded-Client-Cert"
+	headerXRequestedWith       = "X-Requested-With"
+	authorizationHeader        = "Authorization"
+	versionHeader              = "X-Auth-Proxy-Version"
+	headerXContentTypeOptions  = "X-Content-Type-Options"
+	headerXXSSProtection       = "X-XSS-Protection"
+	headerXFrameOptions        = "X-Frame-Options"
+	headerXSTS                 = "X-Strict-Transport-Security"
+	headerXPolicy              = "X-Content-Security-Policy"
+	headerCSP                  = "Content-Security-Policy"
+	headerCSPNonce             = "X-CSP-Nonce"
+	headerWWWAuthenticate      = "WWW-Authenticate"
+	headerTE                   = "Te"
+	headerServerTiming         = "Server-Timing"
+	headerAcceptEncoding       = "Accept-Encoding"
+	headerContentEncoding      = "Content-Encoding"
+	headerRetryAfter           = "Retry-After"
+	headerGatekeeperResource   = "X-Gatekeeper-Resource"
+	headerTestModeSecret       = "X-Test-Mode-Secret"
+	authorizationType          = "Bearer"
+	headerAuthTokenPart        = "X-Auth-Token-Part-"
+	identityHeaderPrefix       = "X-Auth-"
+
+	// commonHeaderSizeLimit is the usual size limit of a header line on upstream servers
+	commonHeaderSizeLimit = 8192
+
+	// jwksCacheRefreshInterval is the interval of the refreshes of the keys cached to disk
+	jwksCacheRefreshInterval = time.Hour
+	// jwksCacheRetryInterval is the pause before fetching again the keys to cache, after a failure
+	jwksCacheRetryInterval = 10 * time.Second
+	// userinfoRetryDelay is the pause before retrying a failed request to the userinfo endpoint
+	userinfoRetryDelay = 100 * time.Millisecond
+	// auditWebhookTimeout is the timeout of the requests posting the access decisions to the audit webhook
+	auditWebhookTimeout = 10 * time.Second
+	// auditWebhookRetryDelay is the pause before posting again a batch of access decisions, doubled on each attempt
+	auditWebhookRetryDelay = time.Second
+	// upstreamOCSPTimeout is the timeout of the queries to the OCSP responders of the upstream certificates
+	upstreamOCSPTimeout = 5 * time.Second
+	// ocspDefaultCacheDuration is how long the answer of an OCSP responder without a next update is kept
+	ocspDefaultCacheDuration = time.Hour
+	// ocspMaxResponseSize bounds the size of the answers of the OCSP responders
+	ocspMaxResponseSize = 1 << 20
+	// backgroundRefreshInterval is the pause between two looks for the sessions to renew in the background
+	backgroundRefreshInterval = time.Second
+	// backgroundRefreshRetryDelay is the pause before renewing again a session in the background
+	backgroundRefreshRetryDelay = 30 * time.Second
+	// upstreamDownPeriod is how long an upstream target refusing the connections is skipped by the balancing
+	upstreamDownPeriod = 10 * time.Second
+	// failedAuthDelayMaxPending is the number of failed authentication responses which may be delayed at once
+	failedAuthDelayMaxPending = 1024
+	// testModeIssuer is the issuer of the tokens crafted in test mode, signed by the service itself
+	testModeIssuer = "gatekeeper-test-mode"
+	// testModeTokenDuration is the lifetime of the tokens crafted in test mode without an expiry
+	testModeTokenDuration = time.Hour
+	// testModeMaxClaimsSize bounds the size of the claims of the tokens crafted in test mode
+	testModeMaxClaimsSize = 1 << 16
+	// metricLabelOverflow is the label of the values past the cap of a metric label
+	metricLabelOverflow = "other"
 
-	jsonMime                  = "application/json; charset=utf-8"
-	headerXForwardedFor       = "X-Forwarded-For"
-	headerXRealIP             = "X-Real-IP"
-	authorizationHeader       = "Authorization"
-	versionHeader             = "X-Auth-Proxy-Version"
-	headerXContentTypeOptions = "X-Content-Type-Options"
-	headerXXSSProtection      = "X-XSS-Protection"
-	headerXFrameOptions       = "X-Frame-Options"
-	headerXSTS                = "X-Strict-Transport-Security"
-	headerXPolicy             = "X-Content-Security-Policy"
-	authorizationType         = "Bearer"
+	// statusClientClosedRequest is the non-standard status used to account for requests cancelled by the client
+	statusClientClosedRequest = 499
 )
@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"go.uber.org/zap"
 )
 
 // SameSite cookie config options
@@ -31,10 +32,84 @@ const (
 	SameSiteNone   = "None"
 )
 
+// partitionedAttribute is the CHIPS cookie attribute, which http.Cookie does not know about
+const partitionedAttribute = "; Partitioned"
+
 // dropCookie drops a cookie into the response
-func (r *oauthProxy) dropCookie(w http.ResponseWriter, host, name, value string, duration time.Duration) {
-	cookie := r.cookieDropper(host, name, value, duration)
-	http.SetCookie(w, cookie)
+func (r *oauthProxy) dropCookie(w http.ResponseWriter, req *http.Request, name, value string, duration time.Duration) {
+	r.writeCookie(w, r.newCookie(req, name, value, duration))
+}
+
+// dropReadableCookie drops a cookie which scripts are allowed to read, regardless of the http-only setting
+func (r *oauthProxy) dropReadableCookie(w http.ResponseWriter, req *http.Request, name, value string, duration time.Duration) {
+	cookie := r.newCookie(req, name, value, duration)
+	cookie.HttpOnly = false
+	r.writeCookie(w, cookie)
+}
+
+// dropRedirectCookie drops a cookie which is read back on the cross-site return from the provider, with
+// the SameSite policy configured for these cookies
+func (r *oauthProxy) dropRedirectCookie(w http.ResponseWriter, req *http.Request, name, value string, duration time.Duration) {
+	r.dropSameSiteCookie(w, req, name, value, duration, r.config.SameSiteRedirectCookie)
+}
+
+// dropSameSiteCookie drops a cookie with its own SameSite policy, if any, instead of the policy of the cookies
+func (r *oauthProxy) dropSameSiteCookie(w http.ResponseWriter, req *http.Request, name, value string, duration time.Duration, sameSite string) {
+	cookie := r.newCookie(req, name, value, duration)
+	switch {
+	case sameSite == SameSiteStrict:
+		cookie.SameSite = http.SameSiteStrictMode
+	case sameSite == SameSiteLax:
+		cookie.SameSite = http.SameSiteLaxMode
+	case sameSite == SameSiteNone && cookie.Secure:
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	r.writeCookie(w, cookie)
+}
+
+// newCookie makes a cookie for the host of the request. In the development mode adapting the cookies to the
+// scheme, the Secure attribute is dropped on plain http requests, so are the attributes requiring it. When
+// the Secure attribute follows the forwarded scheme, it is set on the requests received over tls or forwarded
+// as https by a trusted proxy.
+func (r *oauthProxy) newCookie(req *http.Request, name, value string, duration time.Duration) *http.Cookie {
+	cookie := r.cookieDropper(req.Host, name, value, duration)
+	secure := cookie.Secure
+	switch {
+	case r.config.EnableForwardedSecureCookie:
+		secure = req.TLS != nil || (isSecureRequest(req) && isTrustedProxy(req.RemoteAddr, r.trustedProxies))
+	case r.config.EnableAdaptiveSecureCookie:
+		secure = cookie.Secure && isSecureRequest(req)
+	}
+	if secure != cookie.Secure {
+		cookie.Secure = secure
+		if !secure && cookie.SameSite == http.SameSiteNoneMode {
+			cookie.SameSite = http.SameSiteLaxMode
+		}
+	}
+
+	return cookie
+}
+
+// writeCookie serializes the cookie into the response
+func (r *oauthProxy) writeCookie(w http.ResponseWriter, cookie *http.Cookie) {
+	// partitioned cookies must be secure
+	if !r.config.EnablePartitionedCookies || !cookie.Secure {
+		http.SetCookie(w, cookie)
+		return
+	}
+	if v := cookie.String(); v != "" {
+		w.Header().Add("Set-Cookie", v+partitionedAttribute)
+	}
+}
+
+// partitionCookies adds the Partitioned attribute to the cookies with this name already set in the response
+func partitionCookies(w http.ResponseWriter, name string) {
+	cookies := w.Header()["Set-Cookie"]
+	for i, v := range cookies {
+		if strings.HasPrefix(v, name+"=") && !strings.HasSuffix(v, partitionedAttribute) {
+			cookies[i] = v + partitionedAttribute
+		}
+	}
 }
 
 func (r *oauthProxy) makeCookieDropper() func(string, string, string, time.Duration) *http.Cookie {
@@ -53,6 +128,11 @@ func (r *oauthProxy) makeCookieDropper() func(string, string, string, time.Durat
 		baseCookie.SameSite = http.SameSiteStrictMode
 	case SameSiteLax:
 		baseCookie.SameSite = http.SameSiteLaxMode
+	case SameSiteNone:
+		// partitioned cookies are only accepted cross-site with an explicit SameSite=None
+		if r.config.EnablePartitionedCookies {
+			baseCookie.SameSite = http.SameSiteNoneMode
+		}
 	}
 
 	makeBase := func(name, value string) *http.Cookie {
@@ -123,12 +203,22 @@ func (r *oauthProxy) makeCookieChunker() func(string, string) int {
 	if !r.config.EnableSessionCookies {
 		maxCookieChunkLength -= len("Expires=Mon, 02 Jan 2006 03:04:05 MST; ")
 	}
-	if r.config.SameSiteCookie != "" {
-		maxCookieChunkLength -= len("SameSite=" + r.config.SameSiteCookie + "; ")
+	// the token cookies may have their own SameSite policy: the longest is accounted for
+	sameSite := r.config.SameSiteCookie
+	for _, policy := range []string{r.config.SameSiteAccessCookie, r.config.SameSiteRefreshCookie} {
+		if len(policy) > len(sameSite) {
+			sameSite = policy
+		}
+	}
+	if sameSite != "" {
+		maxCookieChunkLength -= len("SameSite=" + sameSite + "; ")
 	}
 	if r.config.SecureCookie {
 		maxCookieChunkLength -= len("Secure")
 	}
+	if r.config.EnablePartitionedCookies {
+		maxCookieChunkLength -= len(partitionedAttribute)
+	}
 	if r.config.CookieDomain != "" {
 		maxCookieChunkLength -= len("Domain=; ")
 		maxCookieChunkLength -= len(r.config.CookieDomain)
@@ -141,67 +231,161 @@ func (r *oauthProxy) makeCookieChunker() func(string, string) int {
 	}
 }
 
-// dropCookieWithChunks drops a cookie from the response, taking into account possible chunks
-func (r *oauthProxy) dropCookieWithChunks(req *http.Request, w http.ResponseWriter, name, value string, duration time.Duration) {
+// dropCookieWithChunks drops a cookie from the response, taking into account possible chunks. The chunks
+// carry the given SameSite policy, if any.
+func (r *oauthProxy) dropCookieWithChunks(req *http.Request, w http.ResponseWriter, name, value string, duration time.Duration, sameSite string) {
 	maxCookieChunkLength := r.getMaxCookieChunkLength(req, name)
 	if len(value) <= maxCookieChunkLength {
-		r.dropCookie(w, req.Host, name, value, duration)
+		r.dropSameSiteCookie(w, req, name, value, duration, sameSite)
 		return
 	}
 	// write divided cookies because payload is too long for single cookie
-	r.dropCookie(w, req.Host, name, value[0:maxCookieChunkLength], duration)
+	r.dropSameSiteCookie(w, req, name, value[0:maxCookieChunkLength], duration, sameSite)
 	for i := maxCookieChunkLength; i < len(value); i += maxCookieChunkLength {
 		end := i + maxCookieChunkLength
 		if end > len(value) {
 			end = len(value)
 		}
-		r.dropCookie(w, req.Host, name+"-"+strconv.Itoa(i/maxCookieChunkLength), value[i:end], duration)
+		r.dropSameSiteCookie(w, req, name+"-"+strconv.Itoa(i/maxCookieChunkLength), value[i:end], duration, sameSite)
 	}
 }
 
-// dropAccessTokenCookie drops a access token cookie from the response
+// dropAccessTokenCookie drops a access token cookie from the response. The duration derived from the tokens
+// gives way to the configured one, if any.
 func (r *oauthProxy) dropAccessTokenCookie(req *http.Request, w http.ResponseWriter, value string, duration time.Duration) {
-	r.dropCookieWithChunks(req, w, r.config.CookieAccessName, value, duration)
+	switch {
+	case r.config.EnableSessionAccessCookie:
+		duration = 0
+	case r.config.AccessCookieDuration > 0:
+		duration = r.config.AccessCookieDuration
+	}
+	if r.config.EnableOpaqueSessionCookie {
+		id, err := r.keepOpaqueSession(req, value)
+		if err != nil {
+			r.log.Error("failed to keep the session in the store, the access cookie is not issued", zap.Error(err))
+			return
+		}
+		value = id
+	}
+	if r.config.EnableCookieMAC {
+		value = signCookieValue(r.config.CookieAccessName, value, r.config.EncryptionKey)
+	}
+	r.dropCookieWithChunks(req, w, r.config.CookieAccessName, value, duration, r.config.SameSiteAccessCookie)
 }
 
-// dropRefreshTokenCookie drops a refresh token cookie from the response
+// dropRefreshTokenCookie drops a refresh token cookie from the response. The configured duration takes
+// precedence over the expiry of the refresh token.
 func (r *oauthProxy) dropRefreshTokenCookie(req *http.Request, w http.ResponseWriter, value string, duration time.Duration) {
-	r.dropCookieWithChunks(req, w, r.config.CookieRefreshName, value, duration)
+	if r.config.RefreshCookieDuration > 0 {
+		duration = r.config.RefreshCookieDuration
+	}
+	if r.config.EnableCookieMAC {
+		value = signCookieValue(r.config.CookieRefreshName, value, r.config.EncryptionKey)
+	}
+	r.dropCookieWithChunks(req, w, r.config.CookieRefreshName, value, duration, r.config.SameSiteRefreshCookie)
 }
 
 // writeStateParameterCookie sets a state parameter cookie into the response
 func (r *oauthProxy) writeStateParameterCookie(req *http.Request, w http.ResponseWriter) string {
 	uuid := uuid.NewString()
-	r.dropCookie(w, req.Host, requestStateCookie, uuid, 0)
+	r.dropRedirectCookie(w, req, requestStateCookie, uuid, 0)
 
 	return uuid
 }
 
+// writeNonceCookie sets the nonce of the authorization request into the response
+func (r *oauthProxy) writeNonceCookie(req *http.Request, w http.ResponseWriter) string {
+	nonce := uuid.NewString()
+	r.dropRedirectCookie(w, req, requestNonceCookie, nonce, 0)
+
+	return nonce
+}
+
+// dropRefreshCooldownCookie starts the refresh cooldown of the browser. The end of the cooldown is
+// held in the value, as session cookies carry no expiry.
+func (r *oauthProxy) dropRefreshCooldownCookie(req *http.Request, w http.ResponseWriter) {
+	if r.config.RefreshCooldown <= 0 {
+		return
+	}
+	until := time.Now().Add(r.config.RefreshCooldown).Unix()
+	r.dropCookie(w, req, refreshCooldownCookie, strconv.FormatInt(until, 10), r.config.RefreshCooldown)
+}
+
+// inRefreshCooldown indicates the browser had its refresh token rejected moments ago
+func (r *oauthProxy) inRefreshCooldown(req *http.Request) bool {
+	if r.config.RefreshCooldown <= 0 {
+		return false
+	}
+	cookie, err := req.Cookie(refreshCooldownCookie)
+	if err != nil {
+		return false
+	}
+	until, err := strconv.ParseInt(cookie.Value, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	return time.Now().Before(time.Unix(until, 0))
+}
+
+// countRedirectLoop records a redirection of the browser to the authorization and returns the number of
+// redirections within the current window
+func (r *oauthProxy) countRedirectLoop(req *http.Request, w http.ResponseWriter) int {
+	now := time.Now()
+	start, count := now.Unix(), 0
+	if cookie, err := req.Cookie(redirectLoopCookie); err == nil {
+		parts := strings.SplitN(cookie.Value, ":", 2)
+		if len(parts) == 2 {
+			s, errStart := strconv.ParseInt(parts[0], 10, 64)
+			c, errCount := strconv.Atoi(parts[1])
+			if errStart == nil && errCount == nil && now.Sub(time.Unix(s, 0)) <= r.config.RedirectLoopWindow {
+				start, count = s, c
+			}
+		}
+	}
+	count++
+	expires := time.Until(time.Unix(start, 0).Add(r.config.RedirectLoopWindow))
+	r.dropCookie(w, req, redirectLoopCookie, strconv.FormatInt(start, 10)+":"+strconv.Itoa(count), expires)
+
+	return count
+}
+
 // clearAllCookies is just a helper function for the below
 func (r *oauthProxy) clearAllCookies(req *http.Request, w http.ResponseWriter) {
 	r.clearAccessTokenCookie(req, w)
 	r.clearRefreshTokenCookie(req, w)
 	r.clearStateCookie(req, w)
+	if r.bindsSessions() {
+		r.clearSessionBindingCookie(req, w)
+	}
 }
 
 // clearRefreshSessionCookie clears the session cookie
 func (r *oauthProxy) clearRefreshTokenCookie(req *http.Request, w http.ResponseWriter) {
-	r.dropCookie(w, req.Host, r.config.CookieRefreshName, "", -10*time.Hour)
+	r.dropCookie(w, req, r.config.CookieRefreshName, "", -10*time.Hour)
 	r.clearDividedCookies(req, w, r.config.CookieRefreshName)
 }
 
 // clearAccessTokenCookie clears the session cookie
 func (r *oauthProxy) clearAccessTokenCookie(req *http.Request, w http.ResponseWriter) {
-	r.dropCookie(w, req.Host, r.config.CookieAccessName, "", -10*time.Hour)
+	if r.config.EnableOpaqueSessionCookie {
+		r.deleteOpaqueSession(req)
+	}
+	r.dropCookie(w, req, r.config.CookieAccessName, "", -10*time.Hour)
 	r.clearDividedCookies(req, w, r.config.CookieAccessName)
 }
 
 // clearStateCookie clears the session state cookie
 func (r *oauthProxy) clearStateCookie(req *http.Request, w http.ResponseWriter) {
-	r.dropCookie(w, req.Host, requestStateCookie, "", -10*time.Hour)
+	r.dropCookie(w, req, requestStateCookie, "", -10*time.Hour)
 	r.clearDividedCookies(req, w, requestStateCookie)
 }
 
+// clearNonceCookie clears the nonce of the authorization request
+func (r *oauthProxy) clearNonceCookie(req *http.Request, w http.ResponseWriter) {
+	r.dropCookie(w, req, requestNonceCookie, "", -10*time.Hour)
+}
+
 func (r *oauthProxy) clearDividedCookies(req *http.Request, w http.ResponseWriter, name string) {
 	// clear divided cookies
 	for i := 1; i < len(req.Cookies()); i++ {
@@ -209,7 +393,7 @@ func (r *oauthProxy) clearDividedCookies(req *http.Request, w http.ResponseWrite
 		if err != nil {
 			break
 		}
-		r.dropCookie(w, req.Host, name+"-"+strconv.Itoa(i), "", -10*time.Hour)
+		r.dropCookie(w, req, name+"-"+strconv.Itoa(i), "", -10*time.Hour)
 	}
 }
 
@@ -16,8 +16,10 @@ limitations under the License.
 package main
 
 import (
+	"crypto/tls"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -73,7 +75,7 @@ func TestDropCookie(t *testing.T) {
 
 	req := newFakeHTTPRequest("GET", "/admin")
 	resp := httptest.NewRecorder()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1",
@@ -84,7 +86,7 @@ func TestDropCookie(t *testing.T) {
 	p.config.SecureCookie = false
 	p.cookieChunker = p.makeCookieChunker()
 	p.cookieDropper = p.makeCookieDropper()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1",
@@ -95,13 +97,13 @@ func TestDropCookie(t *testing.T) {
 	p.config.SecureCookie = true
 	p.cookieChunker = p.makeCookieChunker()
 	p.cookieDropper = p.makeCookieDropper()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 	assert.NotEqual(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.2; HttpOnly; Secure",
 		"we have not set the cookie, headers: %v", resp.Header())
 
 	p.config.CookieDomain = "test.com"
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 	p.config.SecureCookie = false
 	p.cookieChunker = p.makeCookieChunker()
 	p.cookieDropper = p.makeCookieDropper()
@@ -122,6 +124,32 @@ func TestDropRefreshCookie(t *testing.T) {
 		"we have not set the cookie, headers: %v", resp.Header())
 }
 
+func TestCookieDurations(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	p.config.EnableSessionAccessCookie = true
+	p.config.RefreshCookieDuration = 720 * time.Hour
+
+	req := newFakeHTTPRequest("GET", "/admin")
+	resp := httptest.NewRecorder()
+	p.dropAccessTokenCookie(req, resp, "access", time.Hour)
+	p.dropRefreshTokenCookie(req, resp, "refresh", 0)
+
+	cookies := resp.Result().Cookies()
+	require.Len(t, cookies, 2)
+	assert.Equal(t, p.config.CookieAccessName, cookies[0].Name)
+	assert.True(t, cookies[0].Expires.IsZero(), "the access cookie should be a session cookie")
+	assert.Equal(t, p.config.CookieRefreshName, cookies[1].Name)
+	assertAlmostEquals(t, 720*time.Hour, time.Until(cookies[1].Expires))
+
+	p.config.EnableSessionAccessCookie = false
+	p.config.AccessCookieDuration = 2 * time.Hour
+	resp = httptest.NewRecorder()
+	p.dropAccessTokenCookie(req, resp, "access", time.Minute)
+	cookies = resp.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assertAlmostEquals(t, 2*time.Hour, time.Until(cookies[0].Expires))
+}
+
 func TestSessionOnlyCookie(t *testing.T) {
 	p, _, _ := newTestProxyService(nil)
 	p.config.EnableSessionCookies = true
@@ -130,7 +158,7 @@ func TestSessionOnlyCookie(t *testing.T) {
 
 	req := newFakeHTTPRequest("GET", "/admin")
 	resp := httptest.NewRecorder()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 1*time.Hour)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 1*time.Hour)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1",
@@ -142,7 +170,7 @@ func TestSameSiteCookie(t *testing.T) {
 
 	req := newFakeHTTPRequest("GET", "/admin")
 	resp := httptest.NewRecorder()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1",
@@ -153,7 +181,7 @@ func TestSameSiteCookie(t *testing.T) {
 	p.config.SameSiteCookie = SameSiteStrict
 	p.cookieChunker = p.makeCookieChunker()
 	p.cookieDropper = p.makeCookieDropper()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1; SameSite=Strict",
@@ -164,7 +192,7 @@ func TestSameSiteCookie(t *testing.T) {
 	p.config.SameSiteCookie = SameSiteLax
 	p.cookieChunker = p.makeCookieChunker()
 	p.cookieDropper = p.makeCookieDropper()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1; SameSite=Lax",
@@ -175,19 +203,83 @@ func TestSameSiteCookie(t *testing.T) {
 	p.config.SameSiteCookie = SameSiteNone
 	p.cookieChunker = p.makeCookieChunker()
 	p.cookieDropper = p.makeCookieDropper()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1",
 		"we have not set the cookie, headers: %v", resp.Header())
 }
 
+func TestSameSiteRedirectCookie(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	p.config.SameSiteCookie = SameSiteStrict
+	p.config.SameSiteRedirectCookie = SameSiteLax
+	p.cookieDropper = p.makeCookieDropper()
+
+	req := newFakeHTTPRequest("GET", "/admin")
+	resp := httptest.NewRecorder()
+	p.writeStateParameterCookie(req, resp)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
+
+	cookies := resp.Result().Cookies()
+	require.Len(t, cookies, 2)
+	assert.Equal(t, requestStateCookie, cookies[0].Name)
+	assert.Equal(t, http.SameSiteLaxMode, cookies[0].SameSite)
+	assert.Equal(t, http.SameSiteStrictMode, cookies[1].SameSite)
+
+	p.config.SecureCookie = true
+	p.config.SameSiteRedirectCookie = SameSiteNone
+	p.cookieDropper = p.makeCookieDropper()
+	resp = httptest.NewRecorder()
+	p.writeNonceCookie(req, resp)
+	assert.Contains(t, resp.Header().Get("Set-Cookie"), "; Secure; SameSite=None")
+}
+
+func TestSameSiteTokenCookies(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	p.config.SameSiteCookie = SameSiteLax
+	p.config.SameSiteAccessCookie = SameSiteStrict
+	p.config.SameSiteRefreshCookie = SameSiteStrict
+	p.cookieChunker = p.makeCookieChunker()
+	p.cookieDropper = p.makeCookieDropper()
+
+	req := newFakeHTTPRequest("GET", "/admin")
+	resp := httptest.NewRecorder()
+	p.dropAccessTokenCookie(req, resp, "access", 0)
+	p.dropRefreshTokenCookie(req, resp, "refresh", 0)
+	p.writeStateParameterCookie(req, resp)
+
+	headers := resp.Header()["Set-Cookie"]
+	require.Len(t, headers, 3)
+	assert.Equal(t, p.config.CookieAccessName+"=access; Path=/; Domain=127.0.0.1; SameSite=Strict", headers[0])
+	assert.Equal(t, p.config.CookieRefreshName+"=refresh; Path=/; Domain=127.0.0.1; SameSite=Strict", headers[1])
+	assert.True(t, strings.HasPrefix(headers[2], requestStateCookie+"="))
+	assert.True(t, strings.HasSuffix(headers[2], "; SameSite=Lax"), "the state cookie keeps the policy of the cookies")
+
+	// the chunks of a large token carry the policy as well
+	resp = httptest.NewRecorder()
+	p.dropAccessTokenCookie(req, resp, strings.Repeat("a", 5000), 0)
+	headers = resp.Header()["Set-Cookie"]
+	require.Len(t, headers, 2)
+	for _, header := range headers {
+		assert.True(t, strings.HasSuffix(header, "; SameSite=Strict"), header)
+		assert.True(t, len(header) <= 4096, "the chunk should fit in a cookie")
+	}
+
+	p.config.SecureCookie = true
+	p.config.SameSiteAccessCookie = SameSiteNone
+	p.cookieDropper = p.makeCookieDropper()
+	resp = httptest.NewRecorder()
+	p.dropAccessTokenCookie(req, resp, "access", 0)
+	assert.Equal(t, p.config.CookieAccessName+"=access; Path=/; Domain=127.0.0.1; Secure; SameSite=None", resp.Header().Get("Set-Cookie"))
+}
+
 func TestHTTPOnlyCookie(t *testing.T) {
 	p, _, _ := newTestProxyService(nil)
 
 	req := newFakeHTTPRequest("GET", "/admin")
 	resp := httptest.NewRecorder()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1",
@@ -198,7 +290,7 @@ func TestHTTPOnlyCookie(t *testing.T) {
 	p.config.HTTPOnlyCookie = true
 	p.cookieChunker = p.makeCookieChunker()
 	p.cookieDropper = p.makeCookieDropper()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1; HttpOnly",
@@ -263,3 +355,93 @@ func TestGetMaxCookieChunkLength(t *testing.T) {
 	assert.Equal(t, 3998, p.getMaxCookieChunkLength(req, ""),
 		"cookie chunk calculation is not correct")
 }
+
+func TestPartitionedCookie(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	p.config.SecureCookie = true
+	p.config.SameSiteCookie = SameSiteNone
+	p.config.EnablePartitionedCookies = true
+	p.cookieChunker = p.makeCookieChunker()
+	p.cookieDropper = p.makeCookieDropper()
+
+	req := newFakeHTTPRequest("GET", "/admin")
+	resp := httptest.NewRecorder()
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
+
+	assert.Equal(t, "test-cookie=test-value; Path=/; Domain=127.0.0.1; Secure; SameSite=None; Partitioned",
+		resp.Header().Get("Set-Cookie"),
+		"we have not set the cookie, headers: %v", resp.Header())
+
+	resp = httptest.NewRecorder()
+	p.clearAccessTokenCookie(req, resp)
+	assert.Contains(t, resp.Header().Get("Set-Cookie"), "; Partitioned")
+}
+
+func TestPartitionCookies(t *testing.T) {
+	resp := httptest.NewRecorder()
+	resp.Header().Add("Set-Cookie", "kc-csrf=value; Path=/")
+	resp.Header().Add("Set-Cookie", "other=value; Path=/")
+	partitionCookies(resp, "kc-csrf")
+	partitionCookies(resp, "kc-csrf")
+
+	assert.Equal(t, []string{"kc-csrf=value; Path=/; Partitioned", "other=value; Path=/"}, resp.Header()["Set-Cookie"])
+}
+
+func TestAdaptiveSecureCookie(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	p.config.SecureCookie = true
+	p.config.SameSiteCookie = SameSiteNone
+	p.config.EnablePartitionedCookies = true
+	p.config.EnableAdaptiveSecureCookie = true
+	p.cookieChunker = p.makeCookieChunker()
+	p.cookieDropper = p.makeCookieDropper()
+
+	req := newFakeHTTPRequest("GET", "/admin")
+	resp := httptest.NewRecorder()
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
+
+	assert.Equal(t, "test-cookie=test-value; Path=/; Domain=127.0.0.1; SameSite=Lax",
+		resp.Header().Get("Set-Cookie"),
+		"we have not set the cookie, headers: %v", resp.Header())
+
+	req.Header.Set("X-Forwarded-Proto", "https")
+	resp = httptest.NewRecorder()
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
+
+	assert.Equal(t, "test-cookie=test-value; Path=/; Domain=127.0.0.1; Secure; SameSite=None; Partitioned",
+		resp.Header().Get("Set-Cookie"),
+		"we have not set the cookie, headers: %v", resp.Header())
+}
+
+func TestForwardedSecureCookie(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	p.config.SecureCookie = false
+	p.config.EnableForwardedSecureCookie = true
+	p.trustedProxies, _ = parseTrustedProxies([]string{"10.0.0.0/8"})
+	p.cookieDropper = p.makeCookieDropper()
+
+	cases := []struct {
+		RemoteAddr string
+		Proto      string
+		Secure     bool
+	}{
+		{RemoteAddr: "10.0.0.1:4000", Proto: "https", Secure: true},
+		{RemoteAddr: "10.0.0.1:4000", Proto: "http", Secure: false},
+		{RemoteAddr: "10.0.0.1:4000", Secure: false},
+		// the scheme asserted by an untrusted peer is ignored
+		{RemoteAddr: "192.168.1.1:4000", Proto: "https", Secure: false},
+	}
+	for i, c := range cases {
+		req := newFakeHTTPRequest("GET", "/admin")
+		req.RemoteAddr = c.RemoteAddr
+		if c.Proto != "" {
+			req.Header.Set("X-Forwarded-Proto", c.Proto)
+		}
+		cookie := p.newCookie(req, "test-cookie", "test-value", 0)
+		assert.Equal(t, c.Secure, cookie.Secure, "case %d, expected the secure attribute to be %t", i, c.Secure)
+	}
+
+	req := newFakeHTTPRequest("GET", "/admin")
+	req.TLS = &tls.ConnectionState{}
+	assert.True(t, p.newCookie(req, "test-cookie", "test-value", 0).Secure, "the requests over tls should get secure cookies")
+}
@@ -16,19 +16,24 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"path"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/coreos/go-oidc/jose"
 	"github.com/go-chi/chi"
+	gcsrf "github.com/gorilla/csrf"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -553,3 +558,74 @@ func TestCSRF(t *testing.T) {
 	}
 	t.Logf("CSRF test on POST upstream scenario 8 passed")
 }
+
+func TestCSRFTokenCookie(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableCSRF = true
+	cfg.EncryptionKey = "01234567890123456789012345678901"
+	cfg.CSRFTokenCookie = "XSRF-TOKEN"
+	cfg.Resources = []*Resource{
+		{
+			URL:        "/csrf/*",
+			Methods:    allHTTPMethods,
+			EnableCSRF: true,
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:             "/csrf/test",
+			HasToken:        true,
+			HasCookieToken:  true,
+			ExpectedCode:    http.StatusOK,
+			ExpectedProxy:   true,
+			ExpectedCookies: map[string]string{"XSRF-TOKEN": ""},
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestCSRFScopeClaim(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableCSRF = true
+	cfg.EncryptionKey = "01234567890123456789012345678901"
+	cfg.CSRFScopeClaim = claimSessionID
+	cfg.CSRFCookieName = "kc-csrf"
+	cfg.CSRFHeader = "X-CSRF-Token"
+	cfg.Resources = []*Resource{
+		{
+			URL:        "/csrf/*",
+			Methods:    allHTTPMethods,
+			EnableCSRF: true,
+		},
+	}
+	proxy := newFakeProxy(cfg).proxy
+	handler := proxy.csrf(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(cfg.CSRFHeader, gcsrf.Token(req))
+	}))
+	serve := func(method, sid string, cookies []*http.Cookie, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/csrf/test", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		if token != "" {
+			req.Header.Set(cfg.CSRFHeader, token)
+		}
+		user := &userContext{claims: jose.Claims{claimSessionID: sid}}
+		req = req.WithContext(context.WithValue(req.Context(), contextScopeName, &RequestScope{Identity: user}))
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		return resp
+	}
+
+	// the CSRF state is obtained by a first session
+	resp := serve(http.MethodGet, "session-a", nil, "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	token := resp.Header().Get(cfg.CSRFHeader)
+	cookies := resp.Result().Cookies()
+	require.NotEmpty(t, token)
+	require.NotEmpty(t, cookies)
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodPost, "session-a", cookies, token).Code)
+	assert.Equal(t, http.StatusForbidden, serve(http.MethodPost, "session-b", cookies, token).Code)
+}
@@ -42,7 +42,10 @@ type Config struct {
 	ClientSecret string `json:"client-secret" yaml:"client-secret" usage:"client secret used to authenticate to the oauth service" env:"CLIENT_SECRET"`
 	// RedirectionURL the redirection url
 	RedirectionURL string `json:"redirection-url" yaml:"redirection-url" usage:"redirection url for the oauth callback url, defaults to host header is absent" env:"REDIRECTION_URL"`
-	// RevocationEndpoint is the token revocation endpoint to revoke refresh tokens
+	// EnableRedirectionURLCheck checks on startup the provider accepts the redirection url for the client
+	EnableRedirectionURLCheck bool `json:"enable-redirection-url-check" yaml:"enable-redirection-url-check" usage:"send an authorization request on startup to check the redirection url is registered for the client at the provider"`
+	// RevocationEndpoint is the token revocation endpoint to revoke refresh tokens on logout, e.g. the revocation_endpoint
+	// of the provider (RFC 7009). Defaults to the end session endpoint of the provider.
 	RevocationEndpoint string `json:"revocation-url" yaml:"revocation-url" usage:"url for the revocation endpoint to revoke refresh token" env:"REVOCATION_URL"`
 	// SkipOpenIDProviderTLSVerify skips the tls verification for openid provider communication
 	SkipOpenIDProviderTLSVerify bool `json:"skip-openid-provider-tls-verify" yaml:"skip-openid-provider-tls-verify" usage:"skip the verification of any TLS communication with the openid provider"`
@@ -52,28 +55,86 @@ type Config struct {
 	OpenIDProviderTimeout time.Duration `json:"openid-provider-timeout" yaml:"openid-provider-timeout" usage:"timeout for openid configuration on .well-known/openid-configuration"`
 	// OpenIDProviderCA is the certificate authority issuing the TLS certificate for the OpenID provider
 	OpenIDProviderCA string `json:"openid-provider-ca" yaml:"openid-provider-ca" usage:"certificate authority for openid configuration endpoints"`
+	// OpenIDProviderPinnedSPKI are the base64 sha256 hashes of the public keys the openid provider certificates are pinned to
+	OpenIDProviderPinnedSPKI []string `json:"openid-provider-pinned-spki" yaml:"openid-provider-pinned-spki" usage:"base64 sha256 hash of a subject public key the openid provider certificate chain must present"`
 	// BaseURI is prepended to all the generated URIs
 	BaseURI string `json:"base-uri" yaml:"base-uri" usage:"common prefix for all URIs" env:"BASE_URI"`
 	// OAuthURI is the uri for the oauth endpoints for the proxy
 	OAuthURI string `json:"oauth-uri" yaml:"oauth-uri" usage:"the uri for proxy oauth endpoints" env:"OAUTH_URI"`
 	// Scopes is a list of scope we should request
 	Scopes []string `json:"scopes" yaml:"scopes" usage:"list of scopes requested when authenticating the user"`
+	// DisableDefaultScopes stops requesting the default openid scopes (openid, email, profile) on top of Scopes, which
+	// are then sent as is, in order
+	DisableDefaultScopes bool `json:"disable-default-scopes" yaml:"disable-default-scopes" usage:"only request the configured scopes, in order, without adding the default openid, email and profile scopes. The scopes must then include openid"`
+	// ScopesDelimiter separates the scopes sent to the provider, for the providers not following the standard space
+	ScopesDelimiter string `json:"scopes-delimiter" yaml:"scopes-delimiter" usage:"delimiter of the scopes in the authorization and token requests, for providers not accepting the standard space"`
 	// RequiredScopes is a list of scope we require for a token to be valid
 	RequiredScopes []string `json:"required-scopes" yaml:"required-scopes" usage:"list of scopes required when authenticating the user"`
+	// EnableUserinfoMerge merges claims from the userinfo endpoint into the claims of the token
+	EnableUserinfoMerge bool `json:"enable-userinfo-merge" yaml:"enable-userinfo-merge" usage:"fetches the userinfo of the user once per token and merges the userinfo-claims into the token claims, e.g. for admission on roles or groups only found there"`
+	// UserinfoClaims are the claims taken from the userinfo endpoint when merging
+	UserinfoClaims []string `json:"userinfo-claims" yaml:"userinfo-claims" usage:"the claims of the userinfo endpoint merged into the token claims, overriding them, e.g. groups"`
+	// EnableOpaqueTokens accepts bearer tokens which are not jwt, verified at the userinfo endpoint instead
+	EnableOpaqueTokens bool `json:"enable-opaque-tokens" yaml:"enable-opaque-tokens" usage:"accepts opaque bearer tokens, which are verified and described by the userinfo endpoint rather than locally" env:"ENABLE_OPAQUE_TOKENS"`
+	// OpaqueTokenTTL is how long the userinfo of an opaque token is trusted, as the token carries no expiry
+	OpaqueTokenTTL time.Duration `json:"opaque-token-ttl" yaml:"opaque-token-ttl" usage:"how long an opaque token verified at the userinfo endpoint is trusted before being verified again"`
+	// UserinfoTimeout bounds each request to the userinfo endpoint
+	UserinfoTimeout time.Duration `json:"userinfo-timeout" yaml:"userinfo-timeout" usage:"timeout of the requests to the userinfo endpoint"`
+	// UserinfoRetries is the number of times a request to the userinfo endpoint is retried on a transient error
+	UserinfoRetries int `json:"userinfo-retries" yaml:"userinfo-retries" usage:"number of retries of the requests to the userinfo endpoint failing with a network or server error"`
+	// DebugCaptureBodies logs the request and response bodies of the upstream server errors
+	DebugCaptureBodies bool `json:"debug-capture-bodies" yaml:"debug-capture-bodies" usage:"logs the head of the request and response bodies when the upstream responds with a 5xx, headers holding credentials are redacted. Never applies to websockets nor event streams. DEBUGGING ONLY"`
+	// DebugCaptureBodiesSize is the maximum size of the bodies logged
+	DebugCaptureBodiesSize int `json:"debug-capture-bodies-size" yaml:"debug-capture-bodies-size" usage:"the maximum number of bytes of each body logged by debug-capture-bodies"`
+	// DebugCaptureRedact are the patterns of the body content to redact from the logs
+	DebugCaptureRedact []string `json:"debug-capture-redact" yaml:"debug-capture-redact" usage:"regular expressions of the body content redacted from the logs of debug-capture-bodies, e.g. \"password\":\"[^\"]*\""`
+	// ExpectedAuthorizedParty is the client the tokens must have been issued to (azp claim)
+	ExpectedAuthorizedParty string `json:"expected-authorized-party" yaml:"expected-authorized-party" usage:"rejects tokens whose authorized party (azp claim) is not this client, e.g. the client-id"`
+	// JWKSCacheFile is where the keys of the provider are persisted. They are loaded on startup and verify the tokens
+	// until the keys can be fetched from the provider, e.g. when it is briefly unreachable.
+	JWKSCacheFile string `json:"jwks-cache-file" yaml:"jwks-cache-file" usage:"path of a file the keys of the provider are persisted to, and loaded from on startup to verify the tokens until fresh keys are fetched from the provider"`
+	// AllowedSigningAlgorithms restricts the algorithms the tokens may be signed with, against algorithm confusion
+	AllowedSigningAlgorithms []string `json:"allowed-signing-algorithms" yaml:"allowed-signing-algorithms" usage:"the algorithms the tokens may be signed with, e.g. RS256. Only asymmetric algorithms are accepted, all of them by default"`
+	// EnableTokenTypeCheck rejects the tokens whose typ header or claim is not one of the AcceptedTokenTypes, e.g. an
+	// ID token (typ ID) presented instead of an access token
+	EnableTokenTypeCheck bool `json:"enable-token-type-check" yaml:"enable-token-type-check" usage:"rejects the tokens whose typ header or claim is not one of the accepted-token-types, e.g. ID tokens presented as access tokens"`
+	// AcceptedTokenTypes are the types of token accepted by the EnableTokenTypeCheck
+	AcceptedTokenTypes []string `json:"accepted-token-types" yaml:"accepted-token-types" usage:"the types of token accepted in the typ header or claim, compared regardless of case. Defaults to Bearer, JWT and at+jwt"`
 	// Upstream is the upstream endpoint i.e whom were proxying to
 	Upstream string `json:"upstream-url" yaml:"upstream-url" usage:"url for the upstream endpoint you wish to proxy" env:"UPSTREAM_URL"`
+	// UpstreamSigningKey signs the requests to the upstream with an HMAC-SHA256 of their method, path and timestamp,
+	// in the X-Gatekeeper-Signature and X-Gatekeeper-Timestamp headers. The signing package verifies them.
+	UpstreamSigningKey string `json:"upstream-signing-key" yaml:"upstream-signing-key" usage:"key signing the requests to the upstream, in the X-Gatekeeper-Signature header" env:"UPSTREAM_SIGNING_KEY"`
 	// UpstreamCA is the path to a CA certificate in PEM format to validate the upstream certificate
 	UpstreamCA string `json:"upstream-ca" yaml:"upstream-ca" usage:"the path to a file container a CA certificate to validate the upstream tls endpoint" env:"UPSTREAM_CA"`
 	// Resources is a list of protected resources
 	Resources []*Resource `json:"resources" yaml:"resources" usage:"list of resources 'uri=/admin*|methods=GET,PUT|roles=role1,role2'"`
+	// MiddlewareOrder is the order of the middleware protecting the resources, defaults to the order of defaultMiddlewareOrder
+	MiddlewareOrder []string `json:"middleware-order" yaml:"middleware-order" usage:"the order of the middleware protecting the resources, listing each of authentication, admission, rate-limit, identity-headers and csrf once"`
 	// Headers permits adding customs headers across the board
 	Headers map[string]string `json:"headers" yaml:"headers" usage:"custom headers to the upstream request, key=value"`
 	// PreserveHost preserves the host header of the proxied request in the upstream request. Disabled by default.
 	PreserveHost bool `json:"preserve-host" yaml:"preserve-host" usage:"preserve the host header of the proxied request in the upstream request. Disabled by default" env:"PRESERVE_HOST"`
+	// PreserveRawQuery passes the query string to the upstream exactly as received, e.g. for pre-signed urls. Disabled by default.
+	PreserveRawQuery bool `json:"preserve-raw-query" yaml:"preserve-raw-query" usage:"pass the query string to the upstream exactly as received, never normalized nor re-encoded, e.g. for signed urls. Disabled by default" env:"PRESERVE_RAW_QUERY"`
 	// RequestIDHeader is the header name for request ids
 	RequestIDHeader string `json:"request-id-header" yaml:"request-id-header" usage:"the http header name for request id" env:"REQUEST_ID_HEADER"`
+	// EnableResourceHeader names the resource a request was routed to in the X-Gatekeeper-Resource response header,
+	// e.g. to debug the routing from the browser. Only the name of the resource, or its URL, is told, never its upstream.
+	EnableResourceHeader bool `json:"enable-resource-header" yaml:"enable-resource-header" usage:"names the resource which handled the request in the X-Gatekeeper-Resource response header, for debugging the routing. Disabled by default"`
 	// ResponseHeader is a map of response headers to add to the response
 	ResponseHeaders map[string]string `json:"response-headers" yaml:"response-headers" usage:"custom headers to be added to the http response key=value"`
+	// TrustedProxies is a list of IP addresses or CIDR ranges of the proxies in front of the gatekeeper. The address of the
+	// client is the first untrusted one found in X-Forwarded-For, walking from the right.
+	TrustedProxies []string `json:"trusted-proxies" yaml:"trusted-proxies" usage:"list of IP addresses or CIDR ranges of trusted proxies, e.g. 10.0.0.0/8"`
+	// EnableLockdown restricts the service to the clients of the LockdownAllowlist, the others get a 503. Both settings
+	// are reloaded from the configuration file on SIGHUP.
+	EnableLockdown bool `json:"enable-lockdown" yaml:"enable-lockdown" usage:"only serves the clients of the lockdown-allowlist, responding 503 to the others before any authentication. Reloaded from the configuration file on SIGHUP"`
+	// LockdownAllowlist is a list of IP addresses or CIDR ranges of the clients served during the lockdown
+	LockdownAllowlist []string `json:"lockdown-allowlist" yaml:"lockdown-allowlist" usage:"list of IP addresses or CIDR ranges of the clients served during the lockdown, e.g. the admins. Reloaded from the configuration file on SIGHUP"`
+	// TrustedIdentityHeader is a header carrying the identity of the client, as asserted by a trusted proxy (e.g. a service mesh
+	// authenticating clients with mTLS). Requests from trusted proxies with this header are not authenticated against the provider.
+	TrustedIdentityHeader string `json:"trusted-identity-header" yaml:"trusted-identity-header" usage:"header carrying the client identity asserted by a trusted proxy, e.g. X-Forwarded-Client-Cert. Such requests skip the openid authentication"`
 
 	// EnableSelfSignedTLS indicates we should create a self-signed certificate for the service
 	EnabledSelfSignedTLS bool `json:"enable-self-signed-tls" yaml:"enable-self-signed-tls" usage:"create self signed certificates for the proxy" env:"ENABLE_SELF_SIGNED_TLS"`
@@ -98,12 +159,58 @@ type Config struct {
 	EnableLogging bool `json:"enable-logging" yaml:"enable-logging" usage:"enable http logging of the requests"`
 	// EnableJSONLogging is the logging format
 	EnableJSONLogging bool `json:"enable-json-logging" yaml:"enable-json-logging" usage:"switch on json logging rather than text"`
+	// AccessLogFile is where the requests are logged when EnableLogging is set, apart from the service logs
+	AccessLogFile string `json:"access-log-file" yaml:"access-log-file" usage:"path of the file the requests are logged to, instead of the service logs, or stdout|stderr. Requires enable-logging"`
+	// AccessLogFormat is the format of the access log, json or console. Defaults to the format of the service logs
+	AccessLogFormat string `json:"access-log-format" yaml:"access-log-format" usage:"format of the access log (json|console). Defaults to the format of the service logs"`
+	// AccessLogMaxSize is the size of the access log file beyond which it is rotated
+	AccessLogMaxSize int `json:"access-log-max-size" yaml:"access-log-max-size" usage:"size in bytes beyond which the access log file is rotated, zero to never rotate"`
+	// AccessLogMaxBackups is the number of rotated access log files kept
+	AccessLogMaxBackups int `json:"access-log-max-backups" yaml:"access-log-max-backups" usage:"number of rotated access log files kept, e.g. access.log.1. Defaults to 5"`
+	// AuditLogPath is where the access decisions are logged as json lines, apart from the service and access logs
+	AuditLogPath string `json:"audit-log-path" yaml:"audit-log-path" usage:"path of the file the access decisions are logged to as json lines, or stdout|stderr"`
+	// AuditWebhookURL is where the access decisions are posted in batches, as json arrays
+	AuditWebhookURL string `json:"audit-webhook-url" yaml:"audit-webhook-url" usage:"url the access decisions are posted to in batches, as json arrays" env:"AUDIT_WEBHOOK_URL"`
+	// AuditWebhookBatchSize is the maximum number of access decisions posted at once
+	AuditWebhookBatchSize int `json:"audit-webhook-batch-size" yaml:"audit-webhook-batch-size" usage:"the maximum number of access decisions posted at once to the audit webhook. Defaults to 100"`
+	// AuditWebhookFlushInterval is the pause before posting an incomplete batch
+	AuditWebhookFlushInterval time.Duration `json:"audit-webhook-flush-interval" yaml:"audit-webhook-flush-interval" usage:"the pause before posting an incomplete batch to the audit webhook. Defaults to 5s"`
+	// AuditWebhookQueueSize is the number of access decisions waiting to be posted, beyond which they are dropped
+	AuditWebhookQueueSize int `json:"audit-webhook-queue-size" yaml:"audit-webhook-queue-size" usage:"the number of access decisions waiting to be posted to the audit webhook, beyond which they are dropped. Defaults to 10000"`
+	// AuditWebhookRetries is the number of times a batch is posted again after a failure
+	AuditWebhookRetries int `json:"audit-webhook-retries" yaml:"audit-webhook-retries" usage:"the number of times a batch is posted again to the audit webhook after a failure. Defaults to 3"`
 	// EnableForwarding enables the forwarding proxy
 	EnableForwarding bool `json:"enable-forwarding" yaml:"enable-forwarding" usage:"enables the forwarding proxy mode, signing outbound request"`
 	// EnableSecurityFilter enables the security handler
 	EnableSecurityFilter bool `json:"enable-security-filter" yaml:"enable-security-filter" usage:"enables the security filter handler" env:"ENABLE_SECURITY_FILTER"`
+	// EnableRejectSuspiciousPaths rejects requests whose raw path holds encoded dots, slashes, backslashes, percent
+	// signs or null bytes, as used by path traversal attempts
+	EnableRejectSuspiciousPaths bool `json:"enable-reject-suspicious-paths" yaml:"enable-reject-suspicious-paths" usage:"rejects with 400 the requests whose raw path holds encoded dots, slashes, backslashes, percent signs or null bytes"`
+	// SuspiciousPathsAllowlist are the encoded characters accepted in the path despite EnableRejectSuspiciousPaths
+	SuspiciousPathsAllowlist []string `json:"suspicious-paths-allowlist" yaml:"suspicious-paths-allowlist" usage:"encoded characters legitimately found in the paths, accepted despite enable-reject-suspicious-paths, e.g. %2F"`
+	// DuplicateHeaderPolicy decides which of the Authorization or Cookie headers sent several times by a client is kept
+	DuplicateHeaderPolicy string `json:"duplicate-header-policy" yaml:"duplicate-header-policy" usage:"handling of the requests with several Authorization or Cookie headers: first or last (the other ones are dropped), or reject (400 Bad Request). Left as is by default"`
 	// EnableRefreshTokens indicate's you wish to ignore using refresh tokens and re-auth on expiration of access token
 	EnableRefreshTokens bool `json:"enable-refresh-tokens" yaml:"enable-refresh-tokens" usage:"enables the handling of the refresh tokens" env:"ENABLE_REFRESH_TOKEN"`
+	// RefreshCooldown is the time during which a browser whose refresh token was rejected is not sent back to the provider
+	RefreshCooldown time.Duration `json:"refresh-cooldown" yaml:"refresh-cooldown" usage:"when the provider rejects a refresh token as an invalid grant, the duration during which the same browser gets a 401 instead of a new redirect to the provider, zero to disable"`
+	// RedirectLoopLimit is the number of redirections of a browser to the authorization within RedirectLoopWindow, beyond
+	// which the authentication is deemed looping: the browser gets an error page instead of another redirection
+	RedirectLoopLimit int `json:"redirect-loop-limit" yaml:"redirect-loop-limit" usage:"number of redirections of a browser to the authorization within the redirect-loop-window, beyond which an error page is served instead of redirecting again, zero to disable"`
+	// RedirectLoopWindow is the period over which the redirections to the authorization are counted. Defaults to 30s
+	RedirectLoopWindow time.Duration `json:"redirect-loop-window" yaml:"redirect-loop-window" usage:"the period over which the redirections of a browser to the authorization are counted. Defaults to 30s"`
+	// FailedAuthDelay holds the 401 and 403 responses for this long, with a jitter of half of it either way, to slow
+	// down brute force attempts
+	FailedAuthDelay time.Duration `json:"failed-auth-delay" yaml:"failed-auth-delay" usage:"delays the responses to failed authentications and admissions (401, 403), with a jitter of half the delay either way, to slow down brute force attempts. Disabled by default"`
+	// UnavailableRetryAfter is the delay told to the clients turned down with a 503, plus a jitter of up to half of it
+	UnavailableRetryAfter time.Duration `json:"unavailable-retry-after" yaml:"unavailable-retry-after" usage:"the delay after which the clients turned down with a 503 are told to retry, plus a jitter of up to half the delay. Defaults to 30s, zero to not tell"`
+	// EnableIDTokenNonce binds the authorization request to the returned ID token with a nonce
+	EnableIDTokenNonce bool `json:"enable-id-token-nonce" yaml:"enable-id-token-nonce" usage:"sends a nonce with the authorization request and rejects ID tokens which do not carry it back"`
+	// EnablePKCE adds a proof key to the authorization code flow (RFC 7636), the code verifier is kept in an
+	// encrypted cookie until the code is exchanged
+	EnablePKCE bool `json:"enable-pkce" yaml:"enable-pkce" usage:"sends a code challenge with the authorization request and its verifier with the code exchange (PKCE)"`
+	// PKCEChallengeMethod is the method deriving the code challenge from the verifier
+	PKCEChallengeMethod string `json:"pkce-challenge-method" yaml:"pkce-challenge-method" usage:"method used to derive the pkce code challenge, S256 or plain"`
 	// EnableSessionCookies indicates the cookies, both token and refresh should not be persisted
 	EnableSessionCookies bool `json:"enable-session-cookies" yaml:"enable-session-cookies" usage:"access and refresh tokens are session only i.e. removed browser close" env:"ENABLE_SESSION_COOKIES"`
 	// EnableCSRF will generate a new session object (e.g.a cookie, or in a supported backend storage) to store a CSRF token.
@@ -112,16 +219,42 @@ type Config struct {
 	// CSRFCookieName sets the name of the CSRF (encrypted) cookie, when session storage is a cookie (defaults to kc-csrf).
 	// Note that in this case EncryptionKey is required to encrypt the cookie.
 	CSRFCookieName string `json:"csrf-cookie-name" yaml:"csrf-cookie-name" usage:"the name of CSRF cookie. Defaults to: kc-csrf" env:"CSRF_COOKIE_NAME"`
+	// CSRFTokenCookie sets the name of a cookie readable by scripts, holding the CSRF token on safe requests. This way, a SPA may
+	// fetch the token from the first page load, before issuing any unsafe request.
+	CSRFTokenCookie string `json:"csrf-token-cookie" yaml:"csrf-token-cookie" usage:"the name of a cookie readable by scripts, seeded with the CSRF token on authenticated GET requests, e.g. for SPAs. Disabled by default" env:"CSRF_TOKEN_COOKIE"`
+	// CSRFScopeClaim scopes the CSRF state to the value of a claim of the user, e.g. the session id, so the CSRF tokens
+	// issued to a session are not accepted with another one
+	CSRFScopeClaim string `json:"csrf-scope-claim" yaml:"csrf-scope-claim" usage:"the claim of the user, e.g. sid, to which the CSRF state is scoped: the CSRF tokens are then only accepted with the session which obtained them. Disabled by default"`
 	// CSRFHeader sets the header used in requests and response for the CSRF challenge (defaults to X-CSRF-Token)
 	CSRFHeader string `json:"csrf-header" yaml:"csrf-header" usage:"the header added to responses by gatekeeper and to be added by requests to check against replayed credentials (CSRF). Defaults to: X-CSRF-Token" env:"CSRF_HEADER"`
 	// EnableLoginHandler indicates we want the login handler enabled
 	EnableLoginHandler bool `json:"enable-login-handler" yaml:"enable-login-handler" usage:"enables the handling of the refresh tokens" env:"ENABLE_LOGIN_HANDLER"`
+	// EnableTestMode exposes an endpoint establishing sessions for crafted claims, signed by the service itself, so that
+	// the services behind the proxy can be tested without a provider. TESTING ONLY: requires the TestModeSecret.
+	EnableTestMode bool `json:"enable-test-mode" yaml:"enable-test-mode" usage:"TESTING ONLY - exposes the test-token endpoint, establishing sessions for crafted claims. Requires test-mode-secret, never enable in production"`
+	// TestModeSecret is the secret shared with the tests, expected in the X-Test-Mode-Secret header of the test-token endpoint
+	TestModeSecret string `json:"test-mode-secret" yaml:"test-mode-secret" usage:"TESTING ONLY - the secret expected in the X-Test-Mode-Secret header of the test-token endpoint" env:"TEST_MODE_SECRET"`
+	// EnableIntrospection serves the token introspection (RFC 7662) to the callers authenticated with the client credentials
+	EnableIntrospection bool `json:"enable-introspection" yaml:"enable-introspection" usage:"serves the introspection of the tokens (RFC 7662) on /oauth/introspect, to the callers authenticated with the client id and secret"`
 	// EnableTokenHeader adds the JWT token to the upstream authentication headers as X-Auth-Token header
 	EnableTokenHeader bool `json:"enable-token-header" yaml:"enable-token-header" usage:"enables the token authentication header X-Auth-Token to upstream" env:"ENABLE_TOKEN_HEADER"`
 	// EnableClaimsHeaders adds decoded claims as headers X-Auth-{claim} to the upstream endpoint
 	EnableClaimsHeaders bool `json:"enable-claims-headers" yaml:"enable-claims-headers" usage:"adds decoded claims as headers X-Auth-{claim} to the upstream endpoint. Defaults to true" env:"ENABLE_CLAIMS_HEADERS"`
+	// EnableAMRHeader adds the authentication methods (amr claim) of the user as the X-Auth-AMR header to the upstream endpoint
+	EnableAMRHeader bool `json:"enable-amr-header" yaml:"enable-amr-header" usage:"adds the authentication methods of the user (amr claim) as header X-Auth-AMR to the upstream endpoint" env:"ENABLE_AMR_HEADER"`
+	// IdentityHeadersCase sets the exact casing of identity headers, for upstreams which do not ignore it
+	IdentityHeadersCase map[string]string `json:"identity-headers-case" yaml:"identity-headers-case" usage:"exact casing of the identity headers sent to the upstream, keyed by header e.g. X-Auth-Email=x-auth-email"`
+	// IdentityHeadersEncoding encodes the values of the identity headers holding non-ASCII or control characters,
+	// e.g. accented names, which are not valid in a header
+	IdentityHeadersEncoding string `json:"identity-headers-encoding" yaml:"identity-headers-encoding" usage:"encoding of the identity header values holding non-ASCII or control characters: rfc8187 (UTF-8''%C3%A9), percent (%C3%A9) or base64 (=?UTF-8?b?w6k=?=). The other values are sent as is, as are all values by default"`
+	// ClientResponseClaimHeaders returns claims of the user to the client as response headers, keyed by claim
+	ClientResponseClaimHeaders map[string]string `json:"client-response-claim-headers" yaml:"client-response-claim-headers" usage:"claims of the user returned to the client in response headers, keyed by claim e.g. tenant=X-User-Tenant. Session and token binding claims are refused"`
+	// EnableAMRRoles makes the authentication methods of the user available to the admission checks as roles, e.g. amr:hwk
+	EnableAMRRoles bool `json:"enable-amr-roles" yaml:"enable-amr-roles" usage:"treats the authentication methods of the user (amr claim) as roles prefixed with amr:, e.g. roles=amr:hwk" env:"ENABLE_AMR_ROLES"`
 	// EnableAuthorizationHeader indicates we should pass the authorization header to the upstream endpoint
 	EnableAuthorizationHeader bool `json:"enable-authorization-header" yaml:"enable-authorization-header" usage:"adds the authorization header to the proxy request" env:"ENABLE_AUTHORIZATION_HEADER"`
+	// MaxAuthorizationHeaderSize is the largest authorization header the upstream accepts: larger tokens are split
+	MaxAuthorizationHeaderSize int `json:"max-authorization-header-size" yaml:"max-authorization-header-size" usage:"tokens making a larger authorization header are forwarded in chunks of this size as X-Auth-Token-Part-N headers instead, for the upstream to join. Zero to disable"`
 	// EnableAuthorizationCookies indicates we should pass the authorization cookies to the upstream endpoint. Defaults to false.
 	EnableAuthorizationCookies bool `json:"enable-authorization-cookies" yaml:"enable-authorization-cookies" usage:"adds the authorization cookies to the uptream proxy request. Defaults to false" env:"ENABLE_AUTHORIZATION_COOKIES"`
 	// EnableHTTPSRedirect indicate we should redirect http -> https
@@ -136,6 +269,8 @@ type Config struct {
 	EnableTracing bool `json:"enable-tracing" yaml:"enable-tracing" usage:"enable the opencensus trace collector on /oauth/zpages" env:"ENABLE_TRACING"`
 	// TracingAgentEndpoint register the jaeger agent collecting trace spans
 	TracingAgentEndpoint string `json:"tracing-agent-endpoint" yaml:"tracing-agent-endpoint" usage:"register the opencensus trace collector agent" env:"TRACING_AGENT_ENDPOINT"`
+	// TracingPropagation are the formats of the trace context accepted from the clients and propagated to the upstream
+	TracingPropagation []string `json:"tracing-propagation" yaml:"tracing-propagation" usage:"the formats of the trace context accepted from the clients and propagated to the upstream (tracecontext|b3). Default is both"`
 	// EnableBrowserXSSFilter indicates you want the filter on
 	EnableBrowserXSSFilter bool `json:"filter-browser-xss" yaml:"filter-browser-xss" usage:"enable the adds the X-XSS-Protection header with mode=block"`
 	// EnableContentNoSniff indicates you want the filter on
@@ -144,15 +279,36 @@ type Config struct {
 	EnableFrameDeny bool `json:"filter-frame-deny" yaml:"filter-frame-deny" usage:"enable to the frame deny header"`
 	// ContentSecurityPolicy allows the Content-Security-Policy header value to be set with a custom value
 	ContentSecurityPolicy string `json:"content-security-policy" yaml:"content-security-policy" usage:"specify the content security policy"`
+	// EnableCSPNonce generates a nonce per request, substituted to the {nonce} placeholder of the ContentSecurityPolicy
+	// and passed to the upstream in the X-CSP-Nonce header
+	EnableCSPNonce bool `json:"enable-csp-nonce" yaml:"enable-csp-nonce" usage:"generates a random nonce per request, substituted to {nonce} in the content security policy and passed to the upstream in the X-CSP-Nonce header"`
 	// EnableSTS adds the X-Transport-Strict-Transport-Security with some sensible default seconds and subdomains allowed (no STS preload)
 	EnableSTS bool `json:"filter-sts" yaml:"filter-sts" usage:"adds the X-Transport-Strict-Transport-Security header, without the preload option"`
 	// EnableSTSPreload adds the X-Transport-Strict-Transport-Security with some sensible default seconds and subdomains allowed (with STS preload)
 	EnableSTSPreload bool `json:"filter-sts-preload" yaml:"filter-sts-preload" usage:"adds the X-Transport-Strict-Transport-Security header (with STS preload)"`
 	// LocalhostMetrics indicates that metrics can only be consumed from localhost
 	LocalhostMetrics bool `json:"localhost-metrics" yaml:"localhost-metrics" usage:"enforces the metrics page can only been requested from 127.0.0.1"`
+	// MetricsClaim is a low cardinality claim (e.g. tenant) partitioning the count of the admitted requests
+	MetricsClaim string `json:"metrics-claim" yaml:"metrics-claim" usage:"count the admitted requests by the value of this claim, e.g. a tenant or plan" env:"METRICS_CLAIM"`
+	// MetricsClaimMaxValues caps the distinct values of the metrics claim, the others are counted together
+	MetricsClaimMaxValues int `json:"metrics-claim-max-values" yaml:"metrics-claim-max-values" usage:"the maximum number of distinct values of the metrics claim, any other value is counted as other"`
 
 	// AccessTokenDuration is default duration applied to the access token cookie
 	AccessTokenDuration time.Duration `json:"access-token-duration" yaml:"access-token-duration" usage:"fallback cookie duration for the access token when using refresh tokens"`
+	// AccessCookieDuration fixes the duration of the access token cookie, instead of deriving it from the tokens
+	AccessCookieDuration time.Duration `json:"access-cookie-duration" yaml:"access-cookie-duration" usage:"duration of the access token cookie, regardless of the lifetime of the tokens"`
+	// RefreshCookieDuration fixes the duration of the refresh token cookie, independently of the refresh token expiry
+	RefreshCookieDuration time.Duration `json:"refresh-cookie-duration" yaml:"refresh-cookie-duration" usage:"duration of the refresh token cookie, regardless of the expiry of the refresh token (e.g. 720h)"`
+	// SessionIPBinding binds a browser session to the address of the client at login: exact, or subnet for the clients
+	// moving within their network, e.g. mobile users. The session of a client coming from elsewhere must be renewed
+	SessionIPBinding string `json:"session-ip-binding" yaml:"session-ip-binding" usage:"binds the sessions to the client address at login, the clients coming from another address must authenticate again: exact, or subnet to only bind to the /24 (/64 in IPv6) network. Requires the encryption-key"`
+	// EnableSessionUserAgentBinding binds a browser session to the User-Agent of the client at login. Browser updates
+	// change it too, the users then have to authenticate again
+	EnableSessionUserAgentBinding bool `json:"enable-session-user-agent-binding" yaml:"enable-session-user-agent-binding" usage:"binds the sessions to the User-Agent of the client at login, the clients presenting another one must authenticate again, e.g. after a browser update. Requires the encryption-key"`
+	// EnableCookieMAC appends a MAC to the values of the access and refresh token cookies, to detect tampering
+	EnableCookieMAC bool `json:"enable-cookie-mac" yaml:"enable-cookie-mac" usage:"sign the access and refresh token cookies with a HMAC keyed by the encryption key, the cookies which were tampered with are rejected and cleared"`
+	// EnableSessionAccessCookie keeps the access token in a session cookie, while the refresh token cookie persists
+	EnableSessionAccessCookie bool `json:"enable-session-access-cookie" yaml:"enable-session-access-cookie" usage:"the access token cookie is session only, the refresh token cookie keeps its duration"`
 	// CookieDomain is a list of domains the cookie is available to
 	CookieDomain string `json:"cookie-domain" yaml:"cookie-domain" usage:"domain the access cookie is available to, defaults host header" env:"COOKIE_DOMAIN"`
 	// CookieAccessName is the name of the access cookie holding the access token
@@ -161,14 +317,39 @@ type Config struct {
 	CookieRefreshName string `json:"cookie-refresh-name" yaml:"cookie-refresh-name" usage:"name of the cookie used to hold the encrypted refresh token"`
 	// SameSiteCookie enforces cookies to be send only to same site requests. Defaults to Lax.
 	SameSiteCookie string `json:"same-site-cookie" yaml:"same-site-cookie" usage:"enforces cookies to be send only to same site requests according to the policy (can be Strict|Lax|None). Defaults to Lax" env:"SAME_SITE_COOKIE"`
+	// SameSiteRedirectCookie overrides the SameSite policy of the cookies read back on the return from the provider,
+	// i.e. the state and nonce cookies, as Strict cookies are not sent on this cross-site navigation
+	SameSiteRedirectCookie string `json:"same-site-redirect-cookie" yaml:"same-site-redirect-cookie" usage:"SameSite policy of the state and nonce cookies of the authorization request (can be Lax|None), so they survive the return from the provider when session cookies are Strict. Defaults to the same-site-cookie policy" env:"SAME_SITE_REDIRECT_COOKIE"`
+	// SameSiteAccessCookie overrides the SameSite policy of the access token cookie
+	SameSiteAccessCookie string `json:"same-site-access-cookie" yaml:"same-site-access-cookie" usage:"SameSite policy of the access token cookie (can be Strict|Lax|None). Defaults to the same-site-cookie policy" env:"SAME_SITE_ACCESS_COOKIE"`
+	// SameSiteRefreshCookie overrides the SameSite policy of the refresh token cookie
+	SameSiteRefreshCookie string `json:"same-site-refresh-cookie" yaml:"same-site-refresh-cookie" usage:"SameSite policy of the refresh token cookie (can be Strict|Lax|None). Defaults to the same-site-cookie policy" env:"SAME_SITE_REFRESH_COOKIE"`
 	// SecureCookie enforces the cookie as secure. Defaults to true.
 	SecureCookie bool `json:"secure-cookie" yaml:"secure-cookie" usage:"enforces the cookie to be secure. Defaults to true." env:"SECURE_COOKIE"`
+	// EnableAdaptiveSecureCookie drops the Secure attribute of the cookies set on plain http requests. This is meant
+	// for development setups reached over both http and https.
+	EnableAdaptiveSecureCookie bool `json:"enable-adaptive-secure-cookie" yaml:"enable-adaptive-secure-cookie" usage:"DEVELOPMENT ONLY: drops the secure attribute of the cookies set on plain http requests, when the proxy is reached over both http and https"`
+	// EnableForwardedSecureCookie derives the Secure attribute of the cookies from the scheme of the request, as forwarded
+	// in X-Forwarded-Proto by the trusted proxies, e.g. a load balancer terminating tls. It overrides SecureCookie.
+	EnableForwardedSecureCookie bool `json:"enable-forwarded-secure-cookie" yaml:"enable-forwarded-secure-cookie" usage:"sets the secure attribute of the cookies on the requests received over tls or forwarded with X-Forwarded-Proto: https by a trusted proxy, instead of the secure-cookie setting"`
 	// HTTPOnlyCookie enforces the cookie as http only. Defaults to true.
 	HTTPOnlyCookie bool `json:"http-only-cookie" yaml:"http-only-cookie" usage:"enforces the cookie is in http only mode. Defaults to true" env:"HTTP_ONLY_COOKIE"`
+	// EnablePartitionedCookies sets the Partitioned attribute on the cookies (CHIPS), for cross-site embedded scenarios.
+	// It requires secure cookies with SameSite=None.
+	EnablePartitionedCookies bool `json:"enable-partitioned-cookies" yaml:"enable-partitioned-cookies" usage:"sets the Partitioned attribute (CHIPS) on the cookies, requires secure cookies with same-site-cookie None" env:"ENABLE_PARTITIONED_COOKIES"`
 	// MatchClaims is a series of checks, the claims in the token must match those here
 	MatchClaims map[string]string `json:"match-claims" yaml:"match-claims" usage:"keypair values for matching access token claims e.g. aud=myapp, iss=http://example.*"`
+	// RequiredClaims are the claims the token must carry with a non-empty value
+	RequiredClaims []string `json:"required-claims" yaml:"required-claims" usage:"claims the access token must carry with a non-empty value, e.g. tenant_id"`
+	// StrictClaimTypes denies the tokens whose roles, groups or authentication methods claims are not of the expected
+	// types, instead of coercing or ignoring them
+	StrictClaimTypes bool `json:"strict-claim-types" yaml:"strict-claim-types" usage:"denies access when the roles, groups or amr claims of the token are not of the expected types (objects, arrays of strings), e.g. with a misconfigured mapper"`
 	// AddClaims is a series of claims that should be added to the auth headers
 	AddClaims []string `json:"add-claims" yaml:"add-claims" usage:"extra claims from the token and inject into headers, e.g given_name -> X-Auth-Given-Name"`
+	// AddClaimsArrayFormat is the serialization of the claims of AddClaims holding arrays
+	AddClaimsArrayFormat string `json:"add-claims-array-format" yaml:"add-claims-array-format" usage:"serialization of the extra claims holding arrays: join (comma-separated, as X-Auth-Groups) or repeat (one header per value). Defaults to join"`
+	// ClaimHeaderMap maps claims to the exact headers passed to the upstream, besides the X-Auth ones
+	ClaimHeaderMap map[string]string `json:"claim-header-map" yaml:"claim-header-map" usage:"keypair values of claims and the headers passed to the upstream with their values, e.g. preferred_username=X-Remote-User"`
 
 	// TLSCertificate is the location for a tls certificate
 	TLSCertificate string `json:"tls-cert" yaml:"tls-cert" usage:"path to ths TLS certificate" env:"TLS_CERTIFICATE"`
@@ -182,6 +363,12 @@ type Config struct {
 	TLSClientCertificate string `json:"tls-client-certificate" yaml:"tls-client-certificate" usage:"path to the client certificate for outbound connections in reverse and forwarding proxy modes" env:"TLS_CLIENT_CERTIFICATE"`
 	// TLSClientCertificates is an array of paths to client certificates to use for outbound connections
 	TLSClientCertificates []string `json:"tls-client-certificates" yaml:"tls-client-certificates" usage:"paths to client certificates for outbound connections in reverse and forwarding proxy modes" env:"TLS_CLIENT_CERTIFICATES"`
+	// TLSClientCAFile is the path to the certificate authorities verifying the client certificates presented to the listener
+	TLSClientCAFile string `json:"tls-client-ca-file" yaml:"tls-client-ca-file" usage:"path to the ca certificates verifying the client certificates presented to the listener" env:"TLS_CLIENT_CA_FILE"`
+	// TLSClientAuth is the policy of the listener for the client certificates
+	TLSClientAuth string `json:"tls-client-auth" yaml:"tls-client-auth" usage:"policy for the client certificates: request (optional, verified if given and a ca file is set), require (any certificate) or verify (issued by the ca file). Defaults to verify with a tls-client-ca-file" env:"TLS_CLIENT_AUTH"`
+	// ClientCertClaims maps the claims of the clients authenticated by certificate to the fields of the certificate
+	ClientCertClaims map[string]string `json:"client-cert-claims" yaml:"client-cert-claims" usage:"keypair values of the claims of the clients of cert-auth resources and the certificate fields (cn, o, ou, dns, uri, email, serial) they are taken from, e.g. groups=ou. The roles and groups claims give the roles and groups of the client"`
 	// TLSUseModernSettings sets all TLS options for proxy listener to modern settings (TLS 1.2, advanced cipher suites, ...)
 	TLSUseModernSettings bool `json:"tls-use-modern-settings" yaml:"tls-use-modern-settings" usage:"sets all TLS options for proxy listener to modern settings (TLS 1.2, advanced cipher suites, ...)" env:"TLS_USE_MODERN_SETTINGS"`
 	// TLSMinVersion is the minimum TLS protocol version accepted by proxy listener. TLS 1.0 is the default.
@@ -225,7 +412,53 @@ type Config struct {
 	Hostnames []string `json:"hostnames" yaml:"hostnames" usage:"list of hostnames the service will respond to"`
 
 	// Store is a url for a store resource, used to hold the refresh tokens
-	StoreURL string `json:"store-url" yaml:"store-url" usage:"url for the storage subsystem, e.g redis://127.0.0.1:6379, file:///etc/tokens.file"`
+	StoreURL string `json:"store-url" yaml:"store-url" usage:"url for the storage subsystem, e.g redis://127.0.0.1:6379, file:///etc/tokens.file, memcached://host1:11211,host2:11211?expiration=24h"`
+	// EncryptStoreTokens encrypts the tokens held in the store with the encryption key, so the store alone does not
+	// give them away
+	EncryptStoreTokens bool `json:"encrypt-store-tokens" yaml:"encrypt-store-tokens" usage:"encrypt the tokens held in the store with the encryption-key (AES-GCM). The tokens stored beforehand can no longer be read" env:"ENCRYPT_STORE_TOKENS"`
+	// StoreKeyPrefix is prepended to all keys in the store, so several proxies may share the same store
+	StoreKeyPrefix string `json:"store-key-prefix" yaml:"store-key-prefix" usage:"prefix added to the keys in the store, e.g. to share the store between several instances"`
+	// WarmupTimeout bounds the warm-up run on startup, loading the keys of the provider and connecting to the upstreams.
+	// The readiness endpoint reports the service is not ready in the meantime
+	WarmupTimeout time.Duration `json:"warmup-timeout" yaml:"warmup-timeout" usage:"on startup, load the keys of the provider and connect to the upstreams before reporting ready, for at most this duration. Zero to disable"`
+	// StoreHealthInterval is the interval at which the store is probed, reporting on the readiness endpoint
+	StoreHealthInterval time.Duration `json:"store-health-interval" yaml:"store-health-interval" usage:"interval at which a probe key is written to, read from and removed from the store, reflected by the readiness endpoint and metrics. Zero to disable"`
+	// RefreshTokenSource is the source of the refresh token looked up first when a store is used, the other
+	// one being used as a fallback
+	RefreshTokenSource string `json:"refresh-token-source" yaml:"refresh-token-source" usage:"source of the refresh token looked up first when a store is used, falling back to the other one: store or cookie"`
+	// EnableRefreshTokenMigration moves the refresh tokens still held by cookies into the store on refresh
+	EnableRefreshTokenMigration bool `json:"enable-refresh-token-migration" yaml:"enable-refresh-token-migration" usage:"moves refresh tokens found in cookies to the store when refreshing, then removes the cookie. Requires a store"`
+	// EnableSessionRotation issues fresh session cookies and store keys when the roles or groups of a refreshed token
+	// differ from the previous ones, so that a cookie captured before a privilege change is no longer honoured
+	EnableSessionRotation bool `json:"enable-session-rotation" yaml:"enable-session-rotation" usage:"issue fresh session cookies and invalidate the previous store keys when the roles or groups of the user change on refresh. Requires refresh tokens"`
+	// MaxSessionsPerUser caps the number of concurrent sessions of a user, tracked in the store. By default, the oldest
+	// sessions are evicted when a new one exceeds the cap.
+	MaxSessionsPerUser int `json:"max-sessions-per-user" yaml:"max-sessions-per-user" usage:"maximum number of concurrent sessions per user, tracked in the store. Unlimited by default. The logins of a user made at the same time through several replicas may exceed the limit"`
+	// EnableSessionIDIndex indexes the sessions in the store by the session id (sid claim) of the ID token, so a
+	// back-channel logout can revoke a session knowing only its id
+	EnableSessionIDIndex bool `json:"enable-session-id-index" yaml:"enable-session-id-index" usage:"indexes the sessions in the store by the session id (sid claim) of the ID token, for back-channel logouts. Requires a store and refresh tokens"`
+	// RejectExceedingSessions refuses new logins exceeding MaxSessionsPerUser, rather than evicting the oldest sessions
+	RejectExceedingSessions bool `json:"reject-exceeding-sessions" yaml:"reject-exceeding-sessions" usage:"refuses logins exceeding the maximum number of sessions per user instead of evicting the oldest session"`
+	// RefreshRateLimit caps the number of refreshes of a session (sid claim) within RefreshRateWindow, counted in the
+	// store. A session refreshed more often is likely used with a stolen refresh token: it is invalidated.
+	RefreshRateLimit int `json:"refresh-rate-limit" yaml:"refresh-rate-limit" usage:"maximum number of token refreshes of a session within the refresh-rate-window, beyond which the session is invalidated and the user must log in again. Requires a store, unlimited by default. The limit is approximate: the concurrent refreshes, e.g. through several replicas, may be counted once"`
+	// RefreshRateWindow is the period over which the refreshes of a session are counted. Defaults to 1h
+	RefreshRateWindow time.Duration `json:"refresh-rate-window" yaml:"refresh-rate-window" usage:"the period over which the refreshes of a session are counted against the refresh-rate-limit. Defaults to 1h"`
+	// EnableStoredAccessToken keeps the access token in the store rather than in a browser cookie: only the refresh token
+	// is handed to the browser, and used as the session key
+	EnableStoredAccessToken bool `json:"enable-stored-access-token" yaml:"enable-stored-access-token" usage:"keeps the access token in the store instead of a cookie, the refresh token cookie holds the session. Requires a store and refresh tokens"`
+	// EnableOpaqueSessionCookie hands a random session id to the browser in the access cookie, the token being kept in
+	// the store under this id: the cookie is stable across refreshes and carries nothing sensitive
+	EnableOpaqueSessionCookie bool `json:"enable-opaque-session-cookie" yaml:"enable-opaque-session-cookie" usage:"the access cookie holds an opaque session id, mapped in the store to the access token. Requires a store"`
+	// SessionIDFormat is the format of the opaque session ids, uuid or base64 (url encoding of 32 random bytes)
+	SessionIDFormat string `json:"session-id-format" yaml:"session-id-format" usage:"format of the opaque session ids held in the access cookie, uuid|base64. Defaults to uuid"`
+	// EnableBackgroundRefresh renews the access tokens of the opaque sessions ahead of their expiry, so the requests
+	// do not wait for the provider
+	EnableBackgroundRefresh bool `json:"enable-background-refresh" yaml:"enable-background-refresh" usage:"renews the access tokens of the sessions in the background, within the refresh-grace-period before they expire. Requires opaque session cookies and refresh tokens"`
+	// RefreshGracePeriod is how long before the expiry of the access token a session is renewed in the background
+	RefreshGracePeriod time.Duration `json:"refresh-grace-period" yaml:"refresh-grace-period" usage:"how long before their expiry the access tokens are renewed in the background. Defaults to 1m"`
+	// BackgroundRefreshWorkers is the number of sessions renewed concurrently in the background
+	BackgroundRefreshWorkers int `json:"background-refresh-workers" yaml:"background-refresh-workers" usage:"the number of sessions renewed concurrently in the background. Defaults to 4"`
 
 	// EncryptionKey is the encryption key used to encrypt the refresh token
 	EncryptionKey string `json:"encryption-key" yaml:"encryption-key" usage:"encryption key used to encryption the session state" env:"ENCRYPTION_KEY"`
@@ -234,6 +467,10 @@ type Config struct {
 	InvalidAuthRedirectsWith303 bool `json:"invalid-auth-redirects-with-303" yaml:"invalid-auth-redirects-with-303" usage:"use HTTP 303 redirects instead of 307 for invalid auth tokens"`
 	// NoRedirects informs we should hand back a 401 not a redirect
 	NoRedirects bool `json:"no-redirects" yaml:"no-redirects" usage:"do not have back redirects when no authentication is present, 401 them"`
+	// EnableLoginChallenge informs we should hand back a 401 with the login url to API requests, not a redirect
+	EnableLoginChallenge bool `json:"enable-login-challenge" yaml:"enable-login-challenge" usage:"respond to API requests without a session with a 401 and a json body holding the login url, instead of a redirect"`
+	// WWWAuthenticate is the WWW-Authenticate header of the login challenges, with the login url and authorization endpoint substituted
+	WWWAuthenticate string `json:"www-authenticate" yaml:"www-authenticate" usage:"WWW-Authenticate header of the login challenges, where {login_url} and {authorization_endpoint} are substituted, e.g. Bearer realm=\"app\", authorization_uri=\"{login_url}\""`
 
 	// SkipTokenVerification tells the service to skip verifying the access token - for testing purposes
 	SkipTokenVerification bool `json:"skip-token-verification" yaml:"skip-token-verification" usage:"TESTING ONLY; bypass token verification, only expiration and roles enforced"`
@@ -250,9 +487,31 @@ type Config struct {
 	UpstreamResponseHeaderTimeout time.Duration `json:"upstream-response-header-timeout" yaml:"upstream-response-header-timeout" usage:"the timeout placed on the response header for upstream"`
 	// UpstreamExpectContinueTimeout is the timeout expect continue for upstream
 	UpstreamExpectContinueTimeout time.Duration `json:"upstream-expect-continue-timeout" yaml:"upstream-expect-continue-timeout" usage:"the timeout placed on the expect continue for upstream"`
+	// MaxResponseHeaderBytes limits the size of the response headers of the upstream
+	MaxResponseHeaderBytes int `json:"max-response-header-bytes" yaml:"max-response-header-bytes" usage:"limit on the size of the response headers of the upstream. Defaults to 256KiB"`
+	// UpstreamResponseHeaderPolicy is applied to the upstream responses with headers exceeding MaxResponseHeaderBytes
+	UpstreamResponseHeaderPolicy string `json:"upstream-response-header-policy" yaml:"upstream-response-header-policy" usage:"handling of the upstream responses with oversized headers: error (502 Bad Gateway) or truncate (the headers beyond the limit are dropped). Defaults to error"`
+	// UpstreamTimingHeader is a response header reporting the round-trip time of the request to the upstream
+	UpstreamTimingHeader string `json:"upstream-timing-header" yaml:"upstream-timing-header" usage:"response header reporting the time spent by the upstream, until its response headers: Server-Timing (as upstream;dur=<ms>) or any other header name, e.g. X-Upstream-Duration (in milliseconds)"`
+	// UpstreamRetries is the number of times the GET, HEAD and OPTIONS requests are sent again to the upstream
+	// after a connection error. Disabled by default
+	UpstreamRetries int `json:"upstream-retries" yaml:"upstream-retries" usage:"number of retries of the GET, HEAD and OPTIONS requests failing to connect to the upstream. Disabled by default"`
+	// UpstreamRetryBackoff is the pause before the first retry, doubled on each of the next ones
+	UpstreamRetryBackoff time.Duration `json:"upstream-retry-backoff" yaml:"upstream-retry-backoff" usage:"the pause before the first retry of a request to the upstream, doubled on each of the next ones. Defaults to 100ms"`
+	// RetryOnStatus are the upstream response statuses which are retried as well as the connection errors
+	RetryOnStatus []int `json:"upstream-retry-on-status" yaml:"upstream-retry-on-status" usage:"the upstream response statuses retried as well as the connection errors, e.g. 502, 503"`
+	// EnableResponseDecompression decodes the gzip responses of the upstream for the clients not accepting gzip
+	EnableResponseDecompression bool `json:"enable-response-decompression" yaml:"enable-response-decompression" usage:"decompress the gzip encoded responses of the upstream when the client does not accept gzip. Upgraded connections and event streams are not decompressed"`
 
+	// LogEffectiveConfig logs the configuration on startup, with the defaults applied and the secrets redacted
+	LogEffectiveConfig bool `json:"log-effective-config" yaml:"log-effective-config" usage:"logs the effective configuration on startup, i.e. with the defaults applied, the client secret, encryption key and passwords being redacted"`
+	// EnableLifecycleLogs logs the steps of the startup and shutdown of the service as distinct events, with the
+	// "lifecycle" and "success" fields, so that the failed startups and unclean shutdowns can be alerted upon
+	EnableLifecycleLogs bool `json:"enable-lifecycle-logs" yaml:"enable-lifecycle-logs" usage:"logs the startup and shutdown steps as structured lifecycle events: config loaded, discovery fetched, store connected, listeners started, requests drained and store closed" env:"ENABLE_LIFECYCLE_LOGS"`
 	// Verbose switches on debug logging
 	Verbose bool `json:"verbose" yaml:"verbose" usage:"switch on debug / verbose logging"`
+	// CheckOnly runs the self-checks of the connectivity and certificates, then exits without starting the service
+	CheckOnly bool `json:"check" yaml:"check" usage:"check the provider, the store and the certificates, print a report and exit with 0 on success, 1 on failure"`
 	// EnableProxyProtocol controls the proxy protocol
 	EnableProxyProtocol bool `json:"enabled-proxy-protocol" yaml:"enabled-proxy-protocol" usage:"enable proxy protocol"`
 
@@ -260,6 +519,11 @@ type Config struct {
 	MaxIdleConns int `json:"max-idle-connections" yaml:"max-idle-connections" usage:"max idle upstream / keycloak connections to keep alive, ready for reuse"`
 	// MaxIdleConnsPerHost limits the number of idle connections maintained per host
 	MaxIdleConnsPerHost int `json:"max-idle-connections-per-host" yaml:"max-idle-connections-per-host" usage:"limits the number of idle connections maintained per host"`
+	// EnableUpstreamPoolIsolation gives each upstream host a transport of its own, so that a saturated upstream does not
+	// exhaust the connections of the others
+	EnableUpstreamPoolIsolation bool `json:"enable-upstream-pool-isolation" yaml:"enable-upstream-pool-isolation" usage:"gives each upstream host its own pool of connections, with its own limits, so that a slow upstream does not starve the others"`
+	// UpstreamMaxConnsPerPool limits the connections of each isolated upstream pool, active or idle
+	UpstreamMaxConnsPerPool int `json:"upstream-max-connections-per-pool" yaml:"upstream-max-connections-per-pool" usage:"maximum number of connections, active or idle, of the pool of each upstream host. Requires enable-upstream-pool-isolation, unlimited by default"`
 
 	// ServerReadTimeout is the read timeout on the http server
 	ServerReadTimeout time.Duration `json:"server-read-timeout" yaml:"server-read-timeout" usage:"the server read timeout on the http server"`
@@ -267,6 +531,8 @@ type Config struct {
 	ServerWriteTimeout time.Duration `json:"server-write-timeout" yaml:"server-write-timeout" usage:"the server write timeout on the http server"`
 	// ServerIdleTimeout is the idle timeout on the http server
 	ServerIdleTimeout time.Duration `json:"server-idle-timeout" yaml:"server-idle-timeout" usage:"the server idle timeout on the http server" env:"SERVER_IDLE_TIMEOUT"`
+	// ShutdownGracePeriod is how long the requests in flight are waited for on shutdown
+	ShutdownGracePeriod time.Duration `json:"shutdown-grace-period" yaml:"shutdown-grace-period" usage:"how long the requests in flight are waited for when terminating, the new connections being refused. Defaults to 20s" env:"SHUTDOWN_GRACE_PERIOD"`
 
 	// UseLetsEncrypt controls if we should use letsencrypt to retrieve certificates
 	UseLetsEncrypt bool `json:"use-letsencrypt" yaml:"use-letsencrypt" usage:"use letsencrypt for certificates"`
@@ -276,8 +542,16 @@ type Config struct {
 
 	// SignInPage is the relative url for the sign in page
 	SignInPage string `json:"sign-in-page" yaml:"sign-in-page" usage:"path to custom template displayed for signin"`
-	// ForbiddenPage is a access forbidden page
-	ForbiddenPage string `json:"forbidden-page" yaml:"forbidden-page" usage:"path to custom template used for access forbidden"`
+	// ForbiddenPage is a access forbidden page, rendered with the method, url and matched resource of the request along
+	// with the email and username of the user. The API clients are answered with JSON instead.
+	ForbiddenPage string `json:"forbidden-page" yaml:"forbidden-page" usage:"path to custom template used for access forbidden, served to the browsers only"`
+	// DenialDetailsClients are the first-party clients (azp claim of the token) told why the admission denied them access,
+	// in the JSON body of the 403. The others only get a generic 403, not to leak the policy.
+	DenialDetailsClients []string `json:"denial-details-clients" yaml:"denial-details-clients" usage:"the trusted clients (azp claim of the token) whose forbidden responses detail the missing roles, groups or claims in a JSON body, e.g. a first-party UI. None by default"`
+	// LogoutPage is a page confirming the user has been signed out, rendered instead of the redirection after the logout
+	LogoutPage string `json:"logout-page" yaml:"logout-page" usage:"path to custom template displayed once the user is signed out, with a link to sign in again or to the redirect url, instead of redirecting straight away"`
+	// RedirectLoopPage is a page explaining the authentication is looping
+	RedirectLoopPage string `json:"redirect-loop-page" yaml:"redirect-loop-page" usage:"path to custom template displayed when the redirections to the authorization are looping"`
 	// Tags is passed to the templates
 	Tags map[string]string `json:"tags" yaml:"tags" usage:"keypairs passed to the templates at render,e.g title=Page"`
 
@@ -298,6 +572,30 @@ type RequestScope struct {
 	AccessDenied bool
 	// Identity is the user Identity of the request
 	Identity *userContext
+	// AllowAnonymous indicates the resource is served without an identity to the requests lacking a session
+	AllowAnonymous bool
+	// MatchedResource is the resource the request was routed to, nil for the default route
+	MatchedResource *Resource
+	// DenyReason explains why the admission denied the access
+	DenyReason *DenyReason
+	// RawQuery is the query string as received, before the url is normalized
+	RawQuery string
+	// Balanced is the upstream target of a resource balanced over several upstreams
+	Balanced *balancedRequest
+}
+
+// DenyReason is the machine-readable reason of a denial, told to the trusted clients
+type DenyReason struct {
+	// Reason is the check which failed: roles, groups, claim or claim-types
+	Reason string `json:"reason"`
+	// Roles are the roles required by the resource
+	Roles []string `json:"roles,omitempty"`
+	// RequireAnyRole indicates any of the roles would have been enough
+	RequireAnyRole bool `json:"require_any_role,omitempty"`
+	// Groups are the groups required by the resource, any of them
+	Groups []string `json:"groups,omitempty"`
+	// Claim is the name of the claim which did not match
+	Claim string `json:"claim,omitempty"`
 }
 
 // tokenResponse
@@ -309,3 +607,9 @@ type tokenResponse struct {
 	ExpiresIn    int    `json:"expires_in"`
 	Scope        string `json:"scope,omitempty"`
 }
+
+// loginChallenge is the body handed back to API requests lacking a session
+type loginChallenge struct {
+	LoginURL string `json:"login_url"`
+	State    string `json:"state"`
+}
@@ -204,6 +204,7 @@ func runTestAuth(t *testing.T, listener, realm string) error {
 			redirect := req.FormValue("redirect_uri")
 			state := req.FormValue("state")
 			code := "xyz"
+			fake.rememberNonce(code, req.FormValue("nonce"))
 			location, _ := url.PathUnescape(redirect)
 			u, _ := url.Parse(location)
 			v := u.Query()
@@ -263,6 +263,7 @@ func runTestTLSAuth(t *testing.T, listener, realm string) error {
 			redirect := req.FormValue("redirect_uri")
 			state := req.FormValue("state")
 			code := "zyx"
+			fake.rememberNonce(code, req.FormValue("nonce"))
 			location, _ := url.PathUnescape(redirect)
 			u, _ := url.Parse(location)
 			v := u.Query()
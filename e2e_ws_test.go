@@ -148,6 +148,7 @@ func runTestWSTLSAuth(t *testing.T, listener, realm string) error {
 			redirect := req.FormValue("redirect_uri")
 			state := req.FormValue("state")
 			code := "zzz"
+			fake.rememberNonce(code, req.FormValue("nonce"))
 			location, _ := url.PathUnescape(redirect)
 			u, _ := url.Parse(location)
 			v := u.Query()
@@ -2,11 +2,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -20,16 +25,52 @@ var (
 	ErrInvalidSession = errors.New("invalid session identifier")
 	// ErrAccessTokenExpired indicates the access token has expired
 	ErrAccessTokenExpired = errors.New("the access token has expired")
+	// ErrAccessTokenNotYetValid indicates the access token is used before its not-before time
+	ErrAccessTokenNotYetValid = errors.New("the access token is not yet valid")
+	// ErrRefreshTokenInvalidGrant indicates the provider rejected the refresh token as an invalid grant
+	ErrRefreshTokenInvalidGrant = errors.New("the refresh token was rejected as an invalid grant")
+	// ErrNonceMismatch indicates the ID token does not carry the nonce of the authorization request
+	ErrNonceMismatch = errors.New("the ID token nonce does not match the authorization request")
+	// ErrNoCodeVerifier indicates the pkce code verifier of the authorization request is missing
+	ErrNoCodeVerifier = errors.New("no code verifier found for the authorization request")
+	// ErrSigningAlgorithm indicates the token is not signed with one of the allowed algorithms
+	ErrSigningAlgorithm = errors.New("the token is not signed with an allowed algorithm")
+	// ErrUnexpectedTokenType indicates the token is not of an accepted type, e.g. an ID token instead of an access token
+	ErrUnexpectedTokenType = errors.New("the token is not of an accepted type")
+	// ErrAuthorizedPartyMismatch indicates the token was issued to another client
+	ErrAuthorizedPartyMismatch = errors.New("the token was issued to another authorized party")
 	// ErrRefreshTokenExpired indicates the refresh token as expired
 	ErrRefreshTokenExpired = errors.New("the refresh token has expired")
+	// ErrNoUserinfoEndpoint indicates the provider does not advertise a userinfo endpoint
+	ErrNoUserinfoEndpoint = errors.New("the provider has no userinfo endpoint")
+	// ErrStoreProbeMismatch indicates the store did not return the probe value which was written
+	ErrStoreProbeMismatch = errors.New("the store returned an unexpected probe value")
+	// ErrTooManySessions indicates the user has reached the maximum number of concurrent sessions
+	ErrTooManySessions = errors.New("the maximum number of sessions for the user has been reached")
+	// ErrRefreshRateExceeded indicates the session has been refreshed too many times within the window
+	ErrRefreshRateExceeded = errors.New("the session has exceeded the refresh rate limit")
+	// ErrClaimType indicates a claim of the token does not have the expected type, e.g. a string instead of an array
+	ErrClaimType = errors.New("the claim does not have the expected type")
+	// ErrSessionBinding indicates the session is presented by another client than the one it was bound to at login
+	ErrSessionBinding = errors.New("the session is bound to another client")
 	// ErrNoTokenAudience indicates their is not audience in the token
 	ErrNoTokenAudience = errors.New("the token does not audience in claims")
+	// ErrMalformedSessionCookie indicates the session cookie cannot be decrypted or parsed, e.g. it was truncated
+	ErrMalformedSessionCookie = errors.New("the session cookie is malformed")
+	// ErrCookieSignature indicates the MAC of a cookie does not match its value, i.e. the cookie was tampered with
+	ErrCookieSignature = errors.New("the cookie signature is invalid")
 	// ErrDecryption indicates we can't decrypt the token
 	ErrDecryption = errors.New("failed to decrypt token")
 	// ErrEncode indicates a failure to encode the token
 	ErrEncode = errors.New("failed to encode token")
 	// ErrEncryption indicates a failure to encrypt the token
 	ErrEncryption = errors.New("failed to encrypt token")
+	// ErrStoreDecryption indicates a token read from the store cannot be decrypted, e.g. it was stored unencrypted
+	ErrStoreDecryption = errors.New("failed to decrypt the token held in the store")
+	// ErrCertificateRevoked indicates a certificate presented by an upstream was revoked
+	ErrCertificateRevoked = errors.New("the certificate was revoked")
+	// ErrCertificatePinning indicates the server presented no certificate with a pinned public key
+	ErrCertificatePinning = errors.New("the server certificate does not match any pinned public key")
 )
 
 func methodNotAllowedHandler(w http.ResponseWriter, req *http.Request) {
@@ -45,6 +86,10 @@ func methodNotFoundHandler(w http.ResponseWriter, req *http.Request) {
 func (r *oauthProxy) errorResponse(w http.ResponseWriter, req *http.Request, msg string, code int, err error) {
 	span, logger := r.traceSpanRequest(req)
 
+	if code == http.StatusUnauthorized {
+		r.delayFailedAuth(req)
+	}
+
 	if err == nil {
 		logger.Warn(msg, zap.Int("http_status", code))
 	} else {
@@ -65,6 +110,22 @@ func (r *oauthProxy) errorResponse(w http.ResponseWriter, req *http.Request, msg
 	errorResponse(w, msg, code)
 }
 
+// serviceUnavailable responds 503 to a request the service cannot serve for now, telling the client when to retry
+func (r *oauthProxy) serviceUnavailable(w http.ResponseWriter, req *http.Request, msg string, err error) {
+	r.setRetryAfter(w)
+	r.errorResponse(w, req, msg, http.StatusServiceUnavailable, err)
+}
+
+// setRetryAfter tells the client when to retry, up to half the configured delay later so that the clients
+// turned down together do not all come back at once
+func (r *oauthProxy) setRetryAfter(w http.ResponseWriter) {
+	if r.config.UnavailableRetryAfter <= 0 {
+		return
+	}
+	delay := r.config.UnavailableRetryAfter + time.Duration(rand.Int63n(int64(r.config.UnavailableRetryAfter/2)+1))
+	w.Header().Set(headerRetryAfter, strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+}
+
 func noSniff(w http.ResponseWriter) {
 	w.Header().Set(headerXContentTypeOptions, "nosniff")
 }
@@ -81,16 +142,28 @@ func errorResponse(w http.ResponseWriter, msg string, code int) {
 // accessForbidden redirects the user to the forbidden page
 func (r *oauthProxy) accessForbidden(w http.ResponseWriter, req *http.Request, msgs ...string) context.Context {
 	_, logger := r.traceSpanRequest(req)
+	r.delayFailedAuth(req)
 
-	// are we using a custom http template for 403?
-	if r.config.hasCustomForbiddenPage() {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// are we telling a trusted client why it is denied?
+	if reason := r.denialDetails(req); reason != nil {
+		logger.Debug("user forbidden access, detailing the reason to the client", zap.String("reason", reason.Reason))
+		w.Header().Set("Content-Type", jsonMime)
 		noSniff(w)
 		w.WriteHeader(http.StatusForbidden)
-		name := path.Base(r.config.ForbiddenPage)
-		if err := r.Render(w, name, r.config.Tags); err != nil {
-			logger.Error("failed to render the template", zap.Error(err), zap.String("template", name))
-		}
+		_ = json.NewEncoder(w).Encode(struct {
+			Error  string      `json:"error"`
+			Denial *DenyReason `json:"denial"`
+		}{
+			Error:  "access denied",
+			Denial: reason,
+		})
+
+		return r.revokeProxy(w, req)
+	}
+
+	// are we using a custom http template for 403? the scripts are still answered with JSON
+	if r.config.hasCustomForbiddenPage() && !isAPIRequest(req) {
+		r.forbiddenPageResponse(w, req)
 	} else {
 		var msg string
 		if len(msgs) > 0 {
@@ -109,3 +182,68 @@ func (r *oauthProxy) accessForbidden(w http.ResponseWriter, req *http.Request, m
 
 	return r.revokeProxy(w, req)
 }
+
+// forbiddenPageResponse renders the custom page denying the access, with the request and the resource it matched
+func (r *oauthProxy) forbiddenPageResponse(w http.ResponseWriter, req *http.Request) {
+	_, logger := r.traceSpanRequest(req)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	noSniff(w)
+	w.WriteHeader(http.StatusForbidden)
+	name := path.Base(r.config.ForbiddenPage)
+	model := map[string]string{
+		"method": req.Method,
+		"url":    req.URL.RequestURI(),
+	}
+	if scope, ok := req.Context().Value(contextScopeName).(*RequestScope); ok {
+		if scope.MatchedResource != nil {
+			model["resource"] = scope.MatchedResource.URL
+		}
+		if scope.Identity != nil {
+			model["email"] = scope.Identity.email
+			model["username"] = scope.Identity.preferredName
+		}
+	}
+	if err := r.Render(w, name, mergeMaps(model, r.config.Tags)); err != nil {
+		logger.Error("failed to render the template", zap.Error(err), zap.String("template", name))
+	}
+}
+
+// delayFailedAuth holds the response to a failed authentication or admission for the configured delay, give or take
+// half of it, to slow down brute force attempts. The number of responses held at once is bounded: beyond, the
+// responses are not delayed.
+func (r *oauthProxy) delayFailedAuth(req *http.Request) {
+	if r.config.FailedAuthDelay <= 0 {
+		return
+	}
+	select {
+	case r.failedAuthDelays <- struct{}{}:
+		defer func() { <-r.failedAuthDelays }()
+	default:
+		return
+	}
+
+	delay := r.config.FailedAuthDelay/2 + time.Duration(rand.Int63n(int64(r.config.FailedAuthDelay)))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-req.Context().Done():
+	}
+}
+
+// denialDetails returns the reason of the denial when the client of the token is trusted with it
+func (r *oauthProxy) denialDetails(req *http.Request) *DenyReason {
+	if len(r.config.DenialDetailsClients) == 0 {
+		return nil
+	}
+	scope, ok := req.Context().Value(contextScopeName).(*RequestScope)
+	if !ok || scope.DenyReason == nil || scope.Identity == nil {
+		return nil
+	}
+	client, found, err := scope.Identity.claims.StringClaim(claimAuthorizedParty)
+	if err != nil || !found || !containsString(client, r.config.DenialDetailsClients) {
+		return nil
+	}
+
+	return scope.DenyReason
+}
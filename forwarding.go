@@ -109,7 +109,11 @@ func (r *oauthProxy) createForwardingProxy() error {
 
 			latency := time.Since(start)
 			latencyMetric.Observe(latency.Seconds())
-			r.log.Info("client request",
+			logger := r.log
+			if r.accessLog != nil {
+				logger = r.accessLog
+			}
+			logger.Info("client request",
 				zap.String("method", resp.Request.Method),
 				zap.String("path", resp.Request.URL.Path),
 				zap.Int("status", resp.StatusCode),
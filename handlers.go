@@ -16,8 +16,8 @@ limitations under the License.
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -47,22 +47,7 @@ func (r *oauthProxy) getRedirectionURL(w http.ResponseWriter, req *http.Request)
 		defer span.End()
 	}
 
-	var redirect string
-	switch r.config.RedirectionURL {
-	case "":
-		// need to determine the scheme, cx.Request.URL.Scheme doesn't have it, best way is to default
-		// and then check for TLS
-		scheme := unsecureScheme
-		if req.TLS != nil {
-			scheme = secureScheme
-		}
-		// @QUESTION: should I use the X-Forwarded-<header>?? ..
-		redirect = fmt.Sprintf("%s://%s",
-			defaultTo(req.Header.Get("X-Forwarded-Proto"), scheme),
-			defaultTo(req.Header.Get("X-Forwarded-Host"), req.Host))
-	default:
-		redirect = r.config.RedirectionURL
-	}
+	redirect := r.getBaseURL(req)
 
 	state, _ := req.Cookie(requestStateCookie)
 	if state != nil && req.URL.Query().Get("state") != state.Value {
@@ -76,6 +61,23 @@ func (r *oauthProxy) getRedirectionURL(w http.ResponseWriter, req *http.Request)
 	return fmt.Sprintf("%s%s", redirect, r.config.WithOAuthURI("callback"))
 }
 
+// getBaseURL returns the url the proxy is reached at, either configured or derived from the request
+func (r *oauthProxy) getBaseURL(req *http.Request) string {
+	if r.config.RedirectionURL != "" {
+		return r.config.RedirectionURL
+	}
+	// need to determine the scheme, cx.Request.URL.Scheme doesn't have it, best way is to default
+	// and then check for TLS
+	scheme := unsecureScheme
+	if req.TLS != nil {
+		scheme = secureScheme
+	}
+	// @QUESTION: should I use the X-Forwarded-<header>?? ..
+	return fmt.Sprintf("%s://%s",
+		defaultTo(req.Header.Get("X-Forwarded-Proto"), scheme),
+		defaultTo(req.Header.Get("X-Forwarded-Host"), req.Host))
+}
+
 // oauthAuthorizationHandler is responsible for performing the redirection to oauth provider
 func (r *oauthProxy) oauthAuthorizationHandler(w http.ResponseWriter, req *http.Request) {
 	ctx, span, logger := r.traceSpan(req.Context(), "authorization handler")
@@ -100,11 +102,29 @@ func (r *oauthProxy) oauthAuthorizationHandler(w http.ResponseWriter, req *http.
 		accessType = "offline"
 	}
 
-	authURL := client.AuthCodeURL(req.URL.Query().Get("state"), accessType, "")
+	// step: only a login prompt may be requested, e.g. to step up the authentication
+	var prompt string
+	if req.URL.Query().Get("prompt") == promptLogin {
+		prompt = promptLogin
+	}
+
+	authURL := client.AuthCodeURL(req.URL.Query().Get("state"), accessType, prompt)
+	if r.config.EnableIDTokenNonce {
+		authURL += "&nonce=" + url.QueryEscape(r.writeNonceCookie(req, w))
+	}
+	if r.config.EnablePKCE {
+		challenge, err := r.writeCodeVerifierCookie(req, w)
+		if err != nil {
+			r.errorResponse(w, req.WithContext(ctx), "failed to generate the pkce code verifier", http.StatusInternalServerError, err)
+			return
+		}
+		authURL += challenge
+	}
 	logger.Debug("incoming authorization request from client address",
 		zap.String("access_type", accessType),
+		zap.String("prompt", prompt),
 		zap.String("auth_url", authURL),
-		zap.String("client_ip", req.RemoteAddr))
+		zap.String("client_ip", realIP(req, r.trustedProxies)))
 
 	// step: if we have a custom sign in page, lets display that
 	if r.config.hasCustomSignInPage() {
@@ -138,7 +158,20 @@ func (r *oauthProxy) oauthCallbackHandler(w http.ResponseWriter, req *http.Reque
 		return
 	}
 
-	client, err := r.getOAuthClient(r.getRedirectionURL(w, req.WithContext(ctx)))
+	var client *oauth2.Client
+	var err error
+	switch r.config.EnablePKCE {
+	case true:
+		verifier, errVerifier := r.readCodeVerifierCookie(req)
+		r.clearCodeVerifierCookie(req, w)
+		if errVerifier != nil {
+			r.accessForbidden(w, req.WithContext(ctx), "unable to retrieve the pkce code verifier", errVerifier.Error())
+			return
+		}
+		client, err = r.getPKCEOAuthClient(r.getRedirectionURL(w, req.WithContext(ctx)), verifier)
+	default:
+		client, err = r.getOAuthClient(r.getRedirectionURL(w, req.WithContext(ctx)))
+	}
 	if err != nil {
 		r.errorResponse(w, req.WithContext(ctx), "unable to create a oauth2 client", http.StatusInternalServerError, err)
 		return
@@ -159,6 +192,19 @@ func (r *oauthProxy) oauthCallbackHandler(w http.ResponseWriter, req *http.Reque
 
 		return
 	}
+	if r.config.EnableIDTokenNonce {
+		var nonce string
+		if cookie, err := req.Cookie(requestNonceCookie); err == nil {
+			nonce = cookie.Value
+		}
+		r.clearNonceCookie(req, w)
+		if err = verifyNonce(token, nonce); err != nil {
+			r.accessForbidden(w, req.WithContext(ctx), "unable to verify the nonce of the ID token", err.Error())
+
+			return
+		}
+	}
+	sid := getSessionID(token)
 	access, id, err := parseToken(resp.AccessToken)
 	if err == nil {
 		token = access
@@ -177,7 +223,7 @@ func (r *oauthProxy) oauthCallbackHandler(w http.ResponseWriter, req *http.Reque
 		} else {
 			sessionToken = resp.IDToken
 		}
-		r.commonLogout(ctx, w, req, sessionToken, func(ww http.ResponseWriter) {
+		r.commonLogout(ctx, w, req, sessionToken, func(ww http.ResponseWriter, _ string) {
 			// always return an error after logout in this case
 			r.accessForbidden(w, req.WithContext(ctx), "unable to verify the ID token", err.Error())
 		}, logger.With(zap.String("email", identity.Email)))
@@ -212,10 +258,31 @@ func (r *oauthProxy) oauthCallbackHandler(w http.ResponseWriter, req *http.Reque
 			return
 		}
 
-		// drop in the access token - cookie expiration = access token
-		r.dropAccessTokenCookie(req.WithContext(ctx), w, accessToken, r.getAccessCookieExpiration(token, resp.RefreshToken))
+		// step: enforce the maximum number of sessions of the user
+		if err = r.addUserSession(identity.ID, r.getUserSessionKey(token, encrypted)); err != nil {
+			if err == ErrTooManySessions {
+				r.accessForbidden(w, req.WithContext(ctx), "too many active sessions for user", err.Error())
+				return
+			}
+			logger.Warn("failed to record the session of the user in the store", zap.Error(err))
+		}
+		if err = r.indexSessionID(sid, r.getUserSessionKey(token, encrypted)); err != nil {
+			logger.Warn("failed to index the session by its id in the store", zap.Error(err))
+		}
+
+		switch r.config.EnableStoredAccessToken {
+		case true:
+			// the access token is kept server-side, the refresh token cookie holds the session
+			if err = r.StoreAccessToken(encrypted, accessToken); err != nil {
+				r.errorResponse(w, req.WithContext(ctx), "failed to save the access token in the store", http.StatusInternalServerError, err)
+				return
+			}
+		default:
+			// drop in the access token - cookie expiration = access token
+			r.dropAccessTokenCookie(req.WithContext(ctx), w, accessToken, r.getAccessCookieExpiration(token, resp.RefreshToken))
+		}
 
-		switch r.useStore() {
+		switch r.useStore() && !r.config.EnableStoredAccessToken {
 		case true:
 			if err = r.StoreRefreshToken(token, encrypted); err != nil {
 				logger.Warn("failed to save the refresh token in the store", zap.Error(err))
@@ -230,9 +297,15 @@ func (r *oauthProxy) oauthCallbackHandler(w http.ResponseWriter, req *http.Reque
 			}
 		}
 	} else {
+		if r.config.EnableStoredAccessToken {
+			r.accessForbidden(w, req.WithContext(ctx), "no refresh token issued to hold the session")
+			return
+		}
 		r.dropAccessTokenCookie(req.WithContext(ctx), w, accessToken, time.Until(identity.ExpiresAt))
 	}
 
+	r.dropSessionBindingCookie(req.WithContext(ctx), w, token, identity.ID)
+
 	// step: decode the request variable
 	redirectURI := "/"
 	if req.URL.Query().Get("state") != "" {
@@ -299,12 +372,16 @@ func (r *oauthProxy) loginHandler(w http.ResponseWriter, req *http.Request) {
 		// @metric observe the time taken for a login request
 		oauthLatencyMetric.WithLabelValues("login").Observe(time.Since(start).Seconds())
 
-		_, identity, err := parseToken(token.AccessToken)
+		access, identity, err := parseToken(token.AccessToken)
 		if err != nil {
 			return "unable to decode the access token", http.StatusNotImplemented, err
 		}
 
-		r.dropAccessTokenCookie(req.WithContext(ctx), w, token.AccessToken, time.Until(identity.ExpiresAt))
+		// the tokens are handed back in the response: the access token cookie is skipped when kept server-side
+		if !r.config.EnableStoredAccessToken {
+			r.dropAccessTokenCookie(req.WithContext(ctx), w, token.AccessToken, time.Until(identity.ExpiresAt))
+			r.dropSessionBindingCookie(req.WithContext(ctx), w, access, identity.ID)
+		}
 
 		// @metric a token has been issued
 		oauthTokensMetric.WithLabelValues("login").Inc()
@@ -324,7 +401,7 @@ func (r *oauthProxy) loginHandler(w http.ResponseWriter, req *http.Request) {
 		return "", http.StatusOK, nil
 	}()
 	if err != nil {
-		r.errorResponse(w, req.WithContext(ctx), strings.Join([]string{errorMsg, "client_ip", req.RemoteAddr}, ","), code, err)
+		r.errorResponse(w, req.WithContext(ctx), strings.Join([]string{errorMsg, "client_ip", realIP(req, r.trustedProxies)}, ","), code, err)
 	}
 }
 
@@ -349,27 +426,69 @@ func (r *oauthProxy) logoutHandler(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// step: check if the user has a state session and if so revoke it
-	if r.useStore() {
+	switch {
+	case r.config.EnableStoredAccessToken:
+		if session, err := r.getRefreshTokenFromCookie(req); err == nil {
+			go func() {
+				if err := r.DeleteAccessToken(session); err != nil {
+					logger.Error("unable to remove the access token from store", zap.Error(err))
+				}
+			}()
+		}
+	case r.useStore():
 		go func() {
 			if err := r.DeleteRefreshToken(user.token); err != nil {
 				logger.Error("unable to remove the refresh token from store", zap.Error(err))
 			}
 		}()
 	}
+	// step: the refreshes of the session are not counted anymore
+	if r.config.RefreshRateLimit > 0 && r.useStore() {
+		if sid := getSessionID(user.token); sid != "" {
+			go func() {
+				if err := r.forgetSessionRefreshes(sid); err != nil {
+					logger.Error("unable to remove the refresh count of the session from store", zap.Error(err))
+				}
+			}()
+		}
+	}
 
 	// step: can either use the id token or the refresh token
 	identityToken := user.token.Encode()
-	if refresh, _, err := r.retrieveRefreshToken(req, user); err == nil {
+	if refresh, _, _, err := r.retrieveRefreshToken(req, user); err == nil {
 		identityToken = refresh
 	}
 
-	r.commonLogout(ctx, w, req, identityToken, func(w http.ResponseWriter) {
+	r.commonLogout(ctx, w, req, identityToken, func(w http.ResponseWriter, redirectURL string) {
+		if r.config.hasCustomLogoutPage() {
+			r.logoutPageResponse(w, req.WithContext(ctx), redirectURL)
+			return
+		}
 		w.Header().Set("Content-Type", jsonMime)
 		w.WriteHeader(http.StatusOK)
 	}, logger.With(zap.String("email", user.email)))
 }
 
-func (r *oauthProxy) commonLogout(ctx context.Context, w http.ResponseWriter, req *http.Request, token string, successResponder func(http.ResponseWriter), logger Logger) {
+// logoutPageResponse renders the page confirming the logout, with a link to the redirect url or to sign in again
+func (r *oauthProxy) logoutPageResponse(w http.ResponseWriter, req *http.Request, redirectURL string) {
+	_, logger := r.traceSpanRequest(req)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate, max-age=0")
+	noSniff(w)
+	w.WriteHeader(http.StatusOK)
+	name := path.Base(r.config.LogoutPage)
+	model := map[string]string{
+		"login_url":    path.Clean(r.config.WithOAuthURI(authorizationURL)),
+		"redirect_url": redirectURL,
+	}
+	if err := r.Render(w, name, mergeMaps(model, r.config.Tags)); err != nil {
+		logger.Error("failed to render the template", zap.Error(err), zap.String("template", name))
+	}
+}
+
+// commonLogout clears the session of the user and revokes it on the provider. The user is then redirected, unless
+// the responder takes over, e.g. to render the logout page.
+func (r *oauthProxy) commonLogout(ctx context.Context, w http.ResponseWriter, req *http.Request, token string, successResponder func(http.ResponseWriter, string), logger Logger) {
 	// @metric increment the logout counter
 	oauthTokensMetric.WithLabelValues("logout").Inc()
 
@@ -433,8 +552,10 @@ func (r *oauthProxy) commonLogout(ctx context.Context, w http.ResponseWriter, re
 		encodedSecret := url.QueryEscape(r.config.ClientSecret)
 
 		logger.Debug("revoking user session")
-		// step: construct the url for revocation
-		request, err := http.NewRequestWithContext(ctx, http.MethodPost, revocationURL, bytes.NewBufferString(fmt.Sprintf("refresh_token=%s", token)))
+		// step: construct the url for revocation, the token is passed as expected by the end session endpoint of
+		// keycloak and by the revocation endpoints of RFC 7009 alike
+		form := url.Values{"refresh_token": {token}, "token": {token}}
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, revocationURL, strings.NewReader(form.Encode()))
 		if err != nil {
 			r.errorResponse(w, req.WithContext(ctx), "unable to construct the revocation request", http.StatusInternalServerError, err)
 			return
@@ -458,7 +579,7 @@ func (r *oauthProxy) commonLogout(ctx context.Context, w http.ResponseWriter, re
 
 		// step: check the response
 		switch response.StatusCode {
-		case http.StatusNoContent:
+		case http.StatusOK, http.StatusNoContent:
 			logger.Info("successfully logged out of the endpoint")
 		default:
 			content, _ := ioutil.ReadAll(response.Body)
@@ -466,14 +587,16 @@ func (r *oauthProxy) commonLogout(ctx context.Context, w http.ResponseWriter, re
 				zap.Int("status", response.StatusCode),
 				zap.ByteString("response", content))
 		}
+	} else {
+		logger.Warn("no revocation endpoint, the session is only cleared locally")
 	}
 
-	// step: should we redirect the user
-	if redirectURL != "" {
+	// step: should we redirect the user, or confirm the logout with a page
+	if redirectURL != "" && !r.config.hasCustomLogoutPage() {
 		logger.Debug("redirecting to logout", zap.String("url", redirectURL))
 		r.redirectToURL(redirectURL, w, req.WithContext(ctx), http.StatusTemporaryRedirect)
 	} else {
-		successResponder(w)
+		successResponder(w, redirectURL)
 	}
 }
 
@@ -507,7 +630,7 @@ func (r *oauthProxy) refreshHandler(w http.ResponseWriter, req *http.Request) {
 	}
 
 	if !r.config.EnableRefreshTokens {
-		clientIP := req.RemoteAddr
+		clientIP := realIP(req, r.trustedProxies)
 		logger.Warn("access token refresh is disabled",
 			zap.String("client_ip", clientIP),
 			zap.String("email", user.name),
@@ -549,6 +672,60 @@ func (r *oauthProxy) tokenHandler(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// introspectHandler tells the callers authenticated with the client credentials whether a token is active, and
+// what it holds, as per RFC 7662
+func (r *oauthProxy) introspectHandler(w http.ResponseWriter, req *http.Request) {
+	ctx, span, logger := r.traceSpan(req.Context(), "introspect handler")
+	if span != nil {
+		defer span.End()
+	}
+
+	// step: a public client has no secret to authenticate the callers with
+	clientID, clientSecret, found := req.BasicAuth()
+	if !found || clientSecret == "" || r.config.ClientSecret == "" ||
+		subtle.ConstantTimeCompare([]byte(clientID), []byte(r.config.ClientID)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(clientSecret), []byte(r.config.ClientSecret)) != 1 {
+		w.Header().Set(headerWWWAuthenticate, `Basic realm="introspection"`)
+		r.errorResponse(w, req.WithContext(ctx), "the client credentials are required", http.StatusUnauthorized, nil)
+		return
+	}
+	value := req.PostFormValue("token")
+	if value == "" {
+		r.errorResponse(w, req.WithContext(ctx), "no token to introspect", http.StatusBadRequest, nil)
+		return
+	}
+
+	// step: an inactive token is told apart with no more details
+	response := map[string]interface{}{"active": false}
+	token, identity, err := parseToken(value)
+	if err == nil {
+		err = r.verifyToken(r.client, token)
+	}
+	if err != nil {
+		logger.Debug("the introspected token is not active", zap.Error(err))
+	} else {
+		claims, _ := token.Claims()
+		for k, v := range claims {
+			response[k] = v
+		}
+		username, found, _ := claims.StringClaim(claimPreferredName)
+		if !found {
+			username = identity.Email
+		}
+		scope, _, _ := claims.StringClaim("scope")
+		response["active"] = true
+		response["sub"] = identity.ID
+		response["exp"] = identity.ExpiresAt.Unix()
+		response["scope"] = scope
+		response["username"] = username
+	}
+
+	w.Header().Set("Content-Type", jsonMime)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
 // healthHandler is a health check handler for the service
 func (r *oauthProxy) healthHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", jsonMime)
@@ -557,6 +734,32 @@ func (r *oauthProxy) healthHandler(w http.ResponseWriter, req *http.Request) {
 	_, _ = w.Write([]byte(`{"status":"OK"}`))
 }
 
+// readyHandler reports whether the service is ready to serve requests, i.e. it is not draining, is warmed up and
+// its store is working
+func (r *oauthProxy) readyHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", jsonMime)
+	w.Header().Set(versionHeader, version.GetVersion())
+	if r.isDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"status":"draining"}`))
+		return
+	}
+	if r.isWarmingUp() {
+		r.setRetryAfter(w)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"status":"warming up"}`))
+		return
+	}
+	if !r.isStoreHealthy() {
+		r.setRetryAfter(w)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"status":"store unavailable"}`))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(`{"status":"OK"}`))
+}
+
 // debugHandler is responsible for providing the pprof
 func (r *oauthProxy) debugHandler(w http.ResponseWriter, req *http.Request) {
 	ctx, span, _ := r.traceSpan(req.Context(), "debug handler")
@@ -594,13 +797,25 @@ func (r *oauthProxy) debugHandler(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// retrieveRefreshToken retrieves the refresh token from store or cookie
-func (r *oauthProxy) retrieveRefreshToken(req *http.Request, user *userContext) (token, encrypted string, err error) {
-	switch r.useStore() {
-	case true:
-		token, err = r.GetRefreshToken(user.token)
-	default:
+// retrieveRefreshToken retrieves the refresh token from store or cookie. When a store is used, the configured source
+// is looked up first, then the other one, and fromCookie tells which one held the token.
+func (r *oauthProxy) retrieveRefreshToken(req *http.Request, user *userContext) (token, encrypted string, fromCookie bool, err error) {
+	switch {
+	case !r.useStore() || r.config.EnableStoredAccessToken:
 		token, err = r.getRefreshTokenFromCookie(req)
+		fromCookie = true
+	case r.config.RefreshTokenSource == refreshTokenSourceCookie:
+		if token, err = r.getRefreshTokenFromCookie(req); err != nil {
+			token, err = r.GetRefreshToken(user.token)
+		} else {
+			fromCookie = true
+		}
+	default:
+		if token, err = r.GetRefreshToken(user.token); err != nil {
+			if cookie, cerr := r.getRefreshTokenFromCookie(req); cerr == nil {
+				token, err, fromCookie = cookie, nil, true
+			}
+		}
 	}
 	if err != nil {
 		return
@@ -612,27 +827,61 @@ func (r *oauthProxy) retrieveRefreshToken(req *http.Request, user *userContext)
 }
 
 func (r *oauthProxy) csrfErrorHandler(w http.ResponseWriter, req *http.Request) {
-	r.accessForbidden(w, req, "CSRF error", gcsrf.FailureReason(req).Error(), req.RemoteAddr)
+	r.accessForbidden(w, req, "CSRF error", gcsrf.FailureReason(req).Error(), realIP(req, r.trustedProxies))
 }
 
+// refreshToken renews the access token of the user, and the cookies or store entries holding the session.
+// Only the identity of the user changes: the request keeps its way to the upstream, through the same transport
+// and pool of connections.
 func (r *oauthProxy) refreshToken(w http.ResponseWriter, req *http.Request, user *userContext) error {
 	ctx, span, logger := r.traceSpan(req.Context(), "logout handler")
 	if span != nil {
 		defer span.End()
 	}
 
-	clientIP := req.RemoteAddr
+	clientIP := realIP(req, r.trustedProxies)
 
 	// step: check if the user has refresh token
-	refresh, encrypted, err := r.retrieveRefreshToken(req.WithContext(ctx), user)
+	refresh, encrypted, fromCookie, err := r.retrieveRefreshToken(req.WithContext(ctx), user)
 	if err != nil {
 		logger.Warn("unable to find a refresh token for user",
 			zap.String("client_ip", clientIP),
 			zap.String("email", user.email),
 			zap.Error(err))
+		if errors.Is(err, ErrMalformedSessionCookie) {
+			r.clearAllCookies(req, w)
+		}
 		return err
 	}
 
+	// step: a session refreshed at an abnormal rate hints at a stolen refresh token
+	if r.config.RefreshRateLimit > 0 && r.useStore() {
+		if sid := getSessionID(user.token); sid != "" {
+			count, err := r.countSessionRefresh(sid)
+			if err != nil {
+				logger.Warn("unable to count the refreshes of the session", zap.Error(err))
+			} else if count > r.config.RefreshRateLimit {
+				logger.Warn("the session is refreshed at an abnormal rate, the session is invalidated",
+					zap.String("client_ip", clientIP),
+					zap.String("email", user.email),
+					zap.Int("refreshes", count),
+					zap.Duration("window", r.config.RefreshRateWindow))
+				// @metric a session has been invalidated for an abnormal refresh rate
+				refreshRateExceededMetric.Inc()
+
+				if err := r.store.Delete(r.getUserSessionKey(user.token, encrypted)); err != nil {
+					logger.Error("failed to remove the invalidated session", zap.Error(err))
+				}
+				if err := r.forgetSessionRefreshes(sid); err != nil {
+					logger.Error("failed to remove the refresh count of the invalidated session", zap.Error(err))
+				}
+				r.clearAllCookies(req, w)
+
+				return ErrRefreshRateExceeded
+			}
+		}
+	}
+
 	// attempt to refresh the access token, possibly with a renewed refresh token
 	//
 	// NOTE: atm, this does not retrieve explicit refresh token expiry from oauth2,
@@ -650,6 +899,14 @@ func (r *oauthProxy) refreshToken(w http.ResponseWriter, req *http.Request, user
 				zap.String("client_ip", clientIP),
 				zap.String("email", user.email))
 
+			r.clearAllCookies(req, w)
+		case ErrRefreshTokenInvalidGrant:
+			logger.Warn("refresh token rejected as an invalid grant, the session is cleared",
+				zap.String("client_ip", clientIP),
+				zap.String("email", user.email))
+			// @metric a refresh token has been rejected by the provider
+			oauthTokensMetric.WithLabelValues("refresh_invalid_grant").Inc()
+
 			r.clearAllCookies(req, w)
 		default:
 			r.log.Error("failed to refresh the access token", zap.Error(err))
@@ -669,6 +926,20 @@ func (r *oauthProxy) refreshToken(w http.ResponseWriter, req *http.Request, user
 		refreshExpiresIn = r.getAccessCookieExpiration(token, refresh)
 	}
 
+	// step: a change of privileges rotates the session, so that the cookies captured beforehand are no longer honoured
+	rotate := r.config.EnableSessionRotation && !samePrivileges(user.token, token)
+	if rotate {
+		logger.Info("the privileges of the user changed, the session is rotated",
+			zap.String("client_ip", clientIP),
+			zap.String("email", user.email))
+		// @metric a session has been rotated on a privilege change
+		oauthTokensMetric.WithLabelValues("session_rotated").Inc()
+
+		if r.config.EnableOpaqueSessionCookie {
+			r.rotateOpaqueSession(req, user)
+		}
+	}
+
 	logger.Info("injecting the refreshed access token cookie",
 		zap.String("client_ip", clientIP),
 		zap.String("cookie_name", r.config.CookieAccessName),
@@ -687,9 +958,20 @@ func (r *oauthProxy) refreshToken(w http.ResponseWriter, req *http.Request, user
 	}
 
 	// step: inject the refreshed access token
-	r.dropAccessTokenCookie(req.WithContext(ctx), w, accessToken, accessExpiresIn)
+	if !r.config.EnableStoredAccessToken {
+		r.dropAccessTokenCookie(req.WithContext(ctx), w, accessToken, accessExpiresIn)
+	}
+
+	// step: the session id is usually carried by the access tokens, with the refreshed one taking precedence
+	sid := getSessionID(token, user.token)
 
 	// step: inject the renewed refresh token
+	migrate := r.config.EnableRefreshTokenMigration && r.useStore() && !r.config.EnableStoredAccessToken
+	session := encrypted
+	if newRefreshToken == "" && rotate && fromCookie {
+		// the refresh token kept by the provider is encrypted again, renewing the cookie and the store key it makes
+		newRefreshToken = refresh
+	}
 	if newRefreshToken != "" {
 		logger.Debug("renew refresh cookie with new refresh token",
 			zap.Duration("refresh_expires_in", refreshExpiresIn))
@@ -699,20 +981,72 @@ func (r *oauthProxy) refreshToken(w http.ResponseWriter, req *http.Request, user
 				zap.String("client_ip", clientIP), zap.String("email", user.email), zap.Error(err))
 			return ErrEncryption
 		}
-		r.dropRefreshTokenCookie(req.WithContext(ctx), w, encryptedRefreshToken, refreshExpiresIn)
+		if !migrate {
+			r.dropRefreshTokenCookie(req.WithContext(ctx), w, encryptedRefreshToken, refreshExpiresIn)
+		}
+		session = encryptedRefreshToken
 	}
 
-	if r.useStore() {
-		go func(oldToken, newToken jose.JWT, encrypted string) {
+	// step: the store becomes the only holder of a refresh token migrated from a cookie
+	if migrate && fromCookie {
+		if err := r.StoreRefreshToken(token, session); err != nil {
+			logger.Warn("failed to migrate the refresh token to the store, keeping the cookie",
+				zap.String("client_ip", clientIP),
+				zap.String("email", user.email),
+				zap.Error(err))
+			if newRefreshToken != "" {
+				r.dropRefreshTokenCookie(req.WithContext(ctx), w, session, refreshExpiresIn)
+			}
+		} else {
+			logger.Info("migrated the refresh token from the cookie to the store",
+				zap.String("client_ip", clientIP),
+				zap.String("email", user.email))
+			// @metric a refresh token has been migrated from a cookie to the store
+			oauthTokensMetric.WithLabelValues("refresh_migrated").Inc()
+
+			r.clearRefreshTokenCookie(req.WithContext(ctx), w)
+		}
+	}
+
+	if r.config.EnableStoredAccessToken {
+		if err := r.StoreAccessToken(session, accessToken); err != nil {
+			logger.Error("failed to store the access token",
+				zap.String("client_ip", clientIP), zap.String("email", user.email), zap.Error(err))
+			return err
+		}
+		if session != encrypted {
+			go func(subject, oldSession, newSession string) {
+				if err := r.DeleteAccessToken(oldSession); err != nil {
+					logger.Error("failed to remove old access token", zap.Error(err))
+				}
+				if err := r.replaceUserSession(subject, r.getUserSessionKey(token, oldSession), r.getUserSessionKey(token, newSession)); err != nil {
+					logger.Error("failed to update the sessions of the user", zap.Error(err))
+				}
+				if err := r.indexSessionID(sid, r.getUserSessionKey(token, newSession)); err != nil {
+					logger.Error("failed to update the session id index", zap.Error(err))
+				}
+			}(user.id, encrypted, session)
+		}
+	}
+
+	if r.useStore() && !r.config.EnableStoredAccessToken {
+		go func(subject string, oldToken, newToken jose.JWT, encrypted, session string) {
 			if err := r.DeleteRefreshToken(oldToken); err != nil {
 				logger.Error("failed to remove old token", zap.Error(err))
 			}
 
-			if err := r.StoreRefreshToken(newToken, encrypted); err != nil {
+			if err := r.StoreRefreshToken(newToken, session); err != nil {
 				logger.Error("failed to store refresh token", zap.Error(err))
 				return
 			}
-		}(user.token, token, encrypted)
+
+			if err := r.replaceUserSession(subject, r.getUserSessionKey(oldToken, encrypted), r.getUserSessionKey(newToken, encrypted)); err != nil {
+				logger.Error("failed to update the sessions of the user", zap.Error(err))
+			}
+			if err := r.indexSessionID(sid, r.getUserSessionKey(newToken, encrypted)); err != nil {
+				logger.Error("failed to update the session id index", zap.Error(err))
+			}
+		}(user.id, user.token, token, encrypted, session)
 	}
 
 	// update the user with the new access token and inject into the context
@@ -19,6 +19,9 @@ import (
 	"net/http"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDebugHandler(t *testing.T) {
@@ -193,6 +196,75 @@ func TestLogoutHandlerGood(t *testing.T) {
 	newFakeProxy(nil).RunTests(t, requests)
 }
 
+func TestLogoutHandlerPage(t *testing.T) {
+	c := newFakeKeycloakConfig()
+	c.LogoutPage = "templates/logout.html.tmpl"
+	requests := []fakeRequest{
+		{
+			URI:                     c.WithOAuthURI(logoutURL),
+			HasToken:                true,
+			ExpectedCode:            http.StatusOK,
+			ExpectedContentContains: `<a href="/oauth/authorize">Sign in again</a>`,
+		},
+		{
+			// the redirection is offered as a link instead
+			URI:                     c.WithOAuthURI(logoutURL) + "?redirect=http://example.com",
+			HasToken:                true,
+			ExpectedCode:            http.StatusOK,
+			ExpectedContentContains: `<a href="http://example.com">Continue</a>`,
+		},
+	}
+	newFakeProxy(c).RunTests(t, requests)
+}
+
+func TestLogoutHandlerTokenRevocation(t *testing.T) {
+	c := newFakeKeycloakConfig()
+	c.EnableRefreshTokens = true
+	c.EncryptionKey = testKey
+	refresh, err := encodeText("refresh-token", testKey)
+	require.NoError(t, err)
+	p := newFakeProxy(c)
+	// an RFC 7009 revocation endpoint
+	c.RevocationEndpoint = p.idp.getTokenRevocationURL()
+	requests := []fakeRequest{
+		{
+			URI:             c.WithOAuthURI(logoutURL),
+			HasToken:        true,
+			Cookies:         []*http.Cookie{{Name: c.CookieRefreshName, Value: refresh}},
+			ExpectedCode:    http.StatusOK,
+			ExpectedCookies: map[string]string{c.CookieRefreshName: ""},
+		},
+	}
+	p.RunTests(t, requests)
+
+	assert.True(t, p.idp.isRevoked("refresh-token"))
+}
+
+func TestLogoutHandlerNoRevocationEndpoint(t *testing.T) {
+	c := newFakeKeycloakConfig()
+	c.EnableRefreshTokens = true
+	c.EncryptionKey = testKey
+	refresh, err := encodeText("refresh-token", testKey)
+	require.NoError(t, err)
+	p := newFakeProxy(c)
+	c.RevocationEndpoint = ""
+	p.proxy.idp.EndSessionEndpoint = nil
+
+	// the session is still cleared locally
+	requests := []fakeRequest{
+		{
+			URI:             c.WithOAuthURI(logoutURL),
+			HasToken:        true,
+			Cookies:         []*http.Cookie{{Name: c.CookieRefreshName, Value: refresh}},
+			ExpectedCode:    http.StatusOK,
+			ExpectedCookies: map[string]string{c.CookieRefreshName: ""},
+		},
+	}
+	p.RunTests(t, requests)
+
+	assert.False(t, p.idp.isRevoked("refresh-token"))
+}
+
 func TestTokenHandler(t *testing.T) {
 	uri := newFakeKeycloakConfig().WithOAuthURI(tokenURL)
 	goodToken := newTestToken("example").getToken()
@@ -330,6 +402,29 @@ func TestCallbackURL(t *testing.T) {
 	newFakeProxy(cfg).RunTests(t, requests)
 }
 
+func TestCallbackURLNonce(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableIDTokenNonce = true
+	requests := []fakeRequest{
+		{
+			URI:              cfg.WithOAuthURI(authorizationURL),
+			ExpectedCookies:  map[string]string{requestNonceCookie: ""},
+			ExpectedLocation: "nonce=",
+			ExpectedCode:     http.StatusTemporaryRedirect,
+		},
+		{
+			URI:          cfg.WithOAuthURI(callbackURL) + "?code=fake",
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:          cfg.WithOAuthURI(callbackURL) + "?code=fake",
+			Cookies:      []*http.Cookie{{Name: requestNonceCookie, Value: "forged"}},
+			ExpectedCode: http.StatusForbidden,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
 func TestHealthHandler(t *testing.T) {
 	c := newFakeKeycloakConfig()
 	requests := []fakeRequest{
@@ -348,3 +443,126 @@ func TestHealthHandler(t *testing.T) {
 	}
 	newFakeProxy(nil).RunTests(t, requests)
 }
+
+func TestIntrospectHandlerNoClientSecret(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableIntrospection = true
+	cfg.ClientSecret = ""
+	requests := []fakeRequest{
+		{
+			// an empty secret must not match the empty configured secret
+			URI:          cfg.WithOAuthURI(introspectURL),
+			Method:       http.MethodPost,
+			BasicAuth:    true,
+			Username:     fakeClientID,
+			FormValues:   map[string]string{"token": "not.a.token"},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestIntrospectHandler(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableIntrospection = true
+	uri := cfg.WithOAuthURI(introspectURL)
+	p := newFakeProxy(cfg)
+	active, err := p.idp.signToken(newTestToken(p.idp.getLocation()).claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredToken := newTestToken(p.idp.getLocation())
+	expiredToken.setExpiration(time.Now().Add(-time.Hour))
+	expired, err := p.idp.signToken(expiredToken.claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []fakeRequest{
+		{
+			URI:                     uri,
+			Method:                  http.MethodPost,
+			BasicAuth:               true,
+			Username:                fakeClientID,
+			Password:                fakeSecret,
+			FormValues:              map[string]string{"token": active.Encode()},
+			ExpectedCode:            http.StatusOK,
+			ExpectedHeaders:         map[string]string{"Content-Type": jsonMime},
+			ExpectedContentContains: `"active":true`,
+		},
+		{
+			URI:                     uri,
+			Method:                  http.MethodPost,
+			BasicAuth:               true,
+			Username:                fakeClientID,
+			Password:                fakeSecret,
+			FormValues:              map[string]string{"token": active.Encode()},
+			ExpectedCode:            http.StatusOK,
+			ExpectedContentContains: `"sub":"1e11e539-8256-4b3b-bda8-cc0d56cddb48"`,
+		},
+		{
+			URI:                     uri,
+			Method:                  http.MethodPost,
+			BasicAuth:               true,
+			Username:                fakeClientID,
+			Password:                fakeSecret,
+			FormValues:              map[string]string{"token": active.Encode()},
+			ExpectedCode:            http.StatusOK,
+			ExpectedContentContains: `"username":"rjayawardene"`,
+		},
+		{
+			URI:             uri,
+			Method:          http.MethodPost,
+			BasicAuth:       true,
+			Username:        fakeClientID,
+			Password:        fakeSecret,
+			FormValues:      map[string]string{"token": expired.Encode()},
+			ExpectedCode:    http.StatusOK,
+			ExpectedContent: `{"active":false}` + "\n",
+		},
+		{
+			URI:             uri,
+			Method:          http.MethodPost,
+			BasicAuth:       true,
+			Username:        fakeClientID,
+			Password:        fakeSecret,
+			FormValues:      map[string]string{"token": "not.a.token"},
+			ExpectedCode:    http.StatusOK,
+			ExpectedContent: `{"active":false}` + "\n",
+		},
+		{
+			URI:          uri,
+			Method:       http.MethodPost,
+			BasicAuth:    true,
+			Username:     fakeClientID,
+			Password:     fakeSecret,
+			FormValues:   map[string]string{"other": "value"},
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			// only the callers with the client credentials may introspect
+			URI:          uri,
+			Method:       http.MethodPost,
+			BasicAuth:    true,
+			Username:     fakeClientID,
+			Password:     "wrong",
+			FormValues:   map[string]string{"token": active.Encode()},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:          uri,
+			Method:       http.MethodPost,
+			BasicAuth:    true,
+			Username:     fakeClientID,
+			FormValues:   map[string]string{"token": active.Encode()},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:          uri,
+			Method:       http.MethodPost,
+			FormValues:   map[string]string{"token": active.Encode()},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+	}
+	p.RunTests(t, requests)
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
+	"github.com/coreos/go-oidc/oidc"
+	"go.uber.org/zap"
+)
+
+// keySetCache holds the keys of the provider persisted to disk, so the tokens are verified on startup even though
+// the provider is not reachable yet
+type keySetCache struct {
+	sync.RWMutex
+	path string
+	keys []key.PublicKey
+	// synced tells the keys were fetched from the provider on the last attempt
+	synced bool
+}
+
+func newKeySetCache(path string) *keySetCache {
+	return &keySetCache{path: path}
+}
+
+// load reads the keys persisted by a previous run
+func (c *keySetCache) load() error {
+	content, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	keys, err := parseKeySet(content)
+	if err != nil {
+		return err
+	}
+	c.set(keys)
+
+	return nil
+}
+
+// save persists the keys fetched from the provider and uses them from now on. The file is replaced atomically, not
+// to leave a truncated key set behind.
+func (c *keySetCache) save(content []byte) error {
+	keys, err := parseKeySet(content)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+	c.set(keys)
+
+	return nil
+}
+
+func (c *keySetCache) set(keys []key.PublicKey) {
+	c.Lock()
+	defer c.Unlock()
+	c.keys = keys
+}
+
+func (c *keySetCache) get() []key.PublicKey {
+	c.RLock()
+	defer c.RUnlock()
+	return c.keys
+}
+
+func (c *keySetCache) setSynced(synced bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.synced = synced
+}
+
+// isSynced tells if the provider was reachable on the last attempt to fetch its keys
+func (c *keySetCache) isSynced() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.synced
+}
+
+// parseKeySet decodes a JWKS document, which must hold at least a key
+func parseKeySet(content []byte) ([]key.PublicKey, error) {
+	var set jose.JWKSet
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, err
+	}
+	if len(set.Keys) == 0 {
+		return nil, errors.New("the key set holds no keys")
+	}
+	keys := make([]key.PublicKey, 0, len(set.Keys))
+	for _, jwk := range set.Keys {
+		keys = append(keys, *key.NewPublicKey(jwk))
+	}
+
+	return keys, nil
+}
+
+// syncKeySetCache keeps the cache file up to date with the keys published by the provider, retrying sooner while
+// they cannot be fetched
+func (r *oauthProxy) syncKeySetCache(stop <-chan struct{}) {
+	for {
+		interval := jwksCacheRefreshInterval
+		err := r.refreshKeySetCache()
+		if err != nil {
+			r.log.Warn("unable to refresh the cached keys of the provider", zap.Error(err))
+			interval = jwksCacheRetryInterval
+		}
+		r.keySetCache.setSynced(err == nil)
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// refreshKeySetCache fetches the keys of the provider and persists them
+func (r *oauthProxy) refreshKeySetCache() error {
+	if r.idp.KeysEndpoint == nil {
+		return errors.New("the provider advertises no keys endpoint")
+	}
+	resp, err := r.idpClient.Get(r.idp.KeysEndpoint.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from the keys endpoint", resp.StatusCode)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return r.keySetCache.save(content)
+}
+
+// verifyWithCachedKeys verifies the token against the keys persisted to disk, when the client cannot fetch the
+// keys of the provider
+func (r *oauthProxy) verifyWithCachedKeys(token jose.JWT) error {
+	keys := r.keySetCache.get()
+	if len(keys) == 0 || r.idp.Issuer == nil {
+		return errors.New("no cached keys of the provider")
+	}
+	verifier := oidc.NewJWTVerifier(r.idp.Issuer.String(), r.config.ClientID,
+		func() error { return errors.New("the cached keys are not synced") },
+		func() []key.PublicKey { return keys })
+
+	return verifier.Verify(token)
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestKeySetCache(t *testing.T) {
+	auth := newFakeAuthServer()
+	defer auth.Close()
+	dir, err := ioutil.TempDir("", "jwks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+
+	issuer, _ := url.Parse(auth.getLocation())
+	keys, _ := url.Parse(auth.getLocation() + "/protocol/openid-connect/certs")
+	svc := &oauthProxy{
+		config:      newFakeKeycloakConfig(),
+		log:         zap.NewNop(),
+		idpClient:   http.DefaultClient,
+		keySetCache: newKeySetCache(path),
+	}
+	svc.idp.Issuer, svc.idp.KeysEndpoint = issuer, keys
+	require.NoError(t, svc.refreshKeySetCache())
+	assert.Len(t, svc.keySetCache.get(), 1)
+
+	// the sync records the provider is reachable, and ends with the service
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		svc.syncKeySetCache(stop)
+		close(done)
+	}()
+	close(stop)
+	<-done
+	assert.True(t, svc.keySetCache.isSynced())
+
+	// a corrupted key set does not replace the persisted one
+	assert.Error(t, svc.keySetCache.save([]byte(`{"keys":[]}`)))
+
+	// the next run loads the keys and verifies the tokens with them
+	svc.keySetCache = newKeySetCache(path)
+	require.NoError(t, svc.keySetCache.load())
+	token, err := auth.signToken(newTestToken(auth.getLocation()).claims)
+	require.NoError(t, err)
+	assert.NoError(t, svc.verifyWithCachedKeys(*token))
+
+	token, err = auth.signToken(newTestToken("http://another.example.com").claims)
+	require.NoError(t, err)
+	assert.Error(t, svc.verifyWithCachedKeys(*token))
+
+	assert.Error(t, newKeySetCache(filepath.Join(dir, "missing.json")).load())
+}
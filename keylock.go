@@ -0,0 +1,59 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+)
+
+// keyedLocks serializes the work on the same key within the process, e.g. the updates of the sessions of a user.
+// The zero value is ready to use.
+type keyedLocks struct {
+	sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	holders int
+}
+
+// lock waits for the lock of the key, and returns the function releasing it
+func (l *keyedLocks) lock(key string) func() {
+	l.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*keyedLock)
+	}
+	k, found := l.locks[key]
+	if !found {
+		k = &keyedLock{}
+		l.locks[key] = k
+	}
+	k.holders++
+	l.Unlock()
+
+	k.Lock()
+
+	return func() {
+		k.Unlock()
+		l.Lock()
+		defer l.Unlock()
+		// @step: the locks no one holds or waits for are forgotten
+		if k.holders--; k.holders == 0 {
+			delete(l.locks, key)
+		}
+	}
+}
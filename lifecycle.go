@@ -0,0 +1,83 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// the events of the startup and shutdown of the service
+const (
+	lifecycleConfigLoaded     = "config_loaded"
+	lifecycleDiscoveryFetched = "discovery_fetched"
+	lifecycleStoreConnected   = "store_connected"
+	lifecycleListenerStarted  = "listener_started"
+	lifecycleShutdownStarted  = "shutdown_started"
+	lifecycleDrained          = "drained"
+	lifecycleStoreClosed      = "store_closed"
+)
+
+// lifecycleEvent logs a step of the startup or shutdown of the service, if enabled. All the events share the same
+// message, the step being named by the lifecycle field and its outcome by the success one.
+func (r *oauthProxy) lifecycleEvent(event string, err error, fields ...zap.Field) {
+	if !r.config.EnableLifecycleLogs {
+		return
+	}
+	fields = append([]zap.Field{zap.String("lifecycle", event), zap.Bool("success", err == nil)}, fields...)
+	if err != nil {
+		r.log.Error("lifecycle event", append(fields, zap.Error(err))...)
+		return
+	}
+	r.log.Info("lifecycle event", fields...)
+}
+
+// countInFlight keeps count of the requests being served, reported when the service drains
+func (r *oauthProxy) countInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&r.inFlight, 1)
+		defer atomic.AddInt32(&r.inFlight, -1)
+		next.ServeHTTP(w, req)
+	})
+}
+
+// listenerFields describes a listener of the service, with the address it is actually bound to
+func listenerFields(name string, config listenerConfig, listener net.Listener) []zap.Field {
+	fields := []zap.Field{
+		zap.String("listener", name),
+		zap.String("interface", config.listen),
+		zap.Bool("tls", config.useFileTLS || config.useLetsEncryptTLS || config.useSelfSignedTLS),
+	}
+	if listener != nil {
+		fields = append(fields, zap.String("address", listener.Addr().String()))
+	}
+
+	return fields
+}
+
+// storeKind returns the scheme of the store url, the rest of which may hold credentials
+func storeKind(location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return ""
+	}
+
+	return u.Scheme
+}
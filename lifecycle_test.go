@@ -0,0 +1,126 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// lifecycleEvents returns the fields of the lifecycle events logged, by event
+func lifecycleEvents(logs *observer.ObservedLogs) map[string]map[string]interface{} {
+	events := make(map[string]map[string]interface{})
+	for _, entry := range logs.FilterMessage("lifecycle event").All() {
+		fields := entry.ContextMap()
+		if event, ok := fields["lifecycle"].(string); ok {
+			events[event] = fields
+		}
+	}
+
+	return events
+}
+
+func TestLifecycleListenerEvents(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	cfg := newFakeKeycloakConfig()
+	cfg.Listen = "127.0.0.1:0"
+	cfg.ListenHTTP = ""
+	cfg.EnableLifecycleLogs = true
+	p := &oauthProxy{config: cfg, log: zap.New(core), router: http.NotFoundHandler()}
+	require.NoError(t, p.Run())
+	require.NoError(t, p.Shutdown())
+
+	events := lifecycleEvents(logs)
+	started, found := events[lifecycleListenerStarted]
+	require.True(t, found)
+	assert.Equal(t, true, started["success"])
+	assert.Equal(t, "main", started["listener"])
+	assert.Equal(t, false, started["tls"])
+	assert.Equal(t, p.listener.Addr().String(), started["address"])
+	assert.Contains(t, events, lifecycleDrained)
+	// without a store, there is no store to close
+	assert.NotContains(t, events, lifecycleStoreClosed)
+
+	// the events are not logged unless enabled
+	core, logs = observer.New(zap.InfoLevel)
+	cfg.EnableLifecycleLogs = false
+	p = &oauthProxy{config: cfg, log: zap.New(core), router: http.NotFoundHandler()}
+	require.NoError(t, p.Run())
+	require.NoError(t, p.Shutdown())
+	assert.Empty(t, lifecycleEvents(logs))
+}
+
+func TestLifecycleShutdownEvents(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "keycloak-gatekeeper")
+	require.NoError(t, err)
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	started, release := make(chan struct{}), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		_, _ = w.Write([]byte("the slow response"))
+	}))
+	defer upstream.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.Upstream = upstream.URL
+	cfg.StoreURL = "boltdb:///" + tmpfile.Name()
+	cfg.EnableLifecycleLogs = true
+	cfg.ShutdownGracePeriod = 5 * time.Second
+	cfg.Resources = []*Resource{{URL: "/slow", Methods: allHTTPMethods, WhiteListed: true}}
+	p := newFakeProxy(cfg)
+	defer p.idp.Close()
+	require.NoError(t, p.proxy.createStdProxy(nil))
+	core, logs := observer.New(zap.InfoLevel)
+	p.proxy.log = zap.New(core)
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(p.getServiceURL() + "/slow")
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		done <- err
+	}()
+	<-started
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- p.proxy.Shutdown() }()
+	require.Eventually(t, func() bool {
+		_, found := lifecycleEvents(logs)[lifecycleShutdownStarted]
+		return found
+	}, time.Second, 10*time.Millisecond)
+	close(release)
+	require.NoError(t, <-done)
+	require.NoError(t, <-stopped)
+
+	events := lifecycleEvents(logs)
+	assert.Equal(t, int64(1), events[lifecycleShutdownStarted]["in_flight"])
+	assert.Equal(t, true, events[lifecycleDrained]["success"])
+	assert.Equal(t, int64(0), events[lifecycleDrained]["in_flight"])
+	assert.Equal(t, true, events[lifecycleStoreClosed]["success"])
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"path"
+
+	"go.uber.org/zap"
+)
+
+// lockdownState restricts the service to an allowlist of client addresses, e.g. during an incident
+type lockdownState struct {
+	enabled bool
+	allowed []*net.IPNet
+}
+
+// setLockdown applies the lockdown settings, which may change while the service is running
+func (r *oauthProxy) setLockdown(enabled bool, allowlist []string) error {
+	allowed, err := parseNetworks("lockdown allowlist", allowlist)
+	if err != nil {
+		return err
+	}
+	r.lockdown.Store(&lockdownState{enabled: enabled, allowed: allowed})
+
+	return nil
+}
+
+// reloadLockdown reads the lockdown settings from the configuration file again, the other settings are left untouched
+func (r *oauthProxy) reloadLockdown(configFile string) error {
+	if configFile == "" {
+		return errors.New("the lockdown settings can only be reloaded from a configuration file")
+	}
+	config := newDefaultConfig()
+	if err := readConfigFile(configFile, config); err != nil {
+		return err
+	}
+	if err := r.setLockdown(config.EnableLockdown, config.LockdownAllowlist); err != nil {
+		return err
+	}
+	r.log.Warn("reloaded the lockdown settings",
+		zap.Bool("lockdown", config.EnableLockdown),
+		zap.Strings("allowlist", config.LockdownAllowlist))
+
+	return nil
+}
+
+// lockdownMiddleware refuses the requests of the clients outside of the allowlist while the lockdown is enabled,
+// before any authentication. The health endpoint remains available to the load balancers.
+func (r *oauthProxy) lockdownMiddleware(next http.Handler) http.Handler {
+	health := path.Clean(r.config.WithOAuthURI(healthURL))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		state, _ := r.lockdown.Load().(*lockdownState)
+		if state == nil || !state.enabled || req.URL.Path == health {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if clientIP := realIP(req, r.trustedProxies); !isTrustedProxy(clientIP, state.allowed) {
+			r.serviceUnavailable(w, req, "the service is locked down for maintenance", nil)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
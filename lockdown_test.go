@@ -0,0 +1,78 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	resty "gopkg.in/resty.v1"
+)
+
+func TestLockdown(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableLockdown = true
+	cfg.LockdownAllowlist = []string{"10.0.0.0/8"}
+	cfg.UnavailableRetryAfter = time.Minute
+	cfg.Resources = []*Resource{{URL: "/public/*", Methods: allHTTPMethods, WhiteListed: true}}
+	p := newFakeProxy(cfg)
+
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:          "/public/file",
+			ExpectedCode: http.StatusServiceUnavailable,
+			OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+				assert.NotEmpty(t, resp.Header().Get(headerRetryAfter), "the clients should be told when to retry")
+			},
+		},
+		{URI: cfg.WithOAuthURI(healthURL), ExpectedCode: http.StatusOK},
+		{
+			// no proxy is trusted, a forged address is not let through
+			URI:          "/public/file",
+			Headers:      map[string]string{headerXForwardedFor: "10.0.0.1", headerXRealIP: "10.0.0.1"},
+			ExpectedCode: http.StatusServiceUnavailable,
+		},
+	})
+
+	p = newFakeProxy(cfg)
+	require.NoError(t, p.proxy.setLockdown(true, []string{"10.0.0.0/8", "127.0.0.1"}))
+	p.RunTests(t, []fakeRequest{
+		{URI: "/public/file", ExpectedCode: http.StatusOK, ExpectedProxy: true},
+	})
+
+	// the lockdown is lifted by reloading the configuration file
+	file, err := ioutil.TempFile("", "gatekeeper-*.yml")
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(file.Name()) }()
+	_, err = file.WriteString("enable-lockdown: false\nlockdown-allowlist:\n  - 10.0.0.0/8\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	p = newFakeProxy(cfg)
+	require.NoError(t, p.proxy.setLockdown(true, nil))
+	require.NoError(t, p.proxy.reloadLockdown(file.Name()))
+	p.RunTests(t, []fakeRequest{
+		{URI: "/public/file", ExpectedCode: http.StatusOK, ExpectedProxy: true},
+	})
+
+	assert.Error(t, p.proxy.reloadLockdown(""))
+	assert.Error(t, p.proxy.setLockdown(true, []string{"not_an_ip"}))
+}
@@ -3,12 +3,19 @@ package main
 import (
 	"net"
 	"net/http"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
+	auditEventsDroppedMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "proxy_audit_events_dropped_total",
+			Help: "The total amount of access decisions dropped by the audit webhook, for a full queue or failed posts",
+		},
+	)
 	certificateRotationMetric = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "proxy_certificate_rotation_total",
@@ -35,6 +42,37 @@ var (
 			Help: "A summary of the http request latency for proxy requests (seconds)",
 		},
 	)
+	upstreamLatencyMetric = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name: "proxy_upstream_duration_seconds",
+			Help: "A summary of the round-trip time of the requests to the upstream, until the response headers (seconds)",
+		},
+		[]string{"resource"},
+	)
+	upstreamRetriesMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "proxy_upstream_retries_total",
+			Help: "The total amount of requests sent again to the upstream after a connection error or a retried status",
+		},
+	)
+	storeHealthyMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "proxy_store_healthy",
+			Help: "Whether the last probe of the store succeeded (1) or not (0)",
+		},
+	)
+	suspiciousPathsMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "proxy_suspicious_paths_total",
+			Help: "The total amount of requests rejected for a suspicious encoded path",
+		},
+	)
+	refreshRateExceededMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "proxy_refresh_rate_exceeded_total",
+			Help: "The total amount of sessions invalidated for an abnormal refresh rate",
+		},
+	)
 	statusMetric = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "proxy_request_status_total",
@@ -42,14 +80,67 @@ var (
 		},
 		[]string{"code", "method"},
 	)
+	claimRequestsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_claim_requests_total",
+			Help: "The admitted requests partitioned by the value of the metrics claim",
+		},
+		[]string{"claim", "value"},
+	)
 )
 
 func init() {
+	prometheus.MustRegister(auditEventsDroppedMetric)
 	prometheus.MustRegister(certificateRotationMetric)
+	prometheus.MustRegister(claimRequestsMetric)
 	prometheus.MustRegister(latencyMetric)
 	prometheus.MustRegister(oauthLatencyMetric)
 	prometheus.MustRegister(oauthTokensMetric)
+	prometheus.MustRegister(refreshRateExceededMetric)
 	prometheus.MustRegister(statusMetric)
+	prometheus.MustRegister(storeHealthyMetric)
+	prometheus.MustRegister(suspiciousPathsMetric)
+	prometheus.MustRegister(upstreamLatencyMetric)
+	prometheus.MustRegister(upstreamRetriesMetric)
+}
+
+// labelLimiter caps the distinct values of a metric label, to keep a claim of an unexpected
+// cardinality from creating a series per user
+type labelLimiter struct {
+	sync.Mutex
+	max    int
+	values map[string]struct{}
+}
+
+func newLabelLimiter(max int) *labelLimiter {
+	return &labelLimiter{max: max, values: make(map[string]struct{})}
+}
+
+// label returns the value when already seen or while under the cap, the overflow label otherwise
+func (l *labelLimiter) label(value string) string {
+	l.Lock()
+	defer l.Unlock()
+	if _, found := l.values[value]; found {
+		return value
+	}
+	if len(l.values) >= l.max {
+		return metricLabelOverflow
+	}
+	l.values[value] = struct{}{}
+
+	return value
+}
+
+// countClaimRequest counts an admitted request by the value of the metrics claim, when the token has it
+func (r *oauthProxy) countClaimRequest(user *userContext) {
+	if r.claimMetricValues == nil {
+		return
+	}
+	value, found, err := user.claims.StringClaim(r.config.MetricsClaim)
+	if err != nil || !found {
+		return
+	}
+	claimRequestsMetric.WithLabelValues(r.config.MetricsClaim, r.claimMetricValues.label(value)).Inc()
 }
 
 func (r *oauthProxy) metricsHandler() http.Handler {
@@ -66,7 +157,7 @@ func (r *oauthProxy) proxyMetricsHandler(w http.ResponseWriter, req *http.Reques
 	}
 	if r.config.LocalhostMetrics {
 		// option to only give access to a localhost metrics collection agent
-		if !net.ParseIP(realIP(req)).IsLoopback() {
+		if !net.ParseIP(realIP(req, r.trustedProxies)).IsLoopback() {
 			r.accessForbidden(w, req)
 			return
 		}
@@ -2,13 +2,19 @@ package main
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+	resty "gopkg.in/resty.v1"
 )
 
 func TestMetricsMiddleware(t *testing.T) {
 	cfg := newFakeKeycloakConfig()
 	cfg.EnableMetrics = true
 	cfg.LocalhostMetrics = true
+	cfg.TrustedProxies = []string{"127.0.0.1"}
 	requests := []fakeRequest{
 		{
 			URI:                     cfg.WithOAuthURI(metricsURL),
@@ -16,6 +22,7 @@ func TestMetricsMiddleware(t *testing.T) {
 			ExpectedContentContains: "proxy_request_status_total",
 		},
 		{
+			// a remote client forwarded by the local proxy
 			URI: cfg.WithOAuthURI(metricsURL),
 			Headers: map[string]string{
 				"X-Forwarded-For": "10.0.0.1",
@@ -25,3 +32,72 @@ func TestMetricsMiddleware(t *testing.T) {
 	}
 	newFakeProxy(cfg).RunTests(t, requests)
 }
+
+func TestMetricsMiddlewareForgedAddress(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableMetrics = true
+	cfg.LocalhostMetrics = true
+	p := newFakeProxy(cfg).proxy
+
+	// a remote client claiming to be local, with no trusted proxy
+	req := newFakeHTTPRequest(http.MethodGet, cfg.WithOAuthURI(metricsURL))
+	req.RemoteAddr = "192.168.0.1:1234"
+	req.Header.Set(headerXForwardedFor, "127.0.0.1")
+	req.Header.Set(headerXRealIP, "127.0.0.1")
+	resp := httptest.NewRecorder()
+	p.proxyMetricsHandler(resp, req)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
+
+func TestMetricsMiddlewareTrustedProxies(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableMetrics = true
+	cfg.LocalhostMetrics = true
+	cfg.TrustedProxies = []string{"10.0.0.0/8"}
+	requests := []fakeRequest{
+		{
+			// the local peer is not a trusted proxy: the forwarded address cannot be relied upon
+			URI: cfg.WithOAuthURI(metricsURL),
+			Headers: map[string]string{
+				"X-Forwarded-For": "10.0.0.1",
+			},
+			ExpectedCode:            http.StatusOK,
+			ExpectedContentContains: "proxy_request_status_total",
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestLabelLimiter(t *testing.T) {
+	l := newLabelLimiter(2)
+	assert.Equal(t, "acme", l.label("acme"))
+	assert.Equal(t, "globex", l.label("globex"))
+	assert.Equal(t, metricLabelOverflow, l.label("initech"))
+	assert.Equal(t, "acme", l.label("acme"))
+}
+
+func TestClaimRequestsMetric(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableMetrics = true
+	cfg.MetricsClaim = "tenant"
+	cfg.MetricsClaimMaxValues = 2
+	cfg.Resources = []*Resource{{URL: "/admin", Methods: allHTTPMethods}}
+	requests := []fakeRequest{
+		{URI: "/admin", HasToken: true, TokenClaims: jose.Claims{"tenant": "acme"}, ExpectedProxy: true, ExpectedCode: http.StatusOK},
+		{URI: "/admin", HasToken: true, TokenClaims: jose.Claims{"tenant": "globex"}, ExpectedProxy: true, ExpectedCode: http.StatusOK},
+		{URI: "/admin", HasToken: true, TokenClaims: jose.Claims{"tenant": "initech"}, ExpectedProxy: true, ExpectedCode: http.StatusOK},
+		{URI: "/admin", HasToken: true, ExpectedProxy: true, ExpectedCode: http.StatusOK},
+		{
+			URI:          cfg.WithOAuthURI(metricsURL),
+			ExpectedCode: http.StatusOK,
+			OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+				content := resp.String()
+				assert.Contains(t, content, `proxy_claim_requests_total{claim="tenant",value="acme"}`)
+				assert.Contains(t, content, `proxy_claim_requests_total{claim="tenant",value="globex"}`)
+				assert.Contains(t, content, `proxy_claim_requests_total{claim="tenant",value="other"}`)
+				assert.NotContains(t, content, `value="initech"`)
+			},
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
@@ -17,10 +17,16 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	sha "crypto/sha256"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/PuerkitoBio/purell"
@@ -41,6 +47,7 @@ const (
 func entrypointMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		keep := req.URL.Path
+		rawQuery := req.URL.RawQuery
 		purell.NormalizeURL(req.URL, normalizeFlags)
 
 		// ensure we have a slash in the url
@@ -51,19 +58,71 @@ func entrypointMiddleware(next http.Handler) http.Handler {
 		req.URL.RawPath = req.URL.Path
 
 		// @step: create a context for the request
-		scope := &RequestScope{}
+		scope := &RequestScope{RawQuery: rawQuery}
 		resp := middleware.NewWrapResponseWriter(w, 1)
 		start := time.Now()
+		defer func() {
+			// @metric record the time taken then response code. Requests abandoned by the client
+			// (possibly while streaming the response) are accounted for separately.
+			status := resp.Status()
+			if isClientCancelled(req) {
+				status = statusClientClosedRequest
+			}
+			latencyMetric.Observe(time.Since(start).Seconds())
+			statusMetric.WithLabelValues(fmt.Sprintf("%d", status), req.Method).Inc()
+
+			// place back the original uri for proxying request
+			req.URL.Path = keep
+			req.URL.RawPath = keep
+			req.RequestURI = keep
+		}()
 		next.ServeHTTP(resp, req.WithContext(context.WithValue(req.Context(), contextScopeName, scope)))
+	})
+}
+
+// suspiciousPathMiddleware rejects the requests with suspicious encoded characters in their raw path, before
+// these are normalized
+func (r *oauthProxy) suspiciousPathMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if encoding := findSuspiciousEncoding(req.URL.EscapedPath(), r.config.SuspiciousPathsAllowlist); encoding != "" {
+			// @metric a request has been rejected for a suspicious path
+			suspiciousPathsMetric.Inc()
+
+			r.errorResponse(w, req, "suspicious encoded path", http.StatusBadRequest,
+				fmt.Errorf("found %s in the path %s requested by %s", encoding, req.URL.EscapedPath(), realIP(req, r.trustedProxies)))
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// duplicateHeadersMiddleware canonicalizes the Authorization and Cookie headers sent several times by the client,
+// keeping either the first or last one, or rejects the request, so the token found is always the same
+func (r *oauthProxy) duplicateHeadersMiddleware(next http.Handler) http.Handler {
+	if r.config.DuplicateHeaderPolicy == "" {
+		return next
+	}
 
-		// @metric record the time taken then response code
-		latencyMetric.Observe(time.Since(start).Seconds())
-		statusMetric.WithLabelValues(fmt.Sprintf("%d", resp.Status()), req.Method).Inc()
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, name := range []string{authorizationHeader, "Cookie"} {
+			values := req.Header.Values(name)
+			if len(values) < 2 {
+				continue
+			}
+			switch r.config.DuplicateHeaderPolicy {
+			case duplicateHeaderPolicyFirst:
+				req.Header.Set(name, values[0])
+			case duplicateHeaderPolicyLast:
+				req.Header.Set(name, values[len(values)-1])
+			default:
+				r.errorResponse(w, req, fmt.Sprintf("the %s header must not be sent more than once", name), http.StatusBadRequest,
+					fmt.Errorf("found %d %s headers in the request from %s", len(values), name, realIP(req, r.trustedProxies)))
+				return
+			}
+		}
 
-		// place back the original uri for proxying request
-		req.URL.Path = keep
-		req.URL.RawPath = keep
-		req.RequestURI = keep
+		next.ServeHTTP(w, req)
 	})
 }
 
@@ -94,15 +153,24 @@ func (r *oauthProxy) loggingMiddleware(next http.Handler) http.Handler {
 			panic("middleware does not implement go-chi.middleware.WrapResponseWriter")
 		}
 		next.ServeHTTP(resp, req.WithContext(ctx))
-		addr := req.RemoteAddr
-		logger.Info("client request",
+		addr := realIP(req, r.trustedProxies)
+		var accessLog Stdlog = logger
+		if r.accessLog != nil {
+			accessLog = r.accessLog
+		}
+		fields := []zap.Field{
 			zap.Duration("latency", time.Since(start)),
 			zap.Int("status", resp.Status()),
 			zap.Int("bytes", resp.BytesWritten()),
 			zap.String("client_ip", addr),
 			zap.String("method", req.Method),
 			zap.String("path", req.URL.Path),
-			zap.String("protocol", req.Proto))
+			zap.String("protocol", req.Proto),
+		}
+		if scope, ok := ctx.Value(contextScopeName).(*RequestScope); ok && scope.MatchedResource != nil {
+			fields = append(fields, zap.String("resource", scope.MatchedResource.getName()))
+		}
+		accessLog.Info("client request", fields...)
 	})
 }
 
@@ -115,16 +183,53 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 				defer span.End()
 			}
 
-			clientIP := req.RemoteAddr
+			clientIP := realIP(req, r.trustedProxies)
+
+			// step: the identity has already been asserted by a trusted proxy
+			if scope, ok := ctx.Value(contextScopeName).(*RequestScope); ok && scope.Identity != nil && scope.Identity.isTrusted() {
+				next.ServeHTTP(w, req.WithContext(ctx))
+				return
+			}
 
 			// grab the user identity from the request
 			user, err := r.getIdentity(req.WithContext(ctx))
 			if err != nil {
-				logger.Warn("no session found in request, redirecting for authorization", zap.Error(err))
+				anonymous := allowsAnonymous(ctx)
+				switch {
+				case errors.Is(err, ErrMalformedSessionCookie):
+					// step: clear the cookies, so the browser does not loop through the authorization with them
+					logger.Warn("malformed session cookie found in request, clearing the cookies",
+						zap.String("client_ip", clientIP),
+						zap.Error(err))
+					r.clearAllCookies(req.WithContext(ctx), w)
+				case anonymous:
+					logger.Debug("no session found in request, serving the resource anonymously", zap.Error(err))
+				default:
+					logger.Warn("no session found in request, redirecting for authorization", zap.Error(err))
+				}
+				if anonymous {
+					// step: the resource is served with no identity, nor any credentials passed on
+					r.stripIdentity(req)
+					next.ServeHTTP(w, req.WithContext(ctx))
+					return
+				}
 				next.ServeHTTP(w, req.WithContext(r.redirectToAuthorization(w, req.WithContext(ctx))))
 				return
 			}
 
+			// step: a browser session presented by another client than the one it was bound to must be renewed
+			if r.bindsSessions() && !user.bearerToken {
+				if err := r.checkSessionBinding(req, user); err != nil {
+					logger.Warn("the session is not bound to this client, clearing the cookies",
+						zap.String("client_ip", clientIP),
+						zap.String("email", user.email),
+						zap.Error(err))
+					r.clearAllCookies(req.WithContext(ctx), w)
+					next.ServeHTTP(w, req.WithContext(r.redirectToAuthorization(w, req.WithContext(ctx))))
+					return
+				}
+			}
+
 			// create the request scope
 			scope, ok := req.Context().Value(contextScopeName).(*RequestScope)
 			if !ok {
@@ -149,15 +254,30 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 				return
 			}
 
-			if err := r.verifyToken(r.client, user.token); err != nil {
+			if err := r.verifyIdentity(user); err != nil {
 				// step: if the error post verification is anything other than a token
 				// expired error we immediately throw an access forbidden - as there is
 				// something messed up in the token
-				if err != ErrAccessTokenExpired {
+				switch err {
+				case ErrAccessTokenExpired:
+					// the token may be refreshed below
+				case ErrAccessTokenNotYetValid:
+					logger.Warn("access token is not yet valid",
+						zap.String("client_ip", clientIP),
+						zap.Error(err))
+					// @metric a token has been rejected as used too early
+					oauthTokensMetric.WithLabelValues("not_yet_valid").Inc()
+
+					r.audit(req.WithContext(ctx), auditDecisionDeny, auditReasonNotYetValid)
+					next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
+					return
+				default:
 					logger.Warn("access token failed verification",
 						zap.String("client_ip", clientIP),
 						zap.Error(err))
 
+					scope.DenyReason = &DenyReason{Reason: denyReasonInvalidToken}
+					r.audit(req.WithContext(ctx), auditDecisionDeny, auditReasonInvalidToken)
 					next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
 					return
 				}
@@ -182,6 +302,15 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 					switch err {
 					case ErrEncode, ErrEncryption:
 						r.errorResponse(w, req, err.Error(), http.StatusInternalServerError, err)
+					case ErrRefreshTokenInvalidGrant:
+						// step: a browser which just came back from the provider with a session rejected
+						// once again is not redirected straight away, which would loop
+						if r.inRefreshCooldown(req) {
+							r.errorResponse(w, req.WithContext(ctx), "refresh token rejected again during the cooldown", http.StatusUnauthorized, nil)
+							return
+						}
+						r.dropRefreshCooldownCookie(req, w)
+						next.ServeHTTP(w, req.WithContext(r.redirectToAuthorization(w, req.WithContext(ctx))))
 					default:
 						next.ServeHTTP(w, req.WithContext(r.redirectToAuthorization(w, req.WithContext(ctx))))
 					}
@@ -191,18 +320,31 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 				ctx = context.WithValue(ctx, contextScopeName, scope)
 			}
 
+			// step: complete the claims of the user for admission
+			if r.config.EnableUserinfoMerge {
+				merged, err := r.mergeUserinfo(ctx, scope.Identity)
+				if err != nil {
+					logger.Warn("unable to merge the userinfo of the user",
+						zap.String("client_ip", clientIP),
+						zap.String("email", user.email),
+						zap.Error(err))
+				} else {
+					scope.Identity = merged
+				}
+			}
+
 			next.ServeHTTP(w, req.WithContext(ctx))
 		})
 	}
 }
 
 // checkClaim checks whether claim in userContext matches claimName, match. It can be String or Strings claim.
-func (r *oauthProxy) checkClaim(user *userContext, claimName string, match *regexp.Regexp, resourceURL string) bool {
+func (r *oauthProxy) checkClaim(user *userContext, claimName string, match *regexp.Regexp, resourceName string) bool {
 	errFields := []zapcore.Field{
 		zap.String("claim", claimName),
 		zap.String("access", "denied"),
 		zap.String("email", user.email),
-		zap.String("resource", resourceURL),
+		zap.String("resource", resourceName),
 	}
 
 	if _, found := user.claims[claimName]; !found {
@@ -261,6 +403,10 @@ func (r *oauthProxy) admissionMiddleware(resource *Resource) func(http.Handler)
 	for k, v := range r.config.MatchClaims {
 		claimMatches[k] = regexp.MustCompile(v)
 	}
+	resourceClaimMatches := make(map[string]*regexp.Regexp)
+	for k, v := range resource.MatchClaims {
+		resourceClaimMatches[k] = regexp.MustCompile(v)
+	}
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -274,20 +420,41 @@ func (r *oauthProxy) admissionMiddleware(resource *Resource) func(http.Handler)
 			if !ok {
 				panic("corrupted context: expected *RequestScope")
 			}
-			if scope.AccessDenied {
+			if scope.AccessDenied || (scope.AllowAnonymous && scope.Identity == nil) {
 				next.ServeHTTP(w, req)
 				return
 			}
 			user := scope.Identity
 
+			// @step: a claim of an unexpected type hints at a misconfigured mapper of the provider
+			if r.config.StrictClaimTypes {
+				if err := checkClaimTypes(user.claims); err != nil {
+					logger.Warn("access denied, the claims of the token do not have the expected types",
+						zap.String("access", "denied"),
+						zap.String("email", user.email),
+						zap.String("resource", resource.getName()),
+						zap.Error(err))
+
+					r.audit(req.WithContext(ctx), auditDecisionDeny, denyReasonClaimTypes)
+					next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
+					return
+				}
+			}
+
 			// @step: we need to check the roles
-			if !hasAccess(resource.Roles, user.roles, !resource.RequireAnyRole, false) {
+			roles := user.roles
+			if r.config.EnableAMRRoles {
+				roles = append(user.getAuthMethodRoles(), roles...)
+			}
+			if !hasAccess(resource.Roles, roles, !resource.RequireAnyRole, false) {
 				logger.Warn("access denied, invalid roles",
 					zap.String("access", "denied"),
 					zap.String("email", user.email),
-					zap.String("resource", resource.URL),
+					zap.String("resource", resource.getName()),
 					zap.String("roles", resource.getRoles()))
 
+				scope.DenyReason = &DenyReason{Reason: denyReasonRoles, Roles: resource.Roles, RequireAnyRole: resource.RequireAnyRole}
+				r.audit(req.WithContext(ctx), auditDecisionDeny, scope.DenyReason.Reason)
 				next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
 				return
 			}
@@ -297,26 +464,121 @@ func (r *oauthProxy) admissionMiddleware(resource *Resource) func(http.Handler)
 				logger.Warn("access denied, invalid groups",
 					zap.String("access", "denied"),
 					zap.String("email", user.email),
-					zap.String("resource", resource.URL),
+					zap.String("resource", resource.getName()),
 					zap.String("groups", strings.Join(resource.Groups, ",")))
 
+				scope.DenyReason = &DenyReason{Reason: denyReasonGroups, Groups: resource.Groups}
+				r.audit(req.WithContext(ctx), auditDecisionDeny, scope.DenyReason.Reason)
 				next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
 				return
 			}
 
-			// step: if we have any claim matching, lets validate the tokens has the claims
-			for claimName, match := range claimMatches {
-				if !r.checkClaim(user, claimName, match, resource.URL) {
-					next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
+			// step: the required claims must be present and non-empty
+			if claimName, missing := missingClaim(user.claims, r.config.RequiredClaims); missing {
+				logger.Warn("access denied, a required claim is missing or empty",
+					zap.String("access", "denied"),
+					zap.String("email", user.email),
+					zap.String("resource", resource.getName()),
+					zap.String("claim", claimName))
+
+				scope.DenyReason = &DenyReason{Reason: denyReasonRequiredClaim, Claim: claimName}
+				r.audit(req.WithContext(ctx), auditDecisionDeny, scope.DenyReason.Reason)
+				next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
+				return
+			}
+
+			// step: if we have any claim matching, lets validate the tokens has the claims, both the global
+			// ones and those of the resource
+			for _, matches := range []map[string]*regexp.Regexp{claimMatches, resourceClaimMatches} {
+				for claimName, match := range matches {
+					if !r.checkClaim(user, claimName, match, resource.getName()) {
+						scope.DenyReason = &DenyReason{Reason: denyReasonClaim, Claim: claimName}
+						r.audit(req.WithContext(ctx), auditDecisionDeny, scope.DenyReason.Reason)
+						next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
+						return
+					}
+				}
+			}
+
+			// @step: sensitive methods may require the user to have recently authenticated
+			if resource.requiresStepUp(req.Method) && !user.isAuthenticatedWithin(resource.StepUpMaxAge) {
+				logger.Warn("access denied, authentication is too old for this method",
+					zap.String("access", "denied"),
+					zap.String("email", user.email),
+					zap.String("resource", resource.getName()),
+					zap.String("method", req.Method),
+					zap.Duration("max-age", resource.StepUpMaxAge))
+
+				r.audit(req.WithContext(ctx), auditDecisionDeny, auditReasonAuthenticationAge)
+				if user.isBearer() {
+					r.errorResponse(w, req.WithContext(ctx), "a recent authentication is required", http.StatusUnauthorized, nil)
+					next.ServeHTTP(w, req.WithContext(r.revokeProxy(w, req.WithContext(ctx))))
 					return
 				}
+				next.ServeHTTP(w, req.WithContext(r.redirectToAuthorizationWithPrompt(w, req.WithContext(ctx), promptLogin)))
+				return
 			}
 
 			logger.Debug("access permitted to resource",
 				zap.String("access", "permitted"),
 				zap.String("email", user.email),
 				zap.Duration("expires", time.Until(user.expiresAt)),
-				zap.String("resource", resource.URL))
+				zap.String("resource", resource.getName()))
+
+			r.audit(req.WithContext(ctx), auditDecisionPermit, auditReasonAuthorized)
+			r.countClaimRequest(user)
+			next.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
+
+// rateLimitMiddleware limits the requests to the resource of each user, or client address for anonymous requests,
+// with a bucket per method
+func (r *oauthProxy) rateLimitMiddleware(resource *Resource) func(http.Handler) http.Handler {
+	if len(resource.RateLimits) == 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	limiters := make(map[string]*rateLimiter, len(resource.RateLimits))
+	for m, limit := range resource.RateLimits {
+		limiters[m] = newRateLimiter(limit)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			limiter, found := limiters[req.Method]
+			if !found {
+				next.ServeHTTP(w, req)
+				return
+			}
+			ctx, span, logger := r.traceSpan(req.Context(), "rate limit middleware")
+			if span != nil {
+				defer span.End()
+			}
+
+			scope, ok := ctx.Value(contextScopeName).(*RequestScope)
+			if !ok {
+				panic("corrupted context: expected *RequestScope")
+			}
+			if scope.AccessDenied {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			key := "ip:" + realIP(req, r.trustedProxies)
+			if scope.Identity != nil {
+				key = "user:" + scope.Identity.id
+			}
+			if allowed, wait := limiter.allow(key, time.Now()); !allowed {
+				logger.Warn("rate limit exceeded",
+					zap.String("resource", resource.getName()),
+					zap.String("method", req.Method),
+					zap.String("client_ip", realIP(req, r.trustedProxies)))
+
+				w.Header().Set(headerRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				r.errorResponse(w, req.WithContext(ctx), "too many requests", http.StatusTooManyRequests, nil)
+				next.ServeHTTP(w, req.WithContext(r.revokeProxy(w, req.WithContext(ctx))))
+				return
+			}
 
 			next.ServeHTTP(w, req.WithContext(ctx))
 		})
@@ -337,33 +599,227 @@ func (r *oauthProxy) responseHeaderMiddleware(headers map[string]string) func(ht
 	}
 }
 
+// trustedIdentityMiddleware accepts the identity of the client asserted by a trusted proxy, e.g. a service mesh sidecar
+func (r *oauthProxy) trustedIdentityMiddleware() func(http.Handler) http.Handler {
+	if r.config.TrustedIdentityHeader == "" {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get(r.config.TrustedIdentityHeader) == "" {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			ctx, span, logger := r.traceSpan(req.Context(), "trusted identity middleware")
+			if span != nil {
+				defer span.End()
+			}
+
+			// step: an identity asserted by an untrusted peer is simply discarded
+			if !isTrustedProxy(req.RemoteAddr, r.trustedProxies) {
+				logger.Warn("ignoring identity header from untrusted peer",
+					zap.String("client_ip", req.RemoteAddr),
+					zap.String("header", r.config.TrustedIdentityHeader))
+				req.Header.Del(r.config.TrustedIdentityHeader)
+				next.ServeHTTP(w, req.WithContext(ctx))
+				return
+			}
+
+			user, found := r.getTrustedIdentity(req)
+			if !found {
+				next.ServeHTTP(w, req.WithContext(ctx))
+				return
+			}
+
+			scope, ok := ctx.Value(contextScopeName).(*RequestScope)
+			if !ok {
+				panic("corrupted context: expected *RequestScope")
+			}
+			scope.Identity = user
+			ctx = context.WithValue(ctx, contextScopeName, scope)
+
+			logger.Debug("accepting identity asserted by trusted proxy",
+				zap.String("client_ip", realIP(req, r.trustedProxies)),
+				zap.String("username", user.name))
+
+			next.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
+
+// certIdentityMiddleware authenticates the clients presenting a verified certificate to a cert-auth resource by the
+// certificate, e.g. machine clients with no openid session
+func (r *oauthProxy) certIdentityMiddleware(resource *Resource) func(http.Handler) http.Handler {
+	if !resource.CertAuth {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// step: only the certificates verified by the listener are trusted
+			if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			ctx, span, logger := r.traceSpan(req.Context(), "cert identity middleware")
+			if span != nil {
+				defer span.End()
+			}
+
+			scope, ok := ctx.Value(contextScopeName).(*RequestScope)
+			if !ok {
+				panic("corrupted context: expected *RequestScope")
+			}
+			if scope.Identity != nil {
+				next.ServeHTTP(w, req.WithContext(ctx))
+				return
+			}
+			user, found := r.getCertIdentity(req.TLS.VerifiedChains[0][0])
+			if !found {
+				next.ServeHTTP(w, req.WithContext(ctx))
+				return
+			}
+			scope.Identity = user
+			ctx = context.WithValue(ctx, contextScopeName, scope)
+
+			logger.Debug("accepting identity of the client certificate",
+				zap.String("client_ip", realIP(req, r.trustedProxies)),
+				zap.String("username", user.name),
+				zap.String("resource", resource.getName()))
+
+			next.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
+
+// anonymousResourceMiddleware marks the requests to a resource allowing anonymous access, which are let through
+// without a session rather than redirected for authorization
+func (r *oauthProxy) anonymousResourceMiddleware(resource *Resource) func(http.Handler) http.Handler {
+	if !resource.AllowAnonymous {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			scope, ok := req.Context().Value(contextScopeName).(*RequestScope)
+			if !ok {
+				panic("corrupted context: expected *RequestScope")
+			}
+			scope.AllowAnonymous = true
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// allowsAnonymous indicates the request is for a resource allowing anonymous access
+func allowsAnonymous(ctx context.Context) bool {
+	scope, ok := ctx.Value(contextScopeName).(*RequestScope)
+	return ok && scope.AllowAnonymous
+}
+
+// stripIdentity removes from an anonymous request whatever the upstream could take for an identity: the
+// identity headers supplied by the client, the authorization header and the session cookies
+func (r *oauthProxy) stripIdentity(req *http.Request) {
+	for name := range req.Header {
+		if strings.HasPrefix(name, identityHeaderPrefix) {
+			delete(req.Header, name)
+		}
+	}
+	req.Header.Del(authorizationHeader)
+	_ = filterCookies(req, []string{r.config.CookieAccessName, r.config.CookieRefreshName})
+}
+
 // identityHeadersMiddleware is responsible for adding the authentication headers to upstream
 func (r *oauthProxy) identityHeadersMiddleware(custom []string) func(http.Handler) http.Handler {
 	// config-driven request header setters
 	setters := make([]func(*http.Request, *userContext), 0, 20)
+	setHeader := makeHeaderSetter(r.config.IdentityHeadersCase)
+	if encoding := r.config.IdentityHeadersEncoding; encoding != "" {
+		setRawHeader := setHeader
+		setHeader = func(h http.Header, name string, values ...string) {
+			encoded := make([]string, len(values))
+			for i, value := range values {
+				encoded[i] = encodeHeaderValue(value, encoding)
+			}
+			setRawHeader(h, name, encoded...)
+		}
+	}
 
 	if r.config.EnableClaimsHeaders {
 		setters = append(setters, func(req *http.Request, user *userContext) {
-			req.Header.Set("X-Auth-Audience", strings.Join(user.audiences, ","))
-			req.Header.Set("X-Auth-Email", user.email)
-			req.Header.Set("X-Auth-ExpiresIn", user.expiresAt.String())
-			req.Header.Set("X-Auth-Groups", strings.Join(user.groups, ","))
-			req.Header.Set("X-Auth-Roles", strings.Join(user.roles, ","))
-			req.Header.Set("X-Auth-Subject", user.id)
-			req.Header.Set("X-Auth-Userid", user.name)
-			req.Header.Set("X-Auth-Username", user.name)
+			setHeader(req.Header, "X-Auth-Audience", strings.Join(user.audiences, ","))
+			setHeader(req.Header, "X-Auth-Email", user.email)
+			setHeader(req.Header, "X-Auth-ExpiresIn", user.expiresAt.String())
+			setHeader(req.Header, "X-Auth-Groups", strings.Join(user.groups, ","))
+			setHeader(req.Header, "X-Auth-Roles", strings.Join(user.roles, ","))
+			setHeader(req.Header, "X-Auth-Subject", user.id)
+			setHeader(req.Header, "X-Auth-Userid", user.name)
+			setHeader(req.Header, "X-Auth-Username", user.name)
+		})
+	}
+
+	if r.config.EnableAMRHeader {
+		setters = append(setters, func(req *http.Request, user *userContext) {
+			setHeader(req.Header, "X-Auth-AMR", strings.Join(user.authMethods, ","))
 		})
 	}
 
 	if r.config.EnableTokenHeader {
 		setters = append(setters, func(req *http.Request, user *userContext) {
-			req.Header.Set("X-Auth-Token", user.token.Encode())
+			if user.isTrusted() {
+				return
+			}
+			setHeader(req.Header, "X-Auth-Token", user.accessToken())
 		})
 	}
 
 	if r.config.EnableAuthorizationHeader {
+		var warnLargeToken sync.Once
 		setters = append(setters, func(req *http.Request, user *userContext) {
-			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.token.Encode()))
+			if user.isTrusted() {
+				return
+			}
+			token := user.accessToken()
+			value := fmt.Sprintf("Bearer %s", token)
+			limit := r.config.MaxAuthorizationHeaderSize
+			if limit > 0 {
+				// step: the parts are only ever set by us
+				for k := range req.Header {
+					if strings.HasPrefix(k, headerAuthTokenPart) {
+						delete(req.Header, k)
+					}
+				}
+			}
+			if limit > 0 && len(value) > limit {
+				// step: the upstream cannot take the header, split the token instead
+				req.Header.Del(authorizationHeader)
+				for i := 0; len(token) > 0; i++ {
+					chunk := token
+					if len(chunk) > limit {
+						chunk = token[:limit]
+					}
+					setHeader(req.Header, headerAuthTokenPart+strconv.Itoa(i+1), chunk)
+					token = token[len(chunk):]
+				}
+				return
+			}
+			if len(value) > commonHeaderSizeLimit {
+				warnLargeToken.Do(func() {
+					r.log.Warn("the authorization header exceeds the usual upstream header limits, consider setting max-authorization-header-size",
+						zap.Int("size", len(value)),
+						zap.Int("limit", commonHeaderSizeLimit))
+				})
+			}
+			setHeader(req.Header, authorizationHeader, value)
 		})
 	}
 
@@ -376,6 +832,24 @@ func (r *oauthProxy) identityHeadersMiddleware(custom []string) func(http.Handle
 		})
 	}
 
+	setClaimHeader := func(h http.Header, header string, value interface{}) {
+		// step: the arrays are serialized like the groups and roles, or as repeated headers
+		list, isArray := value.([]interface{})
+		if !isArray {
+			setHeader(h, header, formatClaimValue(value))
+			return
+		}
+		values := make([]string, len(list))
+		for i, x := range list {
+			values[i] = formatClaimValue(x)
+		}
+		if r.config.AddClaimsArrayFormat == claimArrayFormatRepeat && len(values) > 0 {
+			setHeader(h, header, values...)
+		} else {
+			setHeader(h, header, strings.Join(values, ","))
+		}
+	}
+
 	if r.config.EnableClaimsHeaders {
 		customClaims := make(map[string]string)
 		for _, x := range custom {
@@ -384,8 +858,20 @@ func (r *oauthProxy) identityHeadersMiddleware(custom []string) func(http.Handle
 		setters = append(setters, func(req *http.Request, user *userContext) {
 			// inject any custom claims
 			for claim, header := range customClaims {
-				if claim, found := user.claims[claim]; found {
-					req.Header.Set(header, fmt.Sprintf("%v", claim))
+				if value, found := user.claims[claim]; found {
+					setClaimHeader(req.Header, header, value)
+				}
+			}
+		})
+	}
+
+	if len(r.config.ClaimHeaderMap) > 0 {
+		setters = append(setters, func(req *http.Request, user *userContext) {
+			for claim, header := range r.config.ClaimHeaderMap {
+				// step: the upstream must not take a header sent by the client for the claim
+				req.Header.Del(header)
+				if value, found := user.claims[claim]; found {
+					setClaimHeader(req.Header, header, value)
 				}
 			}
 		})
@@ -412,12 +898,58 @@ func (r *oauthProxy) identityHeadersMiddleware(custom []string) func(http.Handle
 	}
 }
 
+var (
+	// sensitiveClaims bind the token to the session or the authorization request, and are never returned to the client
+	sensitiveClaims = []string{"at_hash", "c_hash", "jti", claimNonce, "s_hash", "session_state", claimSessionID}
+	// protectedResponseHeaders are set by the proxy, and are never overridden by the claims returned to the client
+	protectedResponseHeaders = []string{
+		"Set-Cookie",
+		"Location",
+		headerCSP,
+		headerXPolicy,
+		"Strict-Transport-Security",
+		headerXSTS,
+		headerXFrameOptions,
+		headerXContentTypeOptions,
+		headerXXSSProtection,
+	}
+)
+
+// clientClaimHeadersMiddleware returns claims of the user to the client in response headers
+func (r *oauthProxy) clientClaimHeadersMiddleware() func(http.Handler) http.Handler {
+	if len(r.config.ClientResponseClaimHeaders) == 0 {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			scope, ok := req.Context().Value(contextScopeName).(*RequestScope)
+			if !ok {
+				panic("corrupted context: expected *RequestScope")
+			}
+			if scope.Identity != nil {
+				for claim, header := range r.config.ClientResponseClaimHeaders {
+					value, found := scope.Identity.claims[claim]
+					if !found || w.Header().Get(header) != "" {
+						continue
+					}
+					w.Header().Set(header, fmt.Sprintf("%v", value))
+				}
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
 // securityMiddleware performs numerous security checks on the request
 func (r *oauthProxy) securityMiddleware(next http.Handler) http.Handler {
 	r.log.Info("enabling the security filter middleware",
 		zap.Strings("AllowedHosts", r.config.Hostnames),
 		zap.Bool("BrowserXssFilter", r.config.EnableBrowserXSSFilter),
 		zap.String("ContentSecurityPolicy", r.config.ContentSecurityPolicy),
+		zap.Bool("ContentSecurityPolicy with nonce", r.config.EnableCSPNonce),
 		zap.Bool("ContentTypeNosniff", r.config.EnableContentNoSniff),
 		zap.Bool("FrameDeny", r.config.EnableFrameDeny),
 		zap.Bool("StrictTransportSecurity", r.config.EnableSTS || r.config.EnableSTSPreload),
@@ -432,6 +964,10 @@ func (r *oauthProxy) securityMiddleware(next http.Handler) http.Handler {
 		SSLProxyHeaders:       map[string]string{"X-Forwarded-Proto": "https"},
 		SSLRedirect:           r.config.EnableHTTPSRedirect,
 	}
+	if r.config.EnableCSPNonce {
+		// the policy is set for each request, with its own nonce
+		opts.ContentSecurityPolicy = ""
+	}
 	if r.config.EnableSTS || r.config.EnableSTSPreload {
 		opts.STSSeconds = 31536000
 		opts.STSIncludeSubdomains = true
@@ -444,6 +980,16 @@ func (r *oauthProxy) securityMiddleware(next http.Handler) http.Handler {
 		if span != nil {
 			defer span.End()
 		}
+		if r.config.EnableCSPNonce {
+			nonce, err := newCSPNonce()
+			if err != nil {
+				r.errorResponse(w, req.WithContext(ctx), "failed to generate a content security policy nonce", http.StatusInternalServerError, err)
+				return
+			}
+			ctx = secure.WithCSPNonce(ctx, nonce)
+			req.Header.Set(headerCSPNonce, nonce)
+			w.Header().Set(headerCSP, strings.Replace(r.config.ContentSecurityPolicy, cspNoncePlaceholder, nonce, -1))
+		}
 		if err := secureFilter.Process(w, req.WithContext(ctx)); err != nil {
 			logger.Warn("failed security middleware", zap.Error(err))
 			next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
@@ -472,7 +1018,8 @@ func (r *oauthProxy) csrfConfigMiddleware() func(http.Handler) http.Handler {
 		// CSRF protection establishes a session scoped CSRF state with an encrypted cookie.
 		// Encryption algorithm is AES-256
 		r.log.Info("enabling CSRF protection")
-		return gcsrf.Protect([]byte(r.config.EncryptionKey),
+		partition := r.csrfPartitionMiddleware()
+		options := []gcsrf.Option{
 			gcsrf.CookieName(r.config.CSRFCookieName),
 			gcsrf.RequestHeader(r.config.CSRFHeader),
 			gcsrf.Domain(r.config.CookieDomain),
@@ -480,12 +1027,69 @@ func (r *oauthProxy) csrfConfigMiddleware() func(http.Handler) http.Handler {
 			gcsrf.HttpOnly(r.config.HTTPOnlyCookie),
 			gcsrf.Secure(r.config.SecureCookie),
 			gcsrf.Path("/"),
-			gcsrf.ErrorHandler(http.HandlerFunc(r.csrfErrorHandler)))
+			gcsrf.ErrorHandler(partition(http.HandlerFunc(r.csrfErrorHandler))),
+		}
+		protect := gcsrf.Protect([]byte(r.config.EncryptionKey), options...)
+
+		if claim := r.config.CSRFScopeClaim; claim != "" {
+			// step: the CSRF state is signed with a key derived from the claim of the user, so that the state of
+			// another session is not accepted. The requests with no such identity keep the unscoped state.
+			r.log.Info("the CSRF state is scoped to a claim of the user", zap.String("claim", claim))
+
+			return func(next http.Handler) http.Handler {
+				unscoped := protect(partition(next))
 
+				return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					key, ok := r.csrfScopedKey(req, claim)
+					if !ok {
+						unscoped.ServeHTTP(w, req)
+						return
+					}
+					gcsrf.Protect(key, options...)(partition(next)).ServeHTTP(w, req)
+				})
+			}
+		}
+
+		return func(next http.Handler) http.Handler {
+			return protect(partition(next))
+		}
 	}
 	return nil
 }
 
+// csrfScopedKey derives the key of the CSRF state from the value of the claim of the authenticated user
+func (r *oauthProxy) csrfScopedKey(req *http.Request, claim string) ([]byte, bool) {
+	scope, ok := req.Context().Value(contextScopeName).(*RequestScope)
+	if !ok || scope.Identity == nil {
+		return nil, false
+	}
+	value, found, err := scope.Identity.claims.StringClaim(claim)
+	if err != nil || !found || value == "" {
+		return nil, false
+	}
+	mac := hmac.New(sha.New, []byte(r.config.EncryptionKey))
+	_, _ = mac.Write([]byte(claim + "=" + value))
+
+	return mac.Sum(nil), true
+}
+
+// csrfPartitionMiddleware adds the Partitioned attribute to the CSRF cookie, which is set by gorilla/csrf
+// before handing over to the next handler
+func (r *oauthProxy) csrfPartitionMiddleware() func(http.Handler) http.Handler {
+	if !r.config.EnablePartitionedCookies {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			partitionCookies(w, r.config.CSRFCookieName)
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
 func (r *oauthProxy) csrfSkipMiddleware() func(next http.Handler) http.Handler {
 	// for proxy entrypoints: unconditionnaly skips CSRF check on unsafe methods (e.g. for login or profiling routes)
 	if r.config.EnableCSRF {
@@ -519,7 +1123,7 @@ func (r *oauthProxy) csrfSkipResourceMiddleware(resource *Resource) func(http.Ha
 			}
 		}
 
-		r.log.Info("CSRF check enabled for resource", zap.String("resource", resource.URL))
+		r.log.Info("CSRF check enabled for resource", zap.String("resource", resource.getName()))
 		return func(next http.Handler) http.Handler {
 			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 				scope, ok := req.Context().Value(contextScopeName).(*RequestScope)
@@ -586,6 +1190,11 @@ func (r *oauthProxy) csrfHeaderMiddleware() func(next http.Handler) http.Handler
 				// add CSRF header to all responses
 				w.Header().Add(r.config.CSRFHeader, csrfToken)
 
+				// seed the token in a cookie readable by scripts: the headers of a page load are not available to a SPA
+				if r.config.CSRFTokenCookie != "" && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+					r.dropReadableCookie(w, req, r.config.CSRFTokenCookie, csrfToken, 0)
+				}
+
 				next.ServeHTTP(w, req)
 			})
 		}
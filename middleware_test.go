@@ -16,12 +16,20 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -30,6 +38,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/rs/cors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 	resty "gopkg.in/resty.v1"
 )
@@ -307,7 +316,7 @@ func (f *fakeProxy) performUserLogin(uri string) error {
 	}()
 
 	for _, c := range resp.Cookies() {
-		if c.Name == f.config.CookieAccessName || c.Name == f.config.CookieRefreshName {
+		if c.Name == f.config.CookieAccessName || c.Name == f.config.CookieRefreshName || c.Name == sessionBindingCookie {
 			f.cookies[c.Name] = &http.Cookie{
 				Name:   c.Name,
 				Path:   "/",
@@ -504,6 +513,142 @@ func TestStrangeRoutingError(t *testing.T) {
 	newFakeProxy(cfg).RunTests(t, requests)
 }
 
+func TestRequiredClaims(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.RequiredClaims = []string{"tenant_id"}
+	cfg.DenialDetailsClients = []string{"first-party"}
+	cfg.Resources = []*Resource{{URL: "/admin*", Methods: allHTTPMethods}}
+	requests := []fakeRequest{
+		{
+			URI:           "/admin",
+			HasToken:      true,
+			TokenClaims:   jose.Claims{"tenant_id": "acme"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/admin",
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:                     "/admin",
+			HasToken:                true,
+			TokenClaims:             jose.Claims{claimAuthorizedParty: "first-party", "tenant_id": ""},
+			ExpectedCode:            http.StatusForbidden,
+			ExpectedContentContains: `"denial":{"reason":"required-claim","claim":"tenant_id"}`,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestDenialDetails(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.DenialDetailsClients = []string{"first-party"}
+	cfg.MatchClaims = map[string]string{"email": "^.*@example.com$"}
+	cfg.Resources = []*Resource{
+		{
+			URL:            "/admin/*",
+			Methods:        allHTTPMethods,
+			Roles:          []string{"admin", "auditor"},
+			RequireAnyRole: true,
+		},
+		{
+			URL:     "/teams/*",
+			Methods: allHTTPMethods,
+			Groups:  []string{"team"},
+		},
+	}
+	firstParty := jose.Claims{claimAuthorizedParty: "first-party"}
+	requests := []fakeRequest{
+		{
+			URI:                     "/admin/test",
+			HasToken:                true,
+			TokenClaims:             firstParty,
+			ExpectedCode:            http.StatusForbidden,
+			ExpectedContentContains: `"denial":{"reason":"roles","roles":["admin","auditor"],"require_any_role":true}`,
+		},
+		{
+			URI:                     "/teams/test",
+			HasToken:                true,
+			TokenClaims:             firstParty,
+			Roles:                   []string{"admin"},
+			ExpectedCode:            http.StatusForbidden,
+			ExpectedContentContains: `"denial":{"reason":"groups","groups":["team"]}`,
+		},
+		{
+			URI:                     "/admin/test",
+			HasToken:                true,
+			TokenClaims:             jose.Claims{claimAuthorizedParty: "first-party", "email": "gambol99@gmail.com"},
+			Roles:                   []string{"admin"},
+			ExpectedCode:            http.StatusForbidden,
+			ExpectedContentContains: `"denial":{"reason":"claim","claim":"email"}`,
+		},
+		{
+			// a token from another issuer fails its verification
+			URI:                     "/admin/test",
+			HasToken:                true,
+			TokenClaims:             jose.Claims{claimAuthorizedParty: "first-party", "iss": "http://example.com"},
+			Roles:                   []string{"admin"},
+			ExpectedCode:            http.StatusForbidden,
+			ExpectedContentContains: `"denial":{"reason":"invalid-token"}`,
+		},
+		{
+			// the other clients are not told about the policy
+			URI:          "/admin/test",
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+			OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+				assert.NotContains(t, string(resp.Body()), "denial")
+			},
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestResourceHeader(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableResourceHeader = true
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/admin/*",
+			Methods: allHTTPMethods,
+			Roles:   []string{"admin"},
+		},
+		{
+			URL:         "/public/*",
+			Methods:     allHTTPMethods,
+			WhiteListed: true,
+			Upstream:    "http://internal.example.com",
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:             "/admin/test",
+			HasToken:        true,
+			Roles:           []string{"admin"},
+			ExpectedCode:    http.StatusOK,
+			ExpectedProxy:   true,
+			ExpectedHeaders: map[string]string{headerGatekeeperResource: "/admin/*"},
+		},
+		{
+			// the denials tell the resource as well
+			URI:             "/admin/test",
+			HasToken:        true,
+			ExpectedCode:    http.StatusForbidden,
+			ExpectedHeaders: map[string]string{headerGatekeeperResource: "/admin/*"},
+		},
+		{
+			// the whitelisted resources are named by their url, not by their upstream
+			URI:             "/public/test",
+			ExpectedCode:    http.StatusOK,
+			ExpectedProxy:   true,
+			ExpectedHeaders: map[string]string{headerGatekeeperResource: "/public/*"},
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
 func TestNoProxyingRequests(t *testing.T) {
 	c := newFakeKeycloakConfig()
 	c.Resources = []*Resource{
@@ -733,206 +878,743 @@ func TestRequireAnyRoles(t *testing.T) {
 	newFakeProxy(cfg).RunTests(t, requests)
 }
 
-func TestGroupPermissionsMiddleware(t *testing.T) {
+func TestStepUpAuthentication(t *testing.T) {
 	cfg := newFakeKeycloakConfig()
 	cfg.Resources = []*Resource{
 		{
-			URL:     "/with_role_and_group*",
-			Methods: allHTTPMethods,
-			Groups:  []string{"admin"},
-			Roles:   []string{"admin"},
+			URL:           "/step_up/*",
+			Methods:       allHTTPMethods,
+			StepUpMaxAge:  time.Minute,
+			StepUpMethods: []string{http.MethodPost, http.MethodDelete},
 		},
+	}
+	staleAuth := jose.Claims{claimAuthTime: float64(time.Now().Add(-time.Hour).Unix())}
+	recentAuth := jose.Claims{claimAuthTime: float64(time.Now().Unix())}
+	requests := []fakeRequest{
 		{
-			URL:     "/with_group*",
-			Methods: allHTTPMethods,
-			Groups:  []string{"admin"},
+			URI:           "/step_up/test",
+			HasToken:      true,
+			TokenClaims:   staleAuth,
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
 		},
 		{
-			URL:     "/with_many_groups*",
-			Methods: allHTTPMethods,
-			Groups:  []string{"admin", "user", "tester"},
+			URI:           "/step_up/test",
+			Method:        http.MethodPost,
+			HasToken:      true,
+			TokenClaims:   recentAuth,
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
 		},
 		{
-			URL:     "/*",
-			Methods: allHTTPMethods,
-			Roles:   []string{"user"},
+			// the time of the authentication is unknown, the token may have been refreshed long after it
+			URI:          "/step_up/test",
+			Method:       http.MethodPost,
+			HasToken:     true,
+			ExpectedCode: http.StatusUnauthorized,
 		},
-	}
-	requests := []fakeRequest{
 		{
-			URI:          "/",
+			URI:          "/step_up/test",
+			Method:       http.MethodPost,
+			HasToken:     true,
+			TokenClaims:  staleAuth,
 			ExpectedCode: http.StatusUnauthorized,
 		},
 		{
-			URI:          "/with_role_and_group/test",
-			HasToken:     true,
-			Roles:        []string{"admin"},
-			ExpectedCode: http.StatusForbidden,
+			URI:              "/step_up/test",
+			Method:           http.MethodDelete,
+			HasToken:         true,
+			HasCookieToken:   true,
+			TokenClaims:      staleAuth,
+			Redirects:        true,
+			ExpectedCode:     http.StatusTemporaryRedirect,
+			ExpectedLocation: "prompt=login",
 		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestResourceRateLimits(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = []*Resource{
 		{
-			URI:          "/with_role_and_group/test",
-			HasToken:     true,
-			Groups:       []string{"admin"},
-			ExpectedCode: http.StatusForbidden,
+			URL:        "/limited/*",
+			Methods:    allHTTPMethods,
+			RateLimits: map[string]int{http.MethodGet: 2, http.MethodPost: 1},
 		},
+	}
+	retryAfter := func(_ int, _ *resty.Request, resp *resty.Response) {
+		assert.Equal(t, "1", resp.Header().Get(headerRetryAfter))
+	}
+	requests := []fakeRequest{
 		{
-			URI:           "/with_role_and_group/test",
+			URI:           "/limited/test",
+			Method:        http.MethodPost,
 			HasToken:      true,
-			Groups:        []string{"admin"},
-			Roles:         []string{"admin"},
-			ExpectedProxy: true,
 			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
 		},
 		{
-			URI:          "/with_group/hello",
-			HasToken:     true,
-			ExpectedCode: http.StatusForbidden,
-		},
-		{
-			URI:          "/with_groupdd",
-			HasToken:     true,
-			ExpectedCode: http.StatusForbidden,
-		},
-		{
-			URI:          "/with_group/hello",
+			URI:          "/limited/test",
+			Method:       http.MethodPost,
 			HasToken:     true,
-			Groups:       []string{"bad"},
-			ExpectedCode: http.StatusForbidden,
+			ExpectedCode: http.StatusTooManyRequests,
+			OnResponse:   retryAfter,
 		},
 		{
-			URI:           "/with_group/hello",
+			// the buckets of the methods are independent
+			URI:           "/limited/test",
 			HasToken:      true,
-			Groups:        []string{"admin"},
-			ExpectedProxy: true,
 			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
 		},
 		{
-			URI:           "/with_group/hello",
+			URI:           "/limited/test",
 			HasToken:      true,
-			Groups:        []string{"test", "admin"},
-			ExpectedProxy: true,
 			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
 		},
 		{
-			URI:          "/with_many_groups/test",
+			URI:          "/limited/test",
 			HasToken:     true,
-			Groups:       []string{"bad"},
-			ExpectedCode: http.StatusForbidden,
+			ExpectedCode: http.StatusTooManyRequests,
+			OnResponse:   retryAfter,
 		},
 		{
-			URI:           "/with_many_groups/test",
+			// the methods without a limit are not limited
+			URI:           "/limited/test",
+			Method:        http.MethodDelete,
 			HasToken:      true,
-			Groups:        []string{"user"},
-			Roles:         []string{"test"},
-			ExpectedProxy: true,
 			ExpectedCode:  http.StatusOK,
-		},
-		{
-			URI:           "/with_many_groups/test",
-			HasToken:      true,
-			Groups:        []string{"tester", "user"},
 			ExpectedProxy: true,
-			ExpectedCode:  http.StatusOK,
 		},
 		{
-			URI:           "/with_many_groups/test",
+			// so are the buckets of the users
+			URI:           "/limited/test",
+			Method:        http.MethodPost,
 			HasToken:      true,
-			Groups:        []string{"bad", "user"},
-			ExpectedProxy: true,
+			TokenClaims:   jose.Claims{"sub": "another-user"},
 			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
 		},
 	}
 	newFakeProxy(cfg).RunTests(t, requests)
 }
 
-func TestRolePermissionsMiddleware(t *testing.T) {
+func TestResourceRateLimitsForgedAddress(t *testing.T) {
 	cfg := newFakeKeycloakConfig()
 	cfg.Resources = []*Resource{
 		{
-			URL:     "/admin*",
-			Methods: allHTTPMethods,
-			Roles:   []string{fakeAdminRole},
-		},
-		{
-			URL:     "/test*",
-			Methods: []string{"GET"},
-			Roles:   []string{fakeTestRole},
-		},
-		{
-			URL:     "/test_admin_role*",
-			Methods: []string{"GET"},
-			Roles:   []string{fakeAdminRole, fakeTestRole},
-		},
-		{
-			URL:     "/section/*",
-			Methods: allHTTPMethods,
-			Roles:   []string{fakeAdminRole},
+			URL:         "/public/*",
+			Methods:     allHTTPMethods,
+			WhiteListed: true,
+			RateLimits:  map[string]int{http.MethodGet: 1},
 		},
+	}
+	requests := []fakeRequest{
 		{
-			URL:     "/section/one",
-			Methods: allHTTPMethods,
-			Roles:   []string{"one"},
+			URI:           "/public/test",
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
 		},
 		{
-			URL:     "/whitelist",
-			Methods: []string{"GET"},
-			Roles:   []string{},
+			// no proxy is trusted, the anonymous clients are limited by their peer address whatever they forward
+			URI:          "/public/test",
+			Headers:      map[string]string{"X-Forwarded-For": "10.0.0.1", "X-Real-IP": "10.0.0.1"},
+			ExpectedCode: http.StatusTooManyRequests,
 		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	newConfig := func(order []string) *Config {
+		cfg := newFakeKeycloakConfig()
+		cfg.MiddlewareOrder = order
+		cfg.Resources = []*Resource{
+			{URL: "/limited/*", Methods: allHTTPMethods, RateLimits: map[string]int{http.MethodGet: 1}},
+		}
+		return cfg
+	}
+
+	// by default, the requests denied by the authentication are not counted
+	requests := []fakeRequest{
+		{URI: "/limited/test", ExpectedCode: http.StatusUnauthorized},
+		{URI: "/limited/test", ExpectedCode: http.StatusUnauthorized},
+	}
+	newFakeProxy(newConfig(nil)).RunTests(t, requests)
+
+	// the anonymous clients are limited when the rate limit comes first
+	requests = []fakeRequest{
+		{URI: "/limited/test", ExpectedCode: http.StatusUnauthorized},
+		{URI: "/limited/test", ExpectedCode: http.StatusTooManyRequests},
+	}
+	newFakeProxy(newConfig([]string{
+		middlewareRateLimit,
+		middlewareAuthentication,
+		middlewareAdmission,
+		middlewareIdentityHeaders,
+		middlewareCSRF,
+	})).RunTests(t, requests)
+}
+
+func TestAuthMethodsClaim(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableAMRHeader = true
+	cfg.EnableAMRRoles = true
+	cfg.Resources = []*Resource{
 		{
-			URL:     "/*",
+			URL:     "/hwk/*",
 			Methods: allHTTPMethods,
-			Roles:   []string{fakeTestRole},
+			Roles:   []string{authMethodRolePrefix + "hwk"},
 		},
 	}
 	requests := []fakeRequest{
 		{
-			URI:          "/",
-			ExpectedCode: http.StatusUnauthorized,
-		},
-		{ // check for redirect
-			URI:          "/",
-			Redirects:    true,
-			ExpectedCode: http.StatusTemporaryRedirect,
-		},
-		{ // check with a token but not test role
-			URI:          "/",
-			Redirects:    false,
-			HasToken:     true,
-			ExpectedCode: http.StatusForbidden,
-		},
-		{ // check with a token and wrong roles
-			URI:          "/",
-			Redirects:    false,
+			URI:          "/hwk/test",
 			HasToken:     true,
-			Roles:        []string{"one", "two"},
 			ExpectedCode: http.StatusForbidden,
 		},
-		{ // token, wrong roles
-			URI:          "/test",
-			Redirects:    false,
+		{
+			URI:          "/hwk/test",
 			HasToken:     true,
-			Roles:        []string{"bad_role"},
+			TokenClaims:  jose.Claims{claimAuthMethods: "pwd"},
 			ExpectedCode: http.StatusForbidden,
 		},
-		{ // token, but post method
-			URI:           "/test",
-			Method:        http.MethodPost,
-			Redirects:     false,
-			HasToken:      true,
-			Roles:         []string{fakeTestRole},
-			ExpectedCode:  http.StatusMethodNotAllowed,
-			ExpectedProxy: false,
-		},
-		{ // check with correct token
-			URI:           "/test",
-			Redirects:     false,
+		{
+			URI:           "/hwk/test",
 			HasToken:      true,
-			Roles:         []string{fakeTestRole},
+			TokenClaims:   jose.Claims{claimAuthMethods: []string{"pwd", "hwk"}},
 			ExpectedCode:  http.StatusOK,
 			ExpectedProxy: true,
+			ExpectedProxyHeaders: map[string]string{
+				"X-Auth-AMR": "pwd,hwk",
+			},
 		},
-		{ // check with correct token on base
-			URI:           "/",
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestUpstreamBasicAuth(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = []*Resource{
+		{
+			URL:               "/legacy/*",
+			Methods:           allHTTPMethods,
+			UpstreamBasicAuth: "svc:secret",
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:           "/legacy/test",
+			HasToken:      true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
+			ExpectedProxyHeaders: map[string]string{
+				"Authorization": "Basic c3ZjOnNlY3JldA==",
+			},
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestCertIdentityMiddleware(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	p.config.ClientCertClaims = map[string]string{claimResourceRoles: certFieldOrganizationalUnit}
+	cert := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "billing", OrganizationalUnit: []string{"admin"}},
+		SerialNumber: big.NewInt(1),
+	}
+
+	cases := []struct {
+		Resource *Resource
+		TLS      *tls.ConnectionState
+		Expected string
+	}{
+		{
+			Resource: &Resource{URL: "/admin", CertAuth: true},
+			TLS:      &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			Expected: "billing",
+		},
+		{
+			// the certificates the listener did not verify are ignored
+			Resource: &Resource{URL: "/admin", CertAuth: true},
+			TLS:      &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+		},
+		{
+			Resource: &Resource{URL: "/admin", CertAuth: true},
+		},
+		{
+			Resource: &Resource{URL: "/admin"},
+			TLS:      &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+		},
+	}
+	for i, c := range cases {
+		scope := &RequestScope{}
+		req := newFakeHTTPRequest(http.MethodGet, "/admin")
+		req = req.WithContext(context.WithValue(req.Context(), contextScopeName, scope))
+		req.TLS = c.TLS
+		p.certIdentityMiddleware(c.Resource)(http.HandlerFunc(emptyHandler)).ServeHTTP(httptest.NewRecorder(), req)
+
+		if c.Expected == "" {
+			assert.Nil(t, scope.Identity, "case %d", i)
+			continue
+		}
+		if assert.NotNil(t, scope.Identity, "case %d", i) {
+			assert.Equal(t, c.Expected, scope.Identity.name, "case %d", i)
+			assert.Equal(t, []string{"admin"}, scope.Identity.roles, "case %d", i)
+		}
+	}
+}
+
+func TestTrustedIdentityHeader(t *testing.T) {
+	xfcc := `Hash=abcd;URI=spiffe://cluster.local/ns/default/sa/client`
+	cfg := newFakeKeycloakConfig()
+	cfg.TrustedProxies = []string{"127.0.0.1"}
+	cfg.TrustedIdentityHeader = headerXForwardedClientCert
+	requests := []fakeRequest{
+		{
+			URI:          "/admin/test",
+			Headers:      map[string]string{headerXForwardedClientCert: xfcc},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/auth_all/test",
+			Headers:       map[string]string{headerXForwardedClientCert: xfcc},
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
+			ExpectedProxyHeaders: map[string]string{
+				"X-Auth-Subject": "spiffe://cluster.local/ns/default/sa/client",
+			},
+			ExpectedNoProxyHeaders: []string{"Authorization", "X-Auth-Token"},
+		},
+		{
+			URI:          "/auth_all/test",
+			ExpectedCode: http.StatusUnauthorized,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+
+	cfg = newFakeKeycloakConfig()
+	cfg.TrustedProxies = []string{"10.0.0.0/8"}
+	cfg.TrustedIdentityHeader = headerXForwardedClientCert
+	requests = []fakeRequest{
+		{
+			URI:          "/auth_all/test",
+			Headers:      map[string]string{headerXForwardedClientCert: xfcc},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestGroupPermissionsMiddleware(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/with_role_and_group*",
+			Methods: allHTTPMethods,
+			Groups:  []string{"admin"},
+			Roles:   []string{"admin"},
+		},
+		{
+			URL:     "/with_group*",
+			Methods: allHTTPMethods,
+			Groups:  []string{"admin"},
+		},
+		{
+			URL:     "/with_many_groups*",
+			Methods: allHTTPMethods,
+			Groups:  []string{"admin", "user", "tester"},
+		},
+		{
+			URL:     "/*",
+			Methods: allHTTPMethods,
+			Roles:   []string{"user"},
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:          "/",
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:          "/with_role_and_group/test",
+			HasToken:     true,
+			Roles:        []string{"admin"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:          "/with_role_and_group/test",
+			HasToken:     true,
+			Groups:       []string{"admin"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/with_role_and_group/test",
+			HasToken:      true,
+			Groups:        []string{"admin"},
+			Roles:         []string{"admin"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/with_group/hello",
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:          "/with_groupdd",
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:          "/with_group/hello",
+			HasToken:     true,
+			Groups:       []string{"bad"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/with_group/hello",
+			HasToken:      true,
+			Groups:        []string{"admin"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:           "/with_group/hello",
+			HasToken:      true,
+			Groups:        []string{"test", "admin"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/with_many_groups/test",
+			HasToken:     true,
+			Groups:       []string{"bad"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/with_many_groups/test",
+			HasToken:      true,
+			Groups:        []string{"user"},
+			Roles:         []string{"test"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:           "/with_many_groups/test",
+			HasToken:      true,
+			Groups:        []string{"tester", "user"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:           "/with_many_groups/test",
+			HasToken:      true,
+			Groups:        []string{"bad", "user"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestUserinfoMerge(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableUserinfoMerge = true
+	cfg.UserinfoClaims = []string{claimGroups}
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/with_group*",
+			Methods: allHTTPMethods,
+			Groups:  []string{"userinfo-group"},
+		},
+	}
+	p := newFakeProxy(cfg)
+	p.idp.userinfo = jose.Claims{claimGroups: []string{"userinfo-group"}}
+	requests := []fakeRequest{
+		{
+			URI:                  "/with_group/test",
+			HasToken:             true,
+			Groups:               []string{"token-group"},
+			ExpectedProxy:        true,
+			ExpectedCode:         http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{"X-Auth-Groups": "userinfo-group"},
+		},
+	}
+	p.RunTests(t, requests)
+
+	cfg = newFakeKeycloakConfig()
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/with_group*",
+			Methods: allHTTPMethods,
+			Groups:  []string{"userinfo-group"},
+		},
+	}
+	p = newFakeProxy(cfg)
+	p.idp.userinfo = jose.Claims{claimGroups: []string{"userinfo-group"}}
+	requests = []fakeRequest{
+		{
+			URI:          "/with_group/test",
+			HasToken:     true,
+			Groups:       []string{"token-group"},
+			ExpectedCode: http.StatusForbidden,
+		},
+	}
+	p.RunTests(t, requests)
+}
+
+func TestUserinfoMergeKeepsPresentation(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableUserinfoMerge = true
+	cfg.UserinfoClaims = []string{claimGroups}
+	p := newFakeProxy(cfg)
+	defer p.idp.Close()
+
+	token := newTestToken(p.idp.getLocation()).getToken()
+	user, err := extractIdentity(token)
+	require.NoError(t, err)
+	user.bearerToken = true
+	user.sessionID = "session"
+	user.opaqueToken = "opaque"
+	user.trusted = true
+	p.proxy.userinfo.set(getHashKey(&user.token), jose.Claims{claimGroups: []string{"userinfo-group"}}, time.Now().Add(time.Minute))
+
+	merged, err := p.proxy.mergeUserinfo(context.Background(), user)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"userinfo-group"}, merged.groups)
+	assert.True(t, merged.isBearer())
+	assert.Equal(t, "session", merged.sessionID)
+	assert.Equal(t, "opaque", merged.accessToken())
+	assert.True(t, merged.isTrusted())
+}
+
+func TestUserinfoCache(t *testing.T) {
+	c := newUserinfoCache()
+	c.set("expired", jose.Claims{"sub": "expired"}, time.Now().Add(-time.Minute))
+	c.set("valid", jose.Claims{"sub": "valid"}, time.Now().Add(time.Minute))
+
+	_, found := c.get("expired")
+	assert.False(t, found)
+	claims, found := c.get("valid")
+	assert.True(t, found)
+	assert.Equal(t, "valid", claims["sub"])
+
+	c.set("other", jose.Claims{}, time.Now().Add(time.Minute))
+	assert.Len(t, c.entries, 2, "the expired entries should have been evicted")
+}
+
+func TestOpaqueTokens(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableOpaqueTokens = true
+	cfg.OpaqueTokenTTL = time.Minute
+	cfg.Resources = []*Resource{{URL: "/admin*", Methods: allHTTPMethods, Roles: []string{"admin"}}}
+	p := newFakeProxy(cfg)
+	p.idp.opaqueTokens = map[string]jose.Claims{
+		"opaque-admin": {
+			"sub":                "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+			"preferred_username": "rjayawardene",
+			"email":              "gambol99@gmail.com",
+			claimRealmAccess:     map[string]interface{}{claimResourceRoles: []string{"admin"}},
+		},
+		"opaque-user": {
+			"sub":                "a8d8d6b5-4f8e-4b5c-9b52-5a6d5b8b6d1f",
+			"preferred_username": "user",
+		},
+	}
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:           "/admin/test",
+			RawToken:      "opaque-admin",
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{
+				"X-Auth-Username": "rjayawardene",
+				"X-Auth-Email":    "gambol99@gmail.com",
+				"X-Auth-Token":    "opaque-admin",
+				"Authorization":   "Bearer opaque-admin",
+			},
+			OnResponse: func(int, *resty.Request, *resty.Response) {
+				p.idp.Lock()
+				delete(p.idp.opaqueTokens, "opaque-admin")
+				p.idp.Unlock()
+			},
+		},
+		{
+			// the userinfo of the token is cached until the ttl
+			URI:           "/admin/test",
+			RawToken:      "opaque-admin",
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/admin/test",
+			RawToken:     "opaque-user",
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:          "/admin/test",
+			RawToken:     "opaque-unknown",
+			ExpectedCode: http.StatusUnauthorized,
+		},
+	})
+}
+
+func TestOpaqueTokensUserinfoMerge(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableOpaqueTokens = true
+	cfg.OpaqueTokenTTL = time.Minute
+	cfg.EnableUserinfoMerge = true
+	cfg.UserinfoClaims = []string{claimGroups}
+	cfg.EnableAuthorizationHeader = true
+	cfg.Resources = []*Resource{{URL: "/with_group*", Methods: allHTTPMethods, Groups: []string{"userinfo-group"}}}
+	p := newFakeProxy(cfg)
+	p.idp.opaqueTokens = map[string]jose.Claims{
+		"opaque-user": {
+			"sub":                "a8d8d6b5-4f8e-4b5c-9b52-5a6d5b8b6d1f",
+			"preferred_username": "user",
+			claimGroups:          []string{"userinfo-group"},
+		},
+	}
+	// the merged identity still forwards the token as presented, not the claims it was built from
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:           "/with_group/test",
+			RawToken:      "opaque-user",
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{
+				"X-Auth-Groups": "userinfo-group",
+				"X-Auth-Token":  "opaque-user",
+				"Authorization": "Bearer opaque-user",
+			},
+		},
+	})
+}
+
+func TestStrictClaimTypes(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = []*Resource{{URL: "/admin*", Methods: allHTTPMethods}}
+	requests := []fakeRequest{
+		{
+			URI:           "/admin",
+			HasToken:      true,
+			TokenClaims:   jose.Claims{claimAuthMethods: "pwd"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+
+	cfg.StrictClaimTypes = true
+	requests = []fakeRequest{
+		{
+			URI:           "/admin",
+			HasToken:      true,
+			TokenClaims:   jose.Claims{claimAuthMethods: []string{"pwd"}},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/admin",
+			HasToken:     true,
+			TokenClaims:  jose.Claims{claimAuthMethods: "pwd"},
+			ExpectedCode: http.StatusForbidden,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestRolePermissionsMiddleware(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/admin*",
+			Methods: allHTTPMethods,
+			Roles:   []string{fakeAdminRole},
+		},
+		{
+			URL:     "/test*",
+			Methods: []string{"GET"},
+			Roles:   []string{fakeTestRole},
+		},
+		{
+			URL:     "/test_admin_role*",
+			Methods: []string{"GET"},
+			Roles:   []string{fakeAdminRole, fakeTestRole},
+		},
+		{
+			URL:     "/section/*",
+			Methods: allHTTPMethods,
+			Roles:   []string{fakeAdminRole},
+		},
+		{
+			URL:     "/section/one",
+			Methods: allHTTPMethods,
+			Roles:   []string{"one"},
+		},
+		{
+			URL:     "/whitelist",
+			Methods: []string{"GET"},
+			Roles:   []string{},
+		},
+		{
+			URL:     "/*",
+			Methods: allHTTPMethods,
+			Roles:   []string{fakeTestRole},
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:          "/",
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{ // check for redirect
+			URI:          "/",
+			Redirects:    true,
+			ExpectedCode: http.StatusTemporaryRedirect,
+		},
+		{ // check with a token but not test role
+			URI:          "/",
+			Redirects:    false,
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{ // check with a token and wrong roles
+			URI:          "/",
+			Redirects:    false,
+			HasToken:     true,
+			Roles:        []string{"one", "two"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{ // token, wrong roles
+			URI:          "/test",
+			Redirects:    false,
+			HasToken:     true,
+			Roles:        []string{"bad_role"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{ // token, but post method
+			URI:           "/test",
+			Method:        http.MethodPost,
+			Redirects:     false,
+			HasToken:      true,
+			Roles:         []string{fakeTestRole},
+			ExpectedCode:  http.StatusMethodNotAllowed,
+			ExpectedProxy: false,
+		},
+		{ // check with correct token
+			URI:           "/test",
+			Redirects:     false,
+			HasToken:      true,
+			Roles:         []string{fakeTestRole},
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
+		},
+		{ // check with correct token on base
+			URI:           "/",
 			Redirects:     false,
 			HasToken:      true,
 			Roles:         []string{fakeTestRole},
@@ -1066,102 +1748,414 @@ func TestRolePermissionsMiddleware(t *testing.T) {
 	newFakeProxy(cfg).RunTests(t, requests)
 }
 
-func TestCrossSiteHandler(t *testing.T) {
-	cases := []struct {
-		Cors    cors.Options
-		Request fakeRequest
-	}{
+func TestCrossSiteHandler(t *testing.T) {
+	cases := []struct {
+		Cors    cors.Options
+		Request fakeRequest
+	}{
+		{
+			Cors: cors.Options{
+				AllowedOrigins: []string{"*"},
+			},
+			Request: fakeRequest{
+				URI: fakeAuthAllURL,
+				Headers: map[string]string{
+					"Origin": "127.0.0.1",
+				},
+				ExpectedHeaders: map[string]string{
+					"Access-Control-Allow-Origin": "*",
+				},
+			},
+		},
+		{
+			Cors: cors.Options{
+				AllowedOrigins: []string{"*", "https://examples.com"},
+			},
+			Request: fakeRequest{
+				URI: fakeAuthAllURL,
+				Headers: map[string]string{
+					"Origin": "127.0.0.1",
+				},
+				ExpectedHeaders: map[string]string{
+					"Access-Control-Allow-Origin": "*",
+				},
+			},
+		},
+		{
+			Cors: cors.Options{
+				AllowedOrigins: []string{"*"},
+				AllowedMethods: []string{"GET", "POST"},
+			},
+			Request: fakeRequest{
+				URI:    fakeAuthAllURL,
+				Method: http.MethodOptions,
+				Headers: map[string]string{
+					"Origin":                        "127.0.0.1",
+					"Access-Control-Request-Method": "GET",
+				},
+				ExpectedHeaders: map[string]string{
+					"Access-Control-Allow-Origin":  "*",
+					"Access-Control-Allow-Methods": "GET",
+				},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		cfg := newFakeKeycloakConfig()
+		cfg.CorsCredentials = c.Cors.AllowCredentials
+		cfg.CorsExposedHeaders = c.Cors.ExposedHeaders
+		cfg.CorsHeaders = c.Cors.AllowedHeaders
+		cfg.CorsMaxAge = time.Duration(c.Cors.MaxAge) * time.Second
+		cfg.CorsMethods = c.Cors.AllowedMethods
+		cfg.CorsOrigins = c.Cors.AllowedOrigins
+
+		newFakeProxy(cfg).RunTests(t, []fakeRequest{c.Request})
+	}
+}
+func TestCheckRefreshTokens(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	cfg.EncryptionKey = testKey
+	cfg.Verbose = true
+	fn := func(no int, req *resty.Request, resp *resty.Response) {
+		if no == 0 {
+			<-time.After(1000 * time.Millisecond)
+		}
+	}
+	p := newFakeProxy(cfg)
+	p.idp.setTokenExpiration(1000 * time.Millisecond)
+
+	requests := []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasLogin:      true,
+			Redirects:     true,
+			OnResponse:    fn,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:             fakeAuthAllURL,
+			Redirects:       false,
+			ExpectedProxy:   true,
+			ExpectedCode:    http.StatusOK,
+			ExpectedCookies: map[string]string{cfg.CookieAccessName: ""},
+		},
+	}
+	p.RunTests(t, requests)
+}
+
+func TestRefreshTokenInvalidGrant(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	cfg.EncryptionKey = testKey
+	cfg.RefreshCooldown = time.Minute
+	fn := func(no int, req *resty.Request, resp *resty.Response) {
+		if no == 0 {
+			<-time.After(1000 * time.Millisecond)
+		}
+	}
+	p := newFakeProxy(cfg)
+	p.idp.setTokenExpiration(1000 * time.Millisecond).setInvalidGrant(true)
+	cooldown := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+
+	requests := []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasLogin:      true,
+			Redirects:     true,
+			OnResponse:    fn,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:              fakeAuthAllURL,
+			Redirects:        true,
+			ExpectedCode:     http.StatusTemporaryRedirect,
+			ExpectedLocation: "/oauth/authorize",
+			ExpectedCookies:  map[string]string{refreshCooldownCookie: ""},
+		},
+		{
+			URI:          fakeAuthAllURL,
+			Redirects:    true,
+			Cookies:      []*http.Cookie{{Name: refreshCooldownCookie, Value: cooldown}},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+	}
+	p.RunTests(t, requests)
+}
+
+func TestPreserveRawQuery(t *testing.T) {
+	// a pre-signed url: the signature covers the exact query, order and encoding included
+	signed := "X-Amz-Expires=300&X-Amz-Credential=AKID%2f20200101%2Fus-east-1&b=2&a=1;c=3&X-Amz-Signature=ab%2Bcd%3D"
+	cfg := newFakeKeycloakConfig()
+	cfg.PreserveRawQuery = true
+	requests := []fakeRequest{
+		{
+			URI:           "/auth_all//object/../file?" + signed,
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+				var upstream fakeUpstreamResponse
+				require.NoError(t, json.Unmarshal(resp.Body(), &upstream))
+				assert.Equal(t, signed, upstream.RawQuery)
+			},
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestCSPNonce(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableSecurityFilter = true
+	cfg.ContentSecurityPolicy = "script-src 'nonce-{nonce}'"
+	cfg.EnableCSPNonce = true
+	nonces := make(map[string]bool)
+	fn := func(no int, req *resty.Request, resp *resty.Response) {
+		upstream, ok := resp.Result().(*fakeUpstreamResponse)
+		require.True(t, ok)
+		nonce := upstream.Headers.Get(headerCSPNonce)
+		assert.NotEmpty(t, nonce)
+		assert.Equal(t, "script-src 'nonce-"+nonce+"'", resp.Header().Get(headerCSP))
+		assert.False(t, nonces[nonce], "the nonce should not be reused")
+		nonces[nonce] = true
+	}
+	requests := []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasToken:      true,
+			Headers:       map[string]string{headerCSPNonce: "forged"},
+			OnResponse:    fn,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:           fakeAuthAllURL,
+			HasToken:      true,
+			OnResponse:    fn,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+	assert.Len(t, nonces, 2)
+}
+
+func TestDuplicateHeaderPolicy(t *testing.T) {
+	cases := []struct {
+		Policy   string
+		Expected int
+	}{
+		{Policy: duplicateHeaderPolicyFirst, Expected: http.StatusOK},
+		{Policy: duplicateHeaderPolicyLast, Expected: http.StatusTemporaryRedirect},
+		{Policy: duplicateHeaderPolicyReject, Expected: http.StatusBadRequest},
+	}
+	// the redirections to the authorization are not followed
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	for _, c := range cases {
+		cfg := newFakeKeycloakConfig()
+		cfg.DuplicateHeaderPolicy = c.Policy
+		p := newFakeProxy(cfg)
+		token, err := p.idp.signToken(newTestToken(p.idp.getLocation()).claims)
+		require.NoError(t, err)
+
+		req, err := http.NewRequest(http.MethodGet, p.getServiceURL()+fakeAuthAllURL, nil)
+		require.NoError(t, err)
+		req.Header.Add(authorizationHeader, "Bearer "+token.Encode())
+		req.Header.Add(authorizationHeader, "Bearer not-a-token")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, c.Expected, resp.StatusCode, "policy %s", c.Policy)
+	}
+}
+
+func TestRejectSuspiciousPaths(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRejectSuspiciousPaths = true
+	cfg.SuspiciousPathsAllowlist = []string{"%2F"}
+	requests := []fakeRequest{
+		{
+			URI:           "/auth_all/white_listed/page",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/auth_all/%2e%2e/admin",
+			HasToken:     true,
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			URI:          "/auth_all/file%00.png",
+			HasToken:     true,
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			URI:           "/auth_all/a%2Fb",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestClientResponseClaimHeaders(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableSecurityFilter = true
+	cfg.EnableFrameDeny = true
+	cfg.ClientResponseClaimHeaders = map[string]string{
+		"tenant": "X-User-Tenant",
+		"email":  "X-User-Email",
+	}
+	requests := []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasToken:      true,
+			TokenClaims:   jose.Claims{"tenant": "acme"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedHeaders: map[string]string{
+				"X-User-Tenant":     "acme",
+				"X-User-Email":      "gambol99@gmail.com",
+				headerXFrameOptions: "DENY",
+			},
+		},
+		{
+			URI:             fakeAuthAllURL,
+			ExpectedCode:    http.StatusUnauthorized,
+			ExpectedHeaders: map[string]string{"X-User-Tenant": ""},
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestResourceSecurityHeaders(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableSecurityFilter = true
+	cfg.EnableFrameDeny = true
+	cfg.EnableContentNoSniff = true
+	cfg.ContentSecurityPolicy = "default-src 'self'"
+	cfg.Resources = append(cfg.Resources,
+		&Resource{URL: "/api/*", Methods: allHTTPMethods, WhiteListed: true, SkipSecurityHeaders: true},
+		&Resource{
+			URL:             "/embed/*",
+			Methods:         allHTTPMethods,
+			WhiteListed:     true,
+			SecurityHeaders: map[string]string{headerXFrameOptions: "SAMEORIGIN", headerCSP: ""},
+		},
+	)
+	requests := []fakeRequest{
 		{
-			Cors: cors.Options{
-				AllowedOrigins: []string{"*"},
-			},
-			Request: fakeRequest{
-				URI: fakeAuthAllURL,
-				Headers: map[string]string{
-					"Origin": "127.0.0.1",
-				},
-				ExpectedHeaders: map[string]string{
-					"Access-Control-Allow-Origin": "*",
-				},
+			URI:           fakeAuthAllURL,
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedHeaders: map[string]string{
+				headerXFrameOptions:       "DENY",
+				headerXContentTypeOptions: "nosniff",
+				headerCSP:                 "default-src 'self'",
 			},
 		},
 		{
-			Cors: cors.Options{
-				AllowedOrigins: []string{"*", "https://examples.com"},
-			},
-			Request: fakeRequest{
-				URI: fakeAuthAllURL,
-				Headers: map[string]string{
-					"Origin": "127.0.0.1",
-				},
-				ExpectedHeaders: map[string]string{
-					"Access-Control-Allow-Origin": "*",
-				},
+			URI:           "/api/test",
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedHeaders: map[string]string{
+				headerXFrameOptions:       "",
+				headerXContentTypeOptions: "",
+				headerCSP:                 "",
 			},
 		},
 		{
-			Cors: cors.Options{
-				AllowedOrigins: []string{"*"},
-				AllowedMethods: []string{"GET", "POST"},
-			},
-			Request: fakeRequest{
-				URI:    fakeAuthAllURL,
-				Method: http.MethodOptions,
-				Headers: map[string]string{
-					"Origin":                        "127.0.0.1",
-					"Access-Control-Request-Method": "GET",
-				},
-				ExpectedHeaders: map[string]string{
-					"Access-Control-Allow-Origin":  "*",
-					"Access-Control-Allow-Methods": "GET",
-				},
+			URI:           "/embed/test",
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedHeaders: map[string]string{
+				headerXFrameOptions:       "SAMEORIGIN",
+				headerXContentTypeOptions: "nosniff",
+				headerCSP:                 "",
 			},
 		},
 	}
-
-	for _, c := range cases {
-		cfg := newFakeKeycloakConfig()
-		cfg.CorsCredentials = c.Cors.AllowCredentials
-		cfg.CorsExposedHeaders = c.Cors.ExposedHeaders
-		cfg.CorsHeaders = c.Cors.AllowedHeaders
-		cfg.CorsMaxAge = time.Duration(c.Cors.MaxAge) * time.Second
-		cfg.CorsMethods = c.Cors.AllowedMethods
-		cfg.CorsOrigins = c.Cors.AllowedOrigins
-
-		newFakeProxy(cfg).RunTests(t, []fakeRequest{c.Request})
-	}
+	newFakeProxy(cfg).RunTests(t, requests)
 }
-func TestCheckRefreshTokens(t *testing.T) {
+
+func TestMalformedSessionCookie(t *testing.T) {
+	cleared := func(v string) bool { return v == "" }
 	cfg := newFakeKeycloakConfig()
 	cfg.EnableRefreshTokens = true
 	cfg.EncryptionKey = testKey
-	cfg.Verbose = true
-	fn := func(no int, req *resty.Request, resp *resty.Response) {
-		if no == 0 {
-			<-time.After(1000 * time.Millisecond)
-		}
-	}
+	cfg.EnableEncryptedToken = true
 	p := newFakeProxy(cfg)
-	p.idp.setTokenExpiration(1000 * time.Millisecond)
+	token, err := p.idp.signToken(newTestToken(p.idp.getLocation()).claims)
+	require.NoError(t, err)
+	encrypted, err := encodeText(token.Encode(), testKey)
+	require.NoError(t, err)
 
 	requests := []fakeRequest{
+		{
+			// the cookie was truncated
+			URI:                      fakeAuthAllURL,
+			Redirects:                true,
+			Cookies:                  []*http.Cookie{{Name: cfg.CookieAccessName, Value: encrypted[:len(encrypted)/2]}},
+			ExpectedCode:             http.StatusTemporaryRedirect,
+			ExpectedLocation:         "/oauth/authorize",
+			ExpectedCookiesValidator: map[string]func(string) bool{cfg.CookieAccessName: cleared, cfg.CookieRefreshName: cleared},
+		},
+		{
+			// the cookie is not even encrypted
+			URI:                      fakeAuthAllURL,
+			Redirects:                true,
+			Cookies:                  []*http.Cookie{{Name: cfg.CookieAccessName, Value: "corrupted"}},
+			ExpectedCode:             http.StatusTemporaryRedirect,
+			ExpectedLocation:         "/oauth/authorize",
+			ExpectedCookiesValidator: map[string]func(string) bool{cfg.CookieAccessName: cleared},
+		},
 		{
 			URI:           fakeAuthAllURL,
-			HasLogin:      true,
-			Redirects:     true,
-			OnResponse:    fn,
+			Cookies:       []*http.Cookie{{Name: cfg.CookieAccessName, Value: encrypted}},
 			ExpectedProxy: true,
 			ExpectedCode:  http.StatusOK,
 		},
+	}
+	p.RunTests(t, requests)
+}
+
+func TestMaxAuthorizationHeaderSize(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.MaxAuthorizationHeaderSize = 256
+	requests := []fakeRequest{
 		{
-			URI:             fakeAuthAllURL,
-			Redirects:       false,
-			ExpectedProxy:   true,
-			ExpectedCode:    http.StatusOK,
-			ExpectedCookies: map[string]string{cfg.CookieAccessName: ""},
+			URI:                    fakeAuthAllURL,
+			HasToken:               true,
+			Headers:                map[string]string{"X-Auth-Token-Part-9": "forged"},
+			ExpectedProxy:          true,
+			ExpectedCode:           http.StatusOK,
+			ExpectedProxyHeaders:   map[string]string{"X-Auth-Token-Part-1": "", "X-Auth-Token-Part-2": ""},
+			ExpectedNoProxyHeaders: []string{"Authorization", "X-Auth-Token-Part-9"},
 		},
 	}
-	p.RunTests(t, requests)
+	newFakeProxy(cfg).RunTests(t, requests)
+
+	cfg = newFakeKeycloakConfig()
+	cfg.MaxAuthorizationHeaderSize = 64 * 1024
+	requests = []fakeRequest{
+		{
+			URI:                    fakeAuthAllURL,
+			HasToken:               true,
+			ExpectedProxy:          true,
+			ExpectedCode:           http.StatusOK,
+			ExpectedProxyHeaders:   map[string]string{"Authorization": ""},
+			ExpectedNoProxyHeaders: []string{"X-Auth-Token-Part-1"},
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
 }
 
 func TestCheckEncryptedCookie(t *testing.T) {
@@ -1285,6 +2279,81 @@ func TestCustomHeadersHandler(t *testing.T) {
 	}
 }
 
+func TestCustomHeadersArrayFormat(t *testing.T) {
+	claims := jose.Claims{
+		"email":        "gambol99@gmail.com",
+		"entitlements": []string{"read", "write", "admin"},
+	}
+	cfg := newFakeKeycloakConfig()
+	cfg.AddClaims = []string{"entitlements"}
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			URI:                  fakeAuthAllURL,
+			HasToken:             true,
+			TokenClaims:          claims,
+			ExpectedProxyHeaders: map[string]string{"X-Auth-Entitlements": "read,write,admin"},
+			ExpectedProxy:        true,
+			ExpectedCode:         http.StatusOK,
+		},
+	})
+
+	cfg = newFakeKeycloakConfig()
+	cfg.AddClaims = []string{"entitlements"}
+	cfg.AddClaimsArrayFormat = claimArrayFormatRepeat
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasToken:      true,
+			TokenClaims:   claims,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+				var upstream fakeUpstreamResponse
+				require.NoError(t, json.Unmarshal(resp.Body(), &upstream))
+				assert.Equal(t, []string{"read", "write", "admin"}, upstream.Headers["X-Auth-Entitlements"])
+			},
+		},
+	})
+}
+
+func TestClaimHeaderMap(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.ClaimHeaderMap = map[string]string{
+		"preferred_username": "X-Remote-User",
+		"entitlements":       "X-Entitlements",
+		"address":            "X-Address",
+		"level":              "X-Level",
+		"tenant":             "X-Tenant",
+	}
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			URI:      fakeAuthAllURL,
+			HasToken: true,
+			Headers:  map[string]string{"X-Tenant": "spoofed"},
+			TokenClaims: jose.Claims{
+				"preferred_username": "rjayawardene",
+				"entitlements":       []string{"read", "write"},
+				"address":            map[string]interface{}{"country": "UK", "locality": "London"},
+				"level":              1000000,
+			},
+			ExpectedProxyHeaders: map[string]string{
+				"X-Remote-User":   "rjayawardene",
+				"X-Auth-Username": "rjayawardene",
+				"X-Entitlements":  "read,write",
+				"X-Address":       `{"country":"UK","locality":"London"}`,
+				"X-Level":         "1000000",
+			},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+				var upstream fakeUpstreamResponse
+				require.NoError(t, json.Unmarshal(resp.Body(), &upstream))
+				assert.NotContains(t, upstream.Headers, "X-Tenant")
+			},
+		},
+	})
+}
+
 func TestAdmissionHandlerRoles(t *testing.T) {
 	cfg := newFakeKeycloakConfig()
 	cfg.NoRedirects = true
@@ -1356,6 +2425,44 @@ func TestAdmissionHandlerRoles(t *testing.T) {
 // check to see if custom headers are hitting the upstream
 //
 // When EnableDefaultDeny, URIs not declared as resources are not forwarded.
+func TestIdentityHeadersEncoding(t *testing.T) {
+	cases := map[string]map[string]string{
+		identityHeadersEncodingRFC8187: {
+			"X-Auth-Email":    "UTF-8''j%C3%BCrgen%40m%C3%BCnchen.de",
+			"X-Auth-Username": "UTF-8''Jos%C3%A9%20M%C3%BCller",
+			"X-Auth-Subject":  "test-subject",
+		},
+		identityHeadersEncodingPercent: {
+			"X-Auth-Email":    "j%C3%BCrgen@m%C3%BCnchen.de",
+			"X-Auth-Username": "Jos%C3%A9%20M%C3%BCller",
+			"X-Auth-Subject":  "test-subject",
+		},
+		identityHeadersEncodingBase64: {
+			"X-Auth-Email":    "=?UTF-8?b?asO8cmdlbkBtw7xuY2hlbi5kZQ==?=",
+			"X-Auth-Username": "=?UTF-8?b?Sm9zw6kgTcO8bGxlcg==?=",
+			"X-Auth-Subject":  "test-subject",
+		},
+	}
+	for encoding, expected := range cases {
+		cfg := newFakeKeycloakConfig()
+		cfg.IdentityHeadersEncoding = encoding
+		newFakeProxy(cfg).RunTests(t, []fakeRequest{
+			{
+				URI:      fakeAuthAllURL,
+				HasToken: true,
+				TokenClaims: jose.Claims{
+					"sub":                "test-subject",
+					"preferred_username": "José Müller",
+					"email":              "jürgen@münchen.de",
+				},
+				ExpectedProxyHeaders: expected,
+				ExpectedProxy:        true,
+				ExpectedCode:         http.StatusOK,
+			},
+		})
+	}
+}
+
 func TestCustomHeadersUpstream(t *testing.T) {
 	requests := []struct {
 		Headers             map[string]string
@@ -1656,3 +2763,225 @@ func TestRolesAdmissionHandlerClaims(t *testing.T) {
 		newFakeProxy(cfg).RunTests(t, []fakeRequest{c.Request})
 	}
 }
+
+func TestResourceClaimMatch(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.MatchClaims = map[string]string{"item": "^test$"}
+	cfg.Resources = []*Resource{
+		{URL: "/finance/*", Methods: allHTTPMethods, MatchClaims: map[string]string{"department": "^finance$"}},
+		{URL: "/hr/*", Methods: allHTTPMethods, MatchClaims: map[string]string{"department": "^hr$"}},
+		{URL: "/admin*", Methods: allHTTPMethods},
+	}
+	requests := []fakeRequest{
+		{
+			URI:           "/finance/report",
+			HasToken:      true,
+			TokenClaims:   jose.Claims{"item": "test", "department": "finance"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// the global claims match, not those of the resource
+			URI:          "/hr/report",
+			HasToken:     true,
+			TokenClaims:  jose.Claims{"item": "test", "department": "finance"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			// the claims of the resource match, not the global ones
+			URI:          "/finance/report",
+			HasToken:     true,
+			TokenClaims:  jose.Claims{"item": "other", "department": "finance"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			// the resources without claims of their own are only checked against the global ones
+			URI:           "/admin",
+			HasToken:      true,
+			TokenClaims:   jose.Claims{"item": "test", "department": "hr"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestAllowAnonymousResource(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = append(cfg.Resources, &Resource{
+		URL:            "/public/*",
+		Methods:        allHTTPMethods,
+		AllowAnonymous: true,
+	})
+	requests := []fakeRequest{
+		{
+			URI:                    "/public/page",
+			Headers:                map[string]string{"X-Auth-Email": "spoofed@example.com", "Authorization": "Bearer garbage"},
+			ExpectedProxy:          true,
+			ExpectedCode:           http.StatusOK,
+			ExpectedNoProxyHeaders: []string{"X-Auth-Email", "Authorization"},
+		},
+		{
+			URI:                  "/public/page",
+			HasToken:             true,
+			TokenClaims:          jose.Claims{"email": "gambol99@gmail.com"},
+			ExpectedProxy:        true,
+			ExpectedCode:         http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{"X-Auth-Email": "gambol99@gmail.com"},
+		},
+		{
+			// the other resources still require a session
+			URI:              fakeAuthAllURL,
+			Redirects:        true,
+			ExpectedCode:     http.StatusTemporaryRedirect,
+			ExpectedLocation: "/oauth/authorize",
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestCookieMAC(t *testing.T) {
+	cleared := func(v string) bool { return v == "" }
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableCookieMAC = true
+	cfg.EncryptionKey = testKey
+	p := newFakeProxy(cfg)
+	token, err := p.idp.signToken(newTestToken(p.idp.getLocation()).claims)
+	require.NoError(t, err)
+	signed := signCookieValue(cfg.CookieAccessName, token.Encode(), testKey)
+
+	requests := []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			Cookies:       []*http.Cookie{{Name: cfg.CookieAccessName, Value: signed}},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// a valid token without the signature is not accepted in the cookie
+			URI:                      fakeAuthAllURL,
+			Redirects:                true,
+			Cookies:                  []*http.Cookie{{Name: cfg.CookieAccessName, Value: token.Encode()}},
+			ExpectedCode:             http.StatusTemporaryRedirect,
+			ExpectedLocation:         "/oauth/authorize",
+			ExpectedCookiesValidator: map[string]func(string) bool{cfg.CookieAccessName: cleared},
+		},
+		{
+			URI:                      fakeAuthAllURL,
+			Redirects:                true,
+			Cookies:                  []*http.Cookie{{Name: cfg.CookieAccessName, Value: signed[:len(signed)-4]}},
+			ExpectedCode:             http.StatusTemporaryRedirect,
+			ExpectedLocation:         "/oauth/authorize",
+			ExpectedCookiesValidator: map[string]func(string) bool{cfg.CookieAccessName: cleared},
+		},
+		{
+			// bearer tokens are not signed
+			URI:           fakeAuthAllURL,
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+	p.RunTests(t, requests)
+}
+
+func TestFailedAuthDelay(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.FailedAuthDelay = 200 * time.Millisecond
+	requests := []fakeRequest{
+		{URI: "/admin", ExpectedCode: http.StatusUnauthorized},
+		{URI: "/admin", HasToken: true, Roles: []string{"user"}, ExpectedCode: http.StatusForbidden},
+	}
+	start := time.Now()
+	newFakeProxy(cfg).RunTests(t, requests)
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, "the failed responses should have been delayed")
+
+	// the responses beyond the pending delays are not held
+	p := &oauthProxy{config: &Config{FailedAuthDelay: time.Hour}, failedAuthDelays: make(chan struct{}, 1)}
+	p.failedAuthDelays <- struct{}{}
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	start = time.Now()
+	p.delayFailedAuth(req)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// nor are the responses to the requests cancelled by the client
+	<-p.failedAuthDelays
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	p.delayFailedAuth(req.WithContext(ctx))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Empty(t, p.failedAuthDelays)
+}
+
+func TestServiceUnavailableRetryAfter(t *testing.T) {
+	p := &oauthProxy{config: &Config{UnavailableRetryAfter: 10 * time.Second}, log: zap.NewNop()}
+	for i := 0; i < 20; i++ {
+		resp := httptest.NewRecorder()
+		p.serviceUnavailable(resp, httptest.NewRequest(http.MethodGet, "/admin", nil), "overloaded", nil)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+		retryAfter, err := strconv.Atoi(resp.Header().Get(headerRetryAfter))
+		require.NoError(t, err)
+		assert.True(t, retryAfter >= 10 && retryAfter <= 15, "the retry delay %d should be jittered up to half more", retryAfter)
+	}
+
+	p.config.UnavailableRetryAfter = 0
+	resp := httptest.NewRecorder()
+	p.serviceUnavailable(resp, httptest.NewRequest(http.MethodGet, "/admin", nil), "overloaded", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Empty(t, resp.Header().Get(headerRetryAfter))
+}
+
+func TestRegexResourcePrecedence(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableDefaultDeny = true
+	cfg.Resources = []*Resource{
+		{URL: "^/api/v[0-9]+/admin/.*", Methods: allHTTPMethods, Roles: []string{"admin"}},
+		{URL: "^/api/v[0-9]+/.*", Methods: allHTTPMethods, WhiteListed: true},
+		{URL: "/api/v1/admin/status", Methods: allHTTPMethods, WhiteListed: true},
+		{URL: "/api/v2/*", Methods: allHTTPMethods, WhiteListed: true},
+	}
+	requests := []fakeRequest{
+		{
+			// the exact url comes before the overlapping regex
+			URI:           "/api/v1/admin/status",
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// as does the prefix
+			URI:           "/api/v2/admin/users",
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/api/v1/admin/users",
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:          "/api/v3/admin/users",
+			HasToken:     true,
+			Roles:        []string{"user"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/api/v3/admin/users",
+			HasToken:      true,
+			Roles:         []string{"admin"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// the regexes are evaluated in order
+			URI:           "/api/v1/users",
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// the requests matching no resource fall through to the default route
+			URI:          "/other",
+			ExpectedCode: http.StatusUnauthorized,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
@@ -17,8 +17,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coreos/go-oidc/jose"
@@ -55,29 +60,110 @@ func (r *oauthProxy) redirectToURL(url string, w http.ResponseWriter, req *http.
 
 // redirectToAuthorization redirects the user to authorization handler
 func (r *oauthProxy) redirectToAuthorization(w http.ResponseWriter, req *http.Request) context.Context {
+	return r.redirectToAuthorizationWithPrompt(w, req, "")
+}
+
+// redirectToAuthorizationWithPrompt redirects the user to authorization handler, passing a prompt
+// to the provider (e.g. "login" to force a new authentication)
+func (r *oauthProxy) redirectToAuthorizationWithPrompt(w http.ResponseWriter, req *http.Request, prompt string) context.Context {
 	if r.config.NoRedirects {
 		r.errorResponse(w, req, "", http.StatusUnauthorized, nil)
 		return r.revokeProxy(w, req)
 	}
 
+	// step: a browser sent back to the authorization over and over is caught in a loop, e.g. cookies which
+	// are never sent back: tell the user rather than bouncing once more
+	if r.config.RedirectLoopLimit > 0 && !(r.config.EnableLoginChallenge && isAPIRequest(req)) {
+		if count := r.countRedirectLoop(req, w); count > r.config.RedirectLoopLimit {
+			r.redirectLoopResponse(w, req, count)
+			return r.revokeProxy(w, req)
+		}
+	}
+
 	// step: add a state referrer to the authorization page
 	uuid := r.writeStateParameterCookie(req, w)
 	authQuery := fmt.Sprintf("?state=%s", uuid)
+	if prompt != "" {
+		authQuery += "&prompt=" + url.QueryEscape(prompt)
+	}
 
 	// step: if verification is switched off, we can't authorize
 	if r.config.SkipTokenVerification {
 		r.errorResponse(w, req, "refusing to redirect to authorization endpoint, skip token verification switched on", http.StatusForbidden, nil)
 		return r.revokeProxy(w, req)
 	}
+	location := r.config.WithOAuthURI(authorizationURL + authQuery)
+
+	// step: API clients cannot follow the redirect, hand them the login url instead
+	if r.config.EnableLoginChallenge && isAPIRequest(req) {
+		r.loginChallenge(w, req, path.Clean(r.config.WithOAuthURI(authorizationURL))+authQuery, uuid)
+		return r.revokeProxy(w, req)
+	}
+
 	if r.config.InvalidAuthRedirectsWith303 {
-		r.redirectToURL(r.config.WithOAuthURI(authorizationURL+authQuery), w, req, http.StatusSeeOther)
+		r.redirectToURL(location, w, req, http.StatusSeeOther)
 	} else {
-		r.redirectToURL(r.config.WithOAuthURI(authorizationURL+authQuery), w, req, http.StatusTemporaryRedirect)
+		r.redirectToURL(location, w, req, http.StatusTemporaryRedirect)
 	}
 
 	return r.revokeProxy(w, req)
 }
 
+// redirectLoopResponse serves the page explaining the redirections to the authorization are looping
+func (r *oauthProxy) redirectLoopResponse(w http.ResponseWriter, req *http.Request, count int) {
+	_, logger := r.traceSpanRequest(req)
+	logger.Warn("the redirections to the authorization are looping",
+		zap.String("client_ip", realIP(req, r.trustedProxies)),
+		zap.String("path", req.URL.Path),
+		zap.Int("redirections", count),
+		zap.Duration("window", r.config.RedirectLoopWindow))
+
+	if !r.config.hasCustomRedirectLoopPage() {
+		r.errorResponse(w, req, "the authentication is looping, please check the cookies are enabled and try again later",
+			http.StatusLoopDetected, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate, max-age=0")
+	noSniff(w)
+	w.WriteHeader(http.StatusLoopDetected)
+	name := path.Base(r.config.RedirectLoopPage)
+	model := map[string]string{
+		"redirections": strconv.Itoa(count),
+		"window":       r.config.RedirectLoopWindow.String(),
+	}
+	if err := r.Render(w, name, mergeMaps(model, r.config.Tags)); err != nil {
+		logger.Error("failed to render the template", zap.Error(err), zap.String("template", name))
+	}
+}
+
+// loginChallenge responds with a 401 and the url the client should navigate to in order to log in
+func (r *oauthProxy) loginChallenge(w http.ResponseWriter, req *http.Request, location, state string) {
+	_, logger := r.traceSpanRequest(req)
+	logger.Debug("responding with a login challenge", zap.String("location", location))
+
+	content, err := json.Marshal(&loginChallenge{LoginURL: location, State: state})
+	if err != nil {
+		r.errorResponse(w, req, "failed to marshal the login challenge", http.StatusInternalServerError, err)
+		return
+	}
+
+	// step: a smart client may start the authorization from the header alone
+	if r.config.WWWAuthenticate != "" {
+		w.Header().Set(headerWWWAuthenticate, strings.NewReplacer(
+			loginURLPlaceholder, r.getBaseURL(req)+location,
+			authEndpointPlaceholder, r.idp.AuthEndpoint.String(),
+		).Replace(r.config.WWWAuthenticate))
+	}
+
+	w.Header().Set("Content-Type", jsonMime)
+	w.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate, max-age=0")
+	noSniff(w)
+	w.WriteHeader(http.StatusUnauthorized)
+	_, _ = w.Write(content)
+}
+
 // getAccessCookieExpiration calculates the expiration of the access token cookie
 func (r *oauthProxy) getAccessCookieExpiration(token jose.JWT, refresh string) time.Duration {
 	// notes: by default the duration of the access token will be the configuration option, if
@@ -17,10 +17,13 @@ package main
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	resty "gopkg.in/resty.v1"
 )
 
 func TestRedirectToAuthorizationUnauthorized(t *testing.T) {
@@ -57,6 +60,111 @@ func TestRedirectToAuthorizationWith303Enabled(t *testing.T) {
 	newFakeProxy(cfg).RunTests(t, requests)
 }
 
+func TestRedirectToAuthorizationLoginChallenge(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableLoginChallenge = true
+
+	requests := []fakeRequest{
+		{
+			URI:                     "/admin",
+			Redirects:               true,
+			Headers:                 map[string]string{"Accept": "application/json"},
+			ExpectedCode:            http.StatusUnauthorized,
+			ExpectedContentContains: `"login_url":"/oauth/authorize?state=`,
+			ExpectedCookies:         map[string]string{requestStateCookie: ""},
+		},
+		{
+			URI:                     "/admin",
+			Redirects:               true,
+			Headers:                 map[string]string{"X-Requested-With": "XMLHttpRequest"},
+			ExpectedCode:            http.StatusUnauthorized,
+			ExpectedContentContains: `"state":"`,
+		},
+		{
+			URI:              "/admin",
+			Redirects:        true,
+			Headers:          map[string]string{"Accept": "text/html,application/json"},
+			ExpectedLocation: "/oauth/authorize?state",
+			ExpectedCode:     http.StatusTemporaryRedirect,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestRedirectToAuthorizationWWWAuthenticate(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableLoginChallenge = true
+	cfg.WWWAuthenticate = `Bearer realm="app", authorization_uri="{login_url}"`
+	p := newFakeProxy(cfg)
+
+	requests := []fakeRequest{
+		{
+			URI:          "/admin",
+			Redirects:    true,
+			Headers:      map[string]string{"Accept": "application/json"},
+			ExpectedCode: http.StatusUnauthorized,
+			OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+				assert.True(t, strings.HasPrefix(resp.Header().Get(headerWWWAuthenticate),
+					`Bearer realm="app", authorization_uri="`+p.getServiceURL()+`/oauth/authorize?state=`))
+			},
+		},
+		{
+			// browsers are still redirected
+			URI:              "/admin",
+			Redirects:        true,
+			ExpectedLocation: "/oauth/authorize?state",
+			ExpectedCode:     http.StatusTemporaryRedirect,
+		},
+	}
+	p.RunTests(t, requests)
+}
+
+func TestRedirectToAuthorizationLoop(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.RedirectLoopLimit = 3
+	cfg.RedirectLoopWindow = time.Minute
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	requests := []fakeRequest{
+		{
+			URI:              "/admin",
+			Redirects:        true,
+			ExpectedLocation: "/oauth/authorize?state",
+			ExpectedCode:     http.StatusTemporaryRedirect,
+			ExpectedCookiesValidator: map[string]func(string) bool{
+				redirectLoopCookie: func(v string) bool { return strings.HasSuffix(v, ":1") },
+			},
+		},
+		{
+			URI:              "/admin",
+			Redirects:        true,
+			Cookies:          []*http.Cookie{{Name: redirectLoopCookie, Value: now + ":2"}},
+			ExpectedLocation: "/oauth/authorize?state",
+			ExpectedCode:     http.StatusTemporaryRedirect,
+			ExpectedCookiesValidator: map[string]func(string) bool{
+				redirectLoopCookie: func(v string) bool { return v == now+":3" },
+			},
+		},
+		{
+			URI:                     "/admin",
+			Redirects:               true,
+			Cookies:                 []*http.Cookie{{Name: redirectLoopCookie, Value: now + ":3"}},
+			ExpectedCode:            http.StatusLoopDetected,
+			ExpectedContentContains: "the authentication is looping",
+		},
+		{
+			// the redirections counted in a past window are forgotten
+			URI:              "/admin",
+			Redirects:        true,
+			Cookies:          []*http.Cookie{{Name: redirectLoopCookie, Value: stale + ":10"}},
+			ExpectedLocation: "/oauth/authorize?state",
+			ExpectedCode:     http.StatusTemporaryRedirect,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
 func TestRedirectToAuthorizationSkipToken(t *testing.T) {
 	requests := []fakeRequest{
 		{URI: "/admin", ExpectedCode: http.StatusUnauthorized},
@@ -17,6 +17,7 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -25,6 +26,7 @@ import (
 	"strings"
 	"time"
 
+	phttp "github.com/coreos/go-oidc/http"
 	"github.com/coreos/go-oidc/jose"
 	"github.com/coreos/go-oidc/oauth2"
 	"github.com/coreos/go-oidc/oidc"
@@ -33,7 +35,16 @@ import (
 
 // getOAuthClient returns a oauth2 client from the openid client
 func (r *oauthProxy) getOAuthClient(redirectionURL string) (*oauth2.Client, error) {
-	return oauth2.NewClient(r.idpClient, oauth2.Config{
+	return r.newOAuthClient(r.idpClient, redirectionURL)
+}
+
+// getPKCEOAuthClient returns a oauth2 client sending the code verifier with the code exchange
+func (r *oauthProxy) getPKCEOAuthClient(redirectionURL, verifier string) (*oauth2.Client, error) {
+	return r.newOAuthClient(&codeVerifierClient{client: r.idpClient, verifier: verifier}, redirectionURL)
+}
+
+func (r *oauthProxy) newOAuthClient(hc phttp.Client, redirectionURL string) (*oauth2.Client, error) {
+	return oauth2.NewClient(hc, oauth2.Config{
 		Credentials: oauth2.ClientCredentials{
 			ID:     r.config.ClientID,
 			Secret: r.config.ClientSecret,
@@ -41,21 +52,111 @@ func (r *oauthProxy) getOAuthClient(redirectionURL string) (*oauth2.Client, erro
 		AuthMethod:  oauth2.AuthMethodClientSecretBasic,
 		AuthURL:     r.idp.AuthEndpoint.String(),
 		RedirectURL: redirectionURL,
-		Scope:       append(r.config.Scopes, oidc.DefaultScope...),
+		Scope:       r.getScopes(),
 		TokenURL:    r.idp.TokenEndpoint.String(),
 	})
 }
 
+// getScopes returns the scopes requested from the provider, in order: the configured scopes followed by the default
+// openid scopes, unless disabled. With a custom delimiter, the scopes are folded into a single value.
+func (r *oauthProxy) getScopes() []string {
+	scopes := make([]string, 0, len(r.config.Scopes)+len(oidc.DefaultScope))
+	scopes = append(scopes, r.config.Scopes...)
+	if !r.config.DisableDefaultScopes {
+		scopes = append(scopes, oidc.DefaultScope...)
+	}
+	if r.config.ScopesDelimiter != "" && r.config.ScopesDelimiter != " " && len(scopes) > 0 {
+		return []string{strings.Join(scopes, r.config.ScopesDelimiter)}
+	}
+
+	return scopes
+}
+
+// checkRedirectionURL sends an authorization request with the redirection url to the provider, which refuses
+// a redirect_uri not registered for the client: keycloak, for one, answers with a 400 error page
+func (r *oauthProxy) checkRedirectionURL(ctx context.Context, redirectionURL string) error {
+	client, err := r.getOAuthClient(redirectionURL)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodGet, client.AuthCodeURL(redirectionCheckState, "", ""), nil)
+	if err != nil {
+		return err
+	}
+	if r.config.OpenIDProviderTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.config.OpenIDProviderTimeout)
+		defer cancel()
+	}
+
+	// the provider answers with either its login page or a redirection, which is not followed
+	hc := *r.idpClient
+	hc.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to check the redirection url with the provider: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("the provider refused the redirection url %s for the client %s (status %d), check it is a valid redirect uri of the client",
+			redirectionURL, r.config.ClientID, resp.StatusCode)
+	}
+	r.log.Info("the provider accepted the redirection url", zap.String("redirect_uri", redirectionURL))
+
+	return nil
+}
+
 // verifyToken verify that the token in the user context is valid
 func (r *oauthProxy) verifyToken(client *oidc.Client, token jose.JWT) error {
-	if err := client.VerifyJWT(token); err != nil {
+	// step: the algorithm is checked before the signature, whatever the keys of the provider
+	if err := verifySigningAlgorithm(token, r.config.AllowedSigningAlgorithms); err != nil {
+		return err
+	}
+
+	// step: the tokens crafted in test mode are signed by the service itself
+	if r.isTestModeToken(token) {
+		if err := r.verifyTestModeToken(token); err != nil {
+			if strings.Contains(err.Error(), "token is expired") {
+				return ErrAccessTokenExpired
+			}
+			return err
+		}
+	} else if err := client.VerifyJWT(token); err != nil {
 		if strings.Contains(err.Error(), "token is expired") {
 			return ErrAccessTokenExpired
 		}
+		// step: the keys cached to disk stand in for the ones the client could not fetch from the provider, only
+		// while the provider is unreachable: otherwise the keys of the provider are authoritative
+		if r.keySetCache == nil || r.keySetCache.isSynced() {
+			return err
+		}
+		if errc := r.verifyWithCachedKeys(token); errc != nil {
+			return err
+		}
+		r.log.Debug("the token was verified with the cached keys of the provider")
+	}
 
+	// step: the provider library does not check the token is already valid
+	if err := verifyNotBefore(token); err != nil {
 		return err
 	}
 
+	if r.config.EnableTokenTypeCheck {
+		if err := verifyTokenType(token, r.config.AcceptedTokenTypes); err != nil {
+			return err
+		}
+	}
+
+	if r.config.ExpectedAuthorizedParty != "" {
+		if err := verifyAuthorizedParty(token, r.config.ExpectedAuthorizedParty); err != nil {
+			return err
+		}
+	}
+
 	if len(r.config.RequiredScopes) > 0 {
 		claims, err := token.Claims()
 		if err != nil {
@@ -94,6 +195,133 @@ func (r *oauthProxy) verifyToken(client *oidc.Client, token jose.JWT) error {
 	return nil
 }
 
+// verifySigningAlgorithm checks the token is signed with one of the allowed algorithms, or one of the asymmetric
+// ones by default. Unsigned tokens (none) are never allowed.
+func verifySigningAlgorithm(token jose.JWT, allowed []string) error {
+	if len(allowed) == 0 {
+		allowed = asymmetricSigningAlgorithms
+	}
+	alg := token.Header[jose.HeaderKeyAlgorithm]
+	if alg == "" || strings.EqualFold(alg, "none") || !containedIn(alg, allowed, false) {
+		return fmt.Errorf("%w: %q", ErrSigningAlgorithm, alg)
+	}
+
+	return nil
+}
+
+// verifyNotBefore checks the token is not used before its nbf claim, if any. Like the expiry, the
+// not-before time is compared to the current time without tolerance.
+func verifyNotBefore(token jose.JWT) error {
+	claims, err := token.Claims()
+	if err != nil {
+		return err
+	}
+	nbf, found, err := claims.TimeClaim(claimNotBefore)
+	if err != nil {
+		return err
+	}
+	if found && !nbf.IsZero() && time.Now().Before(nbf) {
+		return ErrAccessTokenNotYetValid
+	}
+
+	return nil
+}
+
+// verifyIdentity verifies the access token of the user, but the opaque ones: those were verified by the provider when
+// fetching their userinfo
+func (r *oauthProxy) verifyIdentity(user *userContext) error {
+	if user.isOpaque() {
+		return nil
+	}
+
+	return r.verifyToken(r.client, user.token)
+}
+
+// verifyTokenType checks the typ header and claim of the token, when present, are accepted. The media types are
+// compared without their application/ prefix, e.g. application/at+jwt.
+func verifyTokenType(token jose.JWT, accepted []string) error {
+	claims, err := token.Claims()
+	if err != nil {
+		return err
+	}
+	claimed, _, err := claims.StringClaim(claimTokenType)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnexpectedTokenType, err)
+	}
+	for _, typ := range []string{token.Header[jose.HeaderMediaType], claimed} {
+		if typ == "" {
+			continue
+		}
+		if !isAcceptedTokenType(typ, accepted) {
+			return fmt.Errorf("%w: %s", ErrUnexpectedTokenType, typ)
+		}
+	}
+
+	return nil
+}
+
+// isAcceptedTokenType checks the type is one of the accepted ones, regardless of case
+func isAcceptedTokenType(typ string, accepted []string) bool {
+	typ = strings.TrimPrefix(strings.ToLower(typ), "application/")
+	for _, x := range accepted {
+		if strings.EqualFold(typ, strings.TrimPrefix(strings.ToLower(x), "application/")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verifyAuthorizedParty checks the token was issued to the expected client: the audience may list
+// other clients of the realm
+func verifyAuthorizedParty(token jose.JWT, party string) error {
+	claims, err := token.Claims()
+	if err != nil {
+		return err
+	}
+	azp, found, err := claims.StringClaim(claimAuthorizedParty)
+	if err != nil {
+		return err
+	}
+	if !found || azp != party {
+		return ErrAuthorizedPartyMismatch
+	}
+
+	return nil
+}
+
+// verifyNonce checks the ID token carries back the nonce sent with the authorization request
+func verifyNonce(token jose.JWT, nonce string) error {
+	claims, err := token.Claims()
+	if err != nil {
+		return err
+	}
+	value, found, err := claims.StringClaim(claimNonce)
+	if err != nil {
+		return err
+	}
+	if !found || nonce == "" || subtle.ConstantTimeCompare([]byte(value), []byte(nonce)) != 1 {
+		return ErrNonceMismatch
+	}
+
+	return nil
+}
+
+// getSessionID returns the session id (sid claim) of the first token holding one, if any
+func getSessionID(tokens ...jose.JWT) string {
+	for _, token := range tokens {
+		claims, err := token.Claims()
+		if err != nil {
+			continue
+		}
+		if sid, found, err := claims.StringClaim(claimSessionID); err == nil && found && sid != "" {
+			return sid
+		}
+	}
+
+	return ""
+}
+
 // getRefreshedToken attempts to refresh the access token, returning the parsed token, optionally with a renewed
 // refresh token and the time the access and refresh tokens expire
 //
@@ -110,6 +338,9 @@ func getRefreshedToken(client *oidc.Client, t string) (jose.JWT, string, time.Ti
 		if strings.Contains(err.Error(), "refresh token has expired") {
 			return jose.JWT{}, "", time.Time{}, time.Duration(0), ErrRefreshTokenExpired
 		}
+		if oerr, ok := err.(*oauth2.Error); ok && oerr.Type == oauth2.ErrorInvalidGrant {
+			return jose.JWT{}, "", time.Time{}, time.Duration(0), ErrRefreshTokenInvalidGrant
+		}
 		return jose.JWT{}, "", time.Time{}, time.Duration(0), err
 	}
 
@@ -139,35 +370,66 @@ func exchangeAuthenticationCode(client *oauth2.Client, code string) (oauth2.Toke
 	return getToken(client, oauth2.GrantTypeAuthCode, code)
 }
 
-// getUserinfo is responsible for getting the userinfo from the IDP
-func getUserinfo(client *oauth2.Client, endpoint string, token string) (jose.Claims, error) {
-	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, endpoint, nil)
+// getUserinfo is responsible for getting the userinfo from the IDP. Each attempt is bound by the timeout, and
+// transient failures (network errors, server errors) are retried, unless the context is done.
+func getUserinfo(ctx context.Context, client *oauth2.Client, endpoint string, token string, timeout time.Duration, retries int) (jose.Claims, error) {
+	start := time.Now()
+	defer func() {
+		oauthLatencyMetric.WithLabelValues("userinfo").Observe(time.Since(start).Seconds())
+	}()
+
+	for attempt := 0; ; attempt++ {
+		claims, transient, err := requestUserinfo(ctx, client, endpoint, token, timeout)
+		if err == nil || !transient || attempt >= retries || ctx.Err() != nil {
+			return claims, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(userinfoRetryDelay):
+		}
+	}
+}
+
+// requestUserinfo performs a single request to the userinfo endpoint, telling if a failure is transient
+func requestUserinfo(ctx context.Context, client *oauth2.Client, endpoint string, token string, timeout time.Duration) (jose.Claims, bool, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	req.Header.Set(authorizationHeader, fmt.Sprintf("Bearer %s", token))
 
 	resp, err := client.HttpClient().Do(req)
 	if err != nil {
-		return nil, err
+		return nil, true, err
 	}
 	defer func() {
 		_ = resp.Body.Close()
 	}()
 
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, true, fmt.Errorf("userinfo endpoint responded with status %d", resp.StatusCode)
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("token not validate by userinfo endpoint")
+		return nil, false, errors.New("token not validate by userinfo endpoint")
 	}
 	content, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, true, err
 	}
 	var claims jose.Claims
 	if err := json.Unmarshal(content, &claims); err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	return claims, nil
+	return claims, false, nil
 }
 
 // getToken retrieves a code from the provider, extracts and verified the token
@@ -16,15 +16,19 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -33,6 +37,7 @@ import (
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type fakeAuthServer struct {
@@ -41,6 +46,26 @@ type fakeAuthServer struct {
 	signer     jose.Signer
 	server     *httptest.Server
 	expiration time.Duration
+	// invalidGrant rejects all refresh tokens
+	invalidGrant bool
+	// userinfo holds extra claims returned by the userinfo endpoint
+	userinfo jose.Claims
+	// opaqueTokens holds the userinfo of the opaque access tokens the userinfo endpoint accepts
+	opaqueTokens map[string]jose.Claims
+	// revoked holds the tokens revoked at the revocation endpoint
+	revoked map[string]bool
+
+	// nonces holds the nonce of the authorization requests, by code
+	sync.Mutex
+	nonces map[string]string
+	// challenges holds the pkce code challenge of the authorization requests, by code
+	challenges map[string]pkceChallenge
+}
+
+// pkceChallenge is the code challenge of an authorization request and its method
+type pkceChallenge struct {
+	challenge string
+	method    string
 }
 
 const fakePrivateKey = `
@@ -109,7 +134,10 @@ func newFakeAuthServer() *fakeAuthServer {
 			Modulus:  privateKey.PublicKey.N,
 			Secret:   block.Bytes,
 		},
-		signer: jose.NewSignerRSA("test-kid", *privateKey),
+		signer:     jose.NewSignerRSA("test-kid", *privateKey),
+		nonces:     make(map[string]string),
+		challenges: make(map[string]pkceChallenge),
+		revoked:    make(map[string]bool),
 	}
 
 	r := chi.NewRouter()
@@ -121,6 +149,7 @@ func newFakeAuthServer() *fakeAuthServer {
 	r.Get("/auth/realms/hod-test/protocol/openid-connect/userinfo", service.userInfoHandler)
 	r.Post("/auth/realms/hod-test/protocol/openid-connect/logout", service.logoutHandler)
 	r.Post("/auth/realms/hod-test/protocol/openid-connect/token", service.tokenHandler)
+	r.Post("/auth/realms/hod-test/protocol/openid-connect/revoke", service.revocationHandler)
 
 	service.server = httptest.NewServer(r)
 	location, err := url.Parse(service.server.URL)
@@ -145,6 +174,10 @@ func (r *fakeAuthServer) getRevocationURL() string {
 	return fmt.Sprintf("%s://%s/auth/realms/hod-test/protocol/openid-connect/logout", r.location.Scheme, r.location.Host)
 }
 
+func (r *fakeAuthServer) getTokenRevocationURL() string {
+	return fmt.Sprintf("%s://%s/auth/realms/hod-test/protocol/openid-connect/revoke", r.location.Scheme, r.location.Host)
+}
+
 func (r *fakeAuthServer) signToken(claims jose.Claims) (*jose.JWT, error) {
 	return jose.NewSignedJWT(claims, r.signer)
 }
@@ -154,6 +187,11 @@ func (r *fakeAuthServer) setTokenExpiration(tm time.Duration) *fakeAuthServer {
 	return r
 }
 
+func (r *fakeAuthServer) setInvalidGrant(invalid bool) *fakeAuthServer {
+	r.invalidGrant = invalid
+	return r
+}
+
 func (r *fakeAuthServer) discoveryHandler(w http.ResponseWriter, req *http.Request) {
 	renderJSON(http.StatusOK, w, req, fakeDiscoveryResponse{
 		AuthorizationEndpoint:            fmt.Sprintf("http://%s/auth/realms/hod-test/protocol/openid-connect/auth", r.location.Host),
@@ -186,7 +224,10 @@ func (r *fakeAuthServer) authHandler(w http.ResponseWriter, req *http.Request) {
 	if state == "" {
 		state = "/"
 	}
-	redirectionURL := fmt.Sprintf("%s?state=%s&code=%s", redirect, state, getRandomString(32))
+	code := getRandomString(32)
+	r.rememberNonce(code, req.URL.Query().Get("nonce"))
+	r.rememberChallenge(code, req.URL.Query().Get("code_challenge"), req.URL.Query().Get("code_challenge_method"))
+	redirectionURL := fmt.Sprintf("%s?state=%s&code=%s", redirect, state, code)
 
 	http.Redirect(w, req, redirectionURL, http.StatusTemporaryRedirect)
 }
@@ -200,12 +241,43 @@ func (r *fakeAuthServer) logoutHandler(w http.ResponseWriter, req *http.Request)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (r *fakeAuthServer) revocationHandler(w http.ResponseWriter, req *http.Request) {
+	if id, secret, ok := req.BasicAuth(); !ok || id != fakeClientID || secret != fakeSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	token := req.FormValue("token")
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.Lock()
+	r.revoked[token] = true
+	r.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (r *fakeAuthServer) isRevoked(token string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.revoked[token]
+}
+
 func (r *fakeAuthServer) userInfoHandler(w http.ResponseWriter, req *http.Request) {
 	items := strings.Split(req.Header.Get("Authorization"), " ")
 	if len(items) != 2 {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	r.Lock()
+	opaque, found := r.opaqueTokens[items[1]]
+	r.Unlock()
+	if found {
+		renderJSON(http.StatusOK, w, req, opaque)
+		return
+	}
 	decoded, err := jose.ParseJWT(items[1])
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
@@ -217,7 +289,7 @@ func (r *fakeAuthServer) userInfoHandler(w http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	renderJSON(http.StatusOK, w, req, map[string]interface{}{
+	info := map[string]interface{}{
 		"sub":                claims["sub"],
 		"name":               claims["name"],
 		"given_name":         claims["given_name"],
@@ -225,7 +297,11 @@ func (r *fakeAuthServer) userInfoHandler(w http.ResponseWriter, req *http.Reques
 		"preferred_username": claims["preferred_username"],
 		"email":              claims["email"],
 		"picture":            claims["picture"],
-	})
+	}
+	for k, v := range r.userinfo {
+		info[k] = v
+	}
+	renderJSON(http.StatusOK, w, req, info)
 }
 
 func (r *fakeAuthServer) makeToken(newJTI ...bool) (*jose.JWT, time.Time, error) {
@@ -242,6 +318,57 @@ func (r *fakeAuthServer) makeToken(newJTI ...bool) (*jose.JWT, time.Time, error)
 	return token, expires, err
 }
 
+// rememberNonce keeps the nonce of an authorization request until its code is exchanged
+func (r *fakeAuthServer) rememberNonce(code, nonce string) {
+	if nonce == "" {
+		return
+	}
+	r.Lock()
+	r.nonces[code] = nonce
+	r.Unlock()
+}
+
+// rememberChallenge keeps the pkce code challenge of an authorization request until its code is exchanged
+func (r *fakeAuthServer) rememberChallenge(code, challenge, method string) {
+	if challenge == "" {
+		return
+	}
+	r.Lock()
+	r.challenges[code] = pkceChallenge{challenge: challenge, method: method}
+	r.Unlock()
+}
+
+// verifyChallenge checks the code verifier of the exchange matches the challenge of the authorization request
+func (r *fakeAuthServer) verifyChallenge(code, verifier string) bool {
+	r.Lock()
+	c, found := r.challenges[code]
+	delete(r.challenges, code)
+	r.Unlock()
+	if !found {
+		return verifier == ""
+	}
+
+	return verifier != "" && codeChallenge(verifier, c.method) == c.challenge
+}
+
+// withNonce signs the ID token again with the nonce of the authorization request, if any
+func (r *fakeAuthServer) withNonce(token *jose.JWT, code string) (*jose.JWT, error) {
+	r.Lock()
+	nonce, found := r.nonces[code]
+	delete(r.nonces, code)
+	r.Unlock()
+	if !found {
+		return token, nil
+	}
+	claims, err := token.Claims()
+	if err != nil {
+		return nil, err
+	}
+	claims.Add(claimNonce, nonce)
+
+	return jose.NewSignedJWT(claims, r.signer)
+}
+
 func (r *fakeAuthServer) tokenHandler(w http.ResponseWriter, req *http.Request) {
 	token, expires, err := r.makeToken()
 	if err != nil {
@@ -271,6 +398,13 @@ func (r *fakeAuthServer) tokenHandler(w http.ResponseWriter, req *http.Request)
 			"error_description": "invalid user credentials",
 		})
 	case oauth2.GrantTypeRefreshToken:
+		if r.invalidGrant {
+			renderJSON(http.StatusBadRequest, w, req, map[string]string{
+				"error":             oauth2.ErrorInvalidGrant,
+				"error_description": "Token is not active",
+			})
+			return
+		}
 		token, expires, _ = r.makeToken(true)
 		refreshToken, _, _ := r.makeToken(true)
 		renderJSON(http.StatusOK, w, req, tokenResponse{
@@ -280,8 +414,20 @@ func (r *fakeAuthServer) tokenHandler(w http.ResponseWriter, req *http.Request)
 			ExpiresIn:    expires.Second(),
 		})
 	case oauth2.GrantTypeAuthCode:
+		if !r.verifyChallenge(req.FormValue("code"), req.FormValue("code_verifier")) {
+			renderJSON(http.StatusBadRequest, w, req, map[string]string{
+				"error":             "invalid_grant",
+				"error_description": "PKCE verification failed",
+			})
+			return
+		}
+		idToken, err := r.withNonce(token, req.FormValue("code"))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 		renderJSON(http.StatusOK, w, req, tokenResponse{
-			IDToken:      token.Encode(),
+			IDToken:      idToken.Encode(),
 			AccessToken:  token.Encode(),
 			RefreshToken: token.Encode(),
 			ExpiresIn:    expires.Second(),
@@ -295,11 +441,116 @@ func TestGetUserinfo(t *testing.T) {
 	px, idp, _ := newTestProxyService(nil)
 	token := newTestToken(idp.getLocation()).getToken()
 	client, _ := px.client.OAuthClient()
-	claims, err := getUserinfo(client, px.idp.UserInfoEndpoint.String(), token.Encode())
+	claims, err := getUserinfo(context.Background(), client, px.idp.UserInfoEndpoint.String(), token.Encode(), time.Second, 0)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, claims)
 }
 
+func TestGetUserinfoRetries(t *testing.T) {
+	px, idp, _ := newTestProxyService(nil)
+	token := newTestToken(idp.getLocation()).getToken()
+	client, _ := px.client.OAuthClient()
+
+	var calls int32
+	status := http.StatusServiceUnavailable
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(status)
+			return
+		}
+		_, _ = w.Write([]byte(`{"sub":"1e11e539-8256-4b3b-bda8-cc0d56cddb48"}`))
+	}))
+	defer endpoint.Close()
+
+	// a transient error is retried
+	claims, err := getUserinfo(context.Background(), client, endpoint.URL, token.Encode(), time.Second, 1)
+	require.NoError(t, err)
+	assert.NotEmpty(t, claims)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// a rejected token is not
+	atomic.StoreInt32(&calls, 0)
+	status = http.StatusUnauthorized
+	_, err = getUserinfo(context.Background(), client, endpoint.URL, token.Encode(), time.Second, 1)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestGetUserinfoTimeout(t *testing.T) {
+	px, idp, _ := newTestProxyService(nil)
+	token := newTestToken(idp.getLocation()).getToken()
+	client, _ := px.client.OAuthClient()
+
+	done := make(chan struct{})
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-done:
+		case <-req.Context().Done():
+		}
+	}))
+	defer endpoint.Close()
+	defer close(done)
+
+	start := time.Now()
+	_, err := getUserinfo(context.Background(), client, endpoint.URL, token.Encode(), 100*time.Millisecond, 1)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "the userinfo request should have timed out")
+
+	// a cancelled request is not retried
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = getUserinfo(ctx, client, endpoint.URL, token.Encode(), time.Minute, 3)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestCheckRedirectionURL(t *testing.T) {
+	px, _, _ := newTestProxyService(nil)
+	assert.NoError(t, px.checkRedirectionURL(context.Background(), "http://127.0.0.1/oauth/callback"))
+
+	var redirectURI string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		redirectURI = req.URL.Query().Get("redirect_uri")
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer provider.Close()
+	endpoint, err := url.Parse(provider.URL + "/auth")
+	require.NoError(t, err)
+	px.idp.AuthEndpoint = endpoint
+
+	err = px.checkRedirectionURL(context.Background(), "http://127.0.0.1/oauth/callback")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "refused the redirection url")
+	assert.Equal(t, "http://127.0.0.1/oauth/callback", redirectURI)
+}
+
+func TestGetScopes(t *testing.T) {
+	cases := []struct {
+		Scopes    []string
+		Disable   bool
+		Delimiter string
+		Expected  []string
+	}{
+		{Expected: []string{"openid", "email", "profile"}},
+		{Scopes: []string{"offline"}, Expected: []string{"offline", "openid", "email", "profile"}},
+		{Scopes: []string{"profile", "openid"}, Disable: true, Expected: []string{"profile", "openid"}},
+		{Scopes: []string{"openid", "api"}, Disable: true, Delimiter: " ", Expected: []string{"openid", "api"}},
+		{Scopes: []string{"openid", "api"}, Disable: true, Delimiter: ",", Expected: []string{"openid,api"}},
+	}
+	for i, c := range cases {
+		px := &oauthProxy{config: &Config{Scopes: c.Scopes, DisableDefaultScopes: c.Disable, ScopesDelimiter: c.Delimiter}}
+		assert.Equal(t, c.Expected, px.getScopes(), "case %d", i)
+	}
+
+	px, _, _ := newTestProxyService(nil)
+	px.config.Scopes = []string{"profile", "openid"}
+	px.config.DisableDefaultScopes = true
+	client, err := px.getOAuthClient("http://127.0.0.1/oauth/callback")
+	require.NoError(t, err)
+	location, err := url.Parse(client.AuthCodeURL("state", "", ""))
+	require.NoError(t, err)
+	assert.Equal(t, "profile openid", location.Query().Get("scope"))
+}
+
 func TestTokenExpired(t *testing.T) {
 	px, idp, _ := newTestProxyService(nil)
 	token := newTestToken(idp.getLocation())
@@ -332,6 +583,139 @@ func TestTokenExpired(t *testing.T) {
 	}
 }
 
+func TestTokenNotYetValid(t *testing.T) {
+	px, idp, _ := newTestProxyService(nil)
+	token := newTestToken(idp.getLocation())
+	cs := []struct {
+		NotBefore time.Duration
+		Error     error
+	}{
+		{
+			NotBefore: -1 * time.Minute,
+		},
+		{
+			NotBefore: 1 * time.Hour,
+			Error:     ErrAccessTokenNotYetValid,
+		},
+	}
+	for i, x := range cs {
+		token.claims.Add(claimNotBefore, float64(time.Now().Add(x.NotBefore).Unix()))
+		signed, err := idp.signToken(token.claims)
+		if !assert.NoError(t, err, "case %d unable to sign the token", i) {
+			continue
+		}
+		assert.Equal(t, x.Error, px.verifyToken(px.client, *signed), "case %d", i)
+	}
+}
+
+func TestGetRefreshedTokenInvalidGrant(t *testing.T) {
+	px, idp, _ := newTestProxyService(nil)
+	idp.setInvalidGrant(true)
+	token := newTestToken(idp.getLocation()).getToken()
+	_, _, _, _, err := getRefreshedToken(px.client, token.Encode())
+	assert.Equal(t, ErrRefreshTokenInvalidGrant, err)
+}
+
+func TestVerifyNonce(t *testing.T) {
+	_, idp, _ := newTestProxyService(nil)
+	token := newTestToken(idp.getLocation())
+	token.claims.Add(claimNonce, "expected")
+	signed, err := idp.signToken(token.claims)
+	require.NoError(t, err)
+
+	assert.NoError(t, verifyNonce(*signed, "expected"))
+	assert.Equal(t, ErrNonceMismatch, verifyNonce(*signed, "forged"))
+	assert.Equal(t, ErrNonceMismatch, verifyNonce(*signed, ""))
+	assert.Equal(t, ErrNonceMismatch, verifyNonce(newTestToken(idp.getLocation()).getToken(), "expected"))
+}
+
+func TestTokenAuthorizedParty(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.ExpectedAuthorizedParty = fakeClientID
+	px, idp, _ := newTestProxyService(cfg)
+	cs := []struct {
+		Party interface{}
+		Error error
+	}{
+		{
+			Party: fakeClientID,
+		},
+		{
+			Party: "another-client",
+			Error: ErrAuthorizedPartyMismatch,
+		},
+		{
+			Error: ErrAuthorizedPartyMismatch,
+		},
+	}
+	for i, x := range cs {
+		token := newTestToken(idp.getLocation())
+		delete(token.claims, claimAuthorizedParty)
+		if x.Party != nil {
+			token.claims.Add(claimAuthorizedParty, x.Party)
+		}
+		signed, err := idp.signToken(token.claims)
+		if !assert.NoError(t, err, "case %d unable to sign the token", i) {
+			continue
+		}
+		assert.Equal(t, x.Error, px.verifyToken(px.client, *signed), "case %d", i)
+	}
+}
+
+func TestTokenType(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableTokenTypeCheck = true
+	cfg.AcceptedTokenTypes = newDefaultConfig().AcceptedTokenTypes
+	px, idp, _ := newTestProxyService(cfg)
+	cs := []struct {
+		Type     interface{}
+		Rejected bool
+	}{
+		{},
+		{Type: "Bearer"},
+		{Type: "bearer"},
+		{Type: "ID", Rejected: true},
+		{Type: "Refresh", Rejected: true},
+		{Type: []string{"Bearer"}, Rejected: true},
+	}
+	for i, x := range cs {
+		token := newTestToken(idp.getLocation())
+		if x.Type != nil {
+			token.claims.Add(claimTokenType, x.Type)
+		}
+		signed, err := idp.signToken(token.claims)
+		if !assert.NoError(t, err, "case %d unable to sign the token", i) {
+			continue
+		}
+		err = px.verifyToken(px.client, *signed)
+		assert.Equal(t, x.Rejected, errors.Is(err, ErrUnexpectedTokenType), "case %d: %v", i, err)
+	}
+
+	for typ, accepted := range map[string]bool{"JWT": true, "application/at+jwt": true, "logout+jwt": false} {
+		token, err := jose.NewJWT(jose.JOSEHeader{"alg": "RS256"}, jose.Claims{})
+		require.NoError(t, err)
+		// the typ header is overwritten when building the token
+		token.Header[jose.HeaderMediaType] = typ
+		assert.Equal(t, accepted, verifyTokenType(token, cfg.AcceptedTokenTypes) == nil, "typ %s", typ)
+	}
+}
+
+func TestSigningAlgorithm(t *testing.T) {
+	px, idp, _ := newTestProxyService(nil)
+	signed, err := idp.signToken(newTestToken(idp.getLocation()).claims)
+	require.NoError(t, err)
+	assert.NoError(t, px.verifyToken(px.client, *signed))
+
+	for _, alg := range []string{"", "none", "NONE", "HS256", "HS512"} {
+		token, err := jose.NewJWT(jose.JOSEHeader{jose.HeaderKeyAlgorithm: alg}, newTestToken(idp.getLocation()).claims)
+		require.NoError(t, err)
+		assert.True(t, errors.Is(px.verifyToken(px.client, token), ErrSigningAlgorithm), "alg %q", alg)
+	}
+
+	assert.NoError(t, verifySigningAlgorithm(*signed, []string{"RS256"}))
+	assert.True(t, errors.Is(verifySigningAlgorithm(*signed, []string{"ES256"}), ErrSigningAlgorithm))
+}
+
 func getRandomString(n int) string {
 	b := make([]rune, n)
 	for i := range b {
@@ -0,0 +1,124 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	phttp "github.com/coreos/go-oidc/http"
+	"github.com/coreos/go-oidc/oauth2"
+)
+
+// newCodeVerifier returns a random pkce code verifier, 43 characters of base64url
+func newCodeVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// codeChallenge derives the code challenge sent with the authorization request from the verifier
+func codeChallenge(verifier, method string) string {
+	if method == pkceMethodPlain {
+		return verifier
+	}
+	sum := sha256.Sum256([]byte(verifier))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// codeVerifierClient adds the code verifier to the authorization code exchanges, which the oauth2 client
+// has no means to pass along
+type codeVerifierClient struct {
+	client   phttp.Client
+	verifier string
+}
+
+// Do adds the code_verifier to the form of the token request
+func (c *codeVerifierClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || req.Body == nil {
+		return c.client.Do(req)
+	}
+	content, err := ioutil.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(content))
+	if err != nil {
+		return nil, err
+	}
+	if form.Get("grant_type") == oauth2.GrantTypeAuthCode {
+		form.Set("code_verifier", c.verifier)
+		content = []byte(form.Encode())
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(content))
+	req.ContentLength = int64(len(content))
+	req.Header.Set("Content-Length", strconv.Itoa(len(content)))
+
+	return c.client.Do(req)
+}
+
+// writeCodeVerifierCookie generates the code verifier of the authorization request, keeps it encrypted in a
+// cookie and returns the challenge parameters to add to the authorization url
+func (r *oauthProxy) writeCodeVerifierCookie(req *http.Request, w http.ResponseWriter) (string, error) {
+	verifier, err := newCodeVerifier()
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := encodeText(verifier, r.config.EncryptionKey)
+	if err != nil {
+		return "", err
+	}
+	r.dropRedirectCookie(w, req, requestCodeVerifierCookie, encrypted, 0)
+	method := defaultTo(r.config.PKCEChallengeMethod, pkceMethodS256)
+
+	return "&code_challenge=" + url.QueryEscape(codeChallenge(verifier, method)) +
+		"&code_challenge_method=" + url.QueryEscape(method), nil
+}
+
+// readCodeVerifierCookie returns the decrypted code verifier of the authorization request
+func (r *oauthProxy) readCodeVerifierCookie(req *http.Request) (string, error) {
+	cookie, err := req.Cookie(requestCodeVerifierCookie)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := decodeText(cookie.Value, r.config.EncryptionKey)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(verifier) == "" {
+		return "", ErrNoCodeVerifier
+	}
+
+	return verifier, nil
+}
+
+// clearCodeVerifierCookie clears the code verifier of the authorization request
+func (r *oauthProxy) clearCodeVerifierCookie(req *http.Request, w http.ResponseWriter) {
+	r.dropCookie(w, req, requestCodeVerifierCookie, "", -10*time.Hour)
+}
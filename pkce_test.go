@@ -0,0 +1,148 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodeChallenge(t *testing.T) {
+	verifier, err := newCodeVerifier()
+	require.NoError(t, err)
+	assert.Len(t, verifier, 43)
+	assert.Equal(t, verifier, codeChallenge(verifier, pkceMethodPlain))
+	// RFC 7636 appendix B
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		codeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk", pkceMethodS256))
+}
+
+func TestCodeVerifierClient(t *testing.T) {
+	var form url.Values
+	upstream := &fakeDoer{do: func(req *http.Request) (*http.Response, error) {
+		content, _ := ioutil.ReadAll(req.Body)
+		form, _ = url.ParseQuery(string(content))
+		assert.Equal(t, int64(len(content)), req.ContentLength)
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}}
+	client := &codeVerifierClient{client: upstream, verifier: "verifier"}
+
+	for grantType, expected := range map[string]string{
+		oauth2.GrantTypeAuthCode:     "verifier",
+		oauth2.GrantTypeRefreshToken: "",
+	} {
+		body := url.Values{"grant_type": {grantType}, "code": {"code"}}.Encode()
+		req, err := http.NewRequest(http.MethodPost, "http://idp/token", strings.NewReader(body))
+		require.NoError(t, err)
+		_, err = client.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, expected, form.Get("code_verifier"), "grant type: %s", grantType)
+		assert.Equal(t, "code", form.Get("code"))
+	}
+}
+
+func TestPKCEAuthorizationFlow(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnablePKCE = true
+	cfg.EncryptionKey = testKey
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(location string) *http.Response {
+		resp, err := client.Get(location)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode, location)
+		return resp
+	}
+
+	// the authorization request carries the challenge, the verifier is kept in an encrypted cookie
+	resp := get(p.getServiceURL() + cfg.WithOAuthURI(authorizationURL))
+	authURL, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.NotEmpty(t, authURL.Query().Get("code_challenge"))
+	assert.Equal(t, pkceMethodS256, authURL.Query().Get("code_challenge_method"))
+	var verifier *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == requestCodeVerifierCookie {
+			verifier = cookie
+		}
+	}
+	require.NotNil(t, verifier)
+	decoded, err := decodeText(verifier.Value, cfg.EncryptionKey)
+	require.NoError(t, err)
+	assert.Equal(t, authURL.Query().Get("code_challenge"), codeChallenge(decoded, pkceMethodS256))
+
+	// the provider redirects to the callback, which exchanges the code with the verifier
+	resp = get(authURL.String())
+	resp = get(resp.Header.Get("Location"))
+	var issued bool
+	for _, cookie := range resp.Cookies() {
+		switch cookie.Name {
+		case cfg.CookieAccessName:
+			issued = cookie.Value != ""
+		case requestCodeVerifierCookie:
+			assert.Empty(t, cookie.Value)
+		}
+	}
+	assert.True(t, issued, "the access token should have been issued")
+}
+
+func TestPKCECallbackWithoutVerifier(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnablePKCE = true
+	cfg.EncryptionKey = testKey
+	requests := []fakeRequest{
+		{
+			URI:          cfg.WithOAuthURI(callbackURL) + "?code=fake",
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:          cfg.WithOAuthURI(callbackURL) + "?code=fake",
+			Cookies:      []*http.Cookie{{Name: requestCodeVerifierCookie, Value: "forged"}},
+			ExpectedCode: http.StatusForbidden,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+// fakeDoer is a http client returning canned responses
+type fakeDoer struct {
+	do func(*http.Request) (*http.Response, error)
+}
+
+func (f *fakeDoer) Do(req *http.Request) (*http.Response, error) {
+	return f.do(req)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a set of token buckets refilled at the same rate, one per client
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// newRateLimiter creates a limiter accepting a burst of limit requests per client, refilled at limit per second
+func newRateLimiter(limit int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(limit),
+		buckets: make(map[string]*tokenBucket),
+		pruned:  time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of the client, or returns how long to wait for the next one
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	// @step: the buckets refilled to the brim are forgotten, they are the same as new ones
+	if now.Sub(l.pruned) > time.Minute {
+		for k, b := range l.buckets {
+			if l.refill(b, now) >= l.rate {
+				delete(l.buckets, k)
+			}
+		}
+		l.pruned = now
+	}
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &tokenBucket{tokens: l.rate, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.updated = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+
+	return true, 0
+}
+
+// refill returns the tokens of the bucket at the time given
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed <= 0 {
+		return b.tokens
+	}
+
+	return math.Min(l.rate, b.tokens+elapsed*l.rate)
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		allowed, _ := limiter.allow("alice", now)
+		assert.True(t, allowed, "request %d should have been allowed", i)
+	}
+	allowed, wait := limiter.allow("alice", now)
+	assert.False(t, allowed)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	allowed, _ = limiter.allow("bob", now)
+	assert.True(t, allowed, "the clients should have their own bucket")
+
+	allowed, _ = limiter.allow("alice", now.Add(500*time.Millisecond))
+	assert.True(t, allowed, "the bucket should have been refilled")
+
+	// the full buckets are forgotten
+	limiter.allow("carol", now.Add(2*time.Minute))
+	assert.Len(t, limiter.buckets, 1)
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"go.uber.org/zap"
+)
+
+// backgroundRefresher renews the access tokens of the tracked sessions as they near their expiry, off the
+// request path. The sessions are tracked in memory, a session unknown to this instance being tracked again
+// as soon as it is used.
+type backgroundRefresher struct {
+	sync.Mutex
+	// sessions holds the schedule of the tracked sessions, by opaque session id
+	sessions map[string]*refreshSchedule
+	// grace is how long before the expiry of the access token the session is renewed
+	grace time.Duration
+	// interval is the pause between two looks for the sessions due for a refresh
+	interval time.Duration
+	// refresh renews a session and returns the expiry of its new access token
+	refresh func(id string) (time.Time, error)
+	// workers is the number of concurrent refreshes
+	workers int
+	queue   chan string
+	stop    chan struct{}
+	stopped sync.Once
+	wg      sync.WaitGroup
+}
+
+// refreshSchedule is the expiry of the access token of a session and the last attempt to refresh it
+type refreshSchedule struct {
+	expiresAt time.Time
+	attempted time.Time
+	queued    bool
+}
+
+func newBackgroundRefresher(workers int, grace time.Duration, refresh func(string) (time.Time, error)) *backgroundRefresher {
+	return &backgroundRefresher{
+		sessions: make(map[string]*refreshSchedule),
+		grace:    grace,
+		interval: backgroundRefreshInterval,
+		refresh:  refresh,
+		workers:  workers,
+		queue:    make(chan string, workers),
+		stop:     make(chan struct{}),
+	}
+}
+
+// track records the expiry of the access token of a session
+func (b *backgroundRefresher) track(id string, expiresAt time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	if s, found := b.sessions[id]; found {
+		if expiresAt.After(s.expiresAt) {
+			s.expiresAt = expiresAt
+		}
+		return
+	}
+	b.sessions[id] = &refreshSchedule{expiresAt: expiresAt}
+}
+
+// forget stops tracking a session
+func (b *backgroundRefresher) forget(id string) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.sessions, id)
+}
+
+// due returns the sessions to refresh, marking them as queued. A session which was attempted recently is
+// left alone for a while, so tokens lasting less than the grace period do not loop.
+func (b *backgroundRefresher) due(now time.Time) []string {
+	b.Lock()
+	defer b.Unlock()
+	var ids []string
+	for id, s := range b.sessions {
+		switch {
+		case s.queued:
+		case !now.After(s.expiresAt.Add(-b.grace)):
+		case !s.attempted.IsZero() && now.Sub(s.attempted) < backgroundRefreshRetryDelay:
+		case !now.Before(s.expiresAt):
+			// step: the expired sessions are refreshed by their next request, if any
+			delete(b.sessions, id)
+		default:
+			s.queued = true
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// start runs the scheduler and the workers, until closed
+func (b *backgroundRefresher) start() {
+	for i := 0; i < b.workers; i++ {
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			for id := range b.queue {
+				b.process(id)
+			}
+		}()
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer close(b.queue)
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-b.stop:
+				return
+			}
+			for _, id := range b.due(time.Now()) {
+				select {
+				case b.queue <- id:
+				case <-b.stop:
+					return
+				}
+			}
+		}
+	}()
+}
+
+// process refreshes a session and records the outcome: the sessions whose refresh token was rejected are forgotten
+func (b *backgroundRefresher) process(id string) {
+	expiresAt, err := b.refresh(id)
+
+	b.Lock()
+	defer b.Unlock()
+	s, found := b.sessions[id]
+	if !found {
+		return
+	}
+	s.queued = false
+	s.attempted = time.Now()
+	switch err {
+	case nil:
+		s.expiresAt = expiresAt
+	case ErrRefreshTokenExpired, ErrRefreshTokenInvalidGrant, ErrSessionNotFound, ErrNoSessionStateFound:
+		delete(b.sessions, id)
+	}
+}
+
+// close stops the scheduler and waits for the refreshes in progress
+func (b *backgroundRefresher) close() {
+	b.stopped.Do(func() { close(b.stop) })
+	b.wg.Wait()
+}
+
+// trackOpaqueSession hands a session to the background refresher, if any, given the value of the access cookie
+// held by the session
+func (r *oauthProxy) trackOpaqueSession(id, value string) {
+	if r.refresher == nil {
+		return
+	}
+	token, err := r.parseAccessCookieValue(value)
+	if err != nil {
+		return
+	}
+	if user, err := extractIdentity(token); err == nil {
+		r.refresher.track(id, user.expiresAt)
+	}
+}
+
+// parseAccessCookieValue parses the access token from the value of the access cookie, possibly encrypted
+func (r *oauthProxy) parseAccessCookieValue(value string) (jose.JWT, error) {
+	if r.config.EnableEncryptedToken || r.config.ForceEncryptedCookie {
+		var err error
+		if value, err = decodeText(value, r.config.EncryptionKey); err != nil {
+			return jose.JWT{}, err
+		}
+	}
+
+	return jose.ParseJWT(value)
+}
+
+// refreshOpaqueSession renews the access token held by an opaque session, along with the refresh token kept in the
+// store, and returns the expiry of the new access token
+func (r *oauthProxy) refreshOpaqueSession(id string) (time.Time, error) {
+	value, err := r.GetOpaqueSession(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	token, err := r.parseAccessCookieValue(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	encrypted, err := r.GetRefreshToken(token)
+	if err != nil {
+		return time.Time{}, err
+	}
+	refresh, err := decodeText(encrypted, r.config.EncryptionKey)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	newToken, newRefreshToken, expiresAt, _, err := getRefreshedToken(r.client, refresh)
+	if err != nil {
+		r.log.Warn("failed to refresh the session in the background", zap.Error(err))
+		return time.Time{}, err
+	}
+	accessToken := newToken.Encode()
+	if r.config.EnableEncryptedToken || r.config.ForceEncryptedCookie {
+		if accessToken, err = encodeText(accessToken, r.config.EncryptionKey); err != nil {
+			return time.Time{}, err
+		}
+	}
+	session := encrypted
+	if newRefreshToken != "" {
+		if session, err = encodeText(newRefreshToken, r.config.EncryptionKey); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	// step: the refresh token is stored for the new access token before the session holds it
+	if err = r.StoreRefreshToken(newToken, session); err != nil {
+		return time.Time{}, err
+	}
+	if err = r.StoreOpaqueSession(id, accessToken); err != nil {
+		return time.Time{}, err
+	}
+	if err = r.DeleteRefreshToken(token); err != nil {
+		r.log.Warn("failed to remove the refresh token of the previous access token", zap.Error(err))
+	}
+	if user, err := extractIdentity(token); err == nil {
+		oldKey, newKey := r.getUserSessionKey(token, encrypted), r.getUserSessionKey(newToken, session)
+		if err := r.replaceUserSession(user.id, oldKey, newKey); err != nil {
+			r.log.Warn("failed to update the sessions of the user", zap.Error(err))
+		}
+		if err := r.indexSessionID(getSessionID(newToken, token), newKey); err != nil {
+			r.log.Warn("failed to update the session id index", zap.Error(err))
+		}
+	}
+	// @metric a session has been renewed ahead of its expiry
+	oauthTokensMetric.WithLabelValues("background_renew").Inc()
+
+	return expiresAt, nil
+}
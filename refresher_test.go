@@ -0,0 +1,145 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackgroundRefresherDue(t *testing.T) {
+	b := newBackgroundRefresher(1, time.Minute, nil)
+	now := time.Now()
+	b.track("later", now.Add(time.Hour))
+	b.track("soon", now.Add(45*time.Second))
+	b.track("expired", now.Add(-time.Second))
+
+	assert.Equal(t, []string{"soon"}, b.due(now))
+	assert.Empty(t, b.due(now), "a queued session is not handed twice")
+	assert.NotContains(t, b.sessions, "expired")
+
+	// a session attempted recently is left alone for a while
+	b.refresh = func(string) (time.Time, error) { return time.Time{}, fmt.Errorf("the provider is down") }
+	b.process("soon")
+	assert.Empty(t, b.due(now))
+	assert.Equal(t, []string{"soon"}, b.due(now.Add(backgroundRefreshRetryDelay+time.Second)))
+
+	// a session whose refresh token is rejected is forgotten
+	b.refresh = func(string) (time.Time, error) { return time.Time{}, ErrRefreshTokenInvalidGrant }
+	b.process("soon")
+	assert.NotContains(t, b.sessions, "soon")
+
+	b.forget("later")
+	assert.Empty(t, b.sessions)
+}
+
+func TestBackgroundRefresher(t *testing.T) {
+	var lock sync.Mutex
+	refreshed := make(map[string]int)
+	b := newBackgroundRefresher(2, time.Minute, func(id string) (time.Time, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		refreshed[id]++
+		return time.Now().Add(time.Hour), nil
+	})
+	b.interval = 10 * time.Millisecond
+	b.start()
+
+	b.track("soon", time.Now().Add(30*time.Second))
+	b.track("later", time.Now().Add(time.Hour))
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return refreshed["soon"] == 1
+	}, time.Second, 10*time.Millisecond)
+
+	b.close()
+	b.close()
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, map[string]int{"soon": 1}, refreshed)
+}
+
+func TestBackgroundRefreshSession(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "keycloak-gatekeeper")
+	require.NoError(t, err)
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	cfg := newFakeKeycloakConfig()
+	cfg.StoreURL = "boltdb:///" + tmpfile.Name()
+	cfg.EncryptionKey = testKey
+	cfg.EnableRefreshTokens = true
+	cfg.EnableOpaqueSessionCookie = true
+	cfg.EnableBackgroundRefresh = true
+	cfg.BackgroundRefreshWorkers = 1
+	// the tokens of the fake provider last an hour: they are all due for a refresh
+	cfg.RefreshGracePeriod = 2 * time.Hour
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+		_ = p.proxy.CloseStore()
+	}()
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	location := p.getServiceURL() + cfg.WithOAuthURI(authorizationURL)
+	var id string
+	for i := 0; i < 3 && id == ""; i++ {
+		resp, err := client.Get(location)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+		location = resp.Header.Get("Location")
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == cfg.CookieAccessName {
+				id = cookie.Value
+			}
+		}
+	}
+	require.NotEmpty(t, id, "the login should have issued an opaque session")
+	issued, err := p.proxy.GetOpaqueSession(id)
+	require.NoError(t, err)
+
+	// no request is needed for the session to be renewed
+	assert.Eventually(t, func() bool {
+		v, err := p.proxy.GetOpaqueSession(id)
+		return err == nil && v != issued
+	}, 5*time.Second, 50*time.Millisecond)
+
+	renewed, err := p.proxy.GetOpaqueSession(id)
+	require.NoError(t, err)
+	token, err := p.proxy.parseAccessCookieValue(renewed)
+	require.NoError(t, err)
+	_, err = p.proxy.GetRefreshToken(token)
+	assert.NoError(t, err, "the refresh token should be kept for the renewed access token")
+}
@@ -18,14 +18,21 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Resource represents an upstream resource to protect
 type Resource struct {
-	// URL the url for the resource
+	// Name identifies the resource in the logs, metrics and headers, defaults to its URL
+	Name string `json:"name" yaml:"name"`
+	// URL the url for the resource, or a regex matched against the request path when it starts with a ^.
+	// The exact urls take precedence over the prefixes (ending with a *), then over the regexes, in order.
 	URL string `json:"uri" yaml:"uri"`
 	// Several URLs sharing the same config: expanded as as many resources
 	URLs []string `json:"uris" yaml:"uris"`
@@ -43,10 +50,41 @@ type Resource struct {
 	Groups []string `json:"groups" yaml:"groups"`
 	// EnableCSRF enables CSRF check on this upstream Resource
 	EnableCSRF bool `json:"enable-csrf" yaml:"enable-csrf"`
+	// AllowAnonymous lets the requests without a session through to the upstream, with no identity
+	AllowAnonymous bool `json:"allow-anonymous" yaml:"allow-anonymous"`
+	// CertAuth authenticates the clients presenting a verified certificate by the certificate, without openid
+	CertAuth bool `json:"cert-auth" yaml:"cert-auth"`
+	// EnableTrailers tells the upstream the trailers of its responses are forwarded to the client
+	EnableTrailers bool `json:"enable-trailers" yaml:"enable-trailers"`
 	// StripBasePath is the prefix to strip from URL before sending upstream
 	StripBasePath string `json:"strip-basepath" yaml:"strip-basepath"`
+	// StepUpMaxAge is the maximum age of the authentication for requests using a step-up method.
+	// Older sessions, or the ones whose tokens do not tell the time of the authentication (auth_time claim), are sent
+	// back to the provider to login again.
+	StepUpMaxAge time.Duration `json:"step-up-max-age" yaml:"step-up-max-age"`
+	// StepUpMethods are the methods requiring a fresh authentication, defaults to POST, PUT and DELETE
+	StepUpMethods []string `json:"step-up-methods" yaml:"step-up-methods"`
+	// RateLimits is the number of requests per second accepted for each method, per user or client address.
+	// Each method has its own bucket, the methods not listed are not limited.
+	RateLimits map[string]int `json:"rate-limits" yaml:"rate-limits"`
+	// MatchClaims are the claims the token must match to access the resource, on top of the global ones
+	MatchClaims map[string]string `json:"match-claims" yaml:"match-claims"`
+	// SkipSecurityHeaders removes the browser-oriented security headers (csp, frame, xss and nosniff) from the responses,
+	// e.g. for an api or a page embedded by other sites. Strict transport security is kept.
+	SkipSecurityHeaders bool `json:"skip-security-headers" yaml:"skip-security-headers"`
+	// SecurityHeaders overrides the security headers of the responses, an empty value removes the header
+	SecurityHeaders map[string]string `json:"security-headers" yaml:"security-headers"`
 	// Upstream is the upstream endpoint i.e whom were proxying to
 	Upstream string `json:"upstream-url" yaml:"upstream-url" usage:"url for the upstream endpoint you wish to proxy this resource"`
+	// Upstreams are several upstream endpoints the requests are balanced over, in turn, in place of Upstream
+	Upstreams []string `json:"upstream-urls" yaml:"upstream-urls"`
+	// UpstreamBasicAuth are the credentials supplied to the upstream as basic authentication, in place of the user token.
+	// It is either user:password or a reference to a file holding them, e.g. @/run/secrets/upstream
+	UpstreamBasicAuth string `json:"upstream-basic-auth" yaml:"upstream-basic-auth"`
+	// UpstreamCRL is the path to the revocation lists, PEM or DER, the certificates presented by the upstream are checked against
+	UpstreamCRL string `json:"upstream-crl" yaml:"upstream-crl"`
+	// EnableUpstreamOCSP checks the certificates presented by the upstream with the OCSP responders they name
+	EnableUpstreamOCSP bool `json:"enable-upstream-ocsp" yaml:"enable-upstream-ocsp"`
 	// TODO: UpstreamCA is the path to a CA certificate in PEM format to validate the upstream certificate
 	// UpstreamCA string `json:"upstream-ca" yaml:"upstream-ca" usage:"the path to a file container a CA certificate to validate the upstream tls endpoint for this resource"`
 }
@@ -68,16 +106,18 @@ func (r *Resource) parse(resource string) (*Resource, error) {
 			return nil, errors.New("invalid resource keypair, should be (uri|uris|roles|methods|white-listed)=comma_values")
 		}
 		switch kp[0] {
+		case "name":
+			r.Name = kp[1]
 		case "uri":
 			r.URL = kp[1]
-			if !strings.HasPrefix(r.URL, "/") {
-				return nil, errors.New("the resource uri should start with a '/'")
+			if !strings.HasPrefix(r.URL, "/") && !strings.HasPrefix(r.URL, regexURLPrefix) {
+				return nil, errors.New("the resource uri should start with a '/' or a '^'")
 			}
 		case "uris":
 			r.URLs = strings.Split(kp[1], ",")
 			for _, u := range r.URLs {
-				if !strings.HasPrefix(u, "/") {
-					return nil, errors.New("the resource uri should start with a '/'")
+				if !strings.HasPrefix(u, "/") && !strings.HasPrefix(u, regexURLPrefix) {
+					return nil, errors.New("the resource uri should start with a '/' or a '^'")
 				}
 
 			}
@@ -106,14 +146,89 @@ func (r *Resource) parse(resource string) (*Resource, error) {
 			r.WhiteListed = value
 		case "upstream-url":
 			r.Upstream = kp[1]
+		case "upstream-urls":
+			r.Upstreams = strings.Split(kp[1], ",")
 		case "strip-basepath":
 			r.StripBasePath = kp[1]
+		case "upstream-basic-auth":
+			r.UpstreamBasicAuth = kp[1]
+		case "upstream-crl":
+			r.UpstreamCRL = kp[1]
+		case "enable-upstream-ocsp":
+			v, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, errors.New("the value of enable-upstream-ocsp must be true|TRUE|T or it's false equivalent")
+			}
+			r.EnableUpstreamOCSP = v
 		case "enable-csrf":
 			v, err := strconv.ParseBool(kp[1])
 			if err != nil {
 				return nil, errors.New("the value of enable-csrf must be true|TRUE|T or it's false equivalent")
 			}
 			r.EnableCSRF = v
+		case "allow-anonymous":
+			v, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, errors.New("the value of allow-anonymous must be true|TRUE|T or it's false equivalent")
+			}
+			r.AllowAnonymous = v
+		case "cert-auth":
+			v, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, errors.New("the value of cert-auth must be true|TRUE|T or it's false equivalent")
+			}
+			r.CertAuth = v
+		case "enable-trailers":
+			v, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, errors.New("the value of enable-trailers must be true|TRUE|T or it's false equivalent")
+			}
+			r.EnableTrailers = v
+		case "step-up-max-age":
+			v, err := time.ParseDuration(kp[1])
+			if err != nil {
+				return nil, errors.New("the value of step-up-max-age must be a valid duration")
+			}
+			r.StepUpMaxAge = v
+		case "step-up-methods":
+			r.StepUpMethods = strings.Split(kp[1], ",")
+		case "rate-limits":
+			r.RateLimits = make(map[string]int)
+			for _, limit := range strings.Split(kp[1], ",") {
+				items := strings.SplitN(limit, ":", 2)
+				if len(items) != 2 {
+					return nil, errors.New("the value of rate-limits must be a list of method:requests-per-second")
+				}
+				v, err := strconv.Atoi(items[1])
+				if err != nil {
+					return nil, errors.New("the value of rate-limits must be a list of method:requests-per-second")
+				}
+				r.RateLimits[strings.ToUpper(items[0])] = v
+			}
+		case "match-claims":
+			r.MatchClaims = make(map[string]string)
+			for _, claim := range strings.Split(kp[1], ",") {
+				items := strings.SplitN(claim, ":", 2)
+				if len(items) != 2 || items[0] == "" {
+					return nil, errors.New("the value of match-claims must be a list of claim:regex")
+				}
+				r.MatchClaims[items[0]] = items[1]
+			}
+		case "skip-security-headers":
+			v, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, errors.New("the value of skip-security-headers must be true|TRUE|T or it's false equivalent")
+			}
+			r.SkipSecurityHeaders = v
+		case "security-headers":
+			r.SecurityHeaders = make(map[string]string)
+			for _, header := range strings.Split(kp[1], ",") {
+				items := strings.SplitN(header, ":", 2)
+				if len(items) != 2 || items[0] == "" {
+					return nil, errors.New("the value of security-headers must be a list of header:value")
+				}
+				r.SecurityHeaders[http.CanonicalHeaderKey(items[0])] = items[1]
+			}
 		default:
 			return nil, errors.New("invalid identifier, should be roles, uri or methods")
 		}
@@ -133,6 +248,15 @@ func (r *Resource) valid() error {
 	if r.Roles == nil {
 		r.Roles = make([]string, 0)
 	}
+	if r.AllowAnonymous && (r.WhiteListed || r.BlackListed) {
+		return errors.New("can't allow anonymous access to a white or black listed resource")
+	}
+	if r.AllowAnonymous && (len(r.Roles) > 0 || len(r.Groups) > 0) {
+		return errors.New("can't allow anonymous access to a resource requiring roles or groups")
+	}
+	if r.CertAuth && (r.WhiteListed || r.BlackListed) {
+		return errors.New("can't authenticate the clients by certificate on a white or black listed resource")
+	}
 	if r.URL != "" && len(r.URLs) > 0 {
 		return errors.New("can't specify both uri and uris")
 	}
@@ -146,7 +270,18 @@ func (r *Resource) valid() error {
 			}
 		}
 	}
-	if strings.HasSuffix(r.URL, "/") && !r.WhiteListed {
+	for _, u := range append([]string{r.URL}, r.URLs...) {
+		if !strings.HasPrefix(u, regexURLPrefix) {
+			continue
+		}
+		if _, err := regexp.Compile(u); err != nil {
+			return fmt.Errorf("the resource uri %s is not a valid regex: %v", u, err)
+		}
+		if r.StripBasePath != "" {
+			return fmt.Errorf("the resource uri %s is a regex, which can't be used with strip-basepath", u)
+		}
+	}
+	if strings.HasSuffix(r.URL, "/") && !r.WhiteListed && !r.isRegex() {
 		return fmt.Errorf("you need a wildcard on the url resource to cover all request i.e. --resources=uri=%s*", r.URL)
 	}
 	if r.Upstream != "" {
@@ -154,6 +289,14 @@ func (r *Resource) valid() error {
 			return fmt.Errorf("upstream specified for resource %s is not a valid URL: %q", r.URL, r.Upstream)
 		}
 	}
+	if r.Upstream != "" && len(r.Upstreams) > 0 {
+		return fmt.Errorf("the resource %s can't specify both an upstream and several upstreams", r.URL)
+	}
+	for _, upstream := range r.Upstreams {
+		if u, err := url.Parse(upstream); err != nil || u.Host == "" {
+			return fmt.Errorf("upstream specified for resource %s is not a valid URL: %q", r.URL, upstream)
+		}
+	}
 
 	// step: add any of no methods
 	if len(r.Methods) == 0 {
@@ -166,9 +309,100 @@ func (r *Resource) valid() error {
 		}
 	}
 
+	if r.UpstreamBasicAuth != "" {
+		if _, _, err := r.getUpstreamBasicAuth(); err != nil {
+			return fmt.Errorf("upstream basic auth specified for resource %s is invalid: %v", r.URL, err)
+		}
+	}
+	if r.UpstreamCRL != "" {
+		if _, err := loadCRLs(r.UpstreamCRL); err != nil {
+			return fmt.Errorf("upstream revocation list specified for resource %s is invalid: %v", r.URL, err)
+		}
+	}
+
+	if r.StepUpMaxAge < 0 {
+		return fmt.Errorf("step-up-max-age for resource %s cannot be negative", r.URL)
+	}
+	if r.StepUpMaxAge > 0 && len(r.StepUpMethods) == 0 {
+		r.StepUpMethods = defaultStepUpMethods
+	}
+	for _, m := range r.StepUpMethods {
+		if !isValidHTTPMethod(m) {
+			return fmt.Errorf("invalid step-up method %s", m)
+		}
+	}
+
+	for m, limit := range r.RateLimits {
+		if !isValidHTTPMethod(m) {
+			return fmt.Errorf("invalid rate limited method %s", m)
+		}
+		if limit <= 0 {
+			return fmt.Errorf("the rate limit of %s for resource %s must be positive", m, r.URL)
+		}
+	}
+
+	for k, claim := range r.MatchClaims {
+		if _, err := regexp.Compile(claim); err != nil {
+			return fmt.Errorf("the claim matcher: %s for claim: %s of resource %s is not a valid regex", claim, k, r.URL)
+		}
+	}
+
 	return nil
 }
 
+// applySecurityHeaders removes or overrides the security headers set by the shared security middleware
+func (r Resource) applySecurityHeaders(h http.Header) {
+	if r.SkipSecurityHeaders {
+		for _, k := range browserSecurityHeaders {
+			h.Del(k)
+		}
+	}
+	for k, v := range r.SecurityHeaders {
+		if v == "" {
+			h.Del(k)
+			continue
+		}
+		h.Set(k, v)
+	}
+}
+
+// getUpstreamBasicAuth returns the credentials to supply to the upstream, possibly reading them from a file
+func (r Resource) getUpstreamBasicAuth() (string, string, error) {
+	credentials := r.UpstreamBasicAuth
+	if strings.HasPrefix(credentials, "@") {
+		content, err := ioutil.ReadFile(strings.TrimPrefix(credentials, "@"))
+		if err != nil {
+			return "", "", err
+		}
+		credentials = strings.TrimSpace(string(content))
+	}
+	items := strings.SplitN(credentials, ":", 2)
+	if len(items) != 2 || items[0] == "" {
+		return "", "", errors.New("the credentials should be in the form user:password")
+	}
+
+	return items[0], items[1], nil
+}
+
+// requiresStepUp indicates if requests with this method must come with a fresh authentication
+func (r Resource) requiresStepUp(method string) bool {
+	return r.StepUpMaxAge > 0 && containsString(method, r.StepUpMethods)
+}
+
+// isRegex indicates if the url of the resource is a regex rather than a path
+func (r Resource) isRegex() bool {
+	return strings.HasPrefix(r.URL, regexURLPrefix)
+}
+
+// getName returns the name identifying the resource, its URL unless named
+func (r Resource) getName() string {
+	if r.Name != "" {
+		return r.Name
+	}
+
+	return r.URL
+}
+
 // getRoles returns a list of roles for this resource
 func (r Resource) getRoles() string {
 	return strings.Join(r.Roles, ",")
@@ -191,5 +425,9 @@ func (r Resource) String() string {
 		methods = strings.Join(r.Methods, ",")
 	}
 
+	if r.AllowAnonymous {
+		return fmt.Sprintf("uri: %s, methods: %s, required: %s, or anonymous", r.URL, methods, roles)
+	}
+
 	return fmt.Sprintf("uri: %s, methods: %s, required: %s", r.URL, methods, roles)
 }
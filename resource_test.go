@@ -16,9 +16,13 @@ limitations under the License.
 package main
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDecodeResourceBad(t *testing.T) {
@@ -32,6 +36,12 @@ func TestDecodeResourceBad(t *testing.T) {
 		{Option: "uri=/|white-listed=ERROR"},
 		{Option: "uri=/|require-any-role=BAD"},
 		{Option: "uris=,/toto"},
+		{Option: "uri=/|step-up-max-age=BAD"},
+		{Option: "uri=/|rate-limits=GET"},
+		{Option: "uri=/|rate-limits=GET:many"},
+		{Option: "uri=/|match-claims=department"},
+		{Option: "uri=/|skip-security-headers=maybe"},
+		{Option: "uri=/|security-headers=X-Frame-Options"},
 	}
 	for i, c := range cs {
 		if _, err := newResource().parse(c.Option); err == nil {
@@ -89,6 +99,53 @@ func TestResourceParseOk(t *testing.T) {
 			Option:   "uris=/*,/more,/another|require-any-role=true",
 			Resource: &Resource{URLs: []string{"/*", "/more", "/another"}, Methods: allHTTPMethods, RequireAnyRole: true},
 		},
+		{
+			Option:   "uri=/*|step-up-max-age=5m|step-up-methods=POST,PATCH",
+			Resource: &Resource{URL: "/*", Methods: allHTTPMethods, StepUpMaxAge: 5 * time.Minute, StepUpMethods: []string{"POST", "PATCH"}},
+		},
+		{
+			Option:   "name=api|uri=/api/*",
+			Resource: &Resource{Name: "api", URL: "/api/*", Methods: allHTTPMethods},
+		},
+		{
+			Option:   "uri=/*|rate-limits=get:100,POST:5",
+			Resource: &Resource{URL: "/*", Methods: allHTTPMethods, RateLimits: map[string]int{"GET": 100, "POST": 5}},
+		},
+		{
+			Option:   "uri=/finance/*|match-claims=department:^finance$,iss:http://.*",
+			Resource: &Resource{URL: "/finance/*", Methods: allHTTPMethods, MatchClaims: map[string]string{"department": "^finance$", "iss": "http://.*"}},
+		},
+		{
+			Option:   "uri=/pool/*|upstream-urls=http://first:8080,http://second:8080/base",
+			Resource: &Resource{URL: "/pool/*", Methods: allHTTPMethods, Upstreams: []string{"http://first:8080", "http://second:8080/base"}},
+		},
+		{
+			Option:   "uri=/api/*|skip-security-headers=true",
+			Resource: &Resource{URL: "/api/*", Methods: allHTTPMethods, SkipSecurityHeaders: true},
+		},
+		{
+			Option: "uri=/embed/*|security-headers=x-frame-options:SAMEORIGIN,content-security-policy:",
+			Resource: &Resource{URL: "/embed/*", Methods: allHTTPMethods, SecurityHeaders: map[string]string{
+				headerXFrameOptions: "SAMEORIGIN",
+				headerCSP:           "",
+			}},
+		},
+		{
+			Option:   "uri=/legacy/*|upstream-basic-auth=svc:secret",
+			Resource: &Resource{URL: "/legacy/*", Methods: allHTTPMethods, UpstreamBasicAuth: "svc:secret"},
+		},
+		{
+			Option:   "uri=/public/*|allow-anonymous=true",
+			Resource: &Resource{URL: "/public/*", Methods: allHTTPMethods, AllowAnonymous: true},
+		},
+		{
+			Option:   "uri=/machines/*|cert-auth=true",
+			Resource: &Resource{URL: "/machines/*", Methods: allHTTPMethods, CertAuth: true},
+		},
+		{
+			Option:   "uri=^/api/v[0-9]+/admin/.*|roles=admin",
+			Resource: &Resource{URL: "^/api/v[0-9]+/admin/.*", Methods: allHTTPMethods, Roles: []string{"admin"}},
+		},
 	}
 	for i, x := range cs {
 		r, err := newResource().parse(x.Option)
@@ -134,6 +191,90 @@ func TestIsValid(t *testing.T) {
 				URLs: []string{"/test", "/another"},
 			},
 		},
+		{
+			Resource: &Resource{URL: "/test", StepUpMaxAge: time.Minute},
+			Ok:       true,
+		},
+		{
+			Resource: &Resource{
+				URL:           "/test",
+				StepUpMaxAge:  time.Minute,
+				StepUpMethods: []string{"NO_SUCH_METHOD"},
+			},
+		},
+		{
+			Resource: &Resource{URL: "/test", UpstreamBasicAuth: "svc:secret"},
+			Ok:       true,
+		},
+		{
+			Resource: &Resource{URL: "/test", UpstreamBasicAuth: "no_password"},
+		},
+		{
+			Resource: &Resource{URL: "/test", UpstreamBasicAuth: "@/no/such/file"},
+		},
+		{
+			Resource: &Resource{URL: "/test", AllowAnonymous: true},
+			Ok:       true,
+		},
+		{
+			Resource: &Resource{URL: "/test", AllowAnonymous: true, WhiteListed: true},
+		},
+		{
+			Resource: &Resource{URL: "/test", AllowAnonymous: true, Roles: []string{"admin"}},
+		},
+		{
+			Resource: &Resource{URL: "/test", AllowAnonymous: true, Groups: []string{"staff"}},
+		},
+		{
+			Resource: &Resource{URL: "/test", CertAuth: true, WhiteListed: true},
+		},
+		{
+			Resource: &Resource{URL: "/test", UpstreamCRL: "does_not_exist"},
+		},
+		{
+			Resource: &Resource{URL: "/test", EnableUpstreamOCSP: true},
+			Ok:       true,
+		},
+		{
+			Resource: &Resource{URL: "/test", RateLimits: map[string]int{"GET": 100}},
+			Ok:       true,
+		},
+		{
+			Resource: &Resource{URL: "/test", RateLimits: map[string]int{"NO_SUCH_METHOD": 100}},
+		},
+		{
+			Resource: &Resource{URL: "/test", RateLimits: map[string]int{"GET": 0}},
+		},
+		{
+			Resource: &Resource{URL: "/test", MatchClaims: map[string]string{"department": "^finance$"}},
+			Ok:       true,
+		},
+		{
+			Resource: &Resource{URL: "/test", MatchClaims: map[string]string{"department": "(finance"}},
+		},
+		{
+			Resource: &Resource{URL: "/test", Upstreams: []string{"http://first:8080", "http://second:8080"}},
+			Ok:       true,
+		},
+		{
+			Resource: &Resource{URL: "/test", Upstream: "http://first:8080", Upstreams: []string{"http://second:8080"}},
+		},
+		{
+			Resource: &Resource{URL: "/test", Upstreams: []string{"first"}},
+		},
+		{
+			Resource: &Resource{URL: "^/api/v[0-9]+/admin/"},
+			Ok:       true,
+		},
+		{
+			Resource: &Resource{URL: "^/api/(v1"},
+		},
+		{
+			Resource: &Resource{URL: "^/api/v[0-9]+/.*", StripBasePath: "/api"},
+		},
+		{
+			Resource: &Resource{URLs: []string{"/api/*", "^/api/v[0-9]+/.*"}, StripBasePath: "/api"},
+		},
 	}
 
 	for i, c := range testCases {
@@ -144,6 +285,43 @@ func TestIsValid(t *testing.T) {
 	}
 }
 
+func TestRegexResourceValid(t *testing.T) {
+	err := (&Resource{URL: "^/api/(v1"}).valid()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is not a valid regex")
+
+	err = (&Resource{URL: "^/api/v[0-9]+/.*", StripBasePath: "/api"}).valid()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't be used with strip-basepath")
+
+	// the prefixes can still strip their base path
+	assert.NoError(t, (&Resource{URL: "/api/*", StripBasePath: "/api"}).valid())
+}
+
+func TestGetUpstreamBasicAuth(t *testing.T) {
+	username, password, err := Resource{UpstreamBasicAuth: "svc:se:cret"}.getUpstreamBasicAuth()
+	require.NoError(t, err)
+	assert.Equal(t, "svc", username)
+	assert.Equal(t, "se:cret", password)
+
+	file, err := ioutil.TempFile("", "basic-auth")
+	require.NoError(t, err)
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+	_, err = file.WriteString("svc:secret\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	username, password, err = Resource{UpstreamBasicAuth: "@" + file.Name()}.getUpstreamBasicAuth()
+	require.NoError(t, err)
+	assert.Equal(t, "svc", username)
+	assert.Equal(t, "secret", password)
+
+	_, _, err = Resource{UpstreamBasicAuth: ":secret"}.getUpstreamBasicAuth()
+	assert.Error(t, err)
+}
+
 var expectedRoles = []string{"1", "2", "3"}
 
 const rolesList = "1,2,3"
@@ -157,6 +335,11 @@ func TestResourceString(t *testing.T) {
 	}
 }
 
+func TestResourceGetName(t *testing.T) {
+	assert.Equal(t, "/admin/*", Resource{URL: "/admin/*"}.getName())
+	assert.Equal(t, "admin", Resource{Name: "admin", URL: "/admin/*"}.getName())
+}
+
 func TestGetRoles(t *testing.T) {
 	resource := &Resource{
 		Roles: expectedRoles,
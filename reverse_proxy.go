@@ -16,18 +16,30 @@ limitations under the License.
 package main
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"net/http/httputil"
 
 	"github.com/go-chi/chi"
+	"github.com/oneconcern/keycloak-gatekeeper/signing"
 	"github.com/rs/cors"
 	"go.opencensus.io/trace"
 	"go.uber.org/zap"
@@ -78,6 +90,14 @@ func (r *oauthProxy) createReverseProxy() error {
 
 			e.Post(loginURL, r.loginHandler)
 
+			if r.config.EnableIntrospection {
+				e.Post(introspectURL, r.introspectHandler)
+			}
+
+			if r.testModeKey != nil {
+				e.Post(testTokenURL, r.testTokenHandler)
+			}
+
 			if r.config.ListenAdmin == "" {
 				e.Mount("/", r.createAdminRoutes())
 			}
@@ -97,7 +117,12 @@ func (r *oauthProxy) createReverseProxy() error {
 
 	// step: provision the protected resources
 	addDefaultDeny := r.config.EnableDefaultDeny
+	regexResources := make([]*Resource, 0)
 	for _, x := range r.config.Resources {
+		if x.isRegex() {
+			regexResources = append(regexResources, x)
+			continue
+		}
 		if x.URL[len(x.URL)-1:] == "/" {
 			r.log.Warn("the resource url is not a prefix",
 				zap.String("resource", x.URL),
@@ -109,11 +134,21 @@ func (r *oauthProxy) createReverseProxy() error {
 		}
 	}
 
+	// step: the regex resources are evaluated in order, for the requests falling through to the default route
+	catchAll := chi.Router(engine)
+	if len(regexResources) > 0 {
+		middleware, err := r.regexResourcesMiddleware(regexResources)
+		if err != nil {
+			return err
+		}
+		catchAll = engine.With(middleware)
+	}
+
 	// step: define expected behaviour on default route: "/*"
 	if addDefaultDeny {
 		if r.config.EnableDefaultNotFound {
 			r.log.Info("routes which are not explicitly declared as resources will respond 401 not authenticated or 404 NotFound for authenticated users")
-			engine.With(r.authenticationMiddleware()).
+			catchAll.With(r.authenticationMiddleware()).
 				Handle(allRoutes, http.HandlerFunc(methodNotFoundHandler))
 		} else {
 			r.log.Info("adding a default denial to protected resources: all routes to upstream require authentication")
@@ -131,43 +166,24 @@ func (r *oauthProxy) createReverseProxy() error {
 			}
 			if !foundAllRoutes {
 				r.log.Info("routes which are not explicitly declared as resources will respond 404 NotFound")
-				engine.Handle(allRoutes, http.HandlerFunc(methodNotFoundHandler))
+				catchAll.Handle(allRoutes, http.HandlerFunc(methodNotFoundHandler))
 			}
 		} else {
 			r.log.Warn("routes to upstream are not configured to be denied by default")
-			engine.With(r.proxyMiddleware(nil)).HandleFunc(allRoutes, emptyHandler)
+			catchAll.With(r.proxyMiddleware(nil)).HandleFunc(allRoutes, emptyHandler)
 		}
 	}
 
 	for _, x := range r.config.Resources {
-		r.log.Info("protecting resource", zap.String("resource", x.String()))
-		switch {
-		case !x.WhiteListed && !x.BlackListed:
-			e := engine.With(
-				r.proxyMiddleware(x),
-				r.authenticationMiddleware(),
-				r.admissionMiddleware(x),
-				r.identityHeadersMiddleware(r.config.AddClaims),
-				r.csrfSkipResourceMiddleware(x),
-				r.csrfProtectMiddleware(),
-				r.csrfHeaderMiddleware())
-			e.Handle(x.URL, http.HandlerFunc(methodNotAllowedHandler))
-			for _, m := range x.Methods {
-				e.MethodFunc(m, x.URL, emptyHandler)
-			}
-		case x.WhiteListed:
-			e := engine.With(
-				r.proxyMiddleware(x),
-			)
-			e.Handle(x.URL, http.HandlerFunc(methodNotAllowedHandler))
-			for _, m := range x.Methods {
-				e.MethodFunc(m, x.URL, emptyHandler)
-			}
-		case x.BlackListed:
-			fallthrough
-		default:
-			engine.Handle(x.URL, http.HandlerFunc(r.forbiddenHandler))
+		if x.isRegex() {
+			continue
+		}
+		r.log.Info("protecting resource", zap.String("name", x.getName()), zap.String("resource", x.String()))
+		if x.URL == allRoutes {
+			r.routeResource(catchAll, x.URL, x)
+			continue
 		}
+		r.routeResource(engine, x.URL, x)
 	}
 
 	// startup information
@@ -180,10 +196,6 @@ func (r *oauthProxy) createReverseProxy() error {
 		r.log.Info("token must contain", zap.String("claim", name), zap.String("value", value))
 	}
 
-	if r.config.CorsDisableUpstream {
-		r.log.Warn("CorsDisableUpstream is now deprecated and you may safely remove this from your configuration")
-	}
-
 	if r.config.RedirectionURL == "" {
 		r.log.Warn("no redirection url has been set, will use host headers")
 	}
@@ -199,13 +211,102 @@ func (r *oauthProxy) createReverseProxy() error {
 	return nil
 }
 
+// routeResource routes the requests matching the pattern through the middleware protecting the resource
+func (r *oauthProxy) routeResource(router chi.Router, pattern string, x *Resource) {
+	switch {
+	case !x.WhiteListed && !x.BlackListed:
+		e := router.With(r.resourceMiddleware(x)...)
+		e.Handle(pattern, http.HandlerFunc(methodNotAllowedHandler))
+		for _, m := range x.Methods {
+			e.MethodFunc(m, pattern, emptyHandler)
+		}
+	case x.WhiteListed:
+		e := router.With(
+			r.proxyMiddleware(x),
+			r.rateLimitMiddleware(x),
+		)
+		e.Handle(pattern, http.HandlerFunc(methodNotAllowedHandler))
+		for _, m := range x.Methods {
+			e.MethodFunc(m, pattern, emptyHandler)
+		}
+	case x.BlackListed:
+		fallthrough
+	default:
+		router.Handle(pattern, http.HandlerFunc(r.forbiddenHandler))
+	}
+}
+
+// regexResourcesMiddleware serves the requests matching a regex resource, the first one in order, with the
+// router of this resource. It is only installed on the default route, so the exact and prefix resources come first.
+func (r *oauthProxy) regexResourcesMiddleware(resources []*Resource) (func(http.Handler) http.Handler, error) {
+	matchers := make([]*regexp.Regexp, len(resources))
+	routers := make([]http.Handler, len(resources))
+	for i, x := range resources {
+		matcher, err := regexp.Compile(x.URL)
+		if err != nil {
+			return nil, fmt.Errorf("the uri of resource %s is not a valid regex: %v", x.getName(), err)
+		}
+		r.log.Info("protecting resource", zap.String("name", x.getName()), zap.String("resource", x.String()))
+		router := chi.NewRouter()
+		r.routeResource(router, allRoutes, x)
+		matchers[i], routers[i] = matcher, router
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			for i, matcher := range matchers {
+				if matcher.MatchString(req.URL.Path) {
+					// the router of the resource starts a routing of its own
+					routers[i].ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, nil)))
+					return
+				}
+			}
+			next.ServeHTTP(w, req)
+		})
+	}, nil
+}
+
+// resourceMiddleware returns the chain of middleware protecting a resource, in the configured order
+func (r *oauthProxy) resourceMiddleware(resource *Resource) []func(http.Handler) http.Handler {
+	order := r.config.MiddlewareOrder
+	if len(order) == 0 {
+		order = defaultMiddlewareOrder
+	}
+	chain := []func(http.Handler) http.Handler{r.proxyMiddleware(resource)}
+	for _, name := range order {
+		switch name {
+		case middlewareAuthentication:
+			chain = append(chain,
+				r.trustedIdentityMiddleware(),
+				r.certIdentityMiddleware(resource),
+				r.anonymousResourceMiddleware(resource),
+				r.authenticationMiddleware())
+		case middlewareAdmission:
+			chain = append(chain, r.admissionMiddleware(resource))
+		case middlewareRateLimit:
+			chain = append(chain, r.rateLimitMiddleware(resource))
+		case middlewareIdentityHeaders:
+			chain = append(chain,
+				r.identityHeadersMiddleware(r.config.AddClaims),
+				r.clientClaimHeadersMiddleware())
+		case middlewareCSRF:
+			chain = append(chain,
+				r.csrfSkipResourceMiddleware(resource),
+				r.csrfProtectMiddleware(),
+				r.csrfHeaderMiddleware())
+		}
+	}
+
+	return chain
+}
+
 // proxyMiddleware is responsible for handling reverse proxy request to the upstream endpoint
 func (r *oauthProxy) proxyMiddleware(resource *Resource) func(http.Handler) http.Handler {
 	var upstreamHost, upstreamScheme, upstreamBasePath, stripBasePath, matched string
 	if resource != nil && resource.Upstream != "" {
 		// resource-specific routing to upstream
 		u, _ := url.Parse(resource.Upstream)
-		matched = resource.URL
+		matched = resource.getName()
 		upstreamHost = u.Host
 		upstreamScheme = u.Scheme
 		upstreamBasePath = u.Path
@@ -215,6 +316,16 @@ func (r *oauthProxy) proxyMiddleware(resource *Resource) func(http.Handler) http
 		upstreamScheme = r.endpoint.Scheme
 		upstreamBasePath = r.endpoint.Path
 	}
+	var balancer *upstreamBalancer
+	if resource != nil && len(resource.Upstreams) > 0 {
+		// resource-specific routing to several upstreams in turn
+		var err error
+		matched = resource.getName()
+		if balancer, err = newUpstreamBalancer(resource.Upstreams, upstreamDownPeriod); err != nil {
+			r.log.Error("unable to parse the upstreams of the resource",
+				zap.String("resource", resource.getName()), zap.Error(err))
+		}
+	}
 	if resource != nil {
 		stripBasePath = resource.StripBasePath
 	}
@@ -236,14 +347,45 @@ func (r *oauthProxy) proxyMiddleware(resource *Resource) func(http.Handler) http
 			}
 		})
 	}
+
+	if resource != nil && resource.EnableTrailers {
+		setters = append(setters, func(req *http.Request) {
+			// the upstream may only send its trailers to clients announcing they support them: the trailers
+			// are relayed to the client after the body, which is then always chunked
+			req.Header.Set(headerTE, "trailers")
+		})
+	}
+
+	if resource != nil && resource.UpstreamBasicAuth != "" {
+		// the upstream is given the credentials of a service account, not the user token
+		username, password, err := resource.getUpstreamBasicAuth()
+		if err != nil {
+			r.log.Error("unable to retrieve the upstream basic auth credentials",
+				zap.String("resource", resource.getName()), zap.Error(err))
+		}
+		setters = append(setters, func(req *http.Request) {
+			// the user token may have been set with a custom casing
+			for k := range req.Header {
+				if strings.EqualFold(k, authorizationHeader) {
+					delete(req.Header, k)
+				}
+			}
+			if err == nil {
+				req.SetBasicAuth(username, password)
+			}
+		})
+	}
 	cookieFilter := make([]string, 0, 4)
-	cookieFilter = append(cookieFilter, requestURICookie, requestStateCookie)
+	cookieFilter = append(cookieFilter, requestURICookie, requestStateCookie, requestNonceCookie, requestCodeVerifierCookie, refreshCooldownCookie, sessionBindingCookie)
 	if r.config.EnableCSRF {
 		setters = append(setters, func(req *http.Request) {
 			// remove csrf header
 			req.Header.Del(r.config.CSRFHeader)
 		})
 		cookieFilter = append(cookieFilter, r.config.CSRFCookieName)
+		if r.config.CSRFTokenCookie != "" {
+			cookieFilter = append(cookieFilter, r.config.CSRFTokenCookie)
+		}
 	}
 	if !r.config.EnableAuthorizationCookies {
 		cookieFilter = append(cookieFilter, r.config.CookieAccessName, r.config.CookieRefreshName)
@@ -261,12 +403,21 @@ func (r *oauthProxy) proxyMiddleware(resource *Resource) func(http.Handler) http
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if resource != nil {
+				if sc, ok := req.Context().Value(contextScopeName).(*RequestScope); ok {
+					sc.MatchedResource = resource
+				}
+				if r.config.EnableResourceHeader {
+					w.Header().Set(headerGatekeeperResource, resource.getName())
+				}
+				resource.applySecurityHeaders(w.Header())
+			}
 			next.ServeHTTP(w, req)
 
 			_, span, logger := r.traceSpan(req.Context(), "reverse proxy middleware")
 			if span != nil {
 				defer span.End()
-				propagateSpan(span, req)
+				r.propagateSpan(span, req)
 			}
 
 			// @step: retrieve the request scope
@@ -287,7 +438,7 @@ func (r *oauthProxy) proxyMiddleware(resource *Resource) func(http.Handler) http
 			}
 
 			// @step: add the proxy forwarding headers
-			req.Header.Add("X-Forwarded-For", realIP(req)) // TODO(fredbi): check if still necessary with net/http/httputil reverse proxy
+			req.Header.Add("X-Forwarded-For", realIP(req, r.trustedProxies)) // TODO(fredbi): check if still necessary with net/http/httputil reverse proxy
 			req.Header.Set("X-Forwarded-Host", req.Host)
 			if fp := req.Header.Get("X-Forwarded-Proto"); fp != "" {
 				req.Header.Set("X-Forwarded-Proto", fp)
@@ -298,16 +449,23 @@ func (r *oauthProxy) proxyMiddleware(resource *Resource) func(http.Handler) http
 			// config-driven headers
 			setHeaders(req)
 
-			req.URL.Host = upstreamHost
-			req.URL.Scheme = upstreamScheme
 			if stripBasePath != "" {
 				// strip prefix if needed
 				logger.Debug("stripping prefix from URL", zap.String("stripBasePath", stripBasePath), zap.String("original_path", req.URL.Path))
 				req.URL.Path = strings.TrimPrefix(req.URL.Path, stripBasePath)
 			}
-			if upstreamBasePath != "" {
-				// add upstream URL component if any
-				req.URL.Path = path.Join(upstreamBasePath, req.URL.Path)
+			if balancer != nil {
+				balanced := balancer.route(req)
+				if sc, ok := req.Context().Value(contextScopeName).(*RequestScope); ok {
+					sc.Balanced = balanced
+				}
+			} else {
+				req.URL.Host = upstreamHost
+				req.URL.Scheme = upstreamScheme
+				if upstreamBasePath != "" {
+					// add upstream URL component if any
+					req.URL.Path = path.Join(upstreamBasePath, req.URL.Path)
+				}
 			}
 
 			// @note: by default goproxy only provides a forwarding proxy, thus all requests have to be absolute and we must update the host headers
@@ -315,11 +473,22 @@ func (r *oauthProxy) proxyMiddleware(resource *Resource) func(http.Handler) http
 				req.Host = v
 				req.Header.Del("Host")
 			} else if !r.config.PreserveHost {
-				req.Host = upstreamHost
+				req.Host = req.URL.Host
+			}
+			if r.config.PreserveRawQuery {
+				if sc, ok := req.Context().Value(contextScopeName).(*RequestScope); ok {
+					req.URL.RawQuery = sc.RawQuery
+					// a parsed form would have the query re-encoded by the reverse proxy
+					req.Form = nil
+				}
+			}
+			if r.config.UpstreamSigningKey != "" {
+				// signed last, over the path the upstream receives
+				signing.Sign(req, []byte(r.config.UpstreamSigningKey), time.Now())
 			}
 			logger.Debug("proxying to upstream", zap.String("matched_resource", matched), zap.Stringer("upstream_url", req.URL), zap.String("host_header", req.Host))
 
-			r.upstream.ServeHTTP(w, req)
+			r.upstream.ServeHTTP(w, r.captureBodies(req))
 
 			if r.config.Verbose {
 				// debug response headers
@@ -358,30 +527,116 @@ func (r *oauthProxy) createStdProxy(upstream *url.URL) error {
 		return err
 	}
 
-	transport := &http.Transport{
-		ForceAttemptHTTP2:     true,
-		DialContext:           dialer,
-		TLSClientConfig:       tlsConfig,
-		TLSHandshakeTimeout:   r.config.UpstreamTLSHandshakeTimeout,
-		MaxIdleConns:          r.config.MaxIdleConns,
-		MaxIdleConnsPerHost:   r.config.MaxIdleConnsPerHost,
-		DisableKeepAlives:     !r.config.UpstreamKeepalives,
-		ExpectContinueTimeout: r.config.UpstreamExpectContinueTimeout,
-		ResponseHeaderTimeout: r.config.UpstreamResponseHeaderTimeout,
+	// step: oversized response headers are either refused by the transport, or truncated once received
+	truncateHeaders := r.config.UpstreamResponseHeaderPolicy == upstreamHeaderPolicyTruncate && r.config.MaxResponseHeaderBytes > 0
+	newTLSTransport := func(tlsConfig *tls.Config) (*http.Transport, error) {
+		transport := &http.Transport{
+			ForceAttemptHTTP2:     true,
+			DialContext:           dialer,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   r.config.UpstreamTLSHandshakeTimeout,
+			MaxIdleConns:          r.config.MaxIdleConns,
+			MaxIdleConnsPerHost:   r.config.MaxIdleConnsPerHost,
+			DisableKeepAlives:     !r.config.UpstreamKeepalives,
+			ExpectContinueTimeout: r.config.UpstreamExpectContinueTimeout,
+			ResponseHeaderTimeout: r.config.UpstreamResponseHeaderTimeout,
+		}
+		if !truncateHeaders {
+			transport.MaxResponseHeaderBytes = int64(r.config.MaxResponseHeaderBytes)
+		}
+		if r.config.EnableUpstreamPoolIsolation {
+			transport.MaxConnsPerHost = r.config.UpstreamMaxConnsPerPool
+		}
+		if err := http2.ConfigureTransport(transport); err != nil {
+			return nil, err
+		}
+
+		return transport, nil
 	}
-	if err = http2.ConfigureTransport(transport); err != nil {
-		return err
+	newTransport := func() (*http.Transport, error) {
+		return newTLSTransport(tlsConfig)
+	}
+
+	var roundTripper http.RoundTripper
+	if r.config.EnableUpstreamPoolIsolation {
+		r.log.Info("the connections to each upstream host are pooled apart",
+			zap.Int("max_connections_per_pool", r.config.UpstreamMaxConnsPerPool))
+		roundTripper = newUpstreamPools(newTransport)
+	} else {
+		if roundTripper, err = newTransport(); err != nil {
+			return err
+		}
+	}
+
+	// step: the resources checking the revocation of the upstream certificates have transports of their own
+	resourceTransports := make(map[*Resource]http.RoundTripper)
+	for _, x := range r.config.Resources {
+		if x.UpstreamCRL == "" && !x.EnableUpstreamOCSP {
+			continue
+		}
+		checker, err := newRevocationChecker(x.UpstreamCRL, x.EnableUpstreamOCSP, r.log)
+		if err != nil {
+			return err
+		}
+		resourceTLSConfig := tlsConfig.Clone()
+		resourceTLSConfig.VerifyPeerCertificate = checker.verifyPeerCertificate
+		// the resumed sessions skip the verification of the certificates
+		resourceTLSConfig.ClientSessionCache = nil
+		newResourceTransport := func() (*http.Transport, error) {
+			return newTLSTransport(resourceTLSConfig)
+		}
+		if r.config.EnableUpstreamPoolIsolation {
+			resourceTransports[x] = newUpstreamPools(newResourceTransport)
+		} else if resourceTransports[x], err = newResourceTransport(); err != nil {
+			return err
+		}
+		r.log.Info("the revocation of the upstream certificates is checked",
+			zap.String("resource", x.getName()),
+			zap.String("crl", x.UpstreamCRL),
+			zap.Bool("ocsp", x.EnableUpstreamOCSP))
+	}
+	if len(resourceTransports) > 0 {
+		roundTripper = &resourceTransport{RoundTripper: roundTripper, resources: resourceTransports}
+	}
+	for _, x := range r.config.Resources {
+		if len(x.Upstreams) > 0 {
+			roundTripper = &balancedTransport{RoundTripper: roundTripper}
+			break
+		}
+	}
+	if r.config.UpstreamRetries > 0 {
+		roundTripper = &retryTransport{
+			RoundTripper: roundTripper,
+			retries:      r.config.UpstreamRetries,
+			backoff:      r.config.UpstreamRetryBackoff,
+			statuses:     r.config.RetryOnStatus,
+		}
+	}
+	if r.config.EnableMetrics || r.config.UpstreamTimingHeader != "" {
+		roundTripper = &timedTransport{RoundTripper: roundTripper, header: r.config.UpstreamTimingHeader}
 	}
 	r.upstream = &httputil.ReverseProxy{
 		Director:  func(*http.Request) {}, // most of the work is already done by middleware above. Some of this could be done by Director just as well
-		Transport: transport,
+		Transport: roundTripper,
 		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
 			_, span, logger := r.traceSpan(req.Context(), "reverse proxy middleware")
 			if span != nil {
 				defer span.End()
-				span.SetStatus(trace.Status{Code: trace.StatusCodeInternal, Message: err.Error()})
 			}
 
+			// the client went away: the upstream request has been cancelled along with the client context
+			if isClientCancelled(req) {
+				if span != nil {
+					span.SetStatus(trace.Status{Code: trace.StatusCodeCancelled, Message: err.Error()})
+				}
+				logger.Info("client cancelled the request to upstream", zap.Error(err))
+				w.WriteHeader(statusClientClosedRequest)
+				return
+			}
+
+			if span != nil {
+				span.SetStatus(trace.Status{Code: trace.StatusCodeInternal, Message: err.Error()})
+			}
 			logger.Warn("reverse proxy error", zap.Error(err))
 			r.errorResponse(w, req, "", http.StatusBadGateway, err)
 		},
@@ -394,8 +649,15 @@ func (r *oauthProxy) createStdProxy(upstream *url.URL) error {
 					zap.Int64("content-length", res.ContentLength),
 					zap.Any("headers", res.Header))
 			}
-			// filter out possible conflicting headers from upstream (i.e. gatekeeper value override)
-			if r.config.EnableSecurityFilter {
+			var resource *Resource
+			if res.Request != nil {
+				if sc, ok := res.Request.Context().Value(contextScopeName).(*RequestScope); ok {
+					resource = sc.MatchedResource
+				}
+			}
+			// filter out possible conflicting headers from upstream (i.e. gatekeeper value override),
+			// unless the resource skips the security headers of gatekeeper
+			if r.config.EnableSecurityFilter && (resource == nil || !resource.SkipSecurityHeaders) {
 				if r.config.EnableBrowserXSSFilter {
 					res.Header.Del(headerXXSSProtection)
 				}
@@ -415,6 +677,26 @@ func (r *oauthProxy) createStdProxy(upstream *url.URL) error {
 			for hdr := range r.config.Headers {
 				res.Header.Del(hdr)
 			}
+			if resource != nil {
+				for hdr := range resource.SecurityHeaders {
+					res.Header.Del(hdr)
+				}
+			}
+			if truncateHeaders {
+				if dropped := truncateResponseHeaders(res.Header, int64(r.config.MaxResponseHeaderBytes)); len(dropped) > 0 {
+					r.log.Warn("the response headers of the upstream exceed the limit, some are dropped",
+						zap.Int("limit", r.config.MaxResponseHeaderBytes),
+						zap.Strings("dropped", dropped))
+				}
+			}
+			if r.config.EnableResponseDecompression {
+				if err := decompressResponse(res); err != nil {
+					return err
+				}
+			}
+			if r.config.DebugCaptureBodies {
+				r.logCapturedBodies(res)
+			}
 
 			if len(r.config.CorsOrigins) > 0 {
 				// remove cors headers from upstream
@@ -447,3 +729,400 @@ func (r *oauthProxy) useCors(engine chi.Router) {
 		engine.Use(c.Handler)
 	}
 }
+
+// truncateResponseHeaders drops the header values beyond the size limit, considering the headers by name, and
+// returns the names of the headers dropped
+func truncateResponseHeaders(headers http.Header, limit int64) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var (
+		size    int64
+		dropped []string
+	)
+	for _, name := range names {
+		values := headers[name]
+		for i, v := range values {
+			// account for the ": " and "\r\n" around each header line
+			size += int64(len(name) + len(v) + 4)
+			if size > limit {
+				if i == 0 {
+					headers.Del(name)
+				} else {
+					headers[name] = values[:i]
+				}
+				dropped = append(dropped, name)
+				break
+			}
+		}
+	}
+
+	return dropped
+}
+
+// upstreamPools isolates the connections to each upstream host in a transport of its own, created on the first request
+type upstreamPools struct {
+	sync.Mutex
+	pools        map[string]*http.Transport
+	newTransport func() (*http.Transport, error)
+}
+
+func newUpstreamPools(newTransport func() (*http.Transport, error)) *upstreamPools {
+	return &upstreamPools{
+		pools:        make(map[string]*http.Transport),
+		newTransport: newTransport,
+	}
+}
+
+func (p *upstreamPools) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport, err := p.pool(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	return transport.RoundTrip(req)
+}
+
+// pool returns the transport of the upstream host
+func (p *upstreamPools) pool(host string) (*http.Transport, error) {
+	p.Lock()
+	defer p.Unlock()
+	if transport, found := p.pools[host]; found {
+		return transport, nil
+	}
+	transport, err := p.newTransport()
+	if err != nil {
+		return nil, err
+	}
+	p.pools[host] = transport
+
+	return transport, nil
+}
+
+// upstreamBalancer spreads the requests of a resource over several upstream targets in turn, skipping the
+// targets which lately refused a connection
+type upstreamBalancer struct {
+	// next is the rank of the next target in turn, first for the alignment of the atomic operations
+	next    uint64
+	targets []*upstreamTarget
+	// downPeriod is how long a target refusing a connection is skipped
+	downPeriod time.Duration
+}
+
+// upstreamTarget is one of the upstreams of a balanced resource
+type upstreamTarget struct {
+	// downUntil is the time, in unix nanoseconds, until which the target is skipped
+	downUntil int64
+	url       *url.URL
+}
+
+// balancedRequest is the target a request of a balanced resource is sent to
+type balancedRequest struct {
+	balancer *upstreamBalancer
+	target   *upstreamTarget
+	// path is the path of the request, before the base path of the target is prepended
+	path string
+}
+
+func newUpstreamBalancer(upstreams []string, downPeriod time.Duration) (*upstreamBalancer, error) {
+	b := &upstreamBalancer{downPeriod: downPeriod}
+	for _, upstream := range upstreams {
+		u, err := url.Parse(upstream)
+		if err != nil {
+			return nil, err
+		}
+		b.targets = append(b.targets, &upstreamTarget{url: u})
+	}
+	if len(b.targets) == 0 {
+		return nil, errors.New("no upstream to balance the requests over")
+	}
+
+	return b, nil
+}
+
+// pick returns the next healthy target in turn, or merely the next one when all the targets are down. The turns of
+// the targets down are skipped, rather than handed over to the next target which would then take a double load.
+func (b *upstreamBalancer) pick() (*upstreamTarget, bool) {
+	now := time.Now().UnixNano()
+	count := uint64(len(b.targets))
+	for {
+		start := atomic.LoadUint64(&b.next)
+		picked, healthy := start, false
+		for i := uint64(0); i < count; i++ {
+			if !b.targets[(start+i)%count].isDown(now) {
+				picked, healthy = start+i, true
+				break
+			}
+		}
+		if atomic.CompareAndSwapUint64(&b.next, start, picked+1) {
+			return b.targets[picked%count], healthy
+		}
+	}
+}
+
+// route sends the request to the next target
+func (b *upstreamBalancer) route(req *http.Request) *balancedRequest {
+	target, _ := b.pick()
+	balanced := &balancedRequest{balancer: b, target: target, path: req.URL.Path}
+	target.rewrite(req, balanced.path)
+
+	return balanced
+}
+
+func (t *upstreamTarget) isDown(now int64) bool {
+	return atomic.LoadInt64(&t.downUntil) > now
+}
+
+func (t *upstreamTarget) markDown(period time.Duration) {
+	atomic.StoreInt64(&t.downUntil, time.Now().Add(period).UnixNano())
+}
+
+// rewrite points the url of the request to the target
+func (t *upstreamTarget) rewrite(req *http.Request, p string) {
+	req.URL.Host = t.url.Host
+	req.URL.Scheme = t.url.Scheme
+	req.URL.Path = p
+	if t.url.Path != "" {
+		req.URL.Path = path.Join(t.url.Path, p)
+	}
+}
+
+// resourceTransport sends the requests of some resources through transports of their own
+type resourceTransport struct {
+	http.RoundTripper
+	resources map[*Resource]http.RoundTripper
+}
+
+func (t *resourceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if scope, ok := req.Context().Value(contextScopeName).(*RequestScope); ok && scope.MatchedResource != nil {
+		if transport, found := t.resources[scope.MatchedResource]; found {
+			return transport.RoundTrip(req)
+		}
+	}
+
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// balancedTransport marks down the targets of the balanced resources refusing the connection, and sends the
+// idempotent requests again to the next healthy target
+type balancedTransport struct {
+	http.RoundTripper
+}
+
+func (t *balancedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	scope, ok := req.Context().Value(contextScopeName).(*RequestScope)
+	if !ok || scope.Balanced == nil {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	balanced := scope.Balanced
+	for attempt := 1; ; attempt++ {
+		res, err := t.RoundTripper.RoundTrip(req)
+		if err == nil || !errors.Is(err, syscall.ECONNREFUSED) {
+			return res, err
+		}
+		balanced.target.markDown(balanced.balancer.downPeriod)
+		if attempt >= len(balanced.balancer.targets) || !isIdempotentMethod(req.Method) {
+			return res, err
+		}
+		next, healthy := balanced.balancer.pick()
+		if !healthy {
+			return res, err
+		}
+		retry, ok := rewindRequest(req)
+		if !ok {
+			return res, err
+		}
+		if retry.Host == req.URL.Host {
+			retry.Host = next.url.Host
+		}
+		next.rewrite(retry, balanced.path)
+		balanced.target, req = next, retry
+	}
+}
+
+// retryTransport sends the GET, HEAD and OPTIONS requests again to the upstream after a connection error, or one
+// of the listed statuses, pausing a little longer before each retry. The other methods are never retried, lest
+// the upstream performs a write twice.
+type retryTransport struct {
+	http.RoundTripper
+	retries  int
+	backoff  time.Duration
+	statuses []int
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return t.RoundTripper.RoundTrip(req)
+	}
+	pause := t.backoff
+	for attempt := 0; ; attempt++ {
+		res, err := t.RoundTripper.RoundTrip(req)
+		if attempt >= t.retries || req.Context().Err() != nil || !t.retriable(res, err) {
+			return res, err
+		}
+		retry, ok := rewindRequest(req)
+		if !ok {
+			return res, err
+		}
+		if res != nil {
+			_, _ = io.Copy(ioutil.Discard, res.Body)
+			_ = res.Body.Close()
+		}
+		// @metric a request is sent again to the upstream
+		upstreamRetriesMetric.Inc()
+
+		timer := time.NewTimer(pause)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		pause *= 2
+		req = retry
+	}
+}
+
+// retriable tells if the outcome of a round trip is worth a retry
+func (t *retryTransport) retriable(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	for _, status := range t.statuses {
+		if res.StatusCode == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rewindRequest returns a copy of the request to be sent again, provided its body can be read anew
+func rewindRequest(req *http.Request) (*http.Request, bool) {
+	retry := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return retry, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	retry.Body = body
+
+	return retry, true
+}
+
+// timedTransport measures the round trip of the requests to the upstream, from sending the request until the
+// response headers are received, optionally reporting it to the client in a header
+type timedTransport struct {
+	http.RoundTripper
+	header string
+}
+
+func (t *timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	elapsed := time.Since(start)
+	resource := allRoutes
+	if scope, ok := req.Context().Value(contextScopeName).(*RequestScope); ok && scope.MatchedResource != nil {
+		resource = scope.MatchedResource.getName()
+	}
+	upstreamLatencyMetric.WithLabelValues(resource).Observe(elapsed.Seconds())
+
+	if t.header != "" {
+		duration := strconv.FormatFloat(elapsed.Seconds()*1000, 'f', 3, 64)
+		if strings.EqualFold(t.header, headerServerTiming) {
+			// the metrics of the upstream itself are kept along
+			res.Header.Add(headerServerTiming, "upstream;dur="+duration)
+		} else {
+			res.Header.Set(t.header, duration)
+		}
+	}
+
+	return res, nil
+}
+
+// gzipBody reads a gzip encoded response body, closing both the reader and the underlying body
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (g *gzipBody) Close() error {
+	_ = g.Reader.Close()
+	return g.body.Close()
+}
+
+// decompressResponse decodes a gzip encoded upstream response when the client did not accept this encoding.
+// Upgraded connections and event streams are left untouched, as well as the responses with no body
+// or with several encodings stacked.
+func decompressResponse(res *http.Response) error {
+	if !strings.EqualFold(strings.TrimSpace(res.Header.Get(headerContentEncoding)), "gzip") {
+		return nil
+	}
+	if res.Request == nil || acceptsEncoding(res.Request.Header, "gzip") {
+		return nil
+	}
+	switch {
+	case res.StatusCode == http.StatusSwitchingProtocols,
+		res.StatusCode == http.StatusNoContent,
+		res.StatusCode == http.StatusNotModified,
+		res.Request.Method == http.MethodHead,
+		res.Body == nil || res.Body == http.NoBody,
+		strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream"):
+		return nil
+	}
+
+	reader, err := gzip.NewReader(res.Body)
+	if err != nil {
+		return fmt.Errorf("unable to decompress the upstream response: %w", err)
+	}
+	res.Body = &gzipBody{Reader: reader, body: res.Body}
+	res.Header.Del(headerContentEncoding)
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+	// the decoded representation is no longer byte-for-byte identical to the one tagged by the upstream
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		res.Header.Set("ETag", "W/"+etag)
+	}
+
+	return nil
+}
+
+// acceptsEncoding checks whether the Accept-Encoding header of a request allows the encoding
+func acceptsEncoding(headers http.Header, encoding string) bool {
+	for _, value := range headers.Values(headerAcceptEncoding) {
+		for _, item := range strings.Split(value, ",") {
+			parts := strings.Split(item, ";")
+			name := strings.TrimSpace(parts[0])
+			if !strings.EqualFold(name, encoding) && name != "*" {
+				continue
+			}
+			accepted := true
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+					accepted = err == nil && q > 0
+				}
+			}
+			if accepted {
+				return true
+			}
+		}
+	}
+
+	return false
+}
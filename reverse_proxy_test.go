@@ -0,0 +1,736 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oneconcern/keycloak-gatekeeper/signing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/plugin/ochttp/propagation/b3"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	resty "gopkg.in/resty.v1"
+)
+
+func TestReverseProxyClientCancelled(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	require.NoError(t, p.createStdProxy(nil))
+	proxy, ok := p.upstream.(*httputil.ReverseProxy)
+	require.True(t, ok)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := newFakeHTTPRequest(http.MethodGet, "/admin").WithContext(ctx)
+	resp := httptest.NewRecorder()
+	proxy.ErrorHandler(resp, req, context.Canceled)
+	assert.Equal(t, statusClientClosedRequest, resp.Code)
+	assert.Empty(t, resp.Body.String())
+
+	req = newFakeHTTPRequest(http.MethodGet, "/admin").WithContext(context.Background())
+	resp = httptest.NewRecorder()
+	proxy.ErrorHandler(resp, req, errors.New("connection refused"))
+	assert.Equal(t, http.StatusBadGateway, resp.Code)
+}
+
+func TestReverseProxyCaptureBodies(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.DebugCaptureBodies = true
+	cfg.DebugCaptureBodiesSize = 16
+	cfg.DebugCaptureRedact = []string{`secret`}
+	p, _, _ := newTestProxyService(cfg)
+	core, logs := observer.New(zap.WarnLevel)
+	p.log = zap.New(core)
+	require.NoError(t, p.createStdProxy(nil))
+	proxy, ok := p.upstream.(*httputil.ReverseProxy)
+	require.True(t, ok)
+
+	upstreamResponse := func(code int, contentType string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/admin", strings.NewReader("a secret request body"))
+		req.Header.Set(authorizationHeader, "Bearer token")
+		req = p.captureBodies(req)
+		_, _ = ioutil.ReadAll(req.Body)
+		return &http.Response{
+			StatusCode: code,
+			Header:     http.Header{"Content-Type": []string{contentType}, "Set-Cookie": []string{"session=value"}},
+			Body:       ioutil.NopCloser(strings.NewReader("the upstream response body")),
+			Request:    req,
+		}
+	}
+
+	res := upstreamResponse(http.StatusInternalServerError, "text/plain")
+	require.NoError(t, proxy.ModifyResponse(res))
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "the upstream response body", string(body), "the client should get the whole body")
+	require.Equal(t, 1, logs.Len())
+	fields := logs.All()[0].ContextMap()
+	assert.Equal(t, "a [redacted] request", fields["request_body"])
+	assert.Equal(t, "the upstream res", fields["response_body"])
+	assert.Equal(t, http.Header{authorizationHeader: []string{redacted}}, fields["request_headers"])
+	assert.Contains(t, fields["response_headers"], "Set-Cookie")
+	assert.Equal(t, []string{redacted}, fields["response_headers"].(http.Header)["Set-Cookie"])
+
+	// no capture for successes nor event streams
+	require.NoError(t, proxy.ModifyResponse(upstreamResponse(http.StatusOK, "text/plain")))
+	require.NoError(t, proxy.ModifyResponse(upstreamResponse(http.StatusBadGateway, "text/event-stream")))
+	assert.Equal(t, 1, logs.Len())
+
+	// nor for websockets
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	req.Header.Set("Upgrade", "websocket")
+	assert.Equal(t, req, p.captureBodies(req))
+}
+
+func TestTruncateResponseHeaders(t *testing.T) {
+	headers := http.Header{
+		"A-Header": []string{"1234567890"},
+		"B-Header": []string{"1234567890", "1234567890"},
+		"C-Header": []string{"1234567890"},
+	}
+	// each header line accounts for 22 bytes
+	dropped := truncateResponseHeaders(headers, 50)
+	assert.Equal(t, []string{"B-Header", "C-Header"}, dropped)
+	assert.Equal(t, http.Header{
+		"A-Header": []string{"1234567890"},
+		"B-Header": []string{"1234567890"},
+	}, headers)
+
+	headers = http.Header{"A-Header": []string{"1234567890"}}
+	assert.Empty(t, truncateResponseHeaders(headers, 22))
+	assert.Len(t, headers, 1)
+}
+
+func TestUpstreamResponseHeaderPolicy(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.MaxResponseHeaderBytes = 1024
+	cfg.UpstreamResponseHeaderPolicy = upstreamHeaderPolicyError
+	p, _, _ := newTestProxyService(cfg)
+	require.NoError(t, p.createStdProxy(nil))
+	proxy, ok := p.upstream.(*httputil.ReverseProxy)
+	require.True(t, ok)
+	transport, ok := proxy.Transport.(*http.Transport)
+	require.True(t, ok)
+	assert.Equal(t, int64(1024), transport.MaxResponseHeaderBytes, "the transport should refuse oversized headers")
+
+	cfg = newFakeKeycloakConfig()
+	cfg.MaxResponseHeaderBytes = 30
+	cfg.UpstreamResponseHeaderPolicy = upstreamHeaderPolicyTruncate
+	p, _, _ = newTestProxyService(cfg)
+	require.NoError(t, p.createStdProxy(nil))
+	proxy, ok = p.upstream.(*httputil.ReverseProxy)
+	require.True(t, ok)
+	transport, ok = proxy.Transport.(*http.Transport)
+	require.True(t, ok)
+	assert.Zero(t, transport.MaxResponseHeaderBytes)
+
+	res := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"A-Header": []string{"1234567890"}, "B-Header": []string{"1234567890"}},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    httptest.NewRequest(http.MethodGet, "/admin", nil),
+	}
+	require.NoError(t, proxy.ModifyResponse(res))
+	assert.Equal(t, http.Header{"A-Header": []string{"1234567890"}}, res.Header)
+}
+
+func TestUpstreamTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		_, _ = w.Write([]byte("the upstream response body"))
+		if req.Header.Get("Te") == "trailers" {
+			w.Header().Set("X-Checksum", "d41d8cd98f00b204")
+		}
+	}))
+	defer upstream.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.Upstream = upstream.URL
+	cfg.Resources = []*Resource{
+		{URL: "/trailers/*", Methods: allHTTPMethods, WhiteListed: true, EnableTrailers: true},
+		{URL: "/plain/*", Methods: allHTTPMethods, WhiteListed: true},
+	}
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	require.NoError(t, p.proxy.createStdProxy(nil))
+
+	get := func(uri string) *http.Response {
+		resp, err := http.Get(p.getServiceURL() + uri)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "the upstream response body", string(body))
+		return resp
+	}
+
+	resp := get("/trailers/file")
+	assert.Equal(t, "d41d8cd98f00b204", resp.Trailer.Get("X-Checksum"), "the client should have received the trailer")
+
+	resp = get("/plain/file")
+	assert.Empty(t, resp.Trailer.Get("X-Checksum"))
+}
+
+func TestResponseDecompression(t *testing.T) {
+	compressed := func(content string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write([]byte(content))
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the upstream compresses regardless of what the client asked for
+		if strings.HasSuffix(req.URL.Path, "/events") {
+			w.Header().Set("Content-Type", "text/event-stream")
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write(compressed("the upstream response body"))
+	}))
+	defer upstream.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.Upstream = upstream.URL
+	cfg.EnableResponseDecompression = true
+	cfg.Resources = []*Resource{
+		{URL: "/public/*", Methods: allHTTPMethods, WhiteListed: true},
+	}
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	require.NoError(t, p.proxy.createStdProxy(nil))
+
+	// do not let the client negotiate nor decode the encoding on its own
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	get := func(uri, acceptEncoding string) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, p.getServiceURL()+uri, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, body
+	}
+
+	resp, body := get("/public/file", "identity")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "the upstream response body", string(body))
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, `W/"v1"`, resp.Header.Get("ETag"))
+
+	resp, body = get("/public/file", "gzip;q=0, br")
+	assert.Equal(t, "the upstream response body", string(body))
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+
+	resp, body = get("/public/file", "br, gzip")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, compressed("the upstream response body"), body)
+	assert.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+
+	resp, body = get("/public/events", "identity")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"), "event streams should not be decompressed")
+	assert.Equal(t, compressed("the upstream response body"), body)
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	cases := []struct {
+		Header   string
+		Expected bool
+	}{
+		{Header: "", Expected: false},
+		{Header: "gzip", Expected: true},
+		{Header: "deflate, GZIP", Expected: true},
+		{Header: "br;q=1.0, gzip;q=0.5", Expected: true},
+		{Header: "gzip;q=0", Expected: false},
+		{Header: "gzip;q=0.000", Expected: false},
+		{Header: "identity", Expected: false},
+		{Header: "*", Expected: true},
+		{Header: "*;q=0", Expected: false},
+	}
+	for i, c := range cases {
+		headers := http.Header{}
+		if c.Header != "" {
+			headers.Set("Accept-Encoding", c.Header)
+		}
+		assert.Equal(t, c.Expected, acceptsEncoding(headers, "gzip"), "case %d, header: %q", i, c.Header)
+	}
+}
+
+func TestUpstreamTimingHeader(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Server-Timing", "db;dur=2")
+		time.Sleep(10 * time.Millisecond)
+		_, _ = w.Write([]byte("the upstream response body"))
+	}))
+	defer upstream.Close()
+
+	for _, header := range []string{"Server-Timing", "X-Upstream-Duration"} {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = upstream.URL
+		cfg.UpstreamTimingHeader = header
+		cfg.Resources = []*Resource{{URL: "/public/*", Methods: allHTTPMethods, WhiteListed: true}}
+		p := newFakeProxy(cfg)
+		require.NoError(t, p.proxy.createStdProxy(nil))
+
+		resp, err := http.Get(p.getServiceURL() + "/public/file")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		p.idp.Close()
+		p.proxy.server.Close()
+
+		var value string
+		switch header {
+		case "Server-Timing":
+			values := resp.Header.Values("Server-Timing")
+			require.Len(t, values, 2)
+			assert.Equal(t, "db;dur=2", values[0], "the timings of the upstream should be kept")
+			require.True(t, strings.HasPrefix(values[1], "upstream;dur="))
+			value = strings.TrimPrefix(values[1], "upstream;dur=")
+		default:
+			value = resp.Header.Get(header)
+		}
+		duration, err := strconv.ParseFloat(value, 64)
+		require.NoError(t, err, "header %s", header)
+		assert.True(t, duration >= 10, "the duration should cover the time spent by the upstream, got %s", value)
+	}
+}
+
+func TestUpstreamPoolIsolation(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte(name))
+		}))
+	}
+	first, second := newUpstream("first"), newUpstream("second")
+	defer first.Close()
+	defer second.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.Upstream = first.URL
+	cfg.EnableUpstreamPoolIsolation = true
+	cfg.UpstreamMaxConnsPerPool = 2
+	cfg.Resources = []*Resource{
+		{URL: "/first/*", Methods: allHTTPMethods, WhiteListed: true},
+		{URL: "/second/*", Methods: allHTTPMethods, WhiteListed: true, Upstream: second.URL},
+	}
+	p := newFakeProxy(cfg)
+	defer p.idp.Close()
+	require.NoError(t, p.proxy.createStdProxy(nil))
+
+	for _, name := range []string{"first", "second", "first"} {
+		resp, err := http.Get(p.getServiceURL() + "/" + name + "/file")
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, name, string(body))
+	}
+
+	proxy, ok := p.proxy.upstream.(*httputil.ReverseProxy)
+	require.True(t, ok)
+	pools, ok := proxy.Transport.(*upstreamPools)
+	require.True(t, ok)
+	require.Len(t, pools.pools, 2, "each upstream host should have its own pool")
+	for host, transport := range pools.pools {
+		assert.Equal(t, 2, transport.MaxConnsPerHost, "the pool of %s should be limited", host)
+	}
+}
+
+func TestUpstreamBalancer(t *testing.T) {
+	b, err := newUpstreamBalancer([]string{"http://first", "http://second", "http://third"}, time.Minute)
+	require.NoError(t, err)
+
+	var picked []string
+	for i := 0; i < 4; i++ {
+		target, healthy := b.pick()
+		assert.True(t, healthy)
+		picked = append(picked, target.url.Host)
+	}
+	assert.Equal(t, []string{"first", "second", "third", "first"}, picked)
+
+	b.targets[1].markDown(time.Minute)
+	picked = nil
+	for i := 0; i < 3; i++ {
+		target, _ := b.pick()
+		picked = append(picked, target.url.Host)
+	}
+	assert.Equal(t, []string{"third", "first", "third"}, picked, "the target down should be skipped")
+
+	b.targets[0].markDown(time.Minute)
+	b.targets[2].markDown(time.Minute)
+	_, healthy := b.pick()
+	assert.False(t, healthy)
+
+	_, err = newUpstreamBalancer(nil, time.Minute)
+	assert.Error(t, err)
+}
+
+func TestBalancedUpstreams(t *testing.T) {
+	var mu sync.Mutex
+	served := make(map[string]int)
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			served[name]++
+			mu.Unlock()
+			_, _ = w.Write([]byte(name + req.URL.Path))
+		}))
+	}
+	first, second := newUpstream("first"), newUpstream("second")
+	defer first.Close()
+	defer second.Close()
+	// a backend refusing the connections
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	down := "http://" + listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	cfg := newFakeKeycloakConfig()
+	cfg.Upstream = first.URL
+	cfg.Resources = []*Resource{
+		{URL: "/pool/*", Methods: allHTTPMethods, WhiteListed: true, Upstreams: []string{first.URL, second.URL + "/base"}},
+		{URL: "/flaky/*", Methods: allHTTPMethods, WhiteListed: true, Upstreams: []string{down, second.URL}},
+	}
+	p := newFakeProxy(cfg)
+	defer p.idp.Close()
+	require.NoError(t, p.proxy.createStdProxy(nil))
+
+	send := func(method, uri string) (int, string) {
+		req, err := http.NewRequest(method, p.getServiceURL()+uri, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	var bodies []string
+	for i := 0; i < 4; i++ {
+		code, body := send(http.MethodGet, "/pool/file")
+		assert.Equal(t, http.StatusOK, code)
+		bodies = append(bodies, body)
+	}
+	assert.Equal(t, []string{"first/pool/file", "second/base/pool/file", "first/pool/file", "second/base/pool/file"}, bodies)
+
+	// the idempotent requests are sent again to the next target
+	code, body := send(http.MethodGet, "/flaky/file")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "second/flaky/file", body)
+	// then the backend down is skipped, even for the other methods
+	for i := 0; i < 2; i++ {
+		code, body = send(http.MethodPost, "/flaky/file")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "second/flaky/file", body)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]int{"first": 2, "second": 5}, served)
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	var mu sync.Mutex
+	var attempts, failures, unavailable int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		switch {
+		case failures > 0:
+			// the upstream is restarting: the connection is dropped with no response
+			failures--
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			_ = conn.Close()
+		case unavailable > 0:
+			unavailable--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			_, _ = w.Write([]byte("the upstream response body"))
+		}
+	}))
+	defer upstream.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.Upstream = upstream.URL
+	// each attempt gets a connection of its own, the transport does not replay the requests on new connections
+	cfg.UpstreamKeepalives = false
+	cfg.UpstreamRetries = 3
+	cfg.UpstreamRetryBackoff = 10 * time.Millisecond
+	cfg.RetryOnStatus = []int{http.StatusServiceUnavailable}
+	cfg.Resources = []*Resource{{URL: "/public/*", Methods: allHTTPMethods, WhiteListed: true}}
+	p := newFakeProxy(cfg)
+	defer p.idp.Close()
+	require.NoError(t, p.proxy.createStdProxy(nil))
+
+	cs := []struct {
+		Method      string
+		Failures    int
+		Unavailable int
+		Code        int
+		Attempts    int
+	}{
+		{Method: http.MethodGet, Failures: 2, Code: http.StatusOK, Attempts: 3},
+		{Method: http.MethodHead, Failures: 1, Code: http.StatusOK, Attempts: 2},
+		{Method: http.MethodGet, Unavailable: 2, Code: http.StatusOK, Attempts: 3},
+		{Method: http.MethodGet, Failures: 1, Unavailable: 1, Code: http.StatusOK, Attempts: 3},
+		// the retries are bounded
+		{Method: http.MethodGet, Failures: 10, Code: http.StatusBadGateway, Attempts: 4},
+		{Method: http.MethodGet, Unavailable: 10, Code: http.StatusServiceUnavailable, Attempts: 4},
+		// the writes are never retried
+		{Method: http.MethodPost, Failures: 1, Code: http.StatusBadGateway, Attempts: 1},
+		{Method: http.MethodPut, Unavailable: 1, Code: http.StatusServiceUnavailable, Attempts: 1},
+	}
+	for i, c := range cs {
+		mu.Lock()
+		attempts, failures, unavailable = 0, c.Failures, c.Unavailable
+		mu.Unlock()
+
+		req, err := http.NewRequest(c.Method, p.getServiceURL()+"/public/file", nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, c.Code, resp.StatusCode, "case %d", i)
+		mu.Lock()
+		assert.Equal(t, c.Attempts, attempts, "case %d, unexpected number of attempts", i)
+		mu.Unlock()
+	}
+}
+
+func TestUpstreamLatencyMetricResource(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("the upstream response body"))
+	}))
+	defer upstream.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.Upstream = upstream.URL
+	cfg.EnableMetrics = true
+	cfg.LocalhostMetrics = true
+	cfg.Resources = []*Resource{{Name: "public-files", URL: "/public/*", Methods: allHTTPMethods, WhiteListed: true}}
+	p := newFakeProxy(cfg)
+	defer p.idp.Close()
+	require.NoError(t, p.proxy.createStdProxy(nil))
+
+	resp, err := http.Get(p.getServiceURL() + "/public/file")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	resp, err = http.Get(p.getServiceURL() + cfg.WithOAuthURI(metricsURL))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `proxy_upstream_duration_seconds_count{resource="public-files"}`)
+}
+
+func TestUpstreamTracePropagation(t *testing.T) {
+	// the upstream echoes the headers it receives
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", jsonMime)
+		_ = json.NewEncoder(w).Encode(req.Header)
+	}))
+	defer upstream.Close()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	cases := []struct {
+		Name        string
+		Tracing     bool
+		Propagation []string
+		Headers     map[string]string
+		Check       func(http.Header)
+	}{
+		{
+			Name: "tracing disabled",
+			Check: func(h http.Header) {
+				assert.Empty(t, h.Get("traceparent"))
+				assert.Empty(t, h.Get(b3.TraceIDHeader))
+			},
+		},
+		{
+			Name:    "trace context and b3 by default",
+			Tracing: true,
+			Headers: map[string]string{"traceparent": "00-" + traceID + "-00f067aa0ba902b7-01"},
+			Check: func(h http.Header) {
+				// the upstream joins the trace of the client, under the span of the proxy
+				parts := strings.Split(h.Get("traceparent"), "-")
+				require.Len(t, parts, 4)
+				assert.Equal(t, traceID, parts[1])
+				assert.NotEqual(t, "00f067aa0ba902b7", parts[2])
+				assert.Equal(t, traceID, h.Get(b3.TraceIDHeader))
+				assert.Equal(t, parts[2], h.Get(b3.SpanIDHeader))
+			},
+		},
+		{
+			Name:        "b3 only",
+			Tracing:     true,
+			Propagation: []string{b3Propagation},
+			Headers:     map[string]string{b3.TraceIDHeader: traceID, b3.SpanIDHeader: "00f067aa0ba902b7", b3.SampledHeader: "1"},
+			Check: func(h http.Header) {
+				assert.Empty(t, h.Get("traceparent"))
+				assert.Equal(t, traceID, h.Get(b3.TraceIDHeader))
+				assert.NotEqual(t, "00f067aa0ba902b7", h.Get(b3.SpanIDHeader))
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			cfg := newFakeKeycloakConfig()
+			cfg.Upstream = upstream.URL
+			cfg.EnableTracing = c.Tracing
+			cfg.TracingPropagation = c.Propagation
+			cfg.Resources = []*Resource{{URL: "/public/*", Methods: allHTTPMethods, WhiteListed: true}}
+			p := newFakeProxy(cfg)
+			defer p.idp.Close()
+			require.NoError(t, p.proxy.createStdProxy(nil))
+
+			req, err := http.NewRequest(http.MethodGet, p.getServiceURL()+"/public/file", nil)
+			require.NoError(t, err)
+			for k, v := range c.Headers {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			received := make(http.Header)
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&received))
+			c.Check(received)
+		})
+	}
+}
+
+func TestUpstreamRequestSigning(t *testing.T) {
+	const key = "0123456789abcdef"
+	// the upstream only accepts the requests signed by the proxy
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := signing.Verify(req, []byte(key), time.Now(), time.Minute); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(req.URL.Path))
+	}))
+	defer upstream.Close()
+
+	for _, signed := range []bool{true, false} {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = upstream.URL
+		if signed {
+			cfg.UpstreamSigningKey = key
+		}
+		cfg.Resources = []*Resource{{URL: "/public/*", Methods: allHTTPMethods, WhiteListed: true, StripBasePath: "/public"}}
+		p := newFakeProxy(cfg)
+		require.NoError(t, p.proxy.createStdProxy(nil))
+
+		req, err := http.NewRequest(http.MethodGet, p.getServiceURL()+"/public/file", nil)
+		require.NoError(t, err)
+		// the signatures forged by the client are replaced
+		req.Header.Set(signing.HeaderTimestamp, strconv.FormatInt(time.Now().Unix(), 10))
+		req.Header.Set(signing.HeaderSignature, "forged")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		content, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		p.idp.Close()
+
+		if !signed {
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+			continue
+		}
+		// the signature covers the path the upstream receives
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "/file", string(content))
+	}
+}
+
+func TestUpstreamConnectionReusedOnRefresh(t *testing.T) {
+	var connections int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.Upstream = upstream.URL
+	cfg.UpstreamKeepalives = true
+	cfg.EnableRefreshTokens = true
+	cfg.EncryptionKey = testKey
+	p := newFakeProxy(cfg)
+	p.idp.setTokenExpiration(1000 * time.Millisecond)
+	require.NoError(t, p.proxy.createStdProxy(nil))
+	transport := p.proxy.upstream
+
+	requests := []fakeRequest{
+		{
+			URI:          fakeAuthAllURL,
+			HasLogin:     true,
+			Redirects:    true,
+			ExpectedCode: http.StatusOK,
+			OnResponse: func(int, *resty.Request, *resty.Response) {
+				<-time.After(1000 * time.Millisecond)
+			},
+		},
+		{
+			// the access token has expired and is refreshed
+			URI:             fakeAuthAllURL,
+			ExpectedCode:    http.StatusOK,
+			ExpectedCookies: map[string]string{cfg.CookieAccessName: ""},
+		},
+		{
+			URI:          fakeAuthAllURL,
+			ExpectedCode: http.StatusOK,
+		},
+	}
+	p.RunTests(t, requests)
+
+	// the refresh only renews the identity: the requests share the transport and its kept-alive connection
+	assert.True(t, transport == p.proxy.upstream, "the upstream transport should not have been rebuilt")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connections), "the upstream connection should have been reused")
+}
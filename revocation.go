@@ -0,0 +1,205 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+// revocationChecker rejects the certificates presented by an upstream which were revoked, according to
+// revocation lists and/or the OCSP responders named by the certificates
+type revocationChecker struct {
+	sync.Mutex
+	// crls are the revocation lists, each applying to the certificates of the issuer which signed it
+	crls []*pkix.CertificateList
+	// ocsp enables the queries to the OCSP responders
+	ocsp   bool
+	client *http.Client
+	log    *zap.Logger
+	// statuses caches the answers of the OCSP responders, until their next update
+	statuses map[string]ocspStatus
+}
+
+// ocspStatus is the revocation status of a certificate given by an OCSP responder
+type ocspStatus struct {
+	revoked bool
+	expires time.Time
+}
+
+func newRevocationChecker(crlFile string, enableOCSP bool, log *zap.Logger) (*revocationChecker, error) {
+	c := &revocationChecker{
+		ocsp:     enableOCSP,
+		client:   &http.Client{Timeout: upstreamOCSPTimeout},
+		log:      log,
+		statuses: make(map[string]ocspStatus),
+	}
+	if crlFile != "" {
+		crls, err := loadCRLs(crlFile)
+		if err != nil {
+			return nil, err
+		}
+		c.crls = crls
+	}
+
+	return c, nil
+}
+
+// loadCRLs reads the revocation lists of a file, either PEM blocks or a single DER list
+func loadCRLs(path string) ([]*pkix.CertificateList, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var crls []*pkix.CertificateList
+	for rest := content; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseDERCRL(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("the revocation list %s is invalid: %w", path, err)
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		crl, err := x509.ParseDERCRL(content)
+		if err != nil {
+			return nil, fmt.Errorf("the revocation list %s is invalid: %w", path, err)
+		}
+		crls = append(crls, crl)
+	}
+
+	return crls, nil
+}
+
+// verifyPeerCertificate checks none of the certificates of the chains presented by the upstream was revoked.
+// When the verification of the upstream certificate is skipped, the chain is taken as presented.
+func (c *revocationChecker) verifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	chains := verifiedChains
+	if len(chains) == 0 {
+		chain := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			chain = append(chain, cert)
+		}
+		chains = [][]*x509.Certificate{chain}
+	}
+
+	for _, chain := range chains {
+		for i := 0; i+1 < len(chain); i++ {
+			if err := c.check(chain[i], chain[i+1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// check looks for a certificate in the revocation lists signed by its issuer, then asks the OCSP responder
+// of the certificate, if any. A responder which cannot be reached does not take the upstream down.
+func (c *revocationChecker) check(cert, issuer *x509.Certificate) error {
+	for _, crl := range c.crls {
+		if issuer.CheckCRLSignature(crl) != nil {
+			continue
+		}
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return fmt.Errorf("%w: %s (serial %s)", ErrCertificateRevoked, cert.Subject, cert.SerialNumber)
+			}
+		}
+	}
+
+	if !c.ocsp || len(cert.OCSPServer) == 0 {
+		return nil
+	}
+	revoked, err := c.ocspRevoked(cert, issuer)
+	if err != nil {
+		c.log.Warn("unable to check the revocation of the upstream certificate",
+			zap.String("subject", cert.Subject.String()),
+			zap.String("responder", cert.OCSPServer[0]),
+			zap.Error(err))
+		return nil
+	}
+	if revoked {
+		return fmt.Errorf("%w: %s (serial %s)", ErrCertificateRevoked, cert.Subject, cert.SerialNumber)
+	}
+
+	return nil
+}
+
+// ocspRevoked asks the OCSP responder of a certificate whether it was revoked, the answer being cached
+// until its next update
+func (c *revocationChecker) ocspRevoked(cert, issuer *x509.Certificate) (bool, error) {
+	key := hashString(string(issuer.RawSubjectPublicKeyInfo)) + ":" + cert.SerialNumber.String()
+	c.Lock()
+	status, found := c.statuses[key]
+	c.Unlock()
+	if found && time.Now().Before(status.expires) {
+		return status.revoked, nil
+	}
+
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.client.Post(cert.OCSPServer[0], "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("the ocsp responder responded %d", resp.StatusCode)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, ocspMaxResponseSize))
+	if err != nil {
+		return false, err
+	}
+	response, err := ocsp.ParseResponseForCert(content, cert, issuer)
+	if err != nil {
+		return false, err
+	}
+
+	status = ocspStatus{revoked: response.Status == ocsp.Revoked, expires: response.NextUpdate}
+	if status.expires.IsZero() {
+		status.expires = time.Now().Add(ocspDefaultCacheDuration)
+	}
+	c.Lock()
+	c.statuses[key] = status
+	c.Unlock()
+
+	return status.revoked, nil
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+// fakeCertificateAuthority issues the certificates of the upstreams and revokes them
+type fakeCertificateAuthority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	// serial is the serial number of the last certificate issued
+	serial int64
+}
+
+func newFakeCertificateAuthority(t *testing.T) *fakeCertificateAuthority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		NotAfter:              time.Now().Add(time.Hour),
+		NotBefore:             time.Now().Add(-time.Minute),
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "upstream ca"},
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &fakeCertificateAuthority{cert: cert, key: key, serial: 1}
+}
+
+// issue makes the certificate of an upstream listening on the loopback, naming an OCSP responder if any
+func (f *fakeCertificateAuthority) issue(t *testing.T, responder string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	require.NoError(t, err)
+	f.serial++
+	template := &x509.Certificate{
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		NotAfter:     time.Now().Add(time.Hour),
+		NotBefore:    time.Now().Add(-time.Minute),
+		SerialNumber: big.NewInt(f.serial),
+		Subject:      pkix.Name{CommonName: "upstream"},
+	}
+	if responder != "" {
+		template.OCSPServer = []string{responder}
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, f.cert, &key.PublicKey, f.key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der, f.cert.Raw}, PrivateKey: key}, cert
+}
+
+// revoke writes a revocation list of the certificates to a file
+func (f *fakeCertificateAuthority) revoke(t *testing.T, certs ...*x509.Certificate) string {
+	revoked := make([]pkix.RevokedCertificate, 0, len(certs))
+	for _, cert := range certs {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: cert.SerialNumber, RevocationTime: time.Now()})
+	}
+	der, err := f.cert.CreateCRL(cryptorand.Reader, f.key, revoked, time.Now(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	file, err := ioutil.TempFile("", "upstream-crl")
+	require.NoError(t, err)
+	defer file.Close()
+	require.NoError(t, pem.Encode(file, &pem.Block{Type: "X509 CRL", Bytes: der}))
+
+	return file.Name()
+}
+
+func newTestTLSUpstream(cert tls.Certificate) *httptest.Server {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("the upstream response body"))
+	}))
+	upstream.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	upstream.StartTLS()
+
+	return upstream
+}
+
+func TestUpstreamRevocationList(t *testing.T) {
+	authority := newFakeCertificateAuthority(t)
+	revokedCert, revoked := authority.issue(t, "")
+	validCert, _ := authority.issue(t, "")
+	crl := authority.revoke(t, revoked)
+	defer os.Remove(crl)
+	ca, err := ioutil.TempFile("", "upstream-ca")
+	require.NoError(t, err)
+	defer os.Remove(ca.Name())
+	require.NoError(t, pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: authority.cert.Raw}))
+	require.NoError(t, ca.Close())
+
+	revokedUpstream := newTestTLSUpstream(revokedCert)
+	defer revokedUpstream.Close()
+	validUpstream := newTestTLSUpstream(validCert)
+	defer validUpstream.Close()
+
+	for _, skipVerify := range []bool{false, true} {
+		cfg := newFakeKeycloakConfig()
+		cfg.SkipUpstreamTLSVerify = skipVerify
+		cfg.UpstreamCA = ca.Name()
+		cfg.Upstream = validUpstream.URL
+		cfg.Resources = []*Resource{
+			{URL: "/revoked/*", Methods: allHTTPMethods, WhiteListed: true, Upstream: revokedUpstream.URL, UpstreamCRL: crl},
+			{URL: "/valid/*", Methods: allHTTPMethods, WhiteListed: true, Upstream: validUpstream.URL, UpstreamCRL: crl},
+			{URL: "/unchecked/*", Methods: allHTTPMethods, WhiteListed: true, Upstream: revokedUpstream.URL},
+		}
+		p := newFakeProxy(cfg)
+		require.NoError(t, p.proxy.createStdProxy(nil))
+
+		get := func(uri string) int {
+			resp, err := http.Get(p.getServiceURL() + uri)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			return resp.StatusCode
+		}
+		assert.Equal(t, http.StatusBadGateway, get("/revoked/test"), "skip verify: %t", skipVerify)
+		assert.Equal(t, http.StatusOK, get("/valid/test"), "skip verify: %t", skipVerify)
+		// the revocation is only checked on the resources asking for it
+		assert.Equal(t, http.StatusOK, get("/unchecked/test"), "skip verify: %t", skipVerify)
+
+		p.idp.Close()
+		p.proxy.server.Close()
+	}
+}
+
+func TestUpstreamRevocationOCSP(t *testing.T) {
+	authority := newFakeCertificateAuthority(t)
+	var queries int32
+	responses := make(map[string]int)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		content, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		request, err := ocsp.ParseRequest(content)
+		require.NoError(t, err)
+		status, found := responses[request.SerialNumber.String()]
+		if !found {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		response, err := ocsp.CreateResponse(authority.cert, authority.cert, ocsp.Response{
+			Status:       status,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   time.Now(),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now(),
+		}, authority.key)
+		require.NoError(t, err)
+		_, _ = w.Write(response)
+	}))
+	defer responder.Close()
+
+	_, good := authority.issue(t, responder.URL)
+	_, revoked := authority.issue(t, responder.URL)
+	_, unknown := authority.issue(t, responder.URL)
+	responses[good.SerialNumber.String()] = ocsp.Good
+	responses[revoked.SerialNumber.String()] = ocsp.Revoked
+
+	checker, err := newRevocationChecker("", true, zap.NewNop())
+	require.NoError(t, err)
+	assert.NoError(t, checker.check(good, authority.cert))
+	err = checker.check(revoked, authority.cert)
+	assert.True(t, errors.Is(err, ErrCertificateRevoked), "the certificate should be revoked: %v", err)
+	// a failing responder does not take the upstream down
+	assert.NoError(t, checker.check(unknown, authority.cert))
+
+	// the answers are cached until their next update
+	assert.Equal(t, int32(3), atomic.LoadInt32(&queries))
+	assert.Error(t, checker.check(revoked, authority.cert))
+	assert.NoError(t, checker.check(good, authority.cert))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&queries))
+
+	checker, err = newRevocationChecker("", false, zap.NewNop())
+	require.NoError(t, err)
+	assert.NoError(t, checker.check(revoked, authority.cert), "the responders are only asked when enabled")
+}
+
+func TestLoadRevocationLists(t *testing.T) {
+	authority := newFakeCertificateAuthority(t)
+	_, revoked := authority.issue(t, "")
+	crl := authority.revoke(t, revoked)
+	defer os.Remove(crl)
+
+	crls, err := loadCRLs(crl)
+	require.NoError(t, err)
+	require.Len(t, crls, 1)
+	assert.NoError(t, authority.cert.CheckCRLSignature(crls[0]))
+
+	_, err = loadCRLs("does_not_exist")
+	assert.Error(t, err)
+	invalid, err := ioutil.TempFile("", "upstream-crl")
+	require.NoError(t, err)
+	defer os.Remove(invalid.Name())
+	_, err = invalid.WriteString("not a revocation list")
+	require.NoError(t, err)
+	require.NoError(t, invalid.Close())
+	_, err = loadCRLs(invalid.Name())
+	assert.Error(t, err)
+}
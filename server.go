@@ -28,8 +28,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/acme/autocert"
@@ -37,6 +39,7 @@ import (
 	httplog "log"
 
 	proxyproto "github.com/armon/go-proxyproto"
+	"github.com/coreos/go-oidc/key"
 	"github.com/coreos/go-oidc/oidc"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -52,14 +55,53 @@ type oauthProxy struct {
 	idpClient   *http.Client
 	listener    net.Listener
 	log         *zap.Logger
+	accessLog   *zap.Logger
+	auditLog    *zap.Logger
 	router      http.Handler
 	adminRouter http.Handler
 	server      *http.Server
+	httpServer  *http.Server
+	adminServer *http.Server
 	store       storage
 	templates   *template.Template
 	upstream    reverseProxy
 	csrf        func(http.Handler) http.Handler
 
+	// trustedProxies are the networks of the proxies allowed to assert the client identity
+	trustedProxies []*net.IPNet
+	// captureRedactions are the patterns of the content redacted from the captured bodies
+	captureRedactions []*regexp.Regexp
+	// userinfo caches the userinfo claims merged into the tokens
+	userinfo *userinfoCache
+	// opaqueTokens caches the userinfo claims of the opaque tokens
+	opaqueTokens *userinfoCache
+	// keySetCache holds the keys of the provider persisted to disk
+	keySetCache *keySetCache
+	// storeUnhealthy is set (atomically) while the store fails its probes
+	storeUnhealthy int32
+	// lockdown holds the *lockdownState, swapped when the settings are reloaded
+	lockdown atomic.Value
+	// warmingUp is set (atomically) until the warm-up completes or times out
+	warmingUp int32
+	// draining is set (atomically) once the service is shutting down
+	draining int32
+	// inFlight counts (atomically) the requests being served, when the lifecycle is logged
+	inFlight int32
+	// testModeKey signs the tokens crafted in test mode
+	testModeKey *key.PrivateKey
+	// auditWebhook posts the access decisions to a webhook in the background
+	auditWebhook *auditWebhook
+	// refresher renews the sessions in the background
+	refresher *backgroundRefresher
+	// sessionLocks serializes the updates of the list of sessions of each user
+	sessionLocks keyedLocks
+	// failedAuthDelays bounds the number of failed authentication responses being delayed
+	failedAuthDelays chan struct{}
+	// claimMetricValues bounds the values of the metrics claim used as labels
+	claimMetricValues *labelLimiter
+	// stop is closed on shutdown, ending the background tasks started by Run
+	stop chan struct{}
+
 	// preconfigured closures
 	cookieChunker func(string, string) int
 	cookieDropper func(string, string, string, time.Duration) *http.Cookie
@@ -78,12 +120,69 @@ func newProxy(config *Config) (*oauthProxy, error) {
 	}
 
 	log.Info("starting the service", zap.String("prog", version.Prog), zap.String("author", version.Author), zap.String("version", version.GetVersion()))
+	if config.LogEffectiveConfig {
+		log.Info("effective configuration", zap.Reflect("config", config.redacted()))
+	}
 	svc := &oauthProxy{
 		config: config,
 		log:    log,
 	}
+	svc.lifecycleEvent(lifecycleConfigLoaded, nil, zap.String("discovery_url", config.DiscoveryURL), zap.Int("resources", len(config.Resources)))
 	svc.cookieChunker = svc.makeCookieChunker()
 	svc.cookieDropper = svc.makeCookieDropper()
+	if config.EnableUserinfoMerge {
+		svc.userinfo = newUserinfoCache()
+	}
+	if config.EnableOpaqueTokens {
+		svc.opaqueTokens = newUserinfoCache()
+	}
+	if config.FailedAuthDelay > 0 {
+		svc.failedAuthDelays = make(chan struct{}, failedAuthDelayMaxPending)
+	}
+	if config.MetricsClaim != "" {
+		svc.claimMetricValues = newLabelLimiter(config.MetricsClaimMaxValues)
+	}
+
+	if config.EnableLogging && config.AccessLogFile != "" {
+		if svc.accessLog, err = createAccessLogger(config); err != nil {
+			return nil, err
+		}
+		log.Info("the requests are logged apart from the service logs", zap.String("access_log", config.AccessLogFile))
+	}
+	if config.AuditLogPath != "" {
+		if svc.auditLog, err = createAuditLogger(config); err != nil {
+			return nil, err
+		}
+		log.Info("the access decisions are audited", zap.String("audit_log", config.AuditLogPath))
+	}
+	if config.AuditWebhookURL != "" {
+		svc.auditWebhook = newAuditWebhook(config, log)
+		log.Info("the access decisions are posted to a webhook", zap.String("audit_webhook", config.AuditWebhookURL))
+	}
+	if svc.trustedProxies, err = parseTrustedProxies(config.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if err = svc.setLockdown(config.EnableLockdown, config.LockdownAllowlist); err != nil {
+		return nil, err
+	}
+	if config.EnableLockdown {
+		log.Warn("the service is locked down, only the clients of the allowlist are served",
+			zap.Strings("allowlist", config.LockdownAllowlist))
+	}
+	if svc.captureRedactions, err = compileRedactions(config.DebugCaptureRedact); err != nil {
+		return nil, err
+	}
+	if config.EnableAdaptiveSecureCookie {
+		log.Warn("DEVELOPMENT ONLY - the cookies set on plain http requests are not secure")
+	} else if config.EnableForwardedSecureCookie {
+		log.Info("the secure attribute of the cookies follows the scheme forwarded by the trusted proxies")
+	} else if config.SecureCookie && config.ListenHTTP != "" && !config.EnableHTTPSRedirect {
+		log.Warn("the cookies are secure but the service is also reachable over http: browsers do not send them back over http",
+			zap.String("interface", config.ListenHTTP))
+	}
+	if config.DebugCaptureBodies {
+		log.Warn("DEBUGGING ONLY - the bodies of the upstream server errors are logged")
+	}
 
 	// parse the upstream endpoint
 	if svc.endpoint, err = url.Parse(config.Upstream); err != nil {
@@ -92,16 +191,59 @@ func newProxy(config *Config) (*oauthProxy, error) {
 
 	// initialize the store if any
 	if config.StoreURL != "" {
-		if svc.store, err = createStorage(config.StoreURL); err != nil {
+		svc.store, err = createStorage(config.StoreURL)
+		svc.lifecycleEvent(lifecycleStoreConnected, err, zap.String("store", storeKind(config.StoreURL)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.EnableTestMode {
+		if svc.testModeKey, err = key.GeneratePrivateKey(); err != nil {
 			return nil, err
 		}
+		log.Warn("TESTING ONLY - the test mode is enabled: sessions are established for crafted claims, without the provider. Never enable it in production",
+			zap.String("endpoint", config.WithOAuthURI(testTokenURL)))
+	}
+	if config.EnableBackgroundRefresh {
+		svc.refresher = newBackgroundRefresher(config.BackgroundRefreshWorkers, config.RefreshGracePeriod, svc.refreshOpaqueSession)
 	}
 
 	// initialize the openid client
 	if !config.SkipTokenVerification {
-		if svc.client, svc.idp, svc.idpClient, err = svc.newOpenIDClient(); err != nil {
+		// step: the keys of a previous run verify the tokens until the provider is reachable
+		if config.JWKSCacheFile != "" {
+			svc.keySetCache = newKeySetCache(config.JWKSCacheFile)
+			if err := svc.keySetCache.load(); err != nil {
+				log.Warn("unable to load the cached keys of the provider", zap.String("path", config.JWKSCacheFile), zap.Error(err))
+			} else {
+				log.Info("loaded the cached keys of the provider", zap.String("path", config.JWKSCacheFile))
+			}
+		}
+		svc.client, svc.idp, svc.idpClient, err = svc.newOpenIDClient()
+		svc.lifecycleEvent(lifecycleDiscoveryFetched, err, zap.String("discovery_url", config.DiscoveryURL))
+		if err != nil {
 			return nil, err
 		}
+
+		// step: a redirect_uri which is not registered only shows on the error page of the provider
+		if !config.EnableForwarding && !config.NoRedirects {
+			callback := config.WithOAuthURI("callback")
+			switch config.RedirectionURL {
+			case "":
+				log.Info("the redirect_uri sent to the provider is derived from the host of the requests",
+					zap.String("client_id", config.ClientID),
+					zap.String("redirect_uri", "<scheme>://<host>"+callback))
+			default:
+				log.Info("the redirect_uri sent to the provider must be registered for the client",
+					zap.String("client_id", config.ClientID),
+					zap.String("redirect_uri", config.RedirectionURL+callback))
+			}
+		}
+		if config.EnableRedirectionURLCheck {
+			if err := svc.checkRedirectionURL(context.Background(), config.RedirectionURL+config.WithOAuthURI("callback")); err != nil {
+				return nil, err
+			}
+		}
 	} else {
 		log.Warn("TESTING ONLY CONFIG - access token verification has been disabled")
 	}
@@ -170,6 +312,10 @@ func (r *oauthProxy) useDefaultStack(engine chi.Router) {
 		r.log.Info("enabled the correlation request id middleware")
 		engine.Use(r.requestIDMiddleware(r.config.RequestIDHeader))
 	}
+	// @check the raw path is inspected before being normalized
+	if r.config.EnableRejectSuspiciousPaths {
+		engine.Use(r.suspiciousPathMiddleware)
+	}
 	// @step: enable the entrypoint middleware
 	engine.Use(entrypointMiddleware)
 
@@ -177,6 +323,12 @@ func (r *oauthProxy) useDefaultStack(engine chi.Router) {
 		engine.Use(r.loggingMiddleware)
 	}
 
+	// @step: the token must be found in a single place
+	engine.Use(r.duplicateHeadersMiddleware)
+
+	// @step: the lockdown may be enabled at any time by reloading the settings
+	engine.Use(r.lockdownMiddleware)
+
 	if r.config.EnableSecurityFilter {
 		engine.Use(r.securityMiddleware)
 	}
@@ -184,15 +336,23 @@ func (r *oauthProxy) useDefaultStack(engine chi.Router) {
 
 // Run starts the proxy service
 func (r *oauthProxy) Run() error {
-	listener, err := r.createHTTPListener(makeListenerConfig(r.config))
+	mainListenerConfig := makeListenerConfig(r.config)
+	listener, err := r.createHTTPListener(mainListenerConfig)
+	r.lifecycleEvent(lifecycleListenerStarted, err, listenerFields("main", mainListenerConfig, listener)...)
 	if err != nil {
 		return fmt.Errorf("could not start main service: %v", err)
 	}
 
+	// step: the requests in flight are reported on shutdown
+	handler := r.router
+	if r.config.EnableLifecycleLogs {
+		handler = r.countInFlight(handler)
+	}
+
 	// step: create the main http(s) server
 	server := &http.Server{
 		Addr:         r.config.Listen,
-		Handler:      r.router,
+		Handler:      handler,
 		ReadTimeout:  r.config.ServerReadTimeout,
 		WriteTimeout: r.config.ServerWriteTimeout,
 		IdleTimeout:  r.config.ServerIdleTimeout,
@@ -200,6 +360,35 @@ func (r *oauthProxy) Run() error {
 	r.server = server
 	r.listener = listener
 
+	// step: the background tasks run until the shutdown
+	r.stop = make(chan struct{})
+
+	// step: keep an eye on the store
+	if r.useStore() && r.config.StoreHealthInterval > 0 {
+		go r.monitorStore(r.config.StoreHealthInterval, r.stop)
+	}
+
+	// step: post the access decisions to the audit webhook
+	if r.auditWebhook != nil {
+		r.auditWebhook.start()
+	}
+
+	// step: renew the sessions ahead of their expiry
+	if r.refresher != nil {
+		r.refresher.start()
+	}
+
+	// step: keep the cached keys of the provider fresh
+	if r.keySetCache != nil {
+		go r.syncKeySetCache(r.stop)
+	}
+
+	// step: the service is not ready until warmed up
+	if r.config.WarmupTimeout > 0 {
+		atomic.StoreInt32(&r.warmingUp, 1)
+		go r.warmup(r.config.WarmupTimeout)
+	}
+
 	go func() {
 		r.log.Info("keycloak proxy service starting", zap.String("interface", r.config.Listen))
 		if err = server.Serve(listener); err != nil {
@@ -212,22 +401,25 @@ func (r *oauthProxy) Run() error {
 	// step: are we running http service as well?
 	if r.config.ListenHTTP != "" {
 		r.log.Info("keycloak proxy http service starting", zap.String("interface", r.config.ListenHTTP))
-		httpListener, err := r.createHTTPListener(listenerConfig{
+		httpListenerConfig := listenerConfig{
 			listen:        r.config.ListenHTTP,
 			proxyProtocol: r.config.EnableProxyProtocol,
-		})
+		}
+		httpListener, err := r.createHTTPListener(httpListenerConfig)
+		r.lifecycleEvent(lifecycleListenerStarted, err, listenerFields("http", httpListenerConfig, httpListener)...)
 		if err != nil {
 			return err
 		}
 		httpsvc := &http.Server{
 			Addr:         r.config.ListenHTTP,
-			Handler:      r.router,
+			Handler:      handler,
 			ReadTimeout:  r.config.ServerReadTimeout,
 			WriteTimeout: r.config.ServerWriteTimeout,
 			IdleTimeout:  r.config.ServerIdleTimeout,
 		}
+		r.httpServer = httpsvc
 		go func() {
-			if err := httpsvc.Serve(httpListener); err != nil {
+			if err := httpsvc.Serve(httpListener); err != nil && err != http.ErrServerClosed {
 				r.log.Fatal("failed to start the http redirect service", zap.Error(err))
 			}
 		}()
@@ -238,22 +430,20 @@ func (r *oauthProxy) Run() error {
 	if r.config.ListenAdmin != "" {
 		r.log.Info("keycloak proxy admin service starting", zap.String("interface", r.config.ListenAdmin))
 		var (
-			adminListener net.Listener
-			err           error
+			adminListener       net.Listener
+			adminListenerConfig listenerConfig
+			err                 error
 		)
 
 		r.log.Info("server admin service with scheme:", zap.String("scheme", r.config.ListenAdminScheme))
 		if r.config.ListenAdminScheme == unsecureScheme {
 			// run the admin endpoint (metrics, health) with http
-			adminListener, err = r.createHTTPListener(listenerConfig{
+			adminListenerConfig = listenerConfig{
 				listen:        r.config.ListenAdmin,
 				proxyProtocol: r.config.EnableProxyProtocol,
-			})
-			if err != nil {
-				return err
 			}
 		} else {
-			adminListenerConfig := makeListenerConfig(r.config)
+			adminListenerConfig = makeListenerConfig(r.config)
 
 			// admin specific overides
 			adminListenerConfig.listen = r.config.ListenAdmin
@@ -274,10 +464,11 @@ func (r *oauthProxy) Run() error {
 			if len(r.config.TLSAdminClientCertificates) > 0 {
 				adminListenerConfig.clientCerts = r.config.TLSAdminClientCertificates
 			}
-			adminListener, err = r.createHTTPListener(adminListenerConfig)
-			if err != nil {
-				return err
-			}
+		}
+		adminListener, err = r.createHTTPListener(adminListenerConfig)
+		r.lifecycleEvent(lifecycleListenerStarted, err, listenerFields("admin", adminListenerConfig, adminListener)...)
+		if err != nil {
+			return err
 		}
 		adminsvc := &http.Server{
 			Addr:         r.config.ListenAdmin,
@@ -287,8 +478,9 @@ func (r *oauthProxy) Run() error {
 			IdleTimeout:  r.config.ServerIdleTimeout,
 		}
 
+		r.adminServer = adminsvc
 		go func() {
-			if ers := adminsvc.Serve(adminListener); ers != nil {
+			if ers := adminsvc.Serve(adminListener); ers != nil && ers != http.ErrServerClosed {
 				r.log.Fatal("failed to start the admin service", zap.Error(ers))
 			}
 		}()
@@ -296,11 +488,57 @@ func (r *oauthProxy) Run() error {
 	return nil
 }
 
+// Shutdown drains the service: it reports not ready, refuses the new connections and waits for the requests in
+// flight, up to the shutdown grace period, before closing the store. The admin service, if apart, is closed last
+// so the readiness can be probed meanwhile.
+func (r *oauthProxy) Shutdown() error {
+	atomic.StoreInt32(&r.draining, 1)
+	r.log.Info("draining the service before shutting down", zap.Duration("grace_period", r.config.ShutdownGracePeriod))
+	r.lifecycleEvent(lifecycleShutdownStarted, nil,
+		zap.Int("in_flight", int(atomic.LoadInt32(&r.inFlight))),
+		zap.Duration("grace_period", r.config.ShutdownGracePeriod))
+
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.ShutdownGracePeriod)
+	defer cancel()
+	var drainErr error
+	for _, server := range []*http.Server{r.server, r.httpServer, r.adminServer} {
+		if server == nil {
+			continue
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			r.log.Warn("the grace period expired with requests in flight, closing their connections", zap.Error(err))
+			_ = server.Close()
+			drainErr = err
+		}
+	}
+	// the requests still in flight had their connections closed
+	r.lifecycleEvent(lifecycleDrained, drainErr,
+		zap.Int("in_flight", int(atomic.LoadInt32(&r.inFlight))),
+		zap.Duration("duration", time.Since(started)))
+
+	if r.stop != nil {
+		close(r.stop)
+	}
+	if r.auditWebhook != nil {
+		r.auditWebhook.close()
+	}
+
+	return r.CloseStore()
+}
+
+// isDraining tells if the service is shutting down
+func (r *oauthProxy) isDraining() bool {
+	return atomic.LoadInt32(&r.draining) != 0
+}
+
 // listenerConfig encapsulate listener options
 type listenerConfig struct {
 	ca                  string   // the path to a certificate authority
 	certificate         string   // the path to the certificate if any
 	clientCerts         []string // the paths to client certificates to use for mutual tls
+	clientCA            string   // the path to the certificate authorities verifying the client certificates
+	clientAuth          string   // the policy for the client certificates
 	hostnames           []string // list of hostnames the service will respond to
 	letsEncryptCacheDir string   // the path to cache letsencrypt certificates
 	listen              string   // the interface to bind the listener to
@@ -330,6 +568,8 @@ func makeListenerConfig(config *Config) listenerConfig {
 		ca:                config.TLSCaCertificate,
 		certificate:       config.TLSCertificate,
 		clientCerts:       nil,
+		clientCA:          config.TLSClientCAFile,
+		clientAuth:        config.TLSClientAuth,
 		useLetsEncryptTLS: config.UseLetsEncrypt,
 		useSelfSignedTLS:  config.EnabledSelfSignedTLS,
 		tlsAdvancedConfig: &tlsAdvancedConfig{
@@ -472,6 +712,22 @@ func (r *oauthProxy) createHTTPListener(config listenerConfig) (net.Listener, er
 			tlsConfig.ClientCAs = caCertPool
 			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 		}
+
+		// @check if the clients are asked for a certificate
+		if config.clientCA != "" || config.clientAuth != "" {
+			r.log.Info("enabling the client certificates on the listener",
+				zap.String("policy", config.clientAuth),
+				zap.String("ca", config.clientCA))
+			if config.clientCA != "" {
+				caCertPool, erp := makeCertPool("client CA", config.clientCA)
+				if erp != nil {
+					r.log.Error("unable to read the client CA certificates", zap.String("path", config.clientCA), zap.Error(erp))
+					return nil, erp
+				}
+				tlsConfig.ClientCAs = caCertPool
+			}
+			tlsConfig.ClientAuth = clientAuthType(config.clientAuth, tlsConfig.ClientCAs != nil)
+		}
 		listener = tls.NewListener(listener, tlsConfig)
 	}
 	return listener, nil
@@ -491,6 +747,16 @@ func (r *oauthProxy) createTemplates() error {
 		list = append(list, r.config.ForbiddenPage)
 	}
 
+	if r.config.LogoutPage != "" {
+		r.log.Debug("loading the custom logout page", zap.String("page", r.config.LogoutPage))
+		list = append(list, r.config.LogoutPage)
+	}
+
+	if r.config.RedirectLoopPage != "" {
+		r.log.Debug("loading the custom redirect loop page", zap.String("page", r.config.RedirectLoopPage))
+		list = append(list, r.config.RedirectLoopPage)
+	}
+
 	if len(list) > 0 {
 		r.log.Info("loading the custom templates", zap.String("templates", strings.Join(list, ",")))
 		r.templates = template.Must(template.ParseFiles(list...))
@@ -517,6 +783,14 @@ func (r *oauthProxy) newOpenIDClient() (*oidc.Client, oidc.ProviderConfig, *http
 			return nil, config, nil, err
 		}
 	}
+	tlsConfig := &tls.Config{
+		//nolint:gas
+		InsecureSkipVerify: r.config.SkipOpenIDProviderTLSVerify,
+		RootCAs:            pool,
+	}
+	if len(r.config.OpenIDProviderPinnedSPKI) > 0 {
+		tlsConfig.VerifyPeerCertificate = verifyPinnedSPKI(r.config.OpenIDProviderPinnedSPKI)
+	}
 	hc := &http.Client{
 		Transport: &http.Transport{
 			Proxy: func(_ *http.Request) (*url.URL, error) {
@@ -531,11 +805,7 @@ func (r *oauthProxy) newOpenIDClient() (*oidc.Client, oidc.ProviderConfig, *http
 
 				return nil, nil
 			},
-			TLSClientConfig: &tls.Config{
-				//nolint:gas
-				InsecureSkipVerify: r.config.SkipOpenIDProviderTLSVerify,
-				RootCAs:            pool,
-			},
+			TLSClientConfig: tlsConfig,
 		},
 		Timeout: time.Second * 10,
 	}
@@ -571,7 +841,7 @@ func (r *oauthProxy) newOpenIDClient() (*oidc.Client, oidc.ProviderConfig, *http
 		HTTPClient:     hc,
 		RedirectURL:    fmt.Sprintf("%s/oauth/callback", r.config.RedirectionURL),
 		ProviderConfig: config,
-		Scope:          append(r.config.Scopes, oidc.DefaultScope...),
+		Scope:          r.getScopes(),
 	})
 	if err != nil {
 		return nil, config, hc, err
@@ -620,6 +890,23 @@ func (r *oauthProxy) buildProxyTLSConfig() (*tls.Config, error) {
 	return tlsConfig, nil
 }
 
+// clientAuthType returns the policy of the listener for the client certificates: request asks for a certificate,
+// verified when there are certificate authorities, require rejects the connections without any and verify those
+// without one issued by the certificate authorities
+func clientAuthType(policy string, verify bool) tls.ClientAuthType {
+	switch policy {
+	case tlsClientAuthRequest:
+		if verify {
+			return tls.VerifyClientCertIfGiven
+		}
+		return tls.RequestClientCert
+	case tlsClientAuthRequire:
+		return tls.RequireAnyClientCert
+	default:
+		return tls.RequireAndVerifyClientCert
+	}
+}
+
 func makeCertPool(who string, certs ...string) (*x509.CertPool, error) {
 	caCertPool := x509.NewCertPool()
 	for _, cert := range certs {
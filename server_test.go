@@ -17,12 +17,21 @@ package main
 
 import (
 	"context"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -30,6 +39,9 @@ import (
 	"github.com/coreos/go-oidc/jose"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	resty "gopkg.in/resty.v1"
 )
 
 const (
@@ -149,6 +161,48 @@ func TestForbiddenTemplate(t *testing.T) {
 	newFakeProxy(cfg).RunTests(t, requests)
 }
 
+func TestForbiddenTemplateNegotiation(t *testing.T) {
+	page, err := ioutil.TempFile("", "forbidden-*.html.tmpl")
+	require.NoError(t, err)
+	defer os.Remove(page.Name())
+	_, err = page.WriteString(`<p>{{ .username }} may not {{ .method }} {{ .url }} under {{ .resource }}</p>`)
+	require.NoError(t, err)
+	require.NoError(t, page.Close())
+
+	cfg := newFakeKeycloakConfig()
+	cfg.ForbiddenPage = page.Name()
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/admin/*",
+			Methods: allHTTPMethods,
+			Roles:   []string{fakeAdminRole},
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:                     "/admin/test",
+			HasToken:                true,
+			Headers:                 map[string]string{"Accept": "text/html,application/xhtml+xml"},
+			ExpectedCode:            http.StatusForbidden,
+			ExpectedContentContains: "<p>rjayawardene may not GET /admin/test under /admin/*</p>",
+			OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+				assert.Equal(t, "text/html; charset=utf-8", resp.Header().Get("Content-Type"))
+			},
+		},
+		{
+			URI:          "/admin/test",
+			HasToken:     true,
+			Headers:      map[string]string{"Accept": "application/json"},
+			ExpectedCode: http.StatusForbidden,
+			OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+				assert.Equal(t, jsonMime, resp.Header().Get("Content-Type"))
+				assert.NotContains(t, string(resp.Body()), "<p>")
+			},
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
 func TestRequestIDHeader(t *testing.T) {
 	c := newFakeKeycloakConfig()
 	c.EnableRequestID = true
@@ -277,6 +331,147 @@ func TestProxyProtocol(t *testing.T) {
 	newFakeProxy(c).RunTests(t, requests)
 }
 
+// newTestClientCertificate creates a self-signed client certificate, returned with its pem encoding
+func newTestClientCertificate(t *testing.T, name string) (tls.Certificate, []byte) {
+	key, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	require.NoError(t, err)
+	template := x509.Certificate{
+		BasicConstraintsValid: true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		NotAfter:              time.Now().Add(time.Hour),
+		NotBefore:             time.Now().Add(-time.Minute),
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, &template, &template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestListenerClientAuth(t *testing.T) {
+	trusted, caPEM := newTestClientCertificate(t, "trusted")
+	untrusted, _ := newTestClientCertificate(t, "untrusted")
+	ca, err := ioutil.TempFile("", "client-ca")
+	require.NoError(t, err)
+	defer os.Remove(ca.Name())
+	_, err = ca.Write(caPEM)
+	require.NoError(t, err)
+	require.NoError(t, ca.Close())
+
+	cases := []struct {
+		Policy      string
+		CA          string
+		Certificate *tls.Certificate
+		Ok          bool
+	}{
+		{Policy: tlsClientAuthRequest, Ok: true},
+		{Policy: tlsClientAuthRequest, Certificate: &untrusted, Ok: true},
+		{Policy: tlsClientAuthRequest, CA: ca.Name(), Ok: true},
+		{Policy: tlsClientAuthRequest, CA: ca.Name(), Certificate: &untrusted},
+		{Policy: tlsClientAuthRequire},
+		{Policy: tlsClientAuthRequire, Certificate: &untrusted, Ok: true},
+		{Policy: tlsClientAuthVerify, CA: ca.Name()},
+		{Policy: tlsClientAuthVerify, CA: ca.Name(), Certificate: &untrusted},
+		{Policy: tlsClientAuthVerify, CA: ca.Name(), Certificate: &trusted, Ok: true},
+		{CA: ca.Name(), Certificate: &trusted, Ok: true},
+		{CA: ca.Name()},
+	}
+	for i, c := range cases {
+		proxy := &oauthProxy{
+			config: &Config{SelfSignedTLSHostnames: []string{"127.0.0.1"}, SelfSignedTLSExpiration: time.Hour},
+			log:    zap.NewNop(),
+		}
+		listener, err := proxy.createHTTPListener(listenerConfig{
+			listen:            "127.0.0.1:0",
+			useSelfSignedTLS:  true,
+			clientCA:          c.CA,
+			clientAuth:        c.Policy,
+			tlsAdvancedConfig: &tlsAdvancedConfig{},
+		})
+		require.NoError(t, err, "case %d", i)
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})}
+		go func() { _ = server.Serve(listener) }()
+
+		//nolint:gas
+		clientTLS := &tls.Config{InsecureSkipVerify: true}
+		if c.Certificate != nil {
+			// step: the certificate is sent even when not issued by the authorities the listener asks for
+			certificate := c.Certificate
+			clientTLS.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return certificate, nil
+			}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+		resp, err := client.Get("https://" + listener.Addr().String())
+		if c.Ok {
+			if assert.NoError(t, err, "case %d should have been accepted", i) {
+				_ = resp.Body.Close()
+			}
+		} else {
+			assert.Error(t, err, "case %d should have been rejected", i)
+		}
+		_ = server.Close()
+	}
+}
+
+func TestShutdownDraining(t *testing.T) {
+	started := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		time.Sleep(500 * time.Millisecond)
+		_, _ = w.Write([]byte("the slow response"))
+	}))
+	defer upstream.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.Upstream = upstream.URL
+	cfg.ShutdownGracePeriod = 5 * time.Second
+	cfg.Resources = []*Resource{{URL: "/slow", Methods: allHTTPMethods, WhiteListed: true}}
+	p := newFakeProxy(cfg)
+	defer p.idp.Close()
+	require.NoError(t, p.proxy.createStdProxy(nil))
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	type result struct {
+		content string
+		err     error
+	}
+	inflight := make(chan result, 1)
+	go func() {
+		resp, err := client.Get(p.getServiceURL() + "/slow")
+		if err != nil {
+			inflight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		content, err := ioutil.ReadAll(resp.Body)
+		inflight <- result{content: string(content), err: err}
+	}()
+	<-started
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- p.proxy.Shutdown() }()
+
+	// the service is reported not ready as soon as it drains
+	require.Eventually(t, p.proxy.isDraining, time.Second, 10*time.Millisecond)
+	recorder := httptest.NewRecorder()
+	p.proxy.readyHandler(recorder, newFakeHTTPRequest(http.MethodGet, healthURL))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+
+	// the new connections are refused while the request in flight completes
+	require.Eventually(t, func() bool {
+		_, err := client.Get(p.getServiceURL() + "/slow")
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+
+	r := <-inflight
+	require.NoError(t, r.err)
+	assert.Equal(t, "the slow response", r.content)
+	assert.NoError(t, <-stopped)
+}
+
 func TestTokenEncryption(t *testing.T) {
 	c := newFakeKeycloakConfig()
 	c.EnableEncryptedToken = true
@@ -521,11 +716,12 @@ func makeTestCodeFlowLogin(location string) (*http.Response, error) {
 
 // fakeUpstreamResponse is the response from fake upstream
 type fakeUpstreamResponse struct {
-	URI     string      `json:"uri"`
-	Method  string      `json:"method"`
-	Address string      `json:"address"`
-	Headers http.Header `json:"headers"`
-	Message string      `json:"message"`
+	URI      string      `json:"uri"`
+	RawQuery string      `json:"raw_query"`
+	Method   string      `json:"method"`
+	Address  string      `json:"address"`
+	Headers  http.Header `json:"headers"`
+	Message  string      `json:"message"`
 }
 
 // fakeUpstreamService acts as a fake upstream service, returns the headers and request
@@ -536,11 +732,12 @@ func (f *fakeUpstreamService) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	content, _ := json.Marshal(&fakeUpstreamResponse{
-		URI:     r.RequestURI,
-		Method:  r.Method,
-		Address: r.RemoteAddr,
-		Headers: r.Header,
-		Message: "upstream called",
+		URI:      r.RequestURI,
+		RawQuery: r.URL.RawQuery,
+		Method:   r.Method,
+		Address:  r.RemoteAddr,
+		Headers:  r.Header,
+		Message:  "upstream called",
 	})
 	_, _ = w.Write(content)
 }
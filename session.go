@@ -17,36 +17,74 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 
 	"github.com/coreos/go-oidc/jose"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
 // getIdentity retrieves the user identity from a request, either from a session cookie or a bearer token
 func (r *oauthProxy) getIdentity(req *http.Request) (*userContext, error) {
-	var isBearer bool
+	var isBearer, fromStore bool
 	// step: check for a bearer token or cookie with jwt token
 	access, isBearer, err := getTokenInRequest(req, r.config.CookieAccessName)
+	if err == ErrSessionNotFound && r.config.EnableStoredAccessToken {
+		access, err = r.getAccessTokenFromStore(req)
+		fromStore = true
+	}
 	if err != nil {
 		return nil, err
 	}
+	// step: the cookie would be sent back again and again if not recognized as malformed
+	malformed := func(err error) error {
+		if isBearer {
+			return err
+		}
+		return fmt.Errorf("%w: %v", ErrMalformedSessionCookie, err)
+	}
+	// step: a cookie which was tampered with is rejected before any parsing
+	if r.config.EnableCookieMAC && !isBearer && !fromStore {
+		if access, err = verifyCookieValue(r.config.CookieAccessName, access, r.config.EncryptionKey); err != nil {
+			return nil, malformed(err)
+		}
+	}
+	// step: the access cookie may hold the id of a session kept in the store, rather than the token
+	var sessionID string
+	if r.config.EnableOpaqueSessionCookie && !isBearer && !fromStore {
+		sessionID = access
+		if access, err = r.GetOpaqueSession(sessionID); err != nil {
+			return nil, err
+		}
+	}
 	if r.config.EnableEncryptedToken || r.config.ForceEncryptedCookie && !isBearer {
 		if access, err = decodeText(access, r.config.EncryptionKey); err != nil {
-			return nil, ErrDecryption
+			return nil, malformed(ErrDecryption)
 		}
 	}
 	token, err := jose.ParseJWT(access)
 	if err != nil {
-		return nil, err
+		// step: an opaque bearer token is verified and described by the userinfo endpoint instead
+		if r.config.EnableOpaqueTokens && isBearer {
+			return r.getOpaqueIdentity(req.Context(), access)
+		}
+		return nil, malformed(err)
 	}
 	user, err := extractIdentity(token)
 	if err != nil {
-		return nil, err
+		return nil, malformed(err)
 	}
 	user.bearerToken = isBearer
+	user.sessionID = sessionID
+	if sessionID != "" && r.refresher != nil {
+		r.refresher.track(sessionID, user.expiresAt)
+	}
 
 	r.log.Debug("found the user identity",
 		zap.String("id", user.id),
@@ -64,10 +102,97 @@ func (r *oauthProxy) getRefreshTokenFromCookie(req *http.Request) (string, error
 	if err != nil {
 		return "", err
 	}
+	if r.config.EnableCookieMAC {
+		if token, err = verifyCookieValue(r.config.CookieRefreshName, token, r.config.EncryptionKey); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrMalformedSessionCookie, err)
+		}
+	}
 
 	return token, nil
 }
 
+// getAccessTokenFromStore retrieves the access token kept in the store for the session held by the refresh token cookie
+func (r *oauthProxy) getAccessTokenFromStore(req *http.Request) (string, error) {
+	session, err := r.getRefreshTokenFromCookie(req)
+	if err != nil {
+		return "", err
+	}
+
+	return r.GetAccessToken(session)
+}
+
+// keepOpaqueSession keeps the value of the access cookie in the store and returns the opaque id of the session
+// to hand to the browser. The session refreshed by the request keeps its id, a new session gets a random one.
+func (r *oauthProxy) keepOpaqueSession(req *http.Request, value string) (string, error) {
+	var id string
+	if scope, ok := req.Context().Value(contextScopeName).(*RequestScope); ok && scope.Identity != nil {
+		id = scope.Identity.sessionID
+	}
+	if id == "" {
+		var err error
+		if id, err = newSessionID(r.config.SessionIDFormat); err != nil {
+			return "", err
+		}
+	}
+
+	if err := r.StoreOpaqueSession(id, value); err != nil {
+		return "", err
+	}
+	r.trackOpaqueSession(id, value)
+
+	return id, nil
+}
+
+// rotateOpaqueSession removes the opaque session of the user from the store, the refreshed access cookie then being
+// issued with a new id
+func (r *oauthProxy) rotateOpaqueSession(req *http.Request, user *userContext) {
+	if user.sessionID == "" {
+		return
+	}
+	if r.refresher != nil {
+		r.refresher.forget(user.sessionID)
+	}
+	if err := r.DeleteOpaqueSession(user.sessionID); err != nil {
+		r.log.Warn("failed to remove the rotated session from the store", zap.Error(err))
+	}
+	user.sessionID = ""
+	if scope, ok := req.Context().Value(contextScopeName).(*RequestScope); ok && scope.Identity != nil {
+		scope.Identity.sessionID = ""
+	}
+}
+
+// deleteOpaqueSession removes the session held by the opaque access cookie of the request from the store
+func (r *oauthProxy) deleteOpaqueSession(req *http.Request) {
+	id, err := getTokenInCookie(req, r.config.CookieAccessName)
+	if err != nil {
+		return
+	}
+	if r.config.EnableCookieMAC {
+		if id, err = verifyCookieValue(r.config.CookieAccessName, id, r.config.EncryptionKey); err != nil {
+			return
+		}
+	}
+	if r.refresher != nil {
+		r.refresher.forget(id)
+	}
+	if err = r.DeleteOpaqueSession(id); err != nil {
+		r.log.Warn("failed to remove the session from the store", zap.Error(err))
+	}
+}
+
+// newSessionID generates an opaque session id in the given format
+func newSessionID(format string) (string, error) {
+	if format != sessionIDFormatBase64 {
+		return uuid.NewString(), nil
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 // getTokenInRequest returns the access token from the http request
 func getTokenInRequest(req *http.Request, name string) (string, bool, error) {
 	bearer := true
@@ -128,3 +253,144 @@ func getTokenInCookie(req *http.Request, name string) (string, error) {
 
 	return token.String(), nil
 }
+
+// getTrustedIdentity retrieves the user identity asserted by a trusted proxy in the configured header
+func (r *oauthProxy) getTrustedIdentity(req *http.Request) (*userContext, bool) {
+	value := req.Header.Get(r.config.TrustedIdentityHeader)
+	if strings.EqualFold(r.config.TrustedIdentityHeader, headerXForwardedClientCert) {
+		value = getClientCertIdentity(value)
+	}
+	id := strings.TrimSpace(value)
+	if id == "" {
+		return nil, false
+	}
+
+	return &userContext{
+		id:            id,
+		name:          id,
+		preferredName: id,
+		bearerToken:   true,
+		claims:        jose.Claims{"sub": id},
+		trusted:       true,
+	}, true
+}
+
+// getCertIdentity builds the identity of a client from its verified certificate: the id is the URI SAN, the DNS SAN
+// or the common name of the subject, and the claims, roles and groups are taken from the mapped fields
+func (r *oauthProxy) getCertIdentity(cert *x509.Certificate) (*userContext, bool) {
+	var id string
+	for _, field := range []string{certFieldURI, certFieldDNS, certFieldCommonName} {
+		if values := getCertFieldValues(cert, field); len(values) > 0 {
+			id = values[0]
+			break
+		}
+	}
+	if id == "" {
+		return nil, false
+	}
+
+	user := &userContext{
+		id:            id,
+		name:          id,
+		preferredName: id,
+		bearerToken:   true,
+		claims:        jose.Claims{"sub": id},
+		trusted:       true,
+	}
+	for claim, field := range r.config.ClientCertClaims {
+		values := getCertFieldValues(cert, field)
+		if len(values) == 0 {
+			continue
+		}
+		switch claim {
+		case claimResourceRoles:
+			user.roles = values
+		case claimGroups:
+			user.groups = values
+		case claimEmail:
+			user.email = values[0]
+		}
+		if len(values) == 1 {
+			user.claims[claim] = values[0]
+			continue
+		}
+		list := make([]interface{}, len(values))
+		for i, v := range values {
+			list[i] = v
+		}
+		user.claims[claim] = list
+	}
+
+	return user, true
+}
+
+// getCertFieldValues returns the values of a field of the client certificate
+func getCertFieldValues(cert *x509.Certificate, field string) []string {
+	switch field {
+	case certFieldCommonName:
+		if cert.Subject.CommonName != "" {
+			return []string{cert.Subject.CommonName}
+		}
+	case certFieldOrganization:
+		return cert.Subject.Organization
+	case certFieldOrganizationalUnit:
+		return cert.Subject.OrganizationalUnit
+	case certFieldDNS:
+		return cert.DNSNames
+	case certFieldURI:
+		values := make([]string, 0, len(cert.URIs))
+		for _, u := range cert.URIs {
+			values = append(values, u.String())
+		}
+		return values
+	case certFieldEmail:
+		return cert.EmailAddresses
+	case certFieldSerial:
+		return []string{cert.SerialNumber.String()}
+	}
+
+	return nil
+}
+
+// getClientCertIdentity extracts the identity of the client from a X-Forwarded-Client-Cert header, i.e.
+// the URI SAN, the DNS SAN or the common name of the subject of the certificate presented to the last proxy
+func getClientCertIdentity(value string) string {
+	elements := splitQuoted(value, ',')
+	if len(elements) == 0 {
+		return ""
+	}
+	fields := make(map[string]string)
+	for _, kv := range splitQuoted(elements[len(elements)-1], ';') {
+		items := strings.SplitN(kv, "=", 2)
+		if len(items) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(items[0]))
+		if _, found := fields[key]; !found {
+			fields[key] = unquote(strings.TrimSpace(items[1]))
+		}
+	}
+	if v := fields["uri"]; v != "" {
+		return v
+	}
+	if v := fields["dns"]; v != "" {
+		return v
+	}
+	for _, rdn := range splitQuoted(fields["subject"], ',') {
+		items := strings.SplitN(rdn, "=", 2)
+		if len(items) == 2 && strings.EqualFold(strings.TrimSpace(items[0]), "CN") {
+			return strings.TrimSpace(items[1])
+		}
+	}
+
+	return ""
+}
+
+// unquote removes the double quotes around a value, if any
+func unquote(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return strings.Replace(value[1:len(value)-1], `\"`, `"`, -1)
+	}
+
+	return value
+}
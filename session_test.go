@@ -16,11 +16,16 @@ limitations under the License.
 package main
 
 import (
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"math/big"
 	"net/http"
+	"net/url"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetIndentity(t *testing.T) {
@@ -180,3 +185,100 @@ func TestGetRefreshTokenFromCookie(t *testing.T) {
 		}
 	}
 }
+
+func TestGetClientCertIdentity(t *testing.T) {
+	cases := []struct {
+		Header   string
+		Expected string
+	}{
+		{
+			Header:   "",
+			Expected: "",
+		},
+		{
+			Header:   `By=spiffe://cluster.local/ns/default/sa/api;Hash=abcd;URI=spiffe://cluster.local/ns/default/sa/client`,
+			Expected: "spiffe://cluster.local/ns/default/sa/client",
+		},
+		{
+			Header:   `Hash=abcd;Subject="CN=client,O=example";DNS=client.example.com`,
+			Expected: "client.example.com",
+		},
+		{
+			Header:   `Hash=abcd;Subject="O=example,CN=client"`,
+			Expected: "client",
+		},
+		{
+			Header:   `Hash=abcd;URI=spiffe://first,Hash=efgh;URI=spiffe://last`,
+			Expected: "spiffe://last",
+		},
+		{
+			Header:   `Hash=abcd`,
+			Expected: "",
+		},
+	}
+	for i, x := range cases {
+		assert.Equal(t, x.Expected, getClientCertIdentity(x.Header), "case %d, expected: %s", i, x.Expected)
+	}
+}
+
+func TestGetTrustedIdentity(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	p.config.TrustedIdentityHeader = "X-Client-Identity"
+
+	req := newFakeHTTPRequest(http.MethodGet, "/")
+	_, found := p.getTrustedIdentity(req)
+	assert.False(t, found)
+
+	req.Header.Set("X-Client-Identity", "service-a")
+	user, found := p.getTrustedIdentity(req)
+	require.True(t, found)
+	assert.Equal(t, "service-a", user.id)
+	assert.Equal(t, "service-a", user.name)
+	assert.True(t, user.isTrusted())
+	assert.True(t, user.isBearer())
+}
+
+func TestGetCertIdentity(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	p.config.ClientCertClaims = map[string]string{
+		claimGroups:        certFieldOrganizationalUnit,
+		claimResourceRoles: certFieldOrganization,
+		claimEmail:         certFieldEmail,
+		"serial":           certFieldSerial,
+	}
+	spiffe, _ := url.Parse("spiffe://cluster.local/ns/default/sa/client")
+
+	user, found := p.getCertIdentity(&x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "client",
+			Organization:       []string{"billing"},
+			OrganizationalUnit: []string{"payments", "invoices"},
+		},
+		DNSNames:       []string{"client.example.com"},
+		URIs:           []*url.URL{spiffe},
+		EmailAddresses: []string{"client@example.com"},
+		SerialNumber:   big.NewInt(42),
+	})
+	require.True(t, found)
+	assert.Equal(t, "spiffe://cluster.local/ns/default/sa/client", user.id)
+	assert.Equal(t, "spiffe://cluster.local/ns/default/sa/client", user.name)
+	assert.Equal(t, []string{"billing"}, user.roles)
+	assert.Equal(t, []string{"payments", "invoices"}, user.groups)
+	assert.Equal(t, "client@example.com", user.email)
+	assert.Equal(t, "42", user.claims["serial"])
+	assert.Equal(t, []interface{}{"payments", "invoices"}, user.claims[claimGroups])
+	assert.True(t, user.isTrusted())
+
+	user, found = p.getCertIdentity(&x509.Certificate{
+		Subject:      pkix.Name{CommonName: "client"},
+		DNSNames:     []string{"client.example.com"},
+		SerialNumber: big.NewInt(1),
+	})
+	require.True(t, found)
+	assert.Equal(t, "client.example.com", user.id)
+	assert.Empty(t, user.roles)
+	assert.Empty(t, user.groups)
+
+	_, found = p.getCertIdentity(&x509.Certificate{SerialNumber: big.NewInt(1)})
+	assert.False(t, found)
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package signing signs the requests proxied to the upstream, so the upstream can verify they came through
+// the gatekeeper. The signature is an HMAC-SHA256 over the method, the path and the timestamp of the request.
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// HeaderSignature holds the hex encoded signature of the request
+	HeaderSignature = "X-Gatekeeper-Signature"
+	// HeaderTimestamp holds the unix time the request was signed at
+	HeaderTimestamp = "X-Gatekeeper-Timestamp"
+)
+
+var (
+	// ErrMissingSignature is returned for the requests without a signature or a timestamp
+	ErrMissingSignature = errors.New("the request is not signed")
+	// ErrInvalidSignature is returned for the requests whose signature does not match
+	ErrInvalidSignature = errors.New("the signature of the request is invalid")
+	// ErrExpiredSignature is returned for the requests signed too long ago, or in the future
+	ErrExpiredSignature = errors.New("the signature of the request has expired")
+)
+
+// Signature computes the signature of a request from its method, path and unix timestamp
+func Signature(key []byte, method, path string, timestamp int64) string {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(method + "\n" + path + "\n" + strconv.FormatInt(timestamp, 10)))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign adds the signature and timestamp headers to the request, replacing any sent by the client
+func Sign(req *http.Request, key []byte, now time.Time) {
+	timestamp := now.Unix()
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Signature(key, req.Method, req.URL.Path, timestamp))
+}
+
+// Verify checks the signature of the request, which must have been signed within maxAge of now.
+// A zero maxAge accepts the signatures of any age.
+func Verify(req *http.Request, key []byte, now time.Time, maxAge time.Duration) error {
+	signature := req.Header.Get(HeaderSignature)
+	value := req.Header.Get(HeaderTimestamp)
+	if signature == "" || value == "" {
+		return ErrMissingSignature
+	}
+	timestamp, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(Signature(key, req.Method, req.URL.Path, timestamp))) {
+		return ErrInvalidSignature
+	}
+	if maxAge > 0 {
+		age := now.Sub(time.Unix(timestamp, 0))
+		if age > maxAge || age < -maxAge {
+			return ErrExpiredSignature
+		}
+	}
+
+	return nil
+}
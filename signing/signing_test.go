@@ -0,0 +1,70 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package signing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testKey = []byte("0123456789abcdef")
+
+func TestSignature(t *testing.T) {
+	expected := "21f5bf97b95f9943491db5d93b501a0773f0bd7dcfe9ed6d385fecc26c97a5cc"
+	assert.Equal(t, expected, Signature(testKey, http.MethodGet, "/api/users", 1600000000))
+
+	// tampering with any of the inputs changes the signature
+	assert.NotEqual(t, expected, Signature(testKey, http.MethodPost, "/api/users", 1600000000))
+	assert.NotEqual(t, expected, Signature(testKey, http.MethodGet, "/api/admin", 1600000000))
+	assert.NotEqual(t, expected, Signature(testKey, http.MethodGet, "/api/users", 1600000001))
+	assert.NotEqual(t, expected, Signature([]byte("fedcba9876543210"), http.MethodGet, "/api/users", 1600000000))
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	signed := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/api/users?page=2", nil)
+		Sign(req, testKey, now)
+		return req
+	}
+
+	req := signed()
+	assert.Equal(t, "1600000000", req.Header.Get(HeaderTimestamp))
+	assert.NoError(t, Verify(req, testKey, now.Add(time.Second), time.Minute))
+	assert.NoError(t, Verify(req, testKey, now.Add(time.Hour), 0))
+	assert.Equal(t, ErrExpiredSignature, Verify(req, testKey, now.Add(time.Hour), time.Minute))
+	assert.Equal(t, ErrInvalidSignature, Verify(req, []byte("fedcba9876543210"), now, time.Minute))
+
+	req = signed()
+	req.URL.Path = "/api/admin"
+	assert.Equal(t, ErrInvalidSignature, Verify(req, testKey, now, time.Minute))
+
+	req = signed()
+	req.Method = http.MethodDelete
+	assert.Equal(t, ErrInvalidSignature, Verify(req, testKey, now, time.Minute))
+
+	req = signed()
+	req.Header.Set(HeaderTimestamp, "1600000060")
+	assert.Equal(t, ErrInvalidSignature, Verify(req, testKey, now, time.Minute))
+
+	req = signed()
+	req.Header.Del(HeaderSignature)
+	assert.Equal(t, ErrMissingSignature, Verify(req, testKey, now, time.Minute))
+}
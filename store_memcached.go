@@ -0,0 +1,312 @@
+//go:build !nostores
+// +build !nostores
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// memcachedTimeout bounds the exchanges with the memcached servers
+	memcachedTimeout = 5 * time.Second
+	// memcachedMaxIdleConns is the number of idle connections kept per server
+	memcachedMaxIdleConns = 4
+	// memcachedMaxRelativeExpiration is the longest expiration memcached accepts as relative, beyond
+	// which the expiration is a unix timestamp
+	memcachedMaxRelativeExpiration = 30 * 24 * time.Hour
+)
+
+var (
+	// ErrMemcachedNoServers means the url of the store does not name any server
+	ErrMemcachedNoServers = errors.New("no memcached servers in the store url")
+	// ErrMemcachedKey means the key cannot be stored in memcached
+	ErrMemcachedKey = errors.New("the key is not a valid memcached key")
+)
+
+// memcachedStore holds the tokens in memcached, the keys being distributed across the servers
+type memcachedStore struct {
+	servers    []*memcachedServer
+	expiration time.Duration
+}
+
+// newMemcachedStore creates a store from an url such as memcached://host1:11211,host2:11211?expiration=1h
+func newMemcachedStore(location *url.URL) (storage, error) {
+	var expiration time.Duration
+	if v := location.Query().Get("expiration"); v != "" {
+		var err error
+		if expiration, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid memcached expiration: %s", err)
+		}
+		if expiration < 0 {
+			return nil, errors.New("the memcached expiration cannot be negative")
+		}
+	}
+
+	store := &memcachedStore{expiration: expiration}
+	for _, host := range strings.Split(location.Host, ",") {
+		if host = strings.TrimSpace(host); host == "" {
+			continue
+		}
+		store.servers = append(store.servers, newMemcachedServer(host, func(address string) (net.Conn, error) {
+			return net.DialTimeout("tcp", address, memcachedTimeout)
+		}))
+	}
+	if len(store.servers) == 0 {
+		return nil, ErrMemcachedNoServers
+	}
+
+	return store, nil
+}
+
+// Set adds a token to the store
+func (r *memcachedStore) Set(key, value string) error {
+	server, err := r.pick(key)
+	if err != nil {
+		return err
+	}
+
+	return server.set(key, value, r.exptime())
+}
+
+// Get retrieves a token from the store, a missing key yields an empty value
+func (r *memcachedStore) Get(key string) (string, error) {
+	server, err := r.pick(key)
+	if err != nil {
+		return "", err
+	}
+
+	return server.get(key)
+}
+
+// Delete removes the key
+func (r *memcachedStore) Delete(key string) error {
+	server, err := r.pick(key)
+	if err != nil {
+		return err
+	}
+
+	return server.delete(key)
+}
+
+// Close closes the idle connections to the servers
+func (r *memcachedStore) Close() error {
+	for _, s := range r.servers {
+		s.close()
+	}
+
+	return nil
+}
+
+// pick returns the server holding the key
+func (r *memcachedStore) pick(key string) (*memcachedServer, error) {
+	if len(key) == 0 || len(key) > 250 {
+		return nil, ErrMemcachedKey
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return nil, ErrMemcachedKey
+		}
+	}
+
+	return r.servers[crc32.ChecksumIEEE([]byte(key))%uint32(len(r.servers))], nil
+}
+
+// exptime returns the expiration of the items, in the memcached notation
+func (r *memcachedStore) exptime() int64 {
+	switch {
+	case r.expiration <= 0:
+		return 0
+	case r.expiration > memcachedMaxRelativeExpiration:
+		return time.Now().Add(r.expiration).Unix()
+	case r.expiration < time.Second:
+		return 1
+	}
+
+	return int64(r.expiration / time.Second)
+}
+
+// memcachedServer speaks the memcached text protocol to a server, reusing the connections
+type memcachedServer struct {
+	sync.Mutex
+	address string
+	dial    func(string) (net.Conn, error)
+	idle    []net.Conn
+}
+
+func newMemcachedServer(address string, dial func(string) (net.Conn, error)) *memcachedServer {
+	return &memcachedServer{address: address, dial: dial}
+}
+
+func (s *memcachedServer) set(key, value string, exptime int64) error {
+	return s.do(func(rw *bufio.ReadWriter) error {
+		if _, err := fmt.Fprintf(rw, "set %s 0 %d %d\r\n%s\r\n", key, exptime, len(value), value); err != nil {
+			return err
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		line, err := readMemcachedLine(rw.Reader)
+		if err != nil {
+			return err
+		}
+		if line != "STORED" {
+			return fmt.Errorf("unexpected memcached response: %s", line)
+		}
+
+		return nil
+	})
+}
+
+func (s *memcachedServer) get(key string) (string, error) {
+	var value string
+	err := s.do(func(rw *bufio.ReadWriter) error {
+		if _, err := fmt.Fprintf(rw, "get %s\r\n", key); err != nil {
+			return err
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		line, err := readMemcachedLine(rw.Reader)
+		if err != nil {
+			return err
+		}
+		if line == "END" {
+			return nil
+		}
+		// step: VALUE <key> <flags> <bytes>
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "VALUE" {
+			return fmt.Errorf("unexpected memcached response: %s", line)
+		}
+		size, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return fmt.Errorf("invalid memcached value size: %s", fields[3])
+		}
+		content := make([]byte, size+2)
+		if _, err = io.ReadFull(rw, content); err != nil {
+			return err
+		}
+		value = string(content[:size])
+		if line, err = readMemcachedLine(rw.Reader); err != nil {
+			return err
+		}
+		if line != "END" {
+			return fmt.Errorf("unexpected memcached response: %s", line)
+		}
+
+		return nil
+	})
+
+	return value, err
+}
+
+func (s *memcachedServer) delete(key string) error {
+	return s.do(func(rw *bufio.ReadWriter) error {
+		if _, err := fmt.Fprintf(rw, "delete %s\r\n", key); err != nil {
+			return err
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		line, err := readMemcachedLine(rw.Reader)
+		if err != nil {
+			return err
+		}
+		if line != "DELETED" && line != "NOT_FOUND" {
+			return fmt.Errorf("unexpected memcached response: %s", line)
+		}
+
+		return nil
+	})
+}
+
+// do runs an exchange on a connection to the server, which is kept for reuse unless the exchange failed
+func (s *memcachedServer) do(exchange func(*bufio.ReadWriter) error) error {
+	conn, err := s.conn()
+	if err != nil {
+		return err
+	}
+	if err = conn.SetDeadline(time.Now().Add(memcachedTimeout)); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if err = exchange(bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	s.release(conn)
+
+	return nil
+}
+
+func (s *memcachedServer) conn() (net.Conn, error) {
+	s.Lock()
+	if n := len(s.idle); n > 0 {
+		conn := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.Unlock()
+		return conn, nil
+	}
+	s.Unlock()
+
+	return s.dial(s.address)
+}
+
+func (s *memcachedServer) release(conn net.Conn) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.idle) >= memcachedMaxIdleConns {
+		_ = conn.Close()
+		return
+	}
+	s.idle = append(s.idle, conn)
+}
+
+func (s *memcachedServer) close() {
+	s.Lock()
+	defer s.Unlock()
+	for _, conn := range s.idle {
+		_ = conn.Close()
+	}
+	s.idle = nil
+}
+
+// readMemcachedLine reads a line of the response, turning the error replies into errors
+func readMemcachedLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "ERROR" || strings.HasPrefix(line, "CLIENT_ERROR") || strings.HasPrefix(line, "SERVER_ERROR") {
+		return "", fmt.Errorf("memcached error: %s", line)
+	}
+
+	return line, nil
+}
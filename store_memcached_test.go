@@ -0,0 +1,220 @@
+//go:build !nostores
+// +build !nostores
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMemcached is a memcached server speaking enough of the text protocol for the store
+type fakeMemcached struct {
+	sync.Mutex
+	listener net.Listener
+	items    map[string]string
+	exptimes map[string]string
+}
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeMemcached{listener: listener, items: make(map[string]string), exptimes: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			fmt.Fprint(conn, "ERROR\r\n")
+			continue
+		}
+		f.Lock()
+		switch fields[0] {
+		case "set":
+			size, _ := strconv.Atoi(fields[4])
+			content := make([]byte, size+2)
+			if _, err := io.ReadFull(r, content); err != nil {
+				f.Unlock()
+				return
+			}
+			f.items[fields[1]] = string(content[:size])
+			f.exptimes[fields[1]] = fields[3]
+			fmt.Fprint(conn, "STORED\r\n")
+		case "get":
+			if v, found := f.items[fields[1]]; found {
+				fmt.Fprintf(conn, "VALUE %s 0 %d\r\n%s\r\n", fields[1], len(v), v)
+			}
+			fmt.Fprint(conn, "END\r\n")
+		case "delete":
+			if _, found := f.items[fields[1]]; !found {
+				fmt.Fprint(conn, "NOT_FOUND\r\n")
+				break
+			}
+			delete(f.items, fields[1])
+			fmt.Fprint(conn, "DELETED\r\n")
+		default:
+			fmt.Fprint(conn, "ERROR\r\n")
+		}
+		f.Unlock()
+	}
+}
+
+func (f *fakeMemcached) count() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.items)
+}
+
+func (f *fakeMemcached) exptime(key string) string {
+	f.Lock()
+	defer f.Unlock()
+	return f.exptimes[key]
+}
+
+func (f *fakeMemcached) close() {
+	_ = f.listener.Close()
+}
+
+func newTestMemcachedStore(t *testing.T, location string) storage {
+	u, err := url.Parse(location)
+	require.NoError(t, err)
+	store, err := newMemcachedStore(u)
+	require.NoError(t, err)
+
+	return store
+}
+
+func TestNewMemcachedStore(t *testing.T) {
+	cs := []struct {
+		Location string
+		Servers  int
+		Error    bool
+	}{
+		{Location: "memcached://127.0.0.1:11211", Servers: 1},
+		{Location: "memcached://127.0.0.1:11211,127.0.0.2:11211?expiration=1h", Servers: 2},
+		{Location: "memcached://", Error: true},
+		{Location: "memcached://127.0.0.1:11211?expiration=bad", Error: true},
+		{Location: "memcached://127.0.0.1:11211?expiration=-1h", Error: true},
+	}
+	for i, c := range cs {
+		u, err := url.Parse(c.Location)
+		require.NoError(t, err)
+		store, err := newMemcachedStore(u)
+		if c.Error {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		require.NoError(t, err, "case %d should not have failed", i)
+		assert.Len(t, store.(*memcachedStore).servers, c.Servers, "case %d", i)
+	}
+}
+
+func TestMemcachedStore(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.close()
+	store := newTestMemcachedStore(t, "memcached://"+server.listener.Addr().String()+"?expiration=1h")
+	defer store.Close()
+
+	v, err := store.Get("test")
+	assert.NoError(t, err)
+	assert.Empty(t, v)
+
+	assert.NoError(t, store.Set("test", "value"))
+	v, err = store.Get("test")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", v)
+	assert.Equal(t, "3600", server.exptime("test"))
+
+	assert.NoError(t, store.Delete("test"))
+	assert.NoError(t, store.Delete("test"))
+	v, err = store.Get("test")
+	assert.NoError(t, err)
+	assert.Empty(t, v)
+
+	assert.Equal(t, ErrMemcachedKey, store.Set("a key", "value"))
+}
+
+func TestMemcachedStoreHashKeys(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.close()
+	store := newTestMemcachedStore(t, "memcached://"+server.listener.Addr().String())
+	defer store.Close()
+
+	token := newTestToken("test").getToken()
+	key := getHashKey(&token)
+	assert.NoError(t, store.Set(key, "refresh"))
+	v, err := store.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, "refresh", v)
+}
+
+func TestMemcachedStoreServers(t *testing.T) {
+	first, second := newFakeMemcached(t), newFakeMemcached(t)
+	defer first.close()
+	defer second.close()
+	store := newTestMemcachedStore(t, fmt.Sprintf("memcached://%s,%s",
+		first.listener.Addr().String(), second.listener.Addr().String()))
+	defer store.Close()
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		assert.NoError(t, store.Set(key, key))
+		v, err := store.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, key, v)
+	}
+	assert.Equal(t, 20, first.count()+second.count())
+	assert.NotZero(t, first.count())
+	assert.NotZero(t, second.count())
+}
+
+func TestMemcachedExptime(t *testing.T) {
+	assert.Equal(t, int64(0), (&memcachedStore{}).exptime())
+	assert.Equal(t, int64(1), (&memcachedStore{expiration: time.Millisecond}).exptime())
+	assert.Equal(t, int64(60), (&memcachedStore{expiration: time.Minute}).exptime())
+	assert.True(t, (&memcachedStore{expiration: 60 * 24 * time.Hour}).exptime() > time.Now().Unix())
+}
@@ -19,10 +19,14 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/url"
+	"sync/atomic"
+	"time"
 
 	"github.com/coreos/go-oidc/jose"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
@@ -49,6 +53,8 @@ func createStorage(location string) (storage, error) {
 		store, err = newRedisStore(u)
 	case "boltdb":
 		store, err = newBoltDBStore(u)
+	case "memcached":
+		store, err = newMemcachedStore(u)
 	default:
 		return nil, fmt.Errorf("unsupported store: %s", u.Scheme)
 	}
@@ -63,13 +69,13 @@ func (r *oauthProxy) useStore() bool {
 
 // StoreRefreshToken the token to the store
 func (r *oauthProxy) StoreRefreshToken(token jose.JWT, value string) error {
-	return r.store.Set(getHashKey(&token), value)
+	return r.setStoreToken(r.getStoreKey(&token), value)
 }
 
 // Get retrieves a token from the store, the key we are using here is the access token
 func (r *oauthProxy) GetRefreshToken(token jose.JWT) (string, error) {
 	// step: the key is the access token
-	v, err := r.store.Get(getHashKey(&token))
+	v, err := r.getStoreToken(r.getStoreKey(&token))
 	if err != nil {
 		return v, err
 	}
@@ -82,7 +88,7 @@ func (r *oauthProxy) GetRefreshToken(token jose.JWT) (string, error) {
 
 // DeleteRefreshToken removes a key from the store
 func (r *oauthProxy) DeleteRefreshToken(token jose.JWT) error {
-	if err := r.store.Delete(getHashKey(&token)); err != nil {
+	if err := r.store.Delete(r.getStoreKey(&token)); err != nil {
 		r.log.Error("unable to delete token", zap.Error(err))
 
 		return err
@@ -91,10 +97,334 @@ func (r *oauthProxy) DeleteRefreshToken(token jose.JWT) error {
 	return nil
 }
 
-// Close is used to close off any resources
+// StoreAccessToken keeps the access token in the store, for the session held by the refresh token cookie
+func (r *oauthProxy) StoreAccessToken(session, value string) error {
+	return r.setStoreToken(r.getSessionStoreKey(session), value)
+}
+
+// GetAccessToken retrieves the access token for the session held by the refresh token cookie
+func (r *oauthProxy) GetAccessToken(session string) (string, error) {
+	v, err := r.getStoreToken(r.getSessionStoreKey(session))
+	if err != nil {
+		return v, err
+	}
+	if v == "" {
+		return v, ErrSessionNotFound
+	}
+
+	return v, nil
+}
+
+// DeleteAccessToken removes the access token of a session from the store
+func (r *oauthProxy) DeleteAccessToken(session string) error {
+	if err := r.store.Delete(r.getSessionStoreKey(session)); err != nil {
+		r.log.Error("unable to delete access token", zap.Error(err))
+
+		return err
+	}
+
+	return nil
+}
+
+// StoreOpaqueSession keeps the value of the access cookie in the store, under the opaque session id handed instead
+func (r *oauthProxy) StoreOpaqueSession(id, value string) error {
+	return r.setStoreToken(r.getOpaqueSessionStoreKey(id), value)
+}
+
+// GetOpaqueSession retrieves the value of the access cookie held by an opaque session id
+func (r *oauthProxy) GetOpaqueSession(id string) (string, error) {
+	v, err := r.getStoreToken(r.getOpaqueSessionStoreKey(id))
+	if err != nil {
+		return v, err
+	}
+	if v == "" {
+		return v, ErrSessionNotFound
+	}
+
+	return v, nil
+}
+
+// DeleteOpaqueSession removes the session held by an opaque session id from the store
+func (r *oauthProxy) DeleteOpaqueSession(id string) error {
+	return r.store.Delete(r.getOpaqueSessionStoreKey(id))
+}
+
+// setStoreToken writes a token to the store, encrypted when enabled
+func (r *oauthProxy) setStoreToken(key, value string) error {
+	if r.config.EncryptStoreTokens {
+		encrypted, err := encodeText(value, r.config.EncryptionKey)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrEncryption, err)
+		}
+		value = encrypted
+	}
+
+	return r.store.Set(key, value)
+}
+
+// getStoreToken reads a token from the store, decrypted when enabled. A value which cannot be decrypted is
+// an error, never handed back as a token.
+func (r *oauthProxy) getStoreToken(key string) (string, error) {
+	v, err := r.store.Get(key)
+	if err != nil || v == "" || !r.config.EncryptStoreTokens {
+		return v, err
+	}
+	decrypted, err := decodeText(v, r.config.EncryptionKey)
+	if err != nil {
+		return "", ErrStoreDecryption
+	}
+
+	return decrypted, nil
+}
+
+// getOpaqueSessionStoreKey returns the key of the session held by an opaque session id in the store
+func (r *oauthProxy) getOpaqueSessionStoreKey(id string) string {
+	return r.config.StoreKeyPrefix + opaqueSessionKeyPrefix + hashString(id)
+}
+
+// getStoreKey returns the key of the token in the store, namespaced by the configured prefix
+func (r *oauthProxy) getStoreKey(token *jose.JWT) string {
+	return r.config.StoreKeyPrefix + getHashKey(token)
+}
+
+// getSessionStoreKey returns the key of the access token of a session in the store
+func (r *oauthProxy) getSessionStoreKey(session string) string {
+	return r.config.StoreKeyPrefix + accessTokenKeyPrefix + hashString(session)
+}
+
+// getUserSessionKey returns the key in the store which holds the session, i.e. the refresh token, or the access token
+// when it is kept in the store
+func (r *oauthProxy) getUserSessionKey(token jose.JWT, session string) string {
+	if r.config.EnableStoredAccessToken {
+		return r.getSessionStoreKey(session)
+	}
+
+	return r.getStoreKey(&token)
+}
+
+// getUserSessions retrieves the keys of the sessions of a user, oldest first
+func (r *oauthProxy) getUserSessions(subject string) ([]string, error) {
+	v, err := r.store.Get(r.config.StoreKeyPrefix + sessionsKeyPrefix + subject)
+	if err != nil || v == "" {
+		return nil, err
+	}
+	var sessions []string
+	if err := json.Unmarshal([]byte(v), &sessions); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// setUserSessions records the keys of the sessions of a user
+func (r *oauthProxy) setUserSessions(subject string, sessions []string) error {
+	v, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+
+	return r.store.Set(r.config.StoreKeyPrefix+sessionsKeyPrefix+subject, string(v))
+}
+
+// addUserSession records a new session of the user, enforcing the maximum number of sessions: the oldest sessions
+// are evicted from the store, unless configured to reject the new session. The list of the sessions is updated under
+// a lock of the process only: the replicas sharing the store may still race on it.
+func (r *oauthProxy) addUserSession(subject, key string) error {
+	if r.config.MaxSessionsPerUser <= 0 {
+		return nil
+	}
+	unlock := r.sessionLocks.lock(subject)
+	defer unlock()
+	sessions, err := r.getUserSessions(subject)
+	if err != nil {
+		return err
+	}
+
+	// step: forget about the sessions which have been revoked or have expired
+	active := make([]string, 0, len(sessions)+1)
+	for _, s := range sessions {
+		if v, err := r.store.Get(s); err == nil && v != "" {
+			active = append(active, s)
+		}
+	}
+
+	if excess := len(active) + 1 - r.config.MaxSessionsPerUser; excess > 0 {
+		if r.config.RejectExceedingSessions {
+			return ErrTooManySessions
+		}
+		for _, s := range active[:excess] {
+			if err := r.store.Delete(s); err != nil {
+				return err
+			}
+		}
+		active = active[excess:]
+	}
+
+	return r.setUserSessions(subject, append(active, key))
+}
+
+// replaceUserSession updates the key of a session of the user, e.g. after its tokens have been refreshed
+func (r *oauthProxy) replaceUserSession(subject, oldKey, newKey string) error {
+	if r.config.MaxSessionsPerUser <= 0 {
+		return nil
+	}
+	unlock := r.sessionLocks.lock(subject)
+	defer unlock()
+	sessions, err := r.getUserSessions(subject)
+	if err != nil {
+		return err
+	}
+	for i, s := range sessions {
+		if s == oldKey {
+			sessions[i] = newKey
+			return r.setUserSessions(subject, sessions)
+		}
+	}
+
+	return nil
+}
+
+// indexSessionID records the key of the session in the store under its session id (sid claim), so the session
+// can be revoked knowing only its id
+func (r *oauthProxy) indexSessionID(sid, key string) error {
+	if !r.config.EnableSessionIDIndex || sid == "" {
+		return nil
+	}
+
+	return r.store.Set(r.config.StoreKeyPrefix+sessionIDKeyPrefix+sid, key)
+}
+
+// deleteSessionByID removes the session indexed by its session id (sid claim) from the store
+func (r *oauthProxy) deleteSessionByID(sid string) error {
+	index := r.config.StoreKeyPrefix + sessionIDKeyPrefix + sid
+	key, err := r.store.Get(index)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return ErrSessionNotFound
+	}
+	if err := r.store.Delete(key); err != nil {
+		return err
+	}
+	if err := r.store.Delete(index); err != nil {
+		return err
+	}
+
+	return r.forgetSessionRefreshes(sid)
+}
+
+// refreshCount is the number of refreshes of a session since the start of the current window
+type refreshCount struct {
+	Start int64 `json:"start"`
+	Count int   `json:"count"`
+}
+
+// refreshCountKey returns the key of the count of the refreshes of the session in the store
+func (r *oauthProxy) refreshCountKey(sid string) string {
+	return r.config.StoreKeyPrefix + refreshCountKeyPrefix + hashString(sid)
+}
+
+// countSessionRefresh records a refresh of the session in the store, and returns the number of refreshes of the
+// session within the current window. The count is read then written back: the refreshes made concurrently, e.g.
+// through several replicas, may be counted once.
+func (r *oauthProxy) countSessionRefresh(sid string) (int, error) {
+	key := r.refreshCountKey(sid)
+	v, err := r.store.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	var counter refreshCount
+	if v != "" {
+		if err := json.Unmarshal([]byte(v), &counter); err != nil {
+			return 0, err
+		}
+	}
+	now := time.Now()
+	if v == "" || now.Sub(time.Unix(counter.Start, 0)) > r.config.RefreshRateWindow {
+		counter = refreshCount{Start: now.Unix()}
+	}
+	counter.Count++
+
+	encoded, err := json.Marshal(counter)
+	if err != nil {
+		return 0, err
+	}
+
+	return counter.Count, r.store.Set(key, string(encoded))
+}
+
+// forgetSessionRefreshes removes the count of the refreshes of a session which has ended: the store does not expire
+// the keys by itself
+func (r *oauthProxy) forgetSessionRefreshes(sid string) error {
+	return r.store.Delete(r.refreshCountKey(sid))
+}
+
+// probeStore checks the store is working, writing, reading back then removing a probe key
+func (r *oauthProxy) probeStore(key string) error {
+	value := uuid.NewString()
+	if err := r.store.Set(key, value); err != nil {
+		return err
+	}
+	v, err := r.store.Get(key)
+	if err != nil {
+		return err
+	}
+	if v != value {
+		return ErrStoreProbeMismatch
+	}
+
+	return r.store.Delete(key)
+}
+
+// monitorStore probes the store at every interval, until stopped
+func (r *oauthProxy) monitorStore(interval time.Duration, stop <-chan struct{}) {
+	key := r.config.StoreKeyPrefix + storeProbeKeyPrefix + uuid.NewString()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		r.updateStoreHealth(r.probeStore(key))
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// updateStoreHealth records the outcome of a probe of the store, logging the transitions
+func (r *oauthProxy) updateStoreHealth(err error) {
+	var unhealthy int32
+	if err != nil {
+		unhealthy = 1
+	}
+	was := atomic.SwapInt32(&r.storeUnhealthy, unhealthy)
+	storeHealthyMetric.Set(float64(1 - unhealthy))
+
+	switch {
+	case was == 0 && unhealthy == 1:
+		r.log.Error("the store has become unhealthy", zap.Error(err))
+	case was == 1 && unhealthy == 0:
+		r.log.Info("the store has recovered")
+	}
+}
+
+// isStoreHealthy indicates the last probe of the store succeeded, or the store is not probed
+func (r *oauthProxy) isStoreHealthy() bool {
+	return atomic.LoadInt32(&r.storeUnhealthy) == 0
+}
+
+// Close is used to close off any resources, stopping the background refreshes first
 func (r *oauthProxy) CloseStore() error {
+	if r.refresher != nil {
+		r.refresher.close()
+	}
 	if r.store != nil {
-		return r.store.Close()
+		err := r.store.Close()
+		r.lifecycleEvent(lifecycleStoreClosed, err)
+
+		return err
 	}
 
 	return nil
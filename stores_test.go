@@ -16,10 +16,21 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/coreos/go-oidc/jose"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 func TestCreateStorageRedis(t *testing.T) {
@@ -42,3 +53,492 @@ func TestCreateStorageFail(t *testing.T) {
 	assert.Nil(t, store)
 	assert.Error(t, err)
 }
+
+func TestStoreKeyPrefix(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+	p := &oauthProxy{
+		config: &Config{StoreKeyPrefix: "gatekeeper-1:"},
+		log:    zap.NewNop(),
+		store:  s.store,
+	}
+	token := newTestToken("test").getToken()
+
+	require.NoError(t, p.StoreRefreshToken(token, "refresh"))
+	v, err := s.store.Get("gatekeeper-1:" + getHashKey(&token))
+	require.NoError(t, err)
+	assert.Equal(t, "refresh", v)
+	v, err = s.store.Get(getHashKey(&token))
+	require.NoError(t, err)
+	assert.Empty(t, v)
+
+	v, err = p.GetRefreshToken(token)
+	require.NoError(t, err)
+	assert.Equal(t, "refresh", v)
+
+	require.NoError(t, p.DeleteRefreshToken(token))
+	_, err = p.GetRefreshToken(token)
+	assert.Equal(t, ErrNoSessionStateFound, err)
+}
+
+func TestEncryptStoreTokens(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+	p := &oauthProxy{
+		config: &Config{EncryptStoreTokens: true, EncryptionKey: testKey},
+		log:    zap.NewNop(),
+		store:  s.store,
+	}
+	token := newTestToken("test").getToken()
+
+	require.NoError(t, p.StoreRefreshToken(token, "refresh"))
+	v, err := s.store.Get(getHashKey(&token))
+	require.NoError(t, err)
+	assert.NotEmpty(t, v)
+	assert.NotContains(t, v, "refresh", "the token should not be stored as plaintext")
+	v, err = p.GetRefreshToken(token)
+	require.NoError(t, err)
+	assert.Equal(t, "refresh", v)
+
+	require.NoError(t, p.StoreAccessToken("session", token.Encode()))
+	v, err = s.store.Get(p.getSessionStoreKey("session"))
+	require.NoError(t, err)
+	assert.NotEqual(t, token.Encode(), v)
+	v, err = p.GetAccessToken("session")
+	require.NoError(t, err)
+	assert.Equal(t, token.Encode(), v)
+
+	// the values which cannot be decrypted are rejected, never handed back as tokens
+	require.NoError(t, s.store.Set(getHashKey(&token), "refresh"))
+	_, err = p.GetRefreshToken(token)
+	assert.Equal(t, ErrStoreDecryption, err)
+	p.config.EncryptionKey = "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j"
+	_, err = p.GetAccessToken("session")
+	assert.Equal(t, ErrStoreDecryption, err)
+}
+
+func TestStoreAccessToken(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+	p := &oauthProxy{
+		config: &Config{
+			CookieRefreshName:       refreshCookie,
+			EnableStoredAccessToken: true,
+		},
+		log:   zap.NewNop(),
+		store: s.store,
+	}
+	token := newTestToken("test").getToken()
+
+	_, err := p.GetAccessToken("session")
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	require.NoError(t, p.StoreAccessToken("session", token.Encode()))
+	v, err := p.GetAccessToken("session")
+	require.NoError(t, err)
+	assert.Equal(t, token.Encode(), v)
+
+	// the session cookie is enough to retrieve the identity
+	req := newFakeHTTPRequest(http.MethodGet, "/")
+	req.AddCookie(&http.Cookie{Name: refreshCookie, Value: "session"})
+	user, err := p.getIdentity(req)
+	require.NoError(t, err)
+	assert.False(t, user.isBearer())
+	assert.Equal(t, token.Encode(), user.token.Encode())
+
+	require.NoError(t, p.DeleteAccessToken("session"))
+	_, err = p.getIdentity(req)
+	assert.Error(t, err)
+}
+
+func TestOpaqueSessionCookie(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+	p := &oauthProxy{
+		config: &Config{
+			CookieAccessName:          accessCookie,
+			EnableOpaqueSessionCookie: true,
+			SessionIDFormat:           sessionIDFormatUUID,
+			StoreKeyPrefix:            "gatekeeper-1:",
+		},
+		log:   zap.NewNop(),
+		store: s.store,
+	}
+	p.cookieChunker = p.makeCookieChunker()
+	p.cookieDropper = p.makeCookieDropper()
+	token := newTestToken("test").getToken()
+
+	// the cookie holds a random id, the token being kept in the store
+	resp := httptest.NewRecorder()
+	p.dropAccessTokenCookie(newFakeHTTPRequest(http.MethodGet, "/"), resp, token.Encode(), time.Hour)
+	cookies := resp.Result().Cookies()
+	require.Len(t, cookies, 1)
+	id := cookies[0].Value
+	_, err := uuid.Parse(id)
+	require.NoError(t, err)
+	assert.NotContains(t, id, token.Encode())
+
+	req := newFakeHTTPRequest(http.MethodGet, "/")
+	req.AddCookie(&http.Cookie{Name: accessCookie, Value: id})
+	user, err := p.getIdentity(req)
+	require.NoError(t, err)
+	assert.Equal(t, token.Encode(), user.token.Encode())
+	assert.Equal(t, id, user.sessionID)
+
+	// a refreshed session keeps its id
+	refreshed := newTestToken("test").getToken()
+	req = req.WithContext(context.WithValue(req.Context(), contextScopeName, &RequestScope{Identity: user}))
+	resp = httptest.NewRecorder()
+	p.dropAccessTokenCookie(req, resp, refreshed.Encode(), time.Hour)
+	cookies = resp.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, id, cookies[0].Value)
+	v, err := p.GetOpaqueSession(id)
+	require.NoError(t, err)
+	assert.Equal(t, refreshed.Encode(), v)
+
+	// unknown ids hold no session
+	forged := newFakeHTTPRequest(http.MethodGet, "/")
+	forged.AddCookie(&http.Cookie{Name: accessCookie, Value: "forged"})
+	_, err = p.getIdentity(forged)
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	// clearing the cookie ends the session
+	p.clearAccessTokenCookie(req, httptest.NewRecorder())
+	_, err = p.GetOpaqueSession(id)
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	// base64 ids
+	id, err = newSessionID(sessionIDFormatBase64)
+	require.NoError(t, err)
+	assert.Len(t, id, 43)
+	assert.NotContains(t, id, "=")
+}
+
+func TestMaxSessionsPerUser(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+	p := &oauthProxy{
+		config: &Config{MaxSessionsPerUser: 2},
+		log:    zap.NewNop(),
+		store:  s.store,
+	}
+	for _, key := range []string{"session-1", "session-2"} {
+		require.NoError(t, p.addUserSession("user", key))
+		require.NoError(t, s.store.Set(key, "refresh"))
+	}
+
+	// the oldest session is evicted
+	require.NoError(t, p.addUserSession("user", "session-3"))
+	require.NoError(t, s.store.Set("session-3", "refresh"))
+	v, err := s.store.Get("session-1")
+	require.NoError(t, err)
+	assert.Empty(t, v)
+	sessions, err := p.getUserSessions("user")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"session-2", "session-3"}, sessions)
+
+	// refreshed sessions keep their rank
+	require.NoError(t, p.replaceUserSession("user", "session-2", "session-2b"))
+	require.NoError(t, s.store.Set("session-2b", "refresh"))
+	sessions, err = p.getUserSessions("user")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"session-2b", "session-3"}, sessions)
+
+	// revoked sessions are not accounted for
+	require.NoError(t, s.store.Delete("session-3"))
+	p.config.RejectExceedingSessions = true
+	require.NoError(t, p.addUserSession("user", "session-4"))
+	require.NoError(t, s.store.Set("session-4", "refresh"))
+
+	assert.Equal(t, ErrTooManySessions, p.addUserSession("user", "session-5"))
+	v, err = s.store.Get("session-2b")
+	require.NoError(t, err)
+	assert.Equal(t, "refresh", v)
+}
+
+func TestMaxSessionsPerUserConcurrently(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+	p := &oauthProxy{
+		config: &Config{MaxSessionsPerUser: 100},
+		log:    zap.NewNop(),
+		store:  &slowStore{storage: s.store},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("session-%d", i)
+		require.NoError(t, s.store.Set(key, "refresh"))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, p.addUserSession("user", key))
+		}()
+	}
+	wg.Wait()
+
+	// none of the concurrent logins is lost
+	sessions, err := p.getUserSessions("user")
+	require.NoError(t, err)
+	assert.Len(t, sessions, 20)
+	assert.Empty(t, p.sessionLocks.locks)
+}
+
+// slowStore delays the reads from the store, widening the window of the concurrent updates
+type slowStore struct {
+	storage
+}
+
+func (s *slowStore) Get(key string) (string, error) {
+	time.Sleep(time.Millisecond)
+	return s.storage.Get(key)
+}
+
+// failingStore fails the writes to the store when asked to
+type failingStore struct {
+	storage
+	fail bool
+}
+
+func (f *failingStore) Set(key, value string) error {
+	if f.fail {
+		return errors.New("the store is down")
+	}
+	return f.storage.Set(key, value)
+}
+
+func TestStoreHealth(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+	store := &failingStore{storage: s.store}
+	p := &oauthProxy{
+		config: &Config{},
+		log:    zap.NewNop(),
+		store:  store,
+	}
+	ready := func() int {
+		resp := httptest.NewRecorder()
+		p.readyHandler(resp, newFakeHTTPRequest(http.MethodGet, readyURL))
+		return resp.Code
+	}
+
+	p.updateStoreHealth(p.probeStore("probe"))
+	assert.True(t, p.isStoreHealthy())
+	assert.Equal(t, http.StatusOK, ready())
+	v, err := s.store.Get("probe")
+	require.NoError(t, err)
+	assert.Empty(t, v, "the probe key should have been removed")
+
+	store.fail = true
+	p.updateStoreHealth(p.probeStore("probe"))
+	assert.False(t, p.isStoreHealthy())
+	assert.Equal(t, http.StatusServiceUnavailable, ready())
+
+	store.fail = false
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		p.monitorStore(time.Hour, stop)
+		close(done)
+	}()
+	close(stop)
+	<-done
+	assert.True(t, p.isStoreHealthy())
+	assert.Equal(t, http.StatusOK, ready())
+}
+
+func TestRefreshTokenMigration(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	cfg.EncryptionKey = testKey
+	cfg.EnableRefreshTokenMigration = true
+	p := newFakeProxy(cfg)
+	p.proxy.store = s.store
+
+	token := newTestToken(p.idp.getLocation())
+	access, err := p.idp.signToken(token.claims)
+	require.NoError(t, err)
+	refresh, err := p.idp.signToken(token.claims)
+	require.NoError(t, err)
+	encrypted, err := encodeText(refresh.Encode(), testKey)
+	require.NoError(t, err)
+	user, err := extractIdentity(*access)
+	require.NoError(t, err)
+
+	req := newFakeHTTPRequest(http.MethodGet, "/")
+	req.AddCookie(&http.Cookie{Name: cfg.CookieRefreshName, Value: encrypted})
+
+	// the store does not hold the token yet: falls back to the cookie
+	_, _, fromCookie, err := p.proxy.retrieveRefreshToken(req, user)
+	require.NoError(t, err)
+	assert.True(t, fromCookie)
+
+	resp := httptest.NewRecorder()
+	require.NoError(t, p.proxy.refreshToken(resp, req, user))
+	var cleared bool
+	for _, c := range resp.Result().Cookies() {
+		if c.Name == cfg.CookieRefreshName {
+			assert.Empty(t, c.Value)
+			cleared = true
+		}
+	}
+	assert.True(t, cleared, "the refresh token cookie should have been cleared")
+	v, err := p.proxy.GetRefreshToken(user.token)
+	require.NoError(t, err)
+	assert.NotEqual(t, encrypted, v, "the renewed refresh token should have been stored")
+
+	// both sources now hold a refresh token: the precedence decides
+	stored, _, fromCookie, err := p.proxy.retrieveRefreshToken(req, user)
+	require.NoError(t, err)
+	assert.False(t, fromCookie)
+	assert.NotEqual(t, refresh.Encode(), stored)
+
+	p.proxy.config.RefreshTokenSource = refreshTokenSourceCookie
+	fromClient, _, fromCookie, err := p.proxy.retrieveRefreshToken(req, user)
+	require.NoError(t, err)
+	assert.True(t, fromCookie)
+	assert.Equal(t, refresh.Encode(), fromClient)
+}
+
+func TestSessionIDIndex(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+	p := &oauthProxy{
+		config: &Config{StoreKeyPrefix: "gatekeeper-1:", EnableSessionIDIndex: true},
+		log:    zap.NewNop(),
+		store:  s.store,
+	}
+	token := newTestToken("test")
+	token.claims.Add(claimSessionID, "5bbd0d3c-4b36-4ad1-a3a4-b4ec9f4fb4ad")
+	access := token.getToken()
+	sid := getSessionID(jose.JWT{}, access)
+	require.Equal(t, "5bbd0d3c-4b36-4ad1-a3a4-b4ec9f4fb4ad", sid)
+
+	require.NoError(t, p.StoreRefreshToken(access, "refresh"))
+	require.NoError(t, p.indexSessionID(sid, p.getUserSessionKey(access, "")))
+	_, err := p.countSessionRefresh(sid)
+	require.NoError(t, err)
+	require.NoError(t, p.deleteSessionByID(sid))
+
+	_, err = p.GetRefreshToken(access)
+	assert.Equal(t, ErrNoSessionStateFound, err)
+	v, err := s.store.Get(p.refreshCountKey(sid))
+	require.NoError(t, err)
+	assert.Empty(t, v, "the refresh count of the revoked session should have been removed")
+	assert.Equal(t, ErrSessionNotFound, p.deleteSessionByID(sid))
+
+	// the index is disabled
+	p.config.EnableSessionIDIndex = false
+	require.NoError(t, p.indexSessionID(sid, p.getUserSessionKey(access, "")))
+	assert.Equal(t, ErrSessionNotFound, p.deleteSessionByID(sid))
+}
+
+func TestRefreshRateLimit(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	cfg.EncryptionKey = testKey
+	cfg.RefreshRateLimit = 2
+	cfg.RefreshRateWindow = time.Hour
+	p := newFakeProxy(cfg)
+	p.proxy.store = s.store
+
+	token := newTestToken(p.idp.getLocation())
+	token.claims.Add(claimSessionID, "5bbd0d3c-4b36-4ad1-a3a4-b4ec9f4fb4ad")
+	access, err := p.idp.signToken(token.claims)
+	require.NoError(t, err)
+	encrypted, err := encodeText("refresh", testKey)
+	require.NoError(t, err)
+	user, err := extractIdentity(*access)
+	require.NoError(t, err)
+	require.NoError(t, p.proxy.StoreRefreshToken(user.token, encrypted))
+
+	for i := 1; i <= cfg.RefreshRateLimit; i++ {
+		count, err := p.proxy.countSessionRefresh("5bbd0d3c-4b36-4ad1-a3a4-b4ec9f4fb4ad")
+		require.NoError(t, err)
+		assert.Equal(t, i, count)
+	}
+
+	// one more refresh within the window invalidates the session
+	resp := httptest.NewRecorder()
+	err = p.proxy.refreshToken(resp, newFakeHTTPRequest(http.MethodGet, "/"), user)
+	assert.Equal(t, ErrRefreshRateExceeded, err)
+	_, err = p.proxy.GetRefreshToken(user.token)
+	assert.Equal(t, ErrNoSessionStateFound, err, "the session should have been removed from the store")
+	var cleared bool
+	for _, c := range resp.Result().Cookies() {
+		if c.Name == cfg.CookieAccessName {
+			assert.Empty(t, c.Value)
+			cleared = true
+		}
+	}
+	assert.True(t, cleared, "the access token cookie should have been cleared")
+	v, err := s.store.Get(p.proxy.refreshCountKey("5bbd0d3c-4b36-4ad1-a3a4-b4ec9f4fb4ad"))
+	require.NoError(t, err)
+	assert.Empty(t, v, "the refresh count of the invalidated session should have been removed")
+
+	// the count starts over with a new window
+	p.proxy.config.RefreshRateWindow = time.Nanosecond
+	time.Sleep(time.Second)
+	count, err := p.proxy.countSessionRefresh("5bbd0d3c-4b36-4ad1-a3a4-b4ec9f4fb4ad")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestSessionRotation(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	cfg.EncryptionKey = testKey
+	cfg.EnableOpaqueSessionCookie = true
+	cfg.EnableSessionRotation = true
+	p := newFakeProxy(cfg)
+	defer p.idp.Close()
+	p.proxy.store = s.store
+
+	// refresh returns the opaque id of the session refreshed for a user holding the roles, the tokens of the
+	// provider holding none
+	refresh := func(roles []string) string {
+		token := newTestToken(p.idp.getLocation())
+		token.addRealmRoles(roles)
+		access, err := p.idp.signToken(token.claims)
+		require.NoError(t, err)
+		encrypted, err := encodeText(access.Encode(), testKey)
+		require.NoError(t, err)
+		user, err := extractIdentity(*access)
+		require.NoError(t, err)
+		user.sessionID = "session"
+		require.NoError(t, p.proxy.StoreOpaqueSession(user.sessionID, access.Encode()))
+
+		req := newFakeHTTPRequest(http.MethodGet, "/")
+		req.AddCookie(&http.Cookie{Name: cfg.CookieRefreshName, Value: encrypted})
+		req = req.WithContext(context.WithValue(req.Context(), contextScopeName, &RequestScope{Identity: user}))
+		resp := httptest.NewRecorder()
+		require.NoError(t, p.proxy.refreshToken(resp, req, user))
+		cookie := findCookie(cfg.CookieAccessName, resp.Result().Cookies())
+		require.NotNil(t, cookie)
+
+		return cookie.Value
+	}
+
+	// the privileges are unchanged: the session keeps its id
+	assert.Equal(t, "session", refresh(nil))
+	_, err := p.proxy.GetOpaqueSession("session")
+	assert.NoError(t, err)
+
+	// the privileges changed: the session gets a new id, the previous one being forgotten
+	id := refresh([]string{"admin"})
+	assert.NotEqual(t, "session", id)
+	_, err = p.proxy.GetOpaqueSession("session")
+	assert.Equal(t, ErrSessionNotFound, err)
+	_, err = p.proxy.GetOpaqueSession(id)
+	assert.NoError(t, err)
+
+	// the rotation is disabled
+	p.proxy.config.EnableSessionRotation = false
+	assert.Equal(t, "session", refresh([]string{"admin"}))
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
+	"github.com/coreos/go-oidc/oidc"
+	"go.uber.org/zap"
+)
+
+// isTestModeToken checks the token has been crafted by the test mode, i.e. it is signed by the key of the service
+func (r *oauthProxy) isTestModeToken(token jose.JWT) bool {
+	return r.testModeKey != nil && token.Header[jose.HeaderKeyID] == r.testModeKey.ID()
+}
+
+// verifyTestModeToken verifies a token crafted by the test mode, as the provider ones
+func (r *oauthProxy) verifyTestModeToken(token jose.JWT) error {
+	verifier := oidc.NewJWTVerifier(testModeIssuer, r.config.ClientID,
+		func() error { return errors.New("the token is not signed by the key of the test mode") },
+		func() []key.PublicKey { return []key.PublicKey{*key.NewPublicKey(r.testModeKey.JWK())} })
+
+	return verifier.Verify(token)
+}
+
+// testTokenHandler establishes a session for the claims posted by the tests, signed by the service itself. The
+// issuer is enforced, the audience, issue and expiry times being defaulted. TESTING ONLY: the route only exists in
+// test mode and requires the secret shared with the tests.
+func (r *oauthProxy) testTokenHandler(w http.ResponseWriter, req *http.Request) {
+	ctx, span, logger := r.traceSpan(req.Context(), "test token handler")
+	if span != nil {
+		defer span.End()
+	}
+	clientIP := realIP(req, r.trustedProxies)
+
+	secret := req.Header.Get(headerTestModeSecret)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(r.config.TestModeSecret)) != 1 {
+		r.errorResponse(w, req.WithContext(ctx), "invalid test mode secret, client_ip "+clientIP, http.StatusUnauthorized, nil)
+		return
+	}
+
+	claims := make(jose.Claims)
+	if err := json.NewDecoder(io.LimitReader(req.Body, testModeMaxClaimsSize)).Decode(&claims); err != nil {
+		r.errorResponse(w, req.WithContext(ctx), "the claims of the test token are not a json object", http.StatusBadRequest, err)
+		return
+	}
+	if sub, found, err := claims.StringClaim("sub"); err != nil || !found || sub == "" {
+		r.errorResponse(w, req.WithContext(ctx), "the claims of the test token must hold a sub", http.StatusBadRequest, err)
+		return
+	}
+
+	now := time.Now()
+	claims.Add("iss", testModeIssuer)
+	if _, found := claims[claimAudience]; !found {
+		claims.Add(claimAudience, r.config.ClientID)
+	}
+	if _, found := claims[claimIssuedAt]; !found {
+		claims.Add(claimIssuedAt, float64(now.Unix()))
+	}
+	expiresAt, found, err := claims.TimeClaim(claimExpiration)
+	if err != nil {
+		r.errorResponse(w, req.WithContext(ctx), "the expiry of the test token is invalid", http.StatusBadRequest, err)
+		return
+	}
+	if !found {
+		expiresAt = now.Add(testModeTokenDuration)
+		claims.Add(claimExpiration, float64(expiresAt.Unix()))
+	}
+
+	token, err := jose.NewSignedJWT(claims, r.testModeKey.Signer())
+	if err != nil {
+		r.errorResponse(w, req.WithContext(ctx), "unable to sign the test token", http.StatusInternalServerError, err)
+		return
+	}
+	accessToken := token.Encode()
+	logger.Warn("TESTING ONLY - a session has been established for crafted claims",
+		zap.String("client_ip", clientIP),
+		zap.Any("sub", claims["sub"]))
+
+	value := accessToken
+	if r.config.EnableEncryptedToken || r.config.ForceEncryptedCookie {
+		if value, err = encodeText(value, r.config.EncryptionKey); err != nil {
+			r.errorResponse(w, req.WithContext(ctx), "unable to encode the test token", http.StatusInternalServerError, err)
+			return
+		}
+	}
+	r.dropAccessTokenCookie(req.WithContext(ctx), w, value, time.Until(expiresAt))
+
+	w.Header().Set("Content-Type", jsonMime)
+	if err := json.NewEncoder(w).Encode(tokenResponse{
+		TokenType:   authorizationType,
+		AccessToken: accessToken,
+		ExpiresIn:   int(time.Until(expiresAt).Seconds()),
+	}); err != nil {
+		logger.Error("failed to write the test token", zap.Error(err))
+	}
+}
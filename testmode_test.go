@@ -0,0 +1,100 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTestModeToken(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableTestMode = true
+	cfg.TestModeSecret = "test-secret"
+	cfg.Resources = []*Resource{{URL: "/tested/*", Methods: allHTTPMethods, Roles: []string{"tester"}}}
+	p := newFakeProxy(cfg)
+
+	post := func(secret, claims string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, p.getServiceURL()+cfg.WithOAuthURI(testTokenURL), strings.NewReader(claims))
+		require.NoError(t, err)
+		if secret != "" {
+			req.Header.Set(headerTestModeSecret, secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+	claims := `{"sub":"1e11e539","email":"tester@example.com","preferred_username":"tester","realm_access":{"roles":["tester"]}}`
+
+	for _, secret := range []string{"", "wrong-secret"} {
+		resp := post(secret, claims)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "secret %q", secret)
+		assert.Nil(t, findCookie(cfg.CookieAccessName, resp.Cookies()))
+	}
+	resp := post(cfg.TestModeSecret, `{"email":"tester@example.com"}`)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "the sub is required")
+
+	resp = post(cfg.TestModeSecret, claims)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var token tokenResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&token))
+	require.NotEmpty(t, token.AccessToken)
+	assert.True(t, token.ExpiresIn > 0)
+	cookie := findCookie(cfg.CookieAccessName, resp.Cookies())
+	require.NotNil(t, cookie)
+
+	// the session is accepted like the ones of the provider, with the crafted claims
+	requests := []fakeRequest{
+		{
+			URI:                  "/tested/resource",
+			Cookies:              []*http.Cookie{cookie},
+			ExpectedProxy:        true,
+			ExpectedCode:         http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{"X-Auth-Username": "tester", "X-Auth-Email": "tester@example.com"},
+		},
+		{
+			URI:           "/tested/resource",
+			Headers:       map[string]string{authorizationHeader: "Bearer " + token.AccessToken},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+	p.RunTests(t, requests)
+}
+
+func TestTestModeDisabled(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.TestModeSecret = "test-secret"
+	p := newFakeProxy(cfg)
+	defer p.idp.Close()
+
+	req, err := http.NewRequest(http.MethodPost, p.getServiceURL()+cfg.WithOAuthURI(testTokenURL), strings.NewReader(`{"sub":"1e11e539"}`))
+	require.NoError(t, err)
+	req.Header.Set(headerTestModeSecret, cfg.TestModeSecret)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Nil(t, findCookie(cfg.CookieAccessName, resp.Cookies()))
+}
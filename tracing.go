@@ -11,6 +11,7 @@ import (
 	"github.com/go-chi/chi"
 	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/plugin/ochttp/propagation/b3"
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
 	"go.opencensus.io/trace"
 	"go.opencensus.io/trace/propagation"
 	"go.uber.org/zap"
@@ -90,12 +91,7 @@ func (r *oauthProxy) proxyTracingMiddleware(next http.Handler) http.Handler {
 	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
 
 	// insert instrumentation middleware
-	var propagator propagation.HTTPFormat
-	if r.config.TracingExporter == datadogExporter {
-		propagator = &httpFormat{HTTPFormat: &b3.HTTPFormat{}}
-	} else {
-		propagator = &b3.HTTPFormat{}
-	}
+	propagator := r.tracePropagation()
 
 	instrument1 := func(next http.Handler) http.Handler {
 		return &ochttp.Handler{
@@ -184,12 +180,59 @@ func traceError(span *trace.Span, err error, code int) error {
 	return err
 }
 
-func propagateSpan(span *trace.Span, req *http.Request) {
-	// B3 span propagation (e.g. Opentracing)
-	// NOTE: datadog is supposed to support opentracing headers
-	propagation := &b3.HTTPFormat{}
-	propagation.SpanContextToRequest(span.SpanContext(), req)
+// propagateSpan injects the trace context of the span into the request sent to the upstream
+func (r *oauthProxy) propagateSpan(span *trace.Span, req *http.Request) {
+	r.tracePropagation().SpanContextToRequest(span.SpanContext(), req)
+}
+
+// tracePropagation returns the formats of the trace context exchanged with the clients and the upstream
+func (r *oauthProxy) tracePropagation() propagation.HTTPFormat {
+	formats := r.config.TracingPropagation
+	if len(formats) == 0 {
+		formats = defaultTracingPropagation
+	}
+
+	var propagators multiFormat
+	for _, format := range formats {
+		switch format {
+		case traceContextPropagation:
+			propagators = append(propagators, &tracecontext.HTTPFormat{})
+		case b3Propagation:
+			// B3 span propagation (e.g. Opentracing)
+			// NOTE: datadog is supposed to support opentracing headers
+			if r.config.TracingExporter == datadogExporter {
+				propagators = append(propagators, &httpFormat{HTTPFormat: &b3.HTTPFormat{}})
+			} else {
+				propagators = append(propagators, &b3.HTTPFormat{})
+			}
+		}
+	}
+	if len(propagators) == 1 {
+		return propagators[0]
+	}
+
+	return propagators
+}
+
+// multiFormat extracts the trace context from the first format found in the request, and injects all of them
+type multiFormat []propagation.HTTPFormat
 
+// SpanContextFromRequest extracts the span context with the first format present in the request.
+func (m multiFormat) SpanContextFromRequest(req *http.Request) (trace.SpanContext, bool) {
+	for _, format := range m {
+		if sc, ok := format.SpanContextFromRequest(req); ok {
+			return sc, true
+		}
+	}
+
+	return trace.SpanContext{}, false
+}
+
+// SpanContextToRequest injects the span context in every format into the request.
+func (m multiFormat) SpanContextToRequest(sc trace.SpanContext, req *http.Request) {
+	for _, format := range m {
+		format.SpanContextToRequest(sc, req)
+	}
 }
 
 type httpFormat struct {
@@ -24,6 +24,85 @@ import (
 	"github.com/coreos/go-oidc/oidc"
 )
 
+// missingClaim returns the first of the claims which is absent or empty in the token, if any
+func missingClaim(claims jose.Claims, names []string) (string, bool) {
+	for _, name := range names {
+		switch v := claims[name].(type) {
+		case nil:
+			return name, true
+		case string:
+			if strings.TrimSpace(v) == "" {
+				return name, true
+			}
+		case []interface{}:
+			if len(v) == 0 {
+				return name, true
+			}
+		case []string:
+			if len(v) == 0 {
+				return name, true
+			}
+		case map[string]interface{}:
+			if len(v) == 0 {
+				return name, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// checkClaimTypes verifies the claims holding the roles, groups and authentication methods have the types keycloak
+// issues them with, i.e. objects and arrays of strings, which the extraction of the identity otherwise coerces or skips
+func checkClaimTypes(claims jose.Claims) error {
+	isStrings := func(v interface{}) bool {
+		switch list := v.(type) {
+		case []string:
+			return true
+		case []interface{}:
+			for _, x := range list {
+				if _, ok := x.(string); !ok {
+					return false
+				}
+			}
+			return true
+		}
+		return false
+	}
+
+	if v, found := claims[claimRealmAccess]; found {
+		access, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%w: %s is not an object", ErrClaimType, claimRealmAccess)
+		}
+		if roles, found := access[claimResourceRoles]; found && !isStrings(roles) {
+			return fmt.Errorf("%w: %s.%s is not an array of strings", ErrClaimType, claimRealmAccess, claimResourceRoles)
+		}
+	}
+	if v, found := claims[claimResourceAccess]; found {
+		accesses, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%w: %s is not an object", ErrClaimType, claimResourceAccess)
+		}
+		for name, x := range accesses {
+			access, ok := x.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%w: %s.%s is not an object", ErrClaimType, claimResourceAccess, name)
+			}
+			if roles, found := access[claimResourceRoles]; found && !isStrings(roles) {
+				return fmt.Errorf("%w: %s.%s.%s is not an array of strings", ErrClaimType, claimResourceAccess, name, claimResourceRoles)
+			}
+		}
+	}
+	for _, name := range []string{claimGroups, claimAuthMethods} {
+		if v, found := claims[name]; found && !isStrings(v) {
+			return fmt.Errorf("%w: %s is not an array of strings", ErrClaimType, name)
+		}
+	}
+
+	return nil
+}
+
 // extractIdentity parse the jwt token and extracts the various elements is order to construct
 //
 // This is function that concentrates keycloak dependencies (i.e. the structure of the token).
@@ -32,6 +111,13 @@ func extractIdentity(token jose.JWT) (*userContext, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	return extractIdentityFromClaims(token, claims)
+}
+
+// extractIdentityFromClaims constructs the user context of the token from a set of claims, which may
+// have been completed from other sources than the token
+func extractIdentityFromClaims(token jose.JWT, claims jose.Claims) (*userContext, error) {
 	identity, err := oidc.IdentityFromClaims(claims)
 	if err != nil {
 		return nil, err
@@ -58,8 +144,8 @@ func extractIdentity(token jose.JWT) (*userContext, error) {
 	// @step: extract the realm roles
 	var roleList []string
 	if realmRoles, found := claims[claimRealmAccess].(map[string]interface{}); found {
-		if roles, found := realmRoles[claimResourceRoles]; found {
-			for _, r := range roles.([]interface{}) {
+		if roles, isSlice := realmRoles[claimResourceRoles].([]interface{}); isSlice {
+			for _, r := range roles {
 				roleList = append(roleList, fmt.Sprintf("%s", r))
 			}
 		}
@@ -88,8 +174,22 @@ func extractIdentity(token jose.JWT) (*userContext, error) {
 		return nil, err
 	}
 
+	// @step: extract the authentication methods, which may be a single value
+	authMethods, _, err := claims.StringsClaim(claimAuthMethods)
+	if err != nil {
+		if method, found, erc := claims.StringClaim(claimAuthMethods); erc == nil && found {
+			authMethods = []string{method}
+		}
+	}
+
+	// @step: extract the time of the user authentication: the issuance of the token does not tell it, a token
+	// refreshed long after the login is recent all the same. Without it, the authentication is deemed stale.
+	authTime, _, _ := claims.TimeClaim(claimAuthTime)
+
 	return &userContext{
 		audiences:     audiences,
+		authMethods:   authMethods,
+		authTime:      authTime,
 		claims:        claims,
 		email:         identity.Email,
 		expiresAt:     identity.ExpiresAt,
@@ -108,6 +208,10 @@ type userContext struct {
 	id string
 	// the audience for the token
 	audiences []string
+	// the methods the user authenticated with (amr claim)
+	authMethods []string
+	// the time the user authenticated against the provider
+	authTime time.Time
 	// whether the context is from a session cookie or authorization header
 	bearerToken bool
 	// the claims associated to the token
@@ -126,6 +230,32 @@ type userContext struct {
 	roles []string
 	// the access token itself
 	token jose.JWT
+	// the access token as presented when it is opaque, the token then only holds the claims of the userinfo
+	opaqueToken string
+	// whether the identity has been asserted by a trusted proxy, without any token
+	trusted bool
+	// the opaque id of the session, when the access cookie holds one rather than the token
+	sessionID string
+}
+
+// samePrivileges checks the tokens grant the same roles and groups. Tokens which cannot be parsed are deemed to differ.
+func samePrivileges(previous, current jose.JWT) bool {
+	before, err := extractIdentity(previous)
+	if err != nil {
+		return false
+	}
+	after, err := extractIdentity(current)
+	if err != nil {
+		return false
+	}
+
+	return before.hasSamePrivileges(after)
+}
+
+// hasSamePrivileges checks the identities hold the same roles and groups, whatever their order
+func (r *userContext) hasSamePrivileges(other *userContext) bool {
+	return hasAccess(r.roles, other.roles, true, false) && hasAccess(other.roles, r.roles, true, false) &&
+		hasAccess(r.groups, other.groups, true, false) && hasAccess(other.groups, r.groups, true, false)
 }
 
 // isAudience checks the audience
@@ -143,11 +273,44 @@ func (r *userContext) isExpired() bool {
 	return r.expiresAt.Before(time.Now())
 }
 
+// isAuthenticatedWithin checks if the user has authenticated within the duration
+func (r *userContext) isAuthenticatedWithin(duration time.Duration) bool {
+	return !r.authTime.IsZero() && time.Since(r.authTime) <= duration
+}
+
+// getAuthMethodRoles returns the authentication methods of the user as roles
+func (r *userContext) getAuthMethodRoles() []string {
+	roles := make([]string, 0, len(r.authMethods))
+	for _, method := range r.authMethods {
+		roles = append(roles, authMethodRolePrefix+method)
+	}
+
+	return roles
+}
+
+// isTrusted checks if the identity has been asserted by a trusted proxy
+func (r *userContext) isTrusted() bool {
+	return r.trusted
+}
+
 // isBearer checks if the token
 func (r *userContext) isBearer() bool {
 	return r.bearerToken
 }
 
+// isOpaque checks if the access token is opaque, i.e. verified at the userinfo endpoint
+func (r *userContext) isOpaque() bool {
+	return r.opaqueToken != ""
+}
+
+// accessToken returns the access token to pass on
+func (r *userContext) accessToken() string {
+	if r.isOpaque() {
+		return r.opaqueToken
+	}
+	return r.token.Encode()
+}
+
 // isCookie checks if it's by a cookie
 func (r *userContext) isCookie() bool {
 	return !r.isBearer()
@@ -16,9 +16,11 @@ limitations under the License.
 package main
 
 import (
+	"errors"
 	"testing"
 	"time"
 
+	"github.com/coreos/go-oidc/jose"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -102,6 +104,105 @@ func TestGetUserRealmRoleContext(t *testing.T) {
 	assert.Equal(t, roles, context.roles)
 }
 
+func TestGetUserAuthMethods(t *testing.T) {
+	token := newTestToken("test")
+	context, err := extractIdentity(token.getToken())
+	assert.NoError(t, err)
+	assert.Empty(t, context.authMethods)
+	assert.Empty(t, context.getAuthMethodRoles())
+
+	token.claims[claimAuthMethods] = "pwd"
+	context, err = extractIdentity(token.getToken())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"pwd"}, context.authMethods)
+
+	token.claims[claimAuthMethods] = []string{"pwd", "hwk"}
+	context, err = extractIdentity(token.getToken())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"pwd", "hwk"}, context.authMethods)
+	assert.Equal(t, []string{"amr:pwd", "amr:hwk"}, context.getAuthMethodRoles())
+}
+
+func TestMissingClaim(t *testing.T) {
+	claims := jose.Claims{
+		"tenant_id": "acme",
+		"blank":     " ",
+		"teams":     []interface{}{"a"},
+		"none":      []interface{}{},
+		"scopes":    map[string]interface{}{},
+		"level":     float64(0),
+		"verified":  false,
+	}
+	cases := []struct {
+		Names   []string
+		Missing string
+	}{
+		{Names: nil},
+		{Names: []string{"tenant_id", "teams", "level", "verified"}},
+		{Names: []string{"tenant_id", "absent"}, Missing: "absent"},
+		{Names: []string{"blank"}, Missing: "blank"},
+		{Names: []string{"none"}, Missing: "none"},
+		{Names: []string{"scopes"}, Missing: "scopes"},
+	}
+	for i, c := range cases {
+		name, missing := missingClaim(claims, c.Names)
+		assert.Equal(t, c.Missing != "", missing, "case %d", i)
+		assert.Equal(t, c.Missing, name, "case %d", i)
+	}
+}
+
+func TestCheckClaimTypes(t *testing.T) {
+	cases := []struct {
+		Claims jose.Claims
+		Error  string
+	}{
+		{Claims: jose.Claims{}},
+		{
+			Claims: jose.Claims{
+				claimRealmAccess:    map[string]interface{}{claimResourceRoles: []interface{}{"admin"}},
+				claimResourceAccess: map[string]interface{}{"app": map[string]interface{}{claimResourceRoles: []interface{}{"user"}}},
+				claimGroups:         []interface{}{"/ops"},
+				claimAuthMethods:    []string{"pwd"},
+			},
+		},
+		{
+			Claims: jose.Claims{claimRealmAccess: map[string]interface{}{claimResourceRoles: "admin"}},
+			Error:  "realm_access.roles is not an array of strings",
+		},
+		{
+			Claims: jose.Claims{claimRealmAccess: []interface{}{"admin"}},
+			Error:  "realm_access is not an object",
+		},
+		{
+			Claims: jose.Claims{claimResourceAccess: map[string]interface{}{"app": []interface{}{"user"}}},
+			Error:  "resource_access.app is not an object",
+		},
+		{
+			Claims: jose.Claims{claimResourceAccess: map[string]interface{}{"app": map[string]interface{}{claimResourceRoles: []interface{}{1}}}},
+			Error:  "resource_access.app.roles is not an array of strings",
+		},
+		{
+			Claims: jose.Claims{claimGroups: "/ops"},
+			Error:  "groups is not an array of strings",
+		},
+		{
+			Claims: jose.Claims{claimAuthMethods: "pwd"},
+			Error:  "amr is not an array of strings",
+		},
+	}
+	for i, c := range cases {
+		err := checkClaimTypes(c.Claims)
+		if c.Error == "" {
+			assert.NoError(t, err, "case %d", i)
+			continue
+		}
+		if assert.Error(t, err, "case %d", i) {
+			assert.True(t, errors.Is(err, ErrClaimType), "case %d", i)
+			assert.Contains(t, err.Error(), c.Error, "case %d", i)
+		}
+	}
+}
+
 func TestUserContextString(t *testing.T) {
 	token := newTestToken("test")
 	context, err := extractIdentity(token.getToken())
@@ -109,3 +210,19 @@ func TestUserContextString(t *testing.T) {
 	assert.NotNil(t, context)
 	assert.NotEmpty(t, context.String())
 }
+
+func TestSamePrivileges(t *testing.T) {
+	newToken := func(roles, groups []string) jose.JWT {
+		token := newTestToken("test")
+		token.addRealmRoles(roles)
+		token.addGroups(groups)
+		return token.getToken()
+	}
+	current := newToken([]string{"user", "viewer"}, []string{"staff"})
+
+	assert.True(t, samePrivileges(current, newToken([]string{"viewer", "user"}, []string{"staff"})))
+	assert.False(t, samePrivileges(current, newToken([]string{"user", "viewer", "admin"}, []string{"staff"})))
+	assert.False(t, samePrivileges(current, newToken([]string{"user"}, []string{"staff"})))
+	assert.False(t, samePrivileges(current, newToken([]string{"user", "viewer"}, []string{"staff", "admins"})))
+	assert.False(t, samePrivileges(current, jose.JWT{}))
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+// userinfoCache holds the userinfo claims of the tokens until they expire
+type userinfoCache struct {
+	sync.RWMutex
+	entries map[string]userinfoEntry
+}
+
+type userinfoEntry struct {
+	claims  jose.Claims
+	expires time.Time
+}
+
+func newUserinfoCache() *userinfoCache {
+	return &userinfoCache{entries: make(map[string]userinfoEntry)}
+}
+
+// get retrieves the userinfo claims of the token, if still cached
+func (c *userinfoCache) get(key string) (jose.Claims, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	entry, found := c.entries[key]
+	if !found || time.Now().After(entry.expires) {
+		return nil, false
+	}
+
+	return entry.claims, true
+}
+
+// set caches the userinfo claims of the token, evicting the expired entries
+func (c *userinfoCache) set(key string, claims jose.Claims, expires time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = userinfoEntry{claims: claims, expires: expires}
+}
+
+// mergeUserinfo completes the claims of the user with the allowed claims found at the userinfo endpoint,
+// so they are considered for admission. The userinfo is fetched once per token.
+func (r *oauthProxy) mergeUserinfo(ctx context.Context, user *userContext) (*userContext, error) {
+	key := getHashKey(&user.token)
+	info, found := r.userinfo.get(key)
+	if !found {
+		if r.idp.UserInfoEndpoint == nil {
+			return nil, ErrNoUserinfoEndpoint
+		}
+		client, err := r.client.OAuthClient()
+		if err != nil {
+			return nil, err
+		}
+		info, err = getUserinfo(ctx, client, r.idp.UserInfoEndpoint.String(), user.accessToken(),
+			r.config.UserinfoTimeout, r.config.UserinfoRetries)
+		if err != nil {
+			return nil, err
+		}
+		r.userinfo.set(key, info, user.expiresAt)
+	}
+
+	merged := make(jose.Claims, len(user.claims)+len(r.config.UserinfoClaims))
+	for k, v := range user.claims {
+		merged[k] = v
+	}
+	for _, name := range r.config.UserinfoClaims {
+		if v, found := info[name]; found {
+			merged[name] = v
+		}
+	}
+
+	identity, err := extractIdentityFromClaims(user.token, merged)
+	if err != nil {
+		return nil, err
+	}
+	// step: keep what the claims do not tell, i.e. how the token was presented
+	identity.bearerToken = user.bearerToken
+	identity.opaqueToken = user.opaqueToken
+	identity.trusted = user.trusted
+	identity.sessionID = user.sessionID
+
+	return identity, nil
+}
+
+// getOpaqueIdentity identifies the user of an opaque access token with its userinfo, the provider rejecting the
+// invalid tokens. As the token holds no expiry, the userinfo is cached and trusted for the opaque token ttl.
+func (r *oauthProxy) getOpaqueIdentity(ctx context.Context, access string) (*userContext, error) {
+	key := hashString(access)
+	claims, found := r.opaqueTokens.get(key)
+	if !found {
+		if r.idp.UserInfoEndpoint == nil {
+			return nil, ErrNoUserinfoEndpoint
+		}
+		client, err := r.client.OAuthClient()
+		if err != nil {
+			return nil, err
+		}
+		info, err := getUserinfo(ctx, client, r.idp.UserInfoEndpoint.String(), access,
+			r.config.UserinfoTimeout, r.config.UserinfoRetries)
+		if err != nil {
+			return nil, err
+		}
+
+		// step: the identity expires with the cache entry, and the userinfo carries no audience
+		expires := time.Now().Add(r.config.OpaqueTokenTTL)
+		claims = make(jose.Claims, len(info)+2)
+		for k, v := range info {
+			claims[k] = v
+		}
+		claims[claimExpiration] = float64(expires.Unix())
+		if _, found := claims[claimAudience]; !found {
+			claims[claimAudience] = r.config.ClientID
+		}
+		r.opaqueTokens.set(key, claims, expires)
+	}
+
+	token, err := jose.NewJWT(jose.JOSEHeader{jose.HeaderKeyAlgorithm: "none"}, claims)
+	if err != nil {
+		return nil, err
+	}
+	user, err := extractIdentityFromClaims(token, claims)
+	if err != nil {
+		return nil, err
+	}
+	user.bearerToken = true
+	user.opaqueToken = access
+
+	return user, nil
+}
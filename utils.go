@@ -17,8 +17,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	cryptorand "crypto/rand"
 	"crypto/rsa"
 	sha "crypto/sha256"
@@ -33,8 +35,10 @@ import (
 	"io"
 	"io/ioutil"
 	"math/big"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -61,6 +65,46 @@ var (
 		http.MethodPut,
 		http.MethodTrace,
 	}
+	// defaultStepUpMethods are the methods requiring a fresh authentication when a resource enables step-up
+	defaultStepUpMethods = []string{
+		http.MethodDelete,
+		http.MethodPost,
+		http.MethodPut,
+	}
+	// browserSecurityHeaders are the security headers a resource may skip, strict transport security aside
+	browserSecurityHeaders = []string{
+		headerCSP,
+		headerXFrameOptions,
+		headerXXSSProtection,
+		headerXContentTypeOptions,
+	}
+	// clientCertFields are the fields of the client certificates which may be mapped to claims
+	clientCertFields = []string{
+		certFieldCommonName,
+		certFieldOrganization,
+		certFieldOrganizationalUnit,
+		certFieldDNS,
+		certFieldURI,
+		certFieldEmail,
+		certFieldSerial,
+	}
+	// defaultMiddlewareOrder is the order of the middleware protecting the resources
+	defaultMiddlewareOrder = []string{
+		middlewareAuthentication,
+		middlewareAdmission,
+		middlewareRateLimit,
+		middlewareIdentityHeaders,
+		middlewareCSRF,
+	}
+	// middlewareDependencies are the middleware which must come before the others in the chain
+	middlewareDependencies = map[string][]string{
+		middlewareAdmission:       {middlewareAuthentication},
+		middlewareIdentityHeaders: {middlewareAuthentication},
+	}
+	// defaultTracingPropagation are the formats of the trace context, the W3C one taking precedence
+	defaultTracingPropagation = []string{traceContextPropagation, b3Propagation}
+	// asymmetricSigningAlgorithms are the algorithms the tokens of the provider may be signed with, by default
+	asymmetricSigningAlgorithms = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "PS256", "PS384", "PS512", "EdDSA"}
 )
 
 var (
@@ -133,6 +177,11 @@ func getRequestHostURL(r *http.Request) string {
 	return fmt.Sprintf("%s://%s", scheme, hostname)
 }
 
+// isSecureRequest checks if the request was received over https, possibly by a proxy in front of us
+func isSecureRequest(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), secureScheme)
+}
+
 // readConfigFile reads and parses the configuration file
 func readConfigFile(filename string, config *Config) error {
 	content, err := ioutil.ReadFile(filename)
@@ -202,6 +251,33 @@ func encodeText(plaintext, key string) (string, error) {
 	return base64.RawStdEncoding.EncodeToString(cipherText), nil
 }
 
+// signCookieValue appends to the value of a cookie a MAC of the name and value, keyed with the key
+func signCookieValue(name, value, key string) string {
+	return value + cookieMACSeparator + cookieMAC(name, value, key)
+}
+
+// verifyCookieValue checks the MAC of the value of a cookie, and returns the value without it
+func verifyCookieValue(name, signed, key string) (string, error) {
+	i := strings.LastIndex(signed, cookieMACSeparator)
+	if i < 0 {
+		return "", ErrCookieSignature
+	}
+	value, mac := signed[:i], signed[i+len(cookieMACSeparator):]
+	if !hmac.Equal([]byte(mac), []byte(cookieMAC(name, value, key))) {
+		return "", ErrCookieSignature
+	}
+
+	return value, nil
+}
+
+// cookieMAC computes the MAC of a cookie, bound to its name so values cannot be swapped between cookies
+func cookieMAC(name, value, key string) string {
+	mac := hmac.New(sha.New, []byte(key))
+	_, _ = mac.Write([]byte(name + "=" + value))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
 // decodeText decodes the session state cookie value
 func decodeText(state, key string) (string, error) {
 	cipherText, err := base64.RawStdEncoding.DecodeString(state)
@@ -244,6 +320,16 @@ func decodeKeyPairs(list []string) (map[string]string, error) {
 	return kp, nil
 }
 
+// isIdempotentMethod tells if the requests of the method may be sent again safely
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
+
 // isValidHTTPMethod ensure this is a valid http method type
 func isValidHTTPMethod(method string) bool {
 	for _, x := range allHTTPMethods {
@@ -361,6 +447,97 @@ func toHeader(v string) string {
 	return strings.Join(list, "-")
 }
 
+// formatClaimValue renders a claim value for a header: the strings as they are, the objects and
+// the other values as json
+func formatClaimValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+
+	return string(encoded)
+}
+
+// makeHeaderSetter returns a header setter which writes the headers with the exact casing given, bypassing
+// the canonicalization of http.Header. Headers absent from the casing are set as usual. Several values are sent as
+// repeated headers.
+func makeHeaderSetter(casing map[string]string) func(http.Header, string, ...string) {
+	if len(casing) == 0 {
+		return func(h http.Header, name string, values ...string) {
+			h[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	exact := make(map[string]string, len(casing))
+	for k, v := range casing {
+		exact[http.CanonicalHeaderKey(k)] = v
+	}
+
+	return func(h http.Header, name string, values ...string) {
+		key := http.CanonicalHeaderKey(name)
+		as, found := exact[key]
+		if !found {
+			h[key] = values
+			return
+		}
+		// step: drop the canonical header, which the client may have sent
+		delete(h, key)
+		h[as] = values
+	}
+}
+
+// encodeHeaderValue encodes a value which cannot be sent in a header as is, e.g. a name with accented letters. The
+// values made of printable ASCII characters only are left untouched.
+func encodeHeaderValue(value, encoding string) string {
+	if isHeaderSafe(value) {
+		return value
+	}
+	switch encoding {
+	case identityHeadersEncodingRFC8187:
+		// an ext-value, as in title*=UTF-8''%C3%A9t%C3%A9
+		var b strings.Builder
+		b.WriteString("UTF-8''")
+		for i := 0; i < len(value); i++ {
+			if c := value[i]; isAttrChar(c) {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+		return b.String()
+	case identityHeadersEncodingPercent:
+		return url.PathEscape(value)
+	case identityHeadersEncodingBase64:
+		// an encoded-word, as in =?UTF-8?b?w6l0w6k=?=
+		return mime.BEncoding.Encode("UTF-8", value)
+	default:
+		return value
+	}
+}
+
+// isHeaderSafe checks the value only holds printable ASCII characters, spaces and tabs
+func isHeaderSafe(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; (c < ' ' && c != '\t') || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isAttrChar checks the character may be left unencoded in a RFC 8187 ext-value
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	default:
+		return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+	}
+}
+
 // capitalize capitalizes the first letter of a word
 func capitalize(s string) string {
 	if s == "" {
@@ -416,26 +593,159 @@ func getWithin(expires time.Time, within float64) time.Duration {
 
 // getHashKey returns a hash of the encodes jwt token
 func getHashKey(token *jose.JWT) string {
-	hash := sha.Sum256([]byte(token.Encode()))
+	return hashString(token.Encode())
+}
+
+// hashString returns a digest of the value, suitable for a store key
+func hashString(value string) string {
+	hash := sha.Sum256([]byte(value))
 	return base64.RawStdEncoding.EncodeToString(hash[:])
 }
 
+// newCSPNonce generates a random nonce suited to a content security policy
+func newCSPNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(cryptorand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(nonce), nil
+}
+
 // printError display the command line usage and error
 func printError(message string, args ...interface{}) *cli.ExitError {
 	return cli.NewExitError(fmt.Sprintf("[error] "+message, args...), 1)
 }
 
-// realIP retrieves the client ip address from a http request
-func realIP(req *http.Request) string {
-	ra := req.RemoteAddr
-	if ip := req.Header.Get(headerXForwardedFor); ip != "" {
-		ra = strings.Split(ip, ", ")[0]
-	} else if ip := req.Header.Get(headerXRealIP); ip != "" {
-		ra = ip
-	} else {
-		ra, _, _ = net.SplitHostPort(ra)
+// realIP retrieves the client ip address from a http request.
+//
+// The X-Forwarded-For chain is walked from the right, skipping the trusted proxies: the first untrusted
+// address is the client, since any entry on its left may have been forged by the client itself.
+// When no trusted proxies are configured, the headers are ignored and the peer is the client.
+func realIP(req *http.Request, trusted []*net.IPNet) string {
+	isTrusted := func(addr string) bool {
+		return isTrustedProxy(addr, trusted)
+	}
+
+	remote, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remote = req.RemoteAddr
+	}
+	if len(trusted) == 0 || !isTrusted(remote) {
+		return remote
 	}
-	return ra
+
+	var hops []string
+	for _, header := range req.Header[headerXForwardedFor] {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !isTrusted(hops[i]) {
+			return hops[i]
+		}
+	}
+	// step: every hop is a trusted proxy, the leftmost one is the closest to the client
+	if len(hops) > 0 {
+		return hops[0]
+	}
+	if ip := req.Header.Get(headerXRealIP); ip != "" {
+		return ip
+	}
+
+	return remote
+}
+
+// parseTrustedProxies parses a list of IP addresses or CIDR ranges
+func parseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	return parseNetworks("trusted proxy", list)
+}
+
+// parseNetworks parses a list of IP addresses or CIDR ranges, the kind of list qualifying the errors
+func parseNetworks(kind string, list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, x := range list {
+		if !strings.Contains(x, "/") {
+			ip := net.ParseIP(x)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s address: %q", kind, x)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))})
+			continue
+		}
+		_, network, err := net.ParseCIDR(x)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s range: %q", kind, x)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// isTrustedProxy checks if the address belongs to one of the trusted networks
+func isTrustedProxy(addr string, trusted []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitQuoted splits a value on the separator, ignoring the separators found in double-quoted strings
+func splitQuoted(value string, sep rune) []string {
+	var list []string
+	var quoted, escaped bool
+	start := 0
+	for i, c := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			list = append(list, value[start:i])
+			start = i + 1
+		}
+	}
+	if value != "" {
+		list = append(list, value[start:])
+	}
+
+	return list
+}
+
+// isAPIRequest checks if the request has been issued by a script rather than navigated to by a browser
+func isAPIRequest(req *http.Request) bool {
+	if strings.EqualFold(req.Header.Get(headerXRequestedWith), "XMLHttpRequest") {
+		return true
+	}
+	accept := req.Header.Get("Accept")
+
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// isClientCancelled checks if the request has been abandoned by the client
+func isClientCancelled(req *http.Request) bool {
+	return errors.Is(req.Context().Err(), context.Canceled)
 }
 
 // backported from https://github.com/coreos/go-oidc/blob/master/oidc/verification.go#L28-L37
@@ -448,3 +758,69 @@ func containsString(needle string, haystack []string) bool {
 	}
 	return false
 }
+
+// suspiciousPathEncodings are the encoded characters which may disguise a path traversal, split a path
+// differently upstream or truncate it
+var suspiciousPathEncodings = []string{"%00", "%25", "%2e", "%2f", "%5c"}
+
+// findSuspiciousEncoding returns the first suspicious encoded character found in the raw path and not allowed,
+// or an empty string. Null bytes are always reported.
+func findSuspiciousEncoding(rawPath string, allowed []string) string {
+	if strings.IndexByte(rawPath, 0) >= 0 {
+		return "%00"
+	}
+	lower := strings.ToLower(rawPath)
+	for _, encoding := range suspiciousPathEncodings {
+		if !strings.Contains(lower, encoding) {
+			continue
+		}
+		if encoding == "%00" {
+			return encoding
+		}
+		var found bool
+		for _, v := range allowed {
+			if strings.EqualFold(v, encoding) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return encoding
+		}
+	}
+
+	return ""
+}
+
+// spkiHash returns the base64 sha256 hash of the subject public key info of the certificate
+func spkiHash(cert *x509.Certificate) string {
+	hash := sha.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// verifyPinnedSPKI returns a peer certificate verifier accepting only the chains presenting one of the pinned public keys
+func verifyPinnedSPKI(pins []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		var certs []*x509.Certificate
+		for _, chain := range verifiedChains {
+			certs = append(certs, chain...)
+		}
+		// when the verification is skipped there are no verified chains, we check what the server presented
+		if len(verifiedChains) == 0 {
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, cert)
+			}
+		}
+		for _, cert := range certs {
+			if containedIn(spkiHash(cert), pins, false) {
+				return nil
+			}
+		}
+
+		return ErrCertificatePinning
+	}
+}
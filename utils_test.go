@@ -20,7 +20,9 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"testing"
@@ -235,6 +237,34 @@ func TestDecodeText(t *testing.T) {
 	assert.Equal(t, fakeText, decoded, "the decoded text is not the same")
 }
 
+func TestVerifyCookieValue(t *testing.T) {
+	fakeKey := "HYLNt2JSzD7Lpz0djTRudmlOpbwx1oHB"
+	jwt := newTestToken("test").getToken()
+	token := jwt.Encode()
+
+	signed := signCookieValue("kc-access", token, fakeKey)
+	value, err := verifyCookieValue("kc-access", signed, fakeKey)
+	require.NoError(t, err)
+	assert.Equal(t, token, value)
+
+	for _, c := range []struct {
+		Name   string
+		Signed string
+		Key    string
+	}{
+		{Name: "kc-access", Signed: signed[:len(signed)-1], Key: fakeKey},
+		{Name: "kc-access", Signed: signed[:len(signed)/2], Key: fakeKey},
+		{Name: "kc-access", Signed: "x" + signed, Key: fakeKey},
+		{Name: "kc-access", Signed: token, Key: fakeKey},
+		{Name: "kc-access", Signed: "unsigned", Key: fakeKey},
+		{Name: "kc-state", Signed: signed, Key: fakeKey},
+		{Name: "kc-access", Signed: signed, Key: "ZSeCYDUxIlhDrmPpa1Ldc7il384esSF2"},
+	} {
+		_, err := verifyCookieValue(c.Name, c.Signed, c.Key)
+		assert.Equal(t, ErrCookieSignature, err, "the cookie %q should have been rejected", c.Signed)
+	}
+}
+
 func TestFindCookie(t *testing.T) {
 	cookies := []*http.Cookie{
 		{Name: "cookie_there"},
@@ -636,3 +666,217 @@ func writeFakeConfigFile(t *testing.T, content string) *os.File {
 
 	return f
 }
+
+func TestParseTrustedProxies(t *testing.T) {
+	networks, err := parseTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8", "::1"})
+	require.NoError(t, err)
+	require.Len(t, networks, 3)
+	assert.Equal(t, "127.0.0.1/32", networks[0].String())
+	assert.Equal(t, "10.0.0.0/8", networks[1].String())
+	assert.Equal(t, "::1/128", networks[2].String())
+
+	_, err = parseTrustedProxies([]string{"not_an_ip"})
+	assert.Error(t, err)
+	_, err = parseTrustedProxies([]string{"10.0.0.0/99"})
+	assert.Error(t, err)
+}
+
+func TestIsTrustedProxy(t *testing.T) {
+	networks, err := parseTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8"})
+	require.NoError(t, err)
+
+	assert.True(t, isTrustedProxy("127.0.0.1:8080", networks))
+	assert.True(t, isTrustedProxy("10.1.2.3:443", networks))
+	assert.True(t, isTrustedProxy("10.1.2.3", networks))
+	assert.False(t, isTrustedProxy("192.168.0.1:8080", networks))
+	assert.False(t, isTrustedProxy("garbage", networks))
+	assert.False(t, isTrustedProxy("127.0.0.1:8080", nil))
+}
+
+func TestSplitQuoted(t *testing.T) {
+	assert.Empty(t, splitQuoted("", ','))
+	assert.Equal(t, []string{"a", "b"}, splitQuoted("a,b", ','))
+	assert.Equal(t, []string{`a="x,y"`, "b"}, splitQuoted(`a="x,y",b`, ','))
+	assert.Equal(t, []string{`a="x\",y"`, "b"}, splitQuoted(`a="x\",y",b`, ','))
+}
+
+func TestMakeHeaderSetter(t *testing.T) {
+	h := make(http.Header)
+	makeHeaderSetter(nil)(h, "x-auth-email", "gambol99@gmail.com")
+	assert.Equal(t, []string{"gambol99@gmail.com"}, h["X-Auth-Email"])
+
+	setHeader := makeHeaderSetter(map[string]string{"X-AUTH-EMAIL": "x-auth-email"})
+	h = http.Header{"X-Auth-Email": []string{"forged"}}
+	setHeader(h, "X-Auth-Email", "gambol99@gmail.com")
+	setHeader(h, "X-Auth-Subject", "rjayawardene")
+	assert.Equal(t, http.Header{
+		"x-auth-email":   []string{"gambol99@gmail.com"},
+		"X-Auth-Subject": []string{"rjayawardene"},
+	}, h)
+
+	setHeader(h, "X-Auth-Email", "gambol99@gmail.com", "rohith@example.com")
+	setHeader(h, "X-Auth-Roles", "admin", "test")
+	assert.Equal(t, []string{"gambol99@gmail.com", "rohith@example.com"}, h["x-auth-email"])
+	assert.Equal(t, []string{"admin", "test"}, h["X-Auth-Roles"])
+}
+
+func TestEncodeHeaderValue(t *testing.T) {
+	cases := []struct {
+		Value    string
+		Encoding string
+		Expected string
+	}{
+		{Value: "gambol99@gmail.com", Encoding: identityHeadersEncodingBase64, Expected: "gambol99@gmail.com"},
+		{Value: "Rohith Jayawardene", Encoding: identityHeadersEncodingRFC8187, Expected: "Rohith Jayawardene"},
+		{Value: "José Müller", Encoding: identityHeadersEncodingRFC8187, Expected: "UTF-8''Jos%C3%A9%20M%C3%BCller"},
+		{Value: "jürgen@münchen.de", Encoding: identityHeadersEncodingRFC8187, Expected: "UTF-8''j%C3%BCrgen%40m%C3%BCnchen.de"},
+		{Value: "José Müller", Encoding: identityHeadersEncodingPercent, Expected: "Jos%C3%A9%20M%C3%BCller"},
+		{Value: "jürgen@münchen.de", Encoding: identityHeadersEncodingPercent, Expected: "j%C3%BCrgen@m%C3%BCnchen.de"},
+		{Value: "José Müller", Encoding: identityHeadersEncodingBase64, Expected: "=?UTF-8?b?Sm9zw6kgTcO8bGxlcg==?="},
+		{Value: "line\nbreak", Encoding: identityHeadersEncodingPercent, Expected: "line%0Abreak"},
+		{Value: "José Müller", Encoding: "", Expected: "José Müller"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.Expected, encodeHeaderValue(c.Value, c.Encoding), "value %q encoded as %s", c.Value, c.Encoding)
+	}
+}
+
+func TestIsAPIRequest(t *testing.T) {
+	req := newFakeHTTPRequest(http.MethodGet, "/")
+	assert.False(t, isAPIRequest(req))
+	req.Header.Set("Accept", "application/json")
+	assert.True(t, isAPIRequest(req))
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/json")
+	assert.False(t, isAPIRequest(req))
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	assert.True(t, isAPIRequest(req))
+}
+
+func TestRealIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "127.0.0.1"})
+	require.NoError(t, err)
+
+	cases := []struct {
+		RemoteAddr string
+		Headers    map[string]string
+		Trusted    []*net.IPNet
+		Expected   string
+	}{
+		{
+			RemoteAddr: "127.0.0.1:8080",
+			Expected:   "127.0.0.1",
+		},
+		{
+			// no proxy is trusted, the headers are ignored
+			RemoteAddr: "127.0.0.1:8080",
+			Headers:    map[string]string{headerXForwardedFor: "1.1.1.1, 2.2.2.2"},
+			Expected:   "127.0.0.1",
+		},
+		{
+			RemoteAddr: "192.168.0.1:8080",
+			Headers:    map[string]string{headerXRealIP: "1.1.1.1"},
+			Expected:   "192.168.0.1",
+		},
+		{
+			RemoteAddr: "127.0.0.1:8080",
+			Headers:    map[string]string{headerXForwardedFor: "1.1.1.1, 2.2.2.2"},
+			Trusted:    trusted,
+			Expected:   "2.2.2.2",
+		},
+		{
+			RemoteAddr: "127.0.0.1:8080",
+			Headers:    map[string]string{headerXRealIP: "1.1.1.1"},
+			Trusted:    trusted,
+			Expected:   "1.1.1.1",
+		},
+		{
+			// the client prepended a forged address
+			RemoteAddr: "10.0.0.2:8080",
+			Headers:    map[string]string{headerXForwardedFor: "6.6.6.6, 1.1.1.1, 10.0.0.1"},
+			Trusted:    trusted,
+			Expected:   "1.1.1.1",
+		},
+		{
+			// the peer is not trusted, the header is ignored
+			RemoteAddr: "192.168.0.1:8080",
+			Headers:    map[string]string{headerXForwardedFor: "1.1.1.1"},
+			Trusted:    trusted,
+			Expected:   "192.168.0.1",
+		},
+		{
+			RemoteAddr: "10.0.0.2:8080",
+			Headers:    map[string]string{headerXForwardedFor: "10.0.0.3,10.0.0.1"},
+			Trusted:    trusted,
+			Expected:   "10.0.0.3",
+		},
+		{
+			RemoteAddr: "127.0.0.1:8080",
+			Trusted:    trusted,
+			Expected:   "127.0.0.1",
+		},
+	}
+	for i, c := range cases {
+		req := newFakeHTTPRequest(http.MethodGet, "/")
+		req.RemoteAddr = c.RemoteAddr
+		for k, v := range c.Headers {
+			req.Header.Set(k, v)
+		}
+		assert.Equal(t, c.Expected, realIP(req, c.Trusted), "case %d", i)
+	}
+}
+
+func TestFindSuspiciousEncoding(t *testing.T) {
+	cases := []struct {
+		Path     string
+		Allowed  []string
+		Expected string
+	}{
+		{Path: "/admin/page"},
+		{Path: "/admin/%20page"},
+		{Path: "/admin/%2e%2e/secret", Expected: "%2e"},
+		{Path: "/admin/%2E%2E%2Fsecret", Expected: "%2e"},
+		{Path: "/admin/..%5csecret", Expected: "%5c"},
+		{Path: "/admin/%252e%252e/secret", Expected: "%25"},
+		{Path: "/admin/file%00.png", Expected: "%00"},
+		{Path: "/admin/file%00.png", Allowed: []string{"%00"}, Expected: "%00"},
+		{Path: "/admin/file\x00.png", Expected: "%00"},
+		{Path: "/admin/a%2Fb", Allowed: []string{"%2f"}},
+		{Path: "/admin/a%2Fb%2e", Allowed: []string{"%2F"}, Expected: "%2e"},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.Expected, findSuspiciousEncoding(c.Path, c.Allowed), "case %d", i)
+	}
+}
+
+func TestVerifyPinnedSPKI(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+	pin := spkiHash(upstream.Certificate())
+
+	cases := []struct {
+		Pins       []string
+		SkipVerify bool
+		Ok         bool
+	}{
+		{Pins: []string{pin}, Ok: true},
+		{Pins: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", pin}, Ok: true},
+		{Pins: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}},
+		{Pins: []string{pin}, SkipVerify: true, Ok: true},
+		{Pins: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}, SkipVerify: true},
+	}
+	for i, c := range cases {
+		transport := upstream.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.InsecureSkipVerify = c.SkipVerify
+		transport.TLSClientConfig.VerifyPeerCertificate = verifyPinnedSPKI(c.Pins)
+		client := &http.Client{Transport: transport}
+
+		resp, err := client.Get(upstream.URL)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have been rejected", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d should have been accepted", i) {
+			resp.Body.Close()
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"go.uber.org/zap"
+)
+
+// isWarmingUp indicates the warm-up is still running, the service is not ready until then
+func (r *oauthProxy) isWarmingUp() bool {
+	return atomic.LoadInt32(&r.warmingUp) != 0
+}
+
+// warmup loads the keys of the provider and opens the connections to the upstreams, so that the first requests do
+// not pay for it. The service is ready once the warm-up completes or times out.
+func (r *oauthProxy) warmup(timeout time.Duration) {
+	defer atomic.StoreInt32(&r.warmingUp, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	if r.client != nil && !r.config.SkipTokenVerification {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.warmupKeys(ctx)
+		}()
+	}
+	for _, upstream := range r.warmupUpstreams() {
+		wg.Add(1)
+		go func(upstream *url.URL) {
+			defer wg.Done()
+			if err := r.warmupUpstream(ctx, upstream); err != nil {
+				r.log.Warn("unable to reach the upstream during the warm-up",
+					zap.String("upstream", upstream.String()),
+					zap.Error(err))
+			}
+		}(upstream)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		r.log.Info("the service is warmed up", zap.Duration("duration", time.Since(start)))
+	case <-ctx.Done():
+		r.log.Warn("the warm-up timed out, the service is ready anyway", zap.Duration("timeout", timeout))
+	}
+}
+
+// warmupKeys has the provider keys loaded by the client: they are only fetched when a signature cannot be verified,
+// hence a token with valid claims, but no signature, is submitted. The client takes no context, the keys are left
+// loading in the background once the warm-up is over.
+func (r *oauthProxy) warmupKeys(ctx context.Context) {
+	if r.idp.Issuer == nil || ctx.Err() != nil {
+		return
+	}
+	claims := jose.Claims{}
+	claims.Add("iss", r.idp.Issuer.String())
+	claims.Add("aud", r.config.ClientID)
+	claims.Add("iat", time.Now().Unix())
+	claims.Add("exp", time.Now().Add(time.Minute).Unix())
+	token, err := jose.NewJWT(jose.JOSEHeader{jose.HeaderKeyAlgorithm: "RS256"}, claims)
+	if err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = r.client.VerifyJWT(token)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// warmupUpstreams returns the distinct upstreams of the service and its resources
+func (r *oauthProxy) warmupUpstreams() []*url.URL {
+	var upstreams []*url.URL
+	seen := make(map[string]bool)
+	add := func(upstream *url.URL) {
+		if upstream == nil || upstream.Host == "" || seen[upstream.Host] {
+			return
+		}
+		seen[upstream.Host] = true
+		upstreams = append(upstreams, upstream)
+	}
+
+	add(r.endpoint)
+	for _, resource := range r.config.Resources {
+		if resource.Upstream == "" {
+			continue
+		}
+		if upstream, err := url.Parse(resource.Upstream); err == nil {
+			add(upstream)
+		}
+	}
+
+	return upstreams
+}
+
+// warmupUpstream opens a connection to the upstream through the transport of the proxy, which keeps it for the next
+// requests. Whatever the upstream responds is fine.
+func (r *oauthProxy) warmupUpstream(ctx context.Context, upstream *url.URL) error {
+	proxy, ok := r.upstream.(*httputil.ReverseProxy)
+	if !ok || proxy.Transport == nil {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, (&url.URL{Scheme: upstream.Scheme, Host: upstream.Host, Path: "/"}).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := proxy.Transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
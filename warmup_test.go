@@ -0,0 +1,66 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarmup(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.WarmupTimeout = 5 * time.Second
+	cfg.Upstream = "http://127.0.0.1:2"
+	cfg.Resources = append(cfg.Resources,
+		&Resource{URL: "/other/*", Methods: allHTTPMethods, Upstream: "http://127.0.0.1:1"},
+		&Resource{URL: "/again/*", Methods: allHTTPMethods, Upstream: "http://127.0.0.1:1"})
+	p := newFakeProxy(cfg).proxy
+	ready := func() int {
+		resp := httptest.NewRecorder()
+		p.readyHandler(resp, newFakeHTTPRequest(http.MethodGet, readyURL))
+		return resp.Code
+	}
+
+	assert.Len(t, p.warmupUpstreams(), 2)
+
+	atomic.StoreInt32(&p.warmingUp, 1)
+	assert.Equal(t, http.StatusServiceUnavailable, ready())
+
+	// the unreachable upstream does not prevent the service from getting ready
+	p.warmup(cfg.WarmupTimeout)
+	assert.False(t, p.isWarmingUp())
+	assert.Equal(t, http.StatusOK, ready())
+
+	// the keys are not waited for once the warm-up is over
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		p.warmupKeys(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("the warm-up of the keys should stop with the context")
+	}
+}